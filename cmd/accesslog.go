@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statusRecorder keeps track of what was sent to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		// Implicit WriteHeader.
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// AccessLogJSON is a single line of the access log, when using JSON format.
+type AccessLogJSON struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	// Duration of the request, in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// accessLogger writes a line for each HTTP request.
+type accessLogger struct {
+	format string
+
+	m sync.Mutex
+	w io.Writer
+}
+
+func (al *accessLogger) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(sr, req)
+		if sr.status == 0 {
+			// Nothing was written at all; net/http will send an empty 200.
+			sr.status = http.StatusOK
+		}
+		al.log(req, sr, start, time.Since(start))
+	})
+}
+
+func (al *accessLogger) log(req *http.Request, sr *statusRecorder, start time.Time, duration time.Duration) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	user, _, _ := req.BasicAuth()
+
+	var line []byte
+	if al.format == "json" {
+		line, err = json.Marshal(&AccessLogJSON{
+			Time:       start,
+			RemoteAddr: host,
+			User:       user,
+			Method:     req.Method,
+			Path:       req.URL.RequestURI(),
+			Proto:      req.Proto,
+			Status:     sr.status,
+			Bytes:      sr.bytes,
+			Duration:   duration.Seconds(),
+		})
+		if err != nil {
+			logError("unable to encode access log", "error", err)
+			return
+		}
+		line = append(line, '\n')
+	} else {
+		if user == "" {
+			user = "-"
+		}
+		// Common Log Format, with the duration appended.
+		line = []byte(fmt.Sprintf("%s - %s [%s] %q %d %d %.3f\n",
+			host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			req.Method+" "+req.URL.RequestURI()+" "+req.Proto,
+			sr.status, sr.bytes, duration.Seconds()))
+	}
+
+	al.m.Lock()
+	defer al.m.Unlock()
+	if _, err := al.w.Write(line); err != nil {
+		logError("unable to write access log", "error", err)
+	}
+}
@@ -0,0 +1,528 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrorJSON is the body returned by the API on errors.
+type ErrorJSON struct {
+	Error string `json:"error"`
+}
+
+// APIShotJSON describes a single mapshot in the API.
+type APIShotJSON struct {
+	Name string `json:"name"`
+	// HTTP path where the mapshot content is served.
+	Path string `json:"path"`
+	// Savename, derived from the directory hierarchy.
+	Savename    string    `json:"savename"`
+	Source      string    `json:"source,omitempty"`
+	Tick        int64     `json:"tick,omitempty"`
+	TicksPlayed int64     `json:"ticks_played,omitempty"`
+	Mtime       time.Time `json:"mtime"`
+	// True if the mapshot is stored as a zip file.
+	Archive bool `json:"archive,omitempty"`
+	// Total size of the files & number of tiles; only set once computed in
+	// the background.
+	Bytes int64 `json:"bytes,omitempty"`
+	Tiles int64 `json:"tiles,omitempty"`
+	// From mapshot-user.json.
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// APIShotsJSON is the response of /api/v1/shots.
+type APIShotsJSON struct {
+	Shots []*APIShotJSON `json:"shots"`
+	// Number of mapshots matching the request, across all pages.
+	Total int `json:"total"`
+	// URL of the next page, when using `limit`.
+	Next string `json:"next,omitempty"`
+}
+
+// APIShotDetailsJSON is the response of /api/v1/shots/<name>.
+type APIShotDetailsJSON struct {
+	*APIShotJSON
+	// Content of mapshot.json.
+	Mapshot json.RawMessage   `json:"mapshot"`
+	Stats   *APIShotStatsJSON `json:"stats"`
+}
+
+// APIShotStatsJSON contains information computed from the files of a mapshot.
+type APIShotStatsJSON struct {
+	// Number of tile files.
+	Tiles int64 `json:"tiles"`
+	// Total size of all the files of the mapshot.
+	Bytes int64 `json:"bytes"`
+	// Zoom levels available, across all surfaces.
+	ZoomLevels []int `json:"zoom_levels"`
+}
+
+// DeleteShotJSON is the response to a successful mapshot deletion.
+type DeleteShotJSON struct {
+	Name       string `json:"name"`
+	FreedBytes int64  `json:"freed_bytes"`
+}
+
+// RenameShotJSON is the body of a request to rename a mapshot.
+type RenameShotJSON struct {
+	// New name of the mapshot, like names returned by the API.
+	Name string `json:"name"`
+}
+
+// RescanJSON is the response of /api/rescan.
+type RescanJSON struct {
+	Shots   int `json:"shots"`
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	// Duration of the scan, in seconds.
+	Duration float64 `json:"duration"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		logError("unable to encode JSON response", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(raw)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, &ErrorJSON{Error: fmt.Sprintf(format, a...)})
+}
+
+func (s *Server) newAPIShotJSON(shot *shotInfo) *APIShotJSON {
+	data := &APIShotJSON{
+		Name:        shot.name,
+		Path:        s.urlPath(shot.path),
+		Savename:    shot.savename,
+		Source:      shot.source,
+		Tick:        shot.json.Tick,
+		TicksPlayed: shot.json.TicksPlayed,
+		Mtime:       shot.mtime,
+		Archive:     shot.archive,
+	}
+	if stats := s.stats.lookup(shot); stats != nil {
+		data.Bytes = stats.Bytes
+		data.Tiles = stats.Tiles
+	}
+	if shot.meta != nil {
+		data.Description = shot.meta.Description
+		data.Tags = shot.meta.Tags
+	}
+	return data
+}
+
+// Tiles directories are named `s<surface index>zoom_<zoom level>`.
+var zoomDirRE = regexp.MustCompile(`^s\d+zoom_(\d+)$`)
+
+// shotStats walks the files of a mapshot to compute information about it.
+func shotStats(fsys fs.FS) (*APIShotStatsJSON, error) {
+	stats := &APIShotStatsJSON{
+		ZoomLevels: []int{},
+	}
+	zooms := map[int]bool{}
+	// The MBTiles file itself, already accounted for by its tiles.
+	skip := ""
+	if mf, ok := fsys.(*mbtilesFS); ok {
+		tiles, size, zoomLevels, err := mf.tileStats()
+		if err != nil {
+			return nil, err
+		}
+		stats.Tiles += tiles
+		stats.Bytes += size
+		for _, z := range zoomLevels {
+			zooms[z] = true
+		}
+		// Remaining files are in the mapshot directory, if any; the root of
+		// a .mbtiles file lists nothing.
+		if mf.base != nil {
+			fsys = mf.base
+			skip = mbtilesFile
+		}
+	}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if m := zoomDirRE.FindStringSubmatch(d.Name()); m != nil {
+				z, _ := strconv.Atoi(m[1])
+				zooms[z] = true
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || p == skip {
+			return nil
+		}
+		stats.Bytes += info.Size()
+		if strings.HasPrefix(d.Name(), "tile_") && zoomDirRE.MatchString(path.Base(path.Dir(p))) {
+			stats.Tiles++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for z := range zooms {
+		stats.ZoomLevels = append(stats.ZoomLevels, z)
+	}
+	sort.Ints(stats.ZoomLevels)
+	return stats, nil
+}
+
+// handleAPIShots serves /api/v1/shots, the list of mapshots.
+func (s *Server) handleAPIShots(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+	f, err := parseShotFilter(req.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	// Shots are already sorted & never modified once listed, so pages are
+	// consistent even if a rescan happens in between.
+	page, err := paginate(req.URL.Query(), f.apply(s.currentShots()), shotOrders[s.sf.sort])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	data := &APIShotsJSON{
+		Shots: []*APIShotJSON{},
+		Total: page.total,
+	}
+	for i := range page.shots {
+		data.Shots = append(data.Shots, s.newAPIShotJSON(&page.shots[i]))
+	}
+	if page.next != nil {
+		data.Next = s.urlPath("/api/v1/shots") + "?" + page.next.Encode()
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// handleAPIShot serves /api/v1/shots/<name>, the details of a mapshot.
+func (s *Server) handleAPIShot(w http.ResponseWriter, req *http.Request) {
+	shot, rest := s.lookupShot(strings.TrimPrefix(req.URL.Path, "/api/v1/shots/"))
+	if shot == nil || rest != "" {
+		writeJSONError(w, http.StatusNotFound, "unknown mapshot")
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+
+	// Errors are logged but not returned, to avoid leaking filesystem paths.
+	raw, err := fs.ReadFile(shot.fsys, "mapshot.json")
+	if err != nil {
+		logError("unable to read mapshot.json", "shot", shot.name, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to read mapshot.json")
+		return
+	}
+	if !json.Valid(raw) {
+		writeJSONError(w, http.StatusInternalServerError, "invalid mapshot.json")
+		return
+	}
+	stats := s.stats.lookup(shot)
+	if stats == nil {
+		stats, err = shotStats(shot.fsys)
+		if err != nil {
+			logError("unable to compute stats", "shot", shot.name, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "unable to read mapshot files")
+			return
+		}
+		s.stats.store(shot, stats)
+	}
+	writeJSON(w, http.StatusOK, &APIShotDetailsJSON{
+		APIShotJSON: s.newAPIShotJSON(shot),
+		Mapshot:     raw,
+		Stats:       stats,
+	})
+}
+
+// lookupShot finds the mapshot referred to by the beginning of the provided
+// path. It returns the remainder of the path, which indicates what is being
+// accessed for that mapshot.
+func (s *Server) lookupShot(p string) (*shotInfo, string) {
+	var found *shotInfo
+	rest := ""
+	shots := s.currentShots()
+	for i := range shots {
+		shot := &shots[i]
+		// Prefer longest match, in case a mapshot name is a prefix of another.
+		if found != nil && len(found.name) >= len(shot.name) {
+			continue
+		}
+		if p == shot.name {
+			found, rest = shot, ""
+		} else if strings.HasPrefix(p, shot.name+"/") {
+			found, rest = shot, p[len(shot.name)+1:]
+		}
+	}
+	return found, rest
+}
+
+// shotResources lists what can be accessed under /api/shots/<name>, with the
+// supported methods.
+var shotResources = map[string][]string{
+	"":                {http.MethodDelete},
+	thumbnailFilename: {http.MethodGet, http.MethodHead},
+	"download":        {http.MethodGet, http.MethodHead},
+	"rename":          {http.MethodPost},
+	"meta":            {http.MethodGet, http.MethodHead, http.MethodPut},
+	"share":           {http.MethodPost},
+}
+
+// handleShotsAPI manages requests on /api/shots/<name>.
+func (s *Server) handleShotsAPI(w http.ResponseWriter, req *http.Request) {
+	shot, rest := s.lookupShot(strings.TrimPrefix(req.URL.Path, "/api/shots/"))
+	if shot == nil {
+		writeJSONError(w, http.StatusNotFound, "unknown mapshot")
+		return
+	}
+	methods, ok := shotResources[rest]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+	allowed := false
+	for _, m := range methods {
+		allowed = allowed || m == req.Method
+	}
+	if !allowed {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+
+	switch rest {
+	case "":
+		s.deleteShot(w, shot)
+	case thumbnailFilename:
+		s.serveThumbnail(w, req, shot)
+	case "download":
+		s.serveDownload(w, req, shot)
+	case "rename":
+		s.renameShot(w, req, shot)
+	case "meta":
+		s.handleMeta(w, req, shot)
+	case "share":
+		s.handleCreateShare(w, req, shot)
+	}
+}
+
+func (s *Server) deleteShot(w http.ResponseWriter, shot *shotInfo) {
+	if !s.sf.enableAdmin {
+		writeJSONError(w, http.StatusForbidden, "admin API is disabled; use --enable_admin to enable it")
+		return
+	}
+	if shot.fsPath == "" {
+		writeJSONError(w, http.StatusNotImplemented, "deletion is only supported for mapshots on the local filesystem")
+		return
+	}
+	if !s.inSources(shot.fsPath) {
+		logError("refusing to delete mapshot not within served directories", "path", shot.fsPath)
+		writeJSONError(w, http.StatusForbidden, "mapshot is not within served directories")
+		return
+	}
+
+	size, err := dirSize(shot.fsPath)
+	if err != nil {
+		logWarning("unable to compute size of mapshot", "path", shot.fsPath, "error", err)
+	}
+	remove := os.RemoveAll
+	if shot.archive {
+		for _, src := range s.sources {
+			if ds, ok := src.store.(*dirStore); ok {
+				ds.archives.close(shot.fsPath)
+			}
+		}
+		remove = os.Remove
+	}
+	if err := remove(shot.fsPath); err != nil {
+		logError("unable to delete mapshot", "shot", shot.name, "path", shot.fsPath, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to delete mapshot %s", shot.name)
+		return
+	}
+	logInfo("deleted mapshot", "shot", shot.name, "path", shot.fsPath, "freed", size)
+	s.updateMux()
+
+	writeJSON(w, http.StatusOK, &DeleteShotJSON{
+		Name:       shot.name,
+		FreedBytes: size,
+	})
+}
+
+// renameShot moves the mapshot on disk, so it gets a new name.
+func (s *Server) renameShot(w http.ResponseWriter, req *http.Request, shot *shotInfo) {
+	if !s.sf.enableAdmin {
+		writeJSONError(w, http.StatusForbidden, "admin API is disabled; use --enable_admin to enable it")
+		return
+	}
+	if shot.fsPath == "" {
+		writeJSONError(w, http.StatusNotImplemented, "renaming is only supported for mapshots on the local filesystem")
+		return
+	}
+	if !s.inSources(shot.fsPath) {
+		logError("refusing to rename mapshot not within served directories", "path", shot.fsPath)
+		writeJSONError(w, http.StatusForbidden, "mapshot is not within served directories")
+		return
+	}
+	params := &RenameShotJSON{}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<16)).Decode(params); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	// Names include the source label when serving multiple directories;
+	// mapshots can only be moved within their source.
+	name := params.Name
+	if shot.source != "" {
+		if !strings.HasPrefix(name, shot.source+"/") {
+			writeJSONError(w, http.StatusBadRequest, "new name must start with %q; mapshots cannot be moved to another source", shot.source+"/")
+			return
+		}
+		name = strings.TrimPrefix(name, shot.source+"/")
+	}
+	if err := checkShotName(name); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	ds, err := s.uploadStore(shot.source)
+	if err != nil {
+		writeJSONError(w, http.StatusNotImplemented, "%v", err)
+		return
+	}
+
+	target := filepath.Join(ds.dir, filepath.FromSlash(name))
+	if shot.archive {
+		target += archiveFileSuffix(shot.fsPath)
+	}
+	if _, err := os.Lstat(target); err == nil {
+		writeJSONError(w, http.StatusConflict, "%s already exists", params.Name)
+		return
+	}
+	// Mapshots are not looked for within other mapshots.
+	for dir := filepath.Dir(target); dir != ds.dir && dir != "." && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "mapshot.json")); err == nil {
+			writeJSONError(w, http.StatusConflict, "%s would be within another mapshot", params.Name)
+			return
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		logError("unable to create directory for renamed mapshot", "path", target, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to create parent directory of %s", params.Name)
+		return
+	}
+	if shot.archive {
+		ds.archives.close(shot.fsPath)
+	}
+	// Renames are atomic, so the mapshot is never partially moved.
+	if err := os.Rename(shot.fsPath, target); err != nil {
+		logError("unable to rename mapshot", "from", shot.fsPath, "to", target, "error", err)
+		if errors.Is(err, syscall.EXDEV) {
+			writeJSONError(w, http.StatusConflict, "%s would be on another filesystem; mapshots can only be renamed within a filesystem", params.Name)
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "unable to rename mapshot %s", shot.name)
+		return
+	}
+	logInfo("renamed mapshot", "shot", shot.name, "name", params.Name)
+	s.updateMux()
+
+	renamed, rest := s.lookupShot(params.Name)
+	if renamed == nil || rest != "" {
+		logError("renamed mapshot not found after rescan", "name", params.Name)
+		writeJSONError(w, http.StatusInternalServerError, "mapshot renamed but not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.newAPIShotJSON(renamed))
+}
+
+// inSources verifies that the path is strictly within one of the served
+// directories.
+func (s *Server) inSources(p string) bool {
+	for _, src := range s.sources {
+		ds, ok := src.store.(*dirStore)
+		if !ok {
+			continue
+		}
+		realDir, err := filepath.EvalSymlinks(ds.dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(realDir, p)
+		if err != nil {
+			continue
+		}
+		if rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// dirSize returns the total size of the files within the directory.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// handleRescan serves POST /api/rescan, looking for mapshots immediately
+// instead of waiting for the next periodic rescan - e.g., right after a render.
+// Concurrent requests share the same scan; other scans - periodic ones, or
+// after a change through the API - are run one at a time with it.
+func (s *Server) handleRescan(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+	v, _, _ := s.rescans.Do("rescan", func() (interface{}, error) {
+		return s.updateMux(), nil
+	})
+	res := v.(*scanResult)
+	if res.err != nil {
+		// The error names paths on the server; kept out of the response.
+		logError("rescan failed", "error", res.err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to look for mapshots")
+		return
+	}
+	writeJSON(w, http.StatusOK, &RescanJSON{
+		Shots:    res.shots,
+		Added:    res.added,
+		Removed:  res.removed,
+		Duration: res.duration.Seconds(),
+	})
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShotsAPIEndpoints(t *testing.T) {
+	s, _ := newTestServer(t, newTestServeFlags(t))
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+		allow  string
+		msg    string
+	}{
+		{"GET", "/api/shots/mapshot/test/d-1/meta", http.StatusOK, "", ""},
+		{"GET", "/api/shots/mapshot/test/d-1/bogus", http.StatusNotFound, "", "unknown endpoint"},
+		{"POST", "/api/shots/mapshot/test/d-1/bogus/meta", http.StatusNotFound, "", "unknown endpoint"},
+		{"GET", "/api/shots/mapshot/test/missing/meta", http.StatusNotFound, "", "unknown mapshot"},
+		{"GET", "/api/shots/mapshot/test/d-1/rename", http.StatusMethodNotAllowed, "POST", "unsupported method GET"},
+		{"DELETE", "/api/shots/mapshot/test/d-1/meta", http.StatusMethodNotAllowed, "GET, HEAD, PUT", "unsupported method DELETE"},
+		{"GET", "/api/shots/mapshot/test/d-1", http.StatusMethodNotAllowed, "DELETE", "unsupported method GET"},
+		{"POST", "/api/shots/mapshot/test/d-1/download", http.StatusMethodNotAllowed, "GET, HEAD", "unsupported method POST"},
+	} {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+			if rec.Code != tc.status {
+				t.Fatalf("got status %d, want %d; body: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			if got := rec.Header().Get("Allow"); got != tc.allow {
+				t.Errorf("got Allow %q, want %q", got, tc.allow)
+			}
+			if tc.msg == "" {
+				return
+			}
+			var resp struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid JSON error %q: %v", rec.Body.String(), err)
+			}
+			if resp.Error != tc.msg {
+				t.Errorf("got error %q, want %q", resp.Error, tc.msg)
+			}
+		})
+	}
+}
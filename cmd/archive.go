@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mapshots can be stored as a single zip file, with mapshot.json at the root
+// of the archive.
+const archiveSuffix = ".mapshot.zip"
+
+// isArchiveName indicates whether the file name is one of a mapshot stored as
+// a single file.
+func isArchiveName(name string) bool {
+	return strings.HasSuffix(name, archiveSuffix) || strings.HasSuffix(name, mbtilesSuffix)
+}
+
+// archiveFileSuffix returns the suffix of the mapshot file name, which is not
+// part of the mapshot name.
+func archiveFileSuffix(name string) string {
+	if strings.HasSuffix(name, mbtilesSuffix) {
+		return mbtilesSuffix
+	}
+	return archiveSuffix
+}
+
+// isRegularFile indicates whether the path exists and is a regular file.
+func isRegularFile(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// cachedArchive is an opened mapshot archive.
+type cachedArchive struct {
+	modTime time.Time
+	size    int64
+	// Only one is set, depending on the type of file.
+	zr *zip.ReadCloser
+	db *sql.DB
+}
+
+// archiveCache keeps mapshot archives - zip & MBTiles files - open, so their
+// central directory is read only once instead of on every request.
+type archiveCache struct {
+	m        sync.Mutex
+	archives map[string]*cachedArchive
+}
+
+func newArchiveCache() *archiveCache {
+	return &archiveCache{
+		archives: make(map[string]*cachedArchive),
+	}
+}
+
+// open returns the archive at the given path. It is re-opened if the file
+// changed since it was last opened.
+func (ac *archiveCache) open(path string, info os.FileInfo) (*zip.Reader, error) {
+	ac.m.Lock()
+	defer ac.m.Unlock()
+	if ca := ac.archives[path]; ca != nil {
+		if ca.zr != nil && ca.modTime.Equal(info.ModTime()) && ca.size == info.Size() {
+			return &ca.zr.Reader, nil
+		}
+		ac.closeLocked(path)
+	}
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open archive %s: %w", path, err)
+	}
+	ac.archives[path] = &cachedArchive{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		zr:      zr,
+	}
+	return &zr.Reader, nil
+}
+
+// openMBTiles returns the MBTiles database at the given path. Like open, it is
+// re-opened if the file changed since it was last opened.
+func (ac *archiveCache) openMBTiles(path string, info os.FileInfo) (*sql.DB, error) {
+	ac.m.Lock()
+	defer ac.m.Unlock()
+	if ca := ac.archives[path]; ca != nil {
+		if ca.db != nil && ca.modTime.Equal(info.ModTime()) && ca.size == info.Size() {
+			return ca.db, nil
+		}
+		ac.closeLocked(path)
+	}
+	db, err := openMBTiles(path)
+	if err != nil {
+		return nil, err
+	}
+	ac.archives[path] = &cachedArchive{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		db:      db,
+	}
+	return db, nil
+}
+
+// prune closes all the archives which are not listed in keep.
+func (ac *archiveCache) prune(keep map[string]bool) {
+	ac.m.Lock()
+	defer ac.m.Unlock()
+	for path := range ac.archives {
+		if !keep[path] {
+			ac.closeLocked(path)
+		}
+	}
+}
+
+// close closes the archive at the given path, if it is open.
+func (ac *archiveCache) close(path string) {
+	ac.m.Lock()
+	defer ac.m.Unlock()
+	ac.closeLocked(path)
+}
+
+func (ac *archiveCache) closeLocked(path string) {
+	ca := ac.archives[path]
+	if ca == nil {
+		return
+	}
+	var err error
+	if ca.zr != nil {
+		err = ca.zr.Close()
+	} else {
+		err = ca.db.Close()
+	}
+	if err != nil {
+		logWarning("unable to close archive", "path", path, "error", err)
+	}
+	delete(ac.archives, path)
+}
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authenticator verifies HTTP basic auth credentials.
+type authenticator struct {
+	// Maps user names to a function verifying the provided password.
+	users map[string]func(password string) bool
+	// If set, requests for which it returns true do not need credentials -
+	// e.g., with a share token.
+	bypass func(req *http.Request) bool
+}
+
+func newAuthenticator() *authenticator {
+	return &authenticator{
+		users: make(map[string]func(string) bool),
+	}
+}
+
+// addPlain registers a user with a clear text password.
+func (a *authenticator) addPlain(user, password string) {
+	a.users[user] = func(p string) bool {
+		return subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+	}
+}
+
+// addHashed registers a user with a password in one of the htpasswd formats:
+// bcrypt, {SHA} or plain text.
+func (a *authenticator) addHashed(user, hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash for user %q: %w", user, err)
+		}
+		a.users[user] = func(p string) bool {
+			return bcrypt.CompareHashAndPassword([]byte(hash), []byte(p)) == nil
+		}
+	case strings.HasPrefix(hash, "{SHA}"):
+		expected := []byte(hash[len("{SHA}"):])
+		a.users[user] = func(p string) bool {
+			sum := sha1.Sum([]byte(p))
+			actual := []byte(base64.StdEncoding.EncodeToString(sum[:]))
+			return subtle.ConstantTimeCompare(actual, expected) == 1
+		}
+	case strings.HasPrefix(hash, "$"):
+		return fmt.Errorf("unsupported password hash format for user %q; use bcrypt (htpasswd -B)", user)
+	default:
+		a.addPlain(user, hash)
+	}
+	return nil
+}
+
+// loadFile reads users from a htpasswd-style file - i.e., `user:hash` lines.
+func (a *authenticator) loadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to open auth file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			// Do not include the line itself, as it might contain a password.
+			return fmt.Errorf("invalid entry in auth file %s at line %d", filename, lineno)
+		}
+		if err := a.addHashed(line[:idx], line[idx+1:]); err != nil {
+			return fmt.Errorf("auth file %s, line %d: %w", filename, lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read auth file %s: %w", filename, err)
+	}
+	logInfo("loaded auth file", "path", filename, "users", len(a.users))
+	return nil
+}
+
+func (a *authenticator) check(user, password string) bool {
+	verify := a.users[user]
+	if verify == nil {
+		return false
+	}
+	return verify(password)
+}
+
+// wrap returns a handler requiring basic auth before calling the provided
+// handler.
+func (a *authenticator) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a.bypass != nil && a.bypass(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		user, password, ok := req.BasicAuth()
+		if !ok || !a.check(user, password) {
+			if ok {
+				logInfo("rejected credentials", "user", user, "remote", req.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="mapshot", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// tokenAuthenticator protects API endpoints modifying mapshots with a bearer
+// token, independently of read access.
+type tokenAuthenticator struct {
+	token []byte
+}
+
+// loadAdminToken reads the token from a file, ignoring surrounding
+// whitespace.
+func loadAdminToken(filename string) (string, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("unable to read admin token file: %w", err)
+	}
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %s is empty", filename)
+	}
+	return token, nil
+}
+
+// needsAdminToken indicates whether the request goes to an API endpoint which
+// can modify something - any non read-only method is considered as such - or
+// which exposes secrets, like share tokens.
+func needsAdminToken(req *http.Request) bool {
+	if !strings.HasPrefix(req.URL.Path, "/api/") {
+		return false
+	}
+	if req.URL.Path == "/api/shares" || strings.HasPrefix(req.URL.Path, "/api/shares/") {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// wrap returns a handler requiring the bearer token on mutating API requests,
+// which are then served by `authorized` - i.e., the token replaces basic auth
+// if any. Other requests are served by `h`.
+func (ta *tokenAuthenticator) wrap(h http.Handler, authorized http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !needsAdminToken(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		const scheme = "Bearer "
+		value := req.Header.Get("Authorization")
+		if len(value) < len(scheme) || !strings.EqualFold(value[:len(scheme)], scheme) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mapshot"`)
+			writeJSONError(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(value[len(scheme):])), ta.token) != 1 {
+			logInfo("rejected admin token", "remote", req.RemoteAddr)
+			writeJSONError(w, http.StatusForbidden, "invalid admin token")
+			return
+		}
+		authorized.ServeHTTP(w, req)
+	})
+}
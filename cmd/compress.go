@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Extensions of files which are already compressed; compressing them again
+// would just waste CPU.
+var precompressedExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".webp": true,
+	".avif": true,
+	".gif":  true,
+	".zip":  true,
+	".gz":   true,
+	".br":   true,
+}
+
+// Content types which are worth compressing. Anything else - e.g., images or
+// archives - is sent as is.
+var compressibleTypes = map[string]bool{
+	"text/html":                 true,
+	"text/css":                  true,
+	"text/plain":                true,
+	"text/javascript":           true,
+	"text/xml":                  true,
+	"application/javascript":    true,
+	"application/json":          true,
+	"application/xml":           true,
+	"application/manifest+json": true,
+	"image/svg+xml":             true,
+}
+
+// compressible indicates whether a response with the given Content-Type value
+// should be compressed.
+func compressible(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	return compressibleTypes[mediaType] || strings.HasSuffix(mediaType, "+json")
+}
+
+// acceptsEncoding indicates whether the client supports the given content
+// encoding - e.g., gzip.
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		enc := strings.TrimSpace(part)
+		if idx := strings.Index(enc, ";"); idx >= 0 {
+			if strings.TrimSpace(enc[idx+1:]) == "q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:idx])
+		}
+		if enc == encoding || enc == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressiblePath indicates whether the response for the path might be
+// compressed, from its extension. Paths without a known type - e.g., pages -
+// might be.
+func compressiblePath(p string) bool {
+	ext := strings.ToLower(path.Ext(p))
+	if precompressedExts[ext] {
+		return false
+	}
+	contentType := mime.TypeByExtension(ext)
+	return contentType == "" || compressible(contentType)
+}
+
+// compressHandler transparently gzip responses when the client supports it.
+// Only compressible content types are compressed, based on the Content-Type
+// set by the handler; files which are known to be already compressed - e.g.,
+// tiles - are skipped upfront. Strong ETags of compressed responses get a
+// -gzip suffix, so they do not validate the uncompressed content.
+func compressHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if precompressedExts[strings.ToLower(path.Ext(req.URL.Path))] {
+			h.ServeHTTP(w, req)
+			return
+		}
+		addVary(w.Header(), "Accept-Encoding")
+		if !acceptsEncoding(req, "gzip") {
+			h.ServeHTTP(w, req)
+			return
+		}
+		// Ranges would apply to the uncompressed content, which would not make sense
+		// once compressed. Other files keep supporting them.
+		if compressiblePath(req.URL.Path) {
+			req.Header.Del("Range")
+		}
+		gw := &gzipResponseWriter{
+			ResponseWriter: w,
+			head:           req.Method == http.MethodHead,
+			ifNoneMatch:    entityTags(req.Header.Get("If-None-Match")),
+		}
+		// Clients holding the compressed content send back its ETag; let the
+		// handler match it against its own.
+		var tags []string
+		for _, tag := range gw.ifNoneMatch {
+			if strings.HasSuffix(tag, gzipETagSuffix+`"`) && !strings.HasPrefix(tag, "W/") {
+				tags = append(tags, strings.TrimSuffix(tag, gzipETagSuffix+`"`)+`"`)
+			}
+		}
+		if len(tags) > 0 {
+			req.Header.Set("If-None-Match", strings.Join(append(gw.ifNoneMatch, tags...), ", "))
+		}
+		defer gw.close()
+		h.ServeHTTP(gw, req)
+	})
+}
+
+// Suffix of strong ETags of content compressed on the fly, so they differ
+// from the uncompressed one - as done for the embedded frontend.
+const gzipETagSuffix = "-gzip"
+
+// gzipETag returns the ETag of the compressed content, from the ETag of the
+// uncompressed one. Weak ETags do not need to change.
+func gzipETag(etag string) string {
+	if len(etag) < 2 || !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + gzipETagSuffix + `"`
+}
+
+// entityTags returns the ETags listed in an If-None-Match value.
+func entityTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// hasTag indicates whether the ETag is in the list.
+func hasTag(tags []string, etag string) bool {
+	for _, tag := range tags {
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the content written to it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	head        bool
+	wroteHeader bool
+	// ETags of the request If-None-Match, as sent by the client.
+	ifNoneMatch []string
+	// Only set when the response is actually compressed.
+	gz *gzip.Writer
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	hdr := gw.Header()
+	// No body for those, partial content, or already encoded by the handler.
+	compress := !gw.head && status != http.StatusNoContent && status != http.StatusNotModified && status != http.StatusPartialContent && hdr.Get("Content-Encoding") == "" && compressible(hdr.Get("Content-Type"))
+	if compress {
+		hdr.Del("Content-Length")
+		hdr.Del("Accept-Ranges")
+		hdr.Set("Content-Encoding", "gzip")
+		if etag := hdr.Get("ETag"); etag != "" {
+			hdr.Set("ETag", gzipETag(etag))
+		}
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	// The client has the compressed content, which is still valid.
+	if status == http.StatusNotModified && hdr.Get("Content-Encoding") == "" {
+		if etag := hdr.Get("ETag"); etag != "" && !hasTag(gw.ifNoneMatch, etag) && hasTag(gw.ifNoneMatch, gzipETag(etag)) {
+			hdr.Set("ETag", gzipETag(etag))
+		}
+	}
+	gw.ResponseWriter.WriteHeader(status)
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !gw.wroteHeader {
+		if gw.Header().Get("Content-Type") == "" {
+			gw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz == nil {
+		return gw.ResponseWriter.Write(b)
+	}
+	return gw.gz.Write(b)
+}
+
+// Flush implements http.Flusher, pushing compressed data to the client.
+func (gw *gzipResponseWriter) Flush() {
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if f, ok := gw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker; whatever is written afterwards is not
+// compressed.
+func (gw *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := gw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return h.Hijack()
+}
+
+func (gw *gzipResponseWriter) close() {
+	if gw.gz != nil {
+		gw.gz.Close()
+	}
+}
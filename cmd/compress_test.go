@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func newTestCompressHandler() http.Handler {
+	modTime := time.Unix(1000, 0)
+	return compressHandler(http.FileServer(http.FS(fstest.MapFS{
+		"shots.json":   {Data: []byte(strings.Repeat(`{"name": "foo"}`, 100)), ModTime: modTime},
+		"viewer.svg":   {Data: []byte(strings.Repeat("<svg></svg>", 100)), ModTime: modTime},
+		"tile_0_0.jpg": {Data: []byte("\xff\xd8\xff\xe0 jpeg data"), ModTime: modTime},
+		"render.pdf":   {Data: []byte("%PDF-1.4 some document"), ModTime: modTime},
+		"noext":        {Data: []byte(strings.Repeat("plain text ", 100)), ModTime: modTime},
+	})))
+}
+
+func TestCompressHandler(t *testing.T) {
+	h := newTestCompressHandler()
+	for _, tc := range []struct {
+		desc     string
+		path     string
+		encoding string
+		gzipped  bool
+	}{
+		{"json", "/shots.json", "gzip", true},
+		{"svg", "/viewer.svg", "gzip, deflate, br", true},
+		{"sniffed type", "/noext", "gzip", true},
+		{"wildcard", "/shots.json", "*", true},
+		{"no accept-encoding", "/shots.json", "", false},
+		{"gzip refused", "/shots.json", "gzip;q=0, br", false},
+		{"tile", "/tile_0_0.jpg", "gzip", false},
+		{"not compressible", "/render.pdf", "gzip", false},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			if tc.encoding != "" {
+				req.Header.Set("Accept-Encoding", tc.encoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+			}
+			if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tc.gzipped {
+				t.Fatalf("got Content-Encoding %q, want gzipped=%v", rec.Header().Get("Content-Encoding"), tc.gzipped)
+			}
+			if !tc.gzipped {
+				return
+			}
+			if cl := rec.Header().Get("Content-Length"); cl != "" {
+				t.Errorf("got Content-Length %s on a compressed response", cl)
+			}
+			if ar := rec.Header().Get("Accept-Ranges"); ar != "" {
+				t.Errorf("got Accept-Ranges %q on a compressed response", ar)
+			}
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(gz); err != nil {
+				t.Errorf("invalid gzip content: %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressHandlerVary(t *testing.T) {
+	h := newTestCompressHandler()
+	for _, p := range []string{"/shots.json", "/render.pdf"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", p, nil))
+		if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%s: got Vary %q, want %q", p, got, "Accept-Encoding")
+		}
+	}
+	// Tiles are never compressed, so they do not vary.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/tile_0_0.jpg", nil))
+	if got := rec.Header().Get("Vary"); got != "" {
+		t.Errorf("tile: got Vary %q, want none", got)
+	}
+}
+
+func TestCompressHandlerRange(t *testing.T) {
+	h := newTestCompressHandler()
+	for _, tc := range []struct {
+		desc     string
+		path     string
+		encoding string
+		status   int
+	}{
+		{"compressed", "/shots.json", "gzip", http.StatusOK},
+		{"without gzip", "/shots.json", "", http.StatusPartialContent},
+		{"not compressible", "/render.pdf", "gzip", http.StatusPartialContent},
+		{"tile", "/tile_0_0.jpg", "gzip", http.StatusPartialContent},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			req.Header.Set("Range", "bytes=0-3")
+			if tc.encoding != "" {
+				req.Header.Set("Accept-Encoding", tc.encoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("got status %d, want %d", rec.Code, tc.status)
+			}
+			if tc.status == http.StatusPartialContent {
+				if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+					t.Errorf("got Content-Encoding %q on partial content", enc)
+				}
+				if rec.Body.Len() != 4 {
+					t.Errorf("got %d bytes, want 4", rec.Body.Len())
+				}
+			}
+		})
+	}
+}
+
+func TestCompressHandlerNoBody(t *testing.T) {
+	h := newTestCompressHandler()
+
+	req := httptest.NewRequest("HEAD", "/shots.json", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("HEAD: got Content-Encoding %q", enc)
+	}
+
+	req = httptest.NewRequest("GET", "/shots.json", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-Modified-Since", time.Unix(2000, 0).UTC().Format(http.TimeFormat))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("not modified: got Content-Encoding %q", enc)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("not modified: got %d bytes of body", rec.Body.Len())
+	}
+}
+
+// flushRecorder records whether it was flushed.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (fr *flushRecorder) Flush() {
+	fr.flushes++
+	fr.ResponseRecorder.Flush()
+}
+
+func TestCompressHandlerFlush(t *testing.T) {
+	h := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+	}))
+	req := httptest.NewRequest("GET", "/api/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	fr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(fr, req)
+	if fr.flushes != 1 {
+		t.Errorf("got %d flushes, want 1", fr.flushes)
+	}
+	// Events are not worth compressing; they must reach the client as is.
+	if enc := fr.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("got Content-Encoding %q for events", enc)
+	}
+	if !bytes.Equal(fr.Body.Bytes(), []byte("data: first\n\n")) {
+		t.Errorf("got body %q", fr.Body.Bytes())
+	}
+}
+
+func TestCompressHandlerETag(t *testing.T) {
+	content := strings.Repeat(`{"name": "foo"}`, 100)
+	h := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		etag := req.URL.Query().Get("etag")
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, req, "shots.json", time.Time{}, strings.NewReader(content))
+	}))
+	get := func(etag string, gzipped bool, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/shots.json?etag="+url.QueryEscape(etag), nil)
+		if gzipped {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Each encoding has its own strong ETag.
+	identity := get(`"abc"`, false, "")
+	compressed := get(`"abc"`, true, "")
+	if got := identity.Header().Get("ETag"); got != `"abc"` {
+		t.Errorf("got ETag %q uncompressed, want %q", got, `"abc"`)
+	}
+	if got := compressed.Header().Get("ETag"); got != `"abc-gzip"` {
+		t.Errorf("got ETag %q compressed, want %q", got, `"abc-gzip"`)
+	}
+	// Weak ones do not need to.
+	if got := get(`W/"abc"`, true, "").Header().Get("ETag"); got != `W/"abc"` {
+		t.Errorf("got weak ETag %q compressed, want %q", got, `W/"abc"`)
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		gzipped     bool
+		ifNoneMatch string
+		status      int
+		etag        string
+	}{
+		{"compressed", true, `"abc-gzip"`, http.StatusNotModified, `"abc-gzip"`},
+		{"uncompressed", false, `"abc"`, http.StatusNotModified, `"abc"`},
+		{"uncompressed copy, accepting gzip", true, `"abc"`, http.StatusNotModified, `"abc"`},
+		{"compressed copy, not accepting gzip", false, `"abc-gzip"`, http.StatusOK, `"abc"`},
+		{"changed", true, `"old-gzip"`, http.StatusOK, `"abc-gzip"`},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			rec := get(`"abc"`, tc.gzipped, tc.ifNoneMatch)
+			if rec.Code != tc.status {
+				t.Errorf("got status %d, want %d", rec.Code, tc.status)
+			}
+			if got := rec.Header().Get("ETag"); got != tc.etag {
+				t.Errorf("got ETag %q, want %q", got, tc.etag)
+			}
+		})
+	}
+
+	// ETags already specific to the encoding are kept, e.g., the embedded
+	// frontend.
+	fe := compressHandler(frontendHandler(fstest.MapFS{
+		"index.html": {Data: []byte(strings.Repeat("<p>mapshot</p>", 100))},
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	fe.ServeHTTP(rec, req)
+	etag := rec.Header().Get("ETag")
+	if !strings.HasSuffix(etag, `-gzip"`) || strings.HasSuffix(etag, `-gzip-gzip"`) {
+		t.Fatalf("got frontend ETag %q", etag)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	fe.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != etag {
+		t.Errorf("got status %d, ETag %q for the frontend, want %d, %q", rec.Code, rec.Header().Get("ETag"), http.StatusNotModified, etag)
+	}
+}
@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// mapshotConfig is the content of a config file: defaults for flags, keyed by
+// their long name - e.g., `factorio_binary: /opt/factorio/bin/x64/factorio`.
+type mapshotConfig struct {
+	// Where it was loaded from; "" if there is none.
+	file   string
+	values map[string][]string
+	// Flags which got their value from the config.
+	applied map[string]bool
+	// Flags which got their value from the environment.
+	fromEnv map[string]bool
+}
+
+// defaultConfigFile returns the location of the config file when --config is
+// not specified - e.g., ~/.config/mapshot/config.yaml on Linux.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		logDebug("no config dir", "error", err)
+		return ""
+	}
+	return filepath.Join(dir, "mapshot", "config.yaml")
+}
+
+// loadConfig reads the config file given by --config, or the default one if
+// it exists.
+func loadConfig() (*mapshotConfig, error) {
+	cfg := &mapshotConfig{
+		values:  map[string][]string{},
+		applied: map[string]bool{},
+	}
+	fname := configFile
+	if fname == "" {
+		fname = defaultConfigFile()
+		if fname == "" {
+			return cfg, nil
+		}
+		if _, err := os.Stat(fname); os.IsNotExist(err) {
+			return cfg, nil
+		}
+	}
+	raw, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+	content := map[string]interface{}{}
+	if err := yaml.Unmarshal(raw, &content); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", fname, err)
+	}
+	cfg.file = fname
+	for key, value := range content {
+		values, err := configValues(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q in config file %s: %w", key, fname, err)
+		}
+		cfg.values[key] = values
+	}
+	return cfg, nil
+}
+
+// configValues converts a value of the config file to what would be given on
+// the command line - one string per occurrence of the flag for lists.
+func configValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return []string{""}, nil
+	case []interface{}:
+		var values []string
+		for _, elt := range v {
+			s, err := configScalar(elt)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+	s, err := configScalar(value)
+	if err != nil {
+		return nil, err
+	}
+	return []string{s}, nil
+}
+
+func configScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("expected a string, number, boolean or list of those; got %v", value)
+}
+
+// apply sets the flags of the command which were not given on the command
+// line from the config. It returns the keys which are not a flag of any
+// command; those are ignored, so a config keeps working across versions.
+func (cfg *mapshotConfig) apply(cmd *cobra.Command) ([]string, error) {
+	known := allFlags(cmd.Root())
+	var unknown []string
+	for _, key := range cfg.keys() {
+		if !known[key] {
+			unknown = append(unknown, key)
+			continue
+		}
+		f := cmd.Flags().Lookup(key)
+		// Only some of the keys are for this command; and flags given on the
+		// command line win.
+		if f == nil || f.Changed || key == "config" {
+			continue
+		}
+		for _, v := range cfg.values[key] {
+			if err := cmd.Flags().Set(key, v); err != nil {
+				return nil, fmt.Errorf("config file %s: %w", cfg.file, err)
+			}
+		}
+		cfg.applied[key] = true
+	}
+	return unknown, nil
+}
+
+// keys returns the keys of the config, sorted.
+func (cfg *mapshotConfig) keys() []string {
+	var keys []string
+	for key := range cfg.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// allFlags returns the names of the flags of all the commands below root.
+func allFlags(root *cobra.Command) map[string]bool {
+	names := map[string]bool{}
+	add := func(f *pflag.Flag) {
+		names[f.Name] = true
+	}
+	var walk func(c *cobra.Command)
+	walk = func(c *cobra.Command) {
+		c.LocalFlags().VisitAll(add)
+		for _, sub := range c.Commands() {
+			walk(sub)
+		}
+	}
+	walk(root)
+	pflag.CommandLine.VisitAll(add)
+	return names
+}
+
+// Prefix of the environment variables overriding flags.
+const envPrefix = "MAPSHOT_"
+
+// envName returns the environment variable for the flag - e.g.,
+// MAPSHOT_FACTORIO_BINARY for --factorio_binary.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets the flags of the command which were not given on the command
+// line from their environment variable, if set. It returns the names of the
+// flags which were set.
+func applyEnv(cmd *cobra.Command) (map[string]bool, error) {
+	applied := map[string]bool{}
+	var firstErr error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed || firstErr != nil {
+			return
+		}
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := cmd.Flags().Set(f.Name, v); err != nil {
+			firstErr = fmt.Errorf("invalid $%s: %w", name, err)
+			return
+		}
+		applied[f.Name] = true
+	})
+	return applied, firstErr
+}
+
+// config is the config of the current run, once loaded.
+var config *mapshotConfig
+
+// setupConfig applies the environment and the config file to the flags of the
+// command being run - in that order of precedence, the command line winning
+// over both.
+func setupConfig(cmd *cobra.Command) ([]string, error) {
+	// First, as $MAPSHOT_CONFIG can select the config file.
+	fromEnv, err := applyEnv(cmd)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.fromEnv = fromEnv
+	config = cfg
+	return cfg.apply(cmd)
+}
+
+// addEnvUsage mentions the environment variable of each flag in its help.
+func addEnvUsage(root *cobra.Command) {
+	seen := map[*pflag.Flag]bool{}
+	add := func(f *pflag.Flag) {
+		if seen[f] || f.Name == "help" {
+			return
+		}
+		seen[f] = true
+		f.Usage += " [$" + envName(f.Name) + "]"
+	}
+	var walk func(c *cobra.Command)
+	walk = func(c *cobra.Command) {
+		c.LocalFlags().VisitAll(add)
+		for _, sub := range c.Commands() {
+			walk(sub)
+		}
+	}
+	walk(root)
+	pflag.CommandLine.VisitAll(add)
+}
+
+// flagConfigValue returns the value of the flag as it would be written in the
+// config file.
+func flagConfigValue(f *pflag.Flag, s string) interface{} {
+	t := f.Value.Type()
+	switch {
+	case isListFlag(f):
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		if s == "" {
+			return []string{}
+		}
+		values, err := csv.NewReader(strings.NewReader(s)).Read()
+		if err != nil {
+			return s
+		}
+		return values
+	case t == "bool":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case strings.HasPrefix(t, "int") || strings.HasPrefix(t, "uint"):
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	case strings.HasPrefix(t, "float"):
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+	}
+	return s
+}
+
+// isListFlag indicates if the flag takes multiple values, e.g., when repeated.
+func isListFlag(f *pflag.Flag) bool {
+	t := f.Value.Type()
+	return strings.HasSuffix(t, "Slice") || strings.HasSuffix(t, "Array")
+}
+
+// configLine formats a flag value as a line of config file, with where the
+// value comes from as a comment.
+func configLine(f *pflag.Flag, value interface{}, source string) (string, error) {
+	raw, err := yaml.Marshal(map[string]interface{}{f.Name: value})
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSuffix(string(raw), "\n")
+	if idx := strings.Index(text, "\n"); idx >= 0 {
+		return text[:idx] + " # " + source + text[idx:], nil
+	}
+	return text + " # " + source, nil
+}
+
+var cmdConfig = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the config file of mapshot.",
+}
+
+var cmdConfigShow = &cobra.Command{
+	Use:   "show",
+	Short: "Show the effective configuration, with the source of each value.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if config == nil {
+			return errors.New("no config loaded")
+		}
+		if config.file != "" {
+			fmt.Printf("# Config file: %s\n", config.file)
+		} else if fname := defaultConfigFile(); fname != "" {
+			fmt.Printf("# Config file: none (%s does not exist)\n", fname)
+		}
+		var lines []string
+		show := func(f *pflag.Flag, value interface{}, source string) {
+			if f.Name == "help" || f.Hidden {
+				return
+			}
+			line, err := configLine(f, value, source)
+			if err != nil {
+				logWarning("unable to format flag", "flag", f.Name, "error", err)
+				return
+			}
+			lines = append(lines, line)
+		}
+
+		// Flags available to all commands - including this one, so they
+		// already have their effective value.
+		inherited := map[string]bool{}
+		cmd.InheritedFlags().VisitAll(func(f *pflag.Flag) {
+			inherited[f.Name] = true
+			source := "default"
+			if config.applied[f.Name] {
+				source = "config file"
+			} else if config.fromEnv[f.Name] {
+				source = "environment, $" + envName(f.Name)
+			} else if f.Changed {
+				source = "command line"
+			}
+			show(f, flagConfigValue(f, f.Value.String()), source)
+		})
+		fmt.Println("\n# All commands")
+		printLines(lines)
+
+		for _, c := range cmdRoot.Commands() {
+			if c == cmdConfig || c.Name() == "help" {
+				continue
+			}
+			lines = nil
+			c.LocalFlags().VisitAll(func(f *pflag.Flag) {
+				if inherited[f.Name] {
+					return
+				}
+				if v, ok := os.LookupEnv(envName(f.Name)); ok {
+					show(f, flagConfigValue(f, v), "environment, $"+envName(f.Name))
+					return
+				}
+				values, ok := config.values[f.Name]
+				if !ok {
+					show(f, flagConfigValue(f, f.DefValue), "default")
+					return
+				}
+				// Shown as given; it is only checked when running that
+				// command.
+				if isListFlag(f) {
+					show(f, values, "config file")
+				} else {
+					show(f, flagConfigValue(f, values[len(values)-1]), "config file")
+				}
+			})
+			if len(lines) > 0 {
+				fmt.Printf("\n# %s\n", c.Name())
+				printLines(lines)
+			}
+		}
+		return nil
+	},
+}
+
+func printLines(lines []string) {
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+}
+
+var configFile string
+
+func init() {
+	cmdRoot.PersistentFlags().StringVar(&configFile, "config", "", "Config file in YAML giving defaults for any flag, by its long name - e.g., 'factorio_binary: /opt/factorio/bin/x64/factorio'. Defaults to mapshot/config.yaml in the user config dir - e.g., ~/.config/mapshot/config.yaml on Linux.")
+	cmdConfig.AddCommand(cmdConfigShow)
+	cmdRoot.AddCommand(cmdConfig)
+}
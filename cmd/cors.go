@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsHandler adds CORS headers, allowing pages from other origins to access
+// the API & mapshots content.
+type corsHandler struct {
+	next    http.Handler
+	origins map[string]bool
+	// True if all origins are allowed.
+	any bool
+}
+
+func newCORSHandler(next http.Handler, origins []string) *corsHandler {
+	h := &corsHandler{
+		next:    next,
+		origins: make(map[string]bool),
+	}
+	for _, o := range origins {
+		if o == "*" {
+			h.any = true
+		}
+		h.origins[strings.TrimSuffix(o, "/")] = true
+	}
+	return h
+}
+
+// corsPath indicates whether CORS headers should be provided for the path.
+// The frontend itself is meant to be used directly only.
+func corsPath(p string) bool {
+	return p == "/shots.json" || strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/data/")
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	if origin == "" || !corsPath(req.URL.Path) {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	if !h.any && !h.origins[origin] {
+		// Not allowed. Request is still processed - it is up to the browser to
+		// enforce the restriction.
+		if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.next.ServeHTTP(w, req)
+		return
+	}
+
+	hdr := w.Header()
+	if h.any {
+		hdr.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		hdr.Set("Access-Control-Allow-Origin", origin)
+		// Let explicitly allowed origins use basic auth credentials.
+		hdr.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	// Preflight request.
+	if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+		hdr.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+		if reqHeaders := req.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			hdr.Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+		hdr.Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	hdr.Set("Access-Control-Expose-Headers", "ETag, Content-Length")
+	h.next.ServeHTTP(w, req)
+}
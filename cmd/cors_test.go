@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("content"))
+	})
+	for _, tc := range []struct {
+		desc    string
+		origins []string
+		method  string
+		path    string
+		origin  string
+		// Set for preflight requests.
+		requestMethod string
+		status        int
+		allowOrigin   string
+		credentials   bool
+		// Whether the request reached the handler.
+		served bool
+	}{
+		{"preflight", []string{"https://dash.example.com"}, "OPTIONS", "/api/v1/shots", "https://dash.example.com", "GET", http.StatusNoContent, "https://dash.example.com", true, false},
+		{"preflight with trailing slash in flag", []string{"https://dash.example.com/"}, "OPTIONS", "/shots.json", "https://dash.example.com", "GET", http.StatusNoContent, "https://dash.example.com", true, false},
+		{"preflight with wildcard", []string{"*"}, "OPTIONS", "/data/foo/mapshot.json", "https://other.example.com", "GET", http.StatusNoContent, "*", false, false},
+		{"preflight from disallowed origin", []string{"https://dash.example.com"}, "OPTIONS", "/api/v1/shots", "https://evil.example.com", "DELETE", http.StatusForbidden, "", false, false},
+		{"allowed", []string{"https://dash.example.com"}, "GET", "/shots.json", "https://dash.example.com", "", http.StatusOK, "https://dash.example.com", true, true},
+		{"tile", []string{"https://dash.example.com"}, "GET", "/data/foo/s1zoom_0/tile_0_0.jpg", "https://dash.example.com", "", http.StatusOK, "https://dash.example.com", true, true},
+		{"wildcard", []string{"*"}, "GET", "/shots.json", "https://other.example.com", "", http.StatusOK, "*", false, true},
+		{"disallowed origin", []string{"https://dash.example.com"}, "GET", "/shots.json", "https://evil.example.com", "", http.StatusOK, "", false, true},
+		{"frontend", []string{"*"}, "GET", "/map/", "https://other.example.com", "", http.StatusOK, "", false, true},
+		{"same origin", []string{"*"}, "GET", "/shots.json", "", "", http.StatusOK, "", false, true},
+		{"plain options", []string{"*"}, "OPTIONS", "/api/v1/shots", "https://other.example.com", "", http.StatusOK, "*", false, true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := newCORSHandler(next, tc.origins)
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			if tc.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tc.requestMethod)
+				req.Header.Set("Access-Control-Request-Headers", "Authorization")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("got status %d, want %d", rec.Code, tc.status)
+			}
+			hdr := rec.Header()
+			if got := hdr.Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tc.allowOrigin)
+			}
+			if got := hdr.Get("Access-Control-Allow-Credentials") == "true"; got != tc.credentials {
+				t.Errorf("got Access-Control-Allow-Credentials %q, want set=%v", hdr.Get("Access-Control-Allow-Credentials"), tc.credentials)
+			}
+			if got := rec.Body.String() == "content"; got != tc.served {
+				t.Errorf("got body %q, want served=%v", rec.Body.String(), tc.served)
+			}
+			if tc.origin != "" && corsPath(tc.path) && hdr.Get("Vary") != "Origin" {
+				t.Errorf("got Vary %q, want Origin", hdr.Get("Vary"))
+			}
+			if tc.status == http.StatusNoContent {
+				if got := hdr.Get("Access-Control-Allow-Methods"); got == "" {
+					t.Error("no Access-Control-Allow-Methods on preflight")
+				}
+				if got := hdr.Get("Access-Control-Allow-Headers"); got != "Authorization" {
+					t.Errorf("got Access-Control-Allow-Headers %q, want Authorization", got)
+				}
+			}
+		})
+	}
+}
+
+// Without --cors_origin, no CORS header is ever added.
+func TestCORSUnset(t *testing.T) {
+	s, _ := newTestServer(t, newTestServeFlags(t))
+	h, err := s.sf.wrap(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"GET", "OPTIONS"} {
+		req := httptest.NewRequest(method, "/shots.json", nil)
+		req.Header.Set("Origin", "https://dash.example.com")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		for key := range rec.Header() {
+			if strings.HasPrefix(key, "Access-Control-") {
+				t.Errorf("%s: got CORS header %s", method, key)
+			}
+		}
+	}
+}
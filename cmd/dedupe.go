@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// Prefix of the temporary links created while deduplicating. A leftover from
+// an interrupted pass is replaced on the next one.
+const dedupeTmpPrefix = ".mapshot-dedupe-"
+
+var dedupeFlags struct {
+	dryRun bool
+}
+
+// dedupeFile is a tile considered for deduplication.
+type dedupeFile struct {
+	path string
+	info os.FileInfo
+}
+
+// fileID identifies a file on a filesystem - i.e., its inode.
+type fileID struct {
+	dev, ino uint64
+}
+
+// dedupeStats summarizes a deduplication pass.
+type dedupeStats struct {
+	linked int
+	// Only counts files whose last link was replaced, as the others still use
+	// the same space.
+	saved int64
+	// Set when the number of links of some files is unknown, in which case
+	// saved is an upper bound.
+	upperBound bool
+	failed     int
+}
+
+var cmdDedupe = &cobra.Command{
+	Use:   "dedupe [dir...]",
+	Short: "Replace identical tiles of mapshots by hardlinks, to save disk space.",
+	Long: `Replace identical tiles of mapshots by hardlinks, to save disk space.
+
+Consecutive renders of the same map share most of their tiles. This looks for
+mapshots in the given directories - or in Factorio script-output directory if
+none is specified - and replaces tiles having the same content by hardlinks to
+a single file. Mapshots are served as before; archived mapshots are left
+untouched.
+
+Each file is replaced atomically, so it is safe to interrupt. Tiles must not be
+modified in place afterwards, as the change would affect all mapshots sharing
+that tile.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dirs := args
+		if len(dirs) == 0 {
+			dir, err := factorioSettings.ScriptOutput()
+			if err != nil {
+				return err
+			}
+			dirs = []string{dir}
+		}
+
+		var files []*dedupeFile
+		for _, dir := range dirs {
+			shots, _, err := findShots(dir, newArchiveCache(), scanOptions{}, nil)
+			if err != nil {
+				return err
+			}
+			for _, shot := range shots {
+				if shot.archive {
+					continue
+				}
+				tiles, err := listTiles(shot.fsPath)
+				if err != nil {
+					return err
+				}
+				files = append(files, tiles...)
+			}
+		}
+		fmt.Printf("Found %d tiles\n", len(files))
+
+		stats, err := dedupe(files, dedupeFlags.dryRun)
+		if err != nil {
+			return err
+		}
+		verb := "Replaced"
+		if dedupeFlags.dryRun {
+			verb = "Would replace"
+		}
+		saving := "saving"
+		if stats.upperBound {
+			saving = "saving at most"
+		}
+		fmt.Printf("%s %d tiles by hardlinks, %s %d bytes (%.1f MiB)\n", verb, stats.linked, saving, stats.saved, float64(stats.saved)/(1<<20))
+		if stats.failed > 0 {
+			return fmt.Errorf("unable to link %d tiles; see logs", stats.failed)
+		}
+		return nil
+	},
+}
+
+// listTiles returns the tiles of the mapshot directory.
+func listTiles(shotDir string) ([]*dedupeFile, error) {
+	var files []*dedupeFile
+	err := filepath.Walk(shotDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(shotDir, p)
+		if err != nil {
+			return err
+		}
+		if isTilePath(filepath.ToSlash(rel)) {
+			files = append(files, &dedupeFile{path: p, info: info})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tiles of %s: %w", shotDir, err)
+	}
+	return files, nil
+}
+
+// dedupe links together files with identical content. Only files with the
+// same size are compared, so most files are never read.
+func dedupe(files []*dedupeFile, dryRun bool) (*dedupeStats, error) {
+	stats := &dedupeStats{}
+	// Links left to each replaced file; its space is only freed once none
+	// remains - files can be linked from elsewhere.
+	links := map[fileID]uint64{}
+	bySize := map[int64][]*dedupeFile{}
+	for _, f := range files {
+		bySize[f.info.Size()] = append(bySize[f.info.Size()], f)
+	}
+	for _, group := range bySize {
+		if len(group) < 2 {
+			continue
+		}
+		// First file seen with a given content.
+		canonical := map[[sha256.Size]byte]*dedupeFile{}
+		for _, f := range group {
+			sum, err := hashFile(f.path)
+			if err != nil {
+				return nil, err
+			}
+			c := canonical[sum]
+			if c == nil {
+				canonical[sum] = f
+				continue
+			}
+			if os.SameFile(c.info, f.info) {
+				// Already linked.
+				continue
+			}
+			if !dryRun {
+				if err := replaceByLink(c.path, f.path); err != nil {
+					logWarning("unable to link duplicate file", "path", f.path, "to", c.path, "error", err)
+					stats.failed++
+					continue
+				}
+			}
+			stats.linked++
+			id, n, ok := fileLinks(f.info)
+			if !ok {
+				stats.saved += f.info.Size()
+				stats.upperBound = true
+				continue
+			}
+			if _, seen := links[id]; !seen {
+				links[id] = n
+			}
+			links[id]--
+			if links[id] == 0 {
+				stats.saved += f.info.Size()
+			}
+		}
+	}
+	return stats, nil
+}
+
+func hashFile(p string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(p)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, fmt.Errorf("unable to read %s: %w", p, err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// replaceByLink replaces `target` by a hardlink to `source`. The link is
+// created next to the target and renamed over it, so the target is never
+// missing.
+func replaceByLink(source, target string) error {
+	tmp := filepath.Join(filepath.Dir(target), dedupeTmpPrefix+filepath.Base(target))
+	os.Remove(tmp)
+	if err := os.Link(source, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdDedupe)
+	cmdDedupe.Flags().BoolVar(&dedupeFlags.dryRun, "dry_run", false, "If true, only report how much space would be saved.")
+}
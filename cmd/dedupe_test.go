@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDedupeSaved(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("number of links not available")
+	}
+	quietLogs(t)
+	for _, dryRun := range []bool{true, false} {
+		dir := t.TempDir()
+		content := []byte("identical tile content")
+		write := func(name string) string {
+			p := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(p, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}
+		link := func(source, name string) string {
+			p := filepath.Join(dir, name)
+			if err := os.Link(source, p); err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}
+		paths := []string{
+			write("a.jpg"),
+			// Freed once replaced.
+			write("b.jpg"),
+			// Still linked from outside the mapshots.
+			link(write("outside.jpg"), "c.jpg"),
+		}
+		// Two links to the same file, both replaced; freed once.
+		d := write("d.jpg")
+		paths = append(paths, d, link(d, "e.jpg"))
+
+		var files []*dedupeFile
+		for _, p := range paths {
+			info, err := os.Lstat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, &dedupeFile{path: p, info: info})
+		}
+		stats, err := dedupe(files, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.linked != 4 || stats.failed != 0 {
+			t.Errorf("dry run %v: got %d linked, %d failed; want 4, 0", dryRun, stats.linked, stats.failed)
+		}
+		if want := 2 * int64(len(content)); stats.saved != want || stats.upperBound {
+			t.Errorf("dry run %v: got %d bytes saved (upper bound: %v), want exactly %d", dryRun, stats.saved, stats.upperBound, want)
+		}
+		if dryRun {
+			continue
+		}
+		a, err := os.Stat(paths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range paths[1:] {
+			info, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(a, info) {
+				t.Errorf("%s not linked to %s", p, paths[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLinks returns the identity of the file and its number of hardlinks; ok
+// is false when they are not known.
+func fileLinks(info os.FileInfo) (id fileID, links uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	// Field types vary across systems.
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
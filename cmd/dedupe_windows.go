@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import "os"
+
+// fileLinks returns the identity of the file and its number of hardlinks;
+// they are not available from os.FileInfo on Windows.
+func fileLinks(info os.FileInfo) (id fileID, links uint64, ok bool) {
+	return fileID{}, 0, false
+}
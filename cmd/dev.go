@@ -3,19 +3,18 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/Palats/mapshot/factorio"
-	"github.com/golang/glog"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
 
 func devFactorio(ctx context.Context, fact *factorio.Factorio, checkoutDir string) error {
-	tmpdir, cleanup := getWorkDir()
+	tmpdir, cleanup := getWorkDir(fact.TempDir())
 	defer cleanup()
 
 	// Copy mods
@@ -30,7 +29,7 @@ func devFactorio(ctx context.Context, fact *factorio.Factorio, checkoutDir strin
 	if err := os.Symlink(modDir, dstMapshot); err != nil {
 		return fmt.Errorf("unable to symlink %q: %w", modDir, err)
 	}
-	glog.Infof("mod linked at %q", dstMapshot)
+	logInfo("mod linked", "path", dstMapshot)
 
 	factorioArgs := []string{
 		"--disable-audio",
@@ -45,18 +44,24 @@ func devFactorio(ctx context.Context, fact *factorio.Factorio, checkoutDir strin
 }
 
 func devServe(ctx context.Context, fact *factorio.Factorio, checkoutDir string) error {
+	if serveFlags.frontendDir == "" {
+		serveFlags.frontendDir = filepath.Join(checkoutDir, "frontend", "dist")
+	}
+	if err := serveFlags.validate(); err != nil {
+		return err
+	}
 	baseDir := fact.ScriptOutput()
 	fmt.Printf("Serving data from %s\n", baseDir)
+	fmt.Printf("Serving UI from %s\n", serveFlags.frontendDir)
+	listing, viewer := serveFlags.frontend()
 	s := newServer(
-		baseDir,
-		http.FileServer(http.Dir(path.Join(checkoutDir, "frontend", "dist", "listing"))),
-		http.FileServer(http.Dir(path.Join(checkoutDir, "frontend", "dist", "viewer"))),
+		serveFlags,
+		[]shotSource{{store: newDirStore(baseDir, scanOptions{})}},
+		listing,
+		viewer,
 	)
 	go s.watch(ctx)
-
-	addr := fmt.Sprintf(":%d", port)
-	fmt.Printf("Listening on %s ...\n", addr)
-	return http.ListenAndServe(addr, s)
+	return serveFlags.listenAndServe(ctx, s)
 }
 
 var cmdDev = &cobra.Command{
@@ -72,7 +77,7 @@ parameters come from the game.
 Flag --factorio_verbose is forced to true.
 
 It runs a HTTP server to serve the content in Factorio script-output. It
-uses the UI code in frontend/dist/.
+uses the UI code in frontend/dist/, unless --frontend_dir is specified.
 	`,
 	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -87,7 +92,10 @@ uses the UI code in frontend/dist/.
 			return fmt.Errorf("unable to find current directory: %w", err)
 		}
 
-		grp, ctx := errgroup.WithContext(cmd.Context())
+		// As for render, Factorio does not get Ctrl+C from the terminal.
+		sigCtx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		grp, ctx := errgroup.WithContext(sigCtx)
 
 		if flagDevServe {
 			grp.Go(func() error {
@@ -110,6 +118,7 @@ var (
 
 func init() {
 	renderFlags.Register(cmdDev.PersistentFlags(), "")
+	serveFlags.Register(cmdDev.PersistentFlags(), "")
 	cmdRoot.AddCommand(cmdDev)
 	cmdDev.PersistentFlags().BoolVar(&flagDevFactorio, "factorio", true, "Run Factorio.")
 	cmdDev.PersistentFlags().BoolVar(&flagDevServe, "serve", true, "Run HTTP server.")
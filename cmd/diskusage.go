@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DiskUsageJSON is the response of /api/disk-usage.
+type DiskUsageJSON struct {
+	// Filesystems of the local base directories.
+	Dirs []*DiskUsageDirJSON `json:"dirs"`
+	// Total size of the mapshots, from their stats.
+	ShotsBytes int64 `json:"shots_bytes"`
+	// Number of mapshots whose size is not known yet - e.g., right after
+	// startup; they are not counted in ShotsBytes.
+	PendingShots int `json:"pending_shots,omitempty"`
+	// When the values were computed; they are refreshed at most once per
+	// scan for mapshots.
+	Updated time.Time `json:"updated"`
+}
+
+// DiskUsageDirJSON is part of DiskUsageJSON.
+type DiskUsageDirJSON struct {
+	Source     string `json:"source,omitempty"`
+	Dir        string `json:"dir"`
+	TotalBytes uint64 `json:"total_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+	// Available to the server; might be less than total minus used, e.g.,
+	// with blocks reserved to root.
+	FreeBytes uint64 `json:"free_bytes"`
+	// Set if the space of the filesystem could not be obtained.
+	Error string `json:"error,omitempty"`
+}
+
+// diskSpaceInfo is the space of a filesystem, in bytes.
+type diskSpaceInfo struct {
+	total uint64
+	used  uint64
+	free  uint64
+}
+
+// diskUsageCache keeps the disk usage until the next scan for mapshots.
+type diskUsageCache struct {
+	m sync.Mutex
+	// Scan the data was computed for.
+	scan time.Time
+	data *DiskUsageJSON
+}
+
+// diskUsage returns the disk usage, computing it if there was a scan since
+// the last time.
+func (s *Server) diskUsage() *DiskUsageJSON {
+	s.m.Lock()
+	scan := s.lastScan
+	shots := s.shots
+	s.m.Unlock()
+
+	dc := &s.diskUsageCache
+	dc.m.Lock()
+	defer dc.m.Unlock()
+	if dc.data != nil && dc.scan.Equal(scan) {
+		return dc.data
+	}
+
+	data := &DiskUsageJSON{
+		Dirs:    []*DiskUsageDirJSON{},
+		Updated: time.Now(),
+	}
+	for _, src := range s.sources {
+		ds, ok := src.store.(*dirStore)
+		if !ok {
+			continue
+		}
+		dir := &DiskUsageDirJSON{
+			Source: src.label,
+			Dir:    ds.dir,
+		}
+		if space, err := diskSpace(ds.dir); err != nil {
+			dir.Error = err.Error()
+		} else {
+			dir.TotalBytes = space.total
+			dir.UsedBytes = space.used
+			dir.FreeBytes = space.free
+		}
+		data.Dirs = append(data.Dirs, dir)
+	}
+	for i := range shots {
+		if stats := s.stats.lookup(&shots[i]); stats != nil {
+			data.ShotsBytes += stats.Bytes
+		} else {
+			data.PendingShots++
+		}
+	}
+	dc.scan = scan
+	dc.data = data
+	return data
+}
+
+// handleDiskUsage serves /api/disk-usage, the space used & available to
+// store mapshots.
+func (s *Server) handleDiskUsage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, s.diskUsage())
+}
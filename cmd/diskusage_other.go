@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func diskSpace(path string) (*diskSpaceInfo, error) {
+	return nil, fmt.Errorf("disk usage is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package cmd
+
+import "syscall"
+
+// diskSpace returns the space of the filesystem containing the path.
+func diskSpace(path string) (*diskSpaceInfo, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	// Field types vary across systems.
+	bsize := uint64(st.Bsize)
+	return &diskSpaceInfo{
+		total: uint64(st.Blocks) * bsize,
+		used:  (uint64(st.Blocks) - uint64(st.Bfree)) * bsize,
+		// Blocks reserved for root are not included.
+		free: uint64(st.Bavail) * bsize,
+	}, nil
+}
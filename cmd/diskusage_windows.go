@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskSpace returns the space of the volume containing the path.
+func diskSpace(path string) (*diskSpaceInfo, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	var available, totalBytes, totalFree uint64
+	r, _, err := procGetDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&totalBytes)),
+		uintptr(unsafe.Pointer(&totalFree)),
+	)
+	if r == 0 {
+		return nil, err
+	}
+	return &diskSpaceInfo{
+		total: totalBytes,
+		used:  totalBytes - totalFree,
+		// Takes quotas into account.
+		free: available,
+	}, nil
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// downloadFilename returns the name of the zip file for downloading the
+// mapshot. It uses the archive suffix, so it can be served as is once copied
+// in a base directory.
+func downloadFilename(shot *shotInfo) string {
+	return strings.ReplaceAll(shot.name, "/", "-") + archiveSuffix
+}
+
+// serveDownload serves /api/shots/<name>/download, a zip of the mapshot files.
+// The archive is built while streaming it, one file at a time, without
+// temporary files.
+func (s *Server) serveDownload(w http.ResponseWriter, req *http.Request, shot *shotInfo) {
+	if shot.tilesDB != "" {
+		writeJSONError(w, http.StatusNotImplemented, "download is not supported for mapshots with tiles in an MBTiles file")
+		return
+	}
+	hdr := w.Header()
+	hdr.Set("Content-Type", "application/zip")
+	hdr.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": downloadFilename(shot)}))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	zw := zip.NewWriter(w)
+	err := fs.WalkDir(shot.fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		fh, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		fh.Name = p
+		// Tiles are already compressed.
+		fh.Method = zip.Store
+		dst, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		src, err := shot.fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(dst, src)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// Headers are already sent; abort the connection so the client does
+		// not get a truncated archive looking complete.
+		logError("unable to send archive", "shot", shot.name, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Palats/mapshot/embed"
+	"github.com/Palats/mapshot/factorio"
+)
+
+// dryRun describes what the render of the save would do with --dry_run,
+// after the same checks as a real render. It returns where the mapshot would
+// be written; the last part of it is only known once rendered.
+func dryRun(fact *factorio.Factorio, version *factorio.VersionInfo, rf *RenderFlags, ro *renderOptions, job *renderJob) (string, error) {
+	out := job.out
+	name := saveName(job.rawname)
+
+	srcSavegame, err := fact.FindSaveFile(job.rawname)
+	if err != nil {
+		return "", fmt.Errorf("unable to find savegame %q: %w", job.rawname, err)
+	}
+	fp, err := newSaveFingerprint(srcSavegame)
+	if err != nil {
+		return "", fmt.Errorf("unable to read savegame %q: %w", srcSavegame, err)
+	}
+	dstRoot := ro.output
+	if dstRoot == "" {
+		dstRoot = fact.ScriptOutput()
+	}
+	if err := checkWritable(dstRoot); err != nil {
+		return "", fmt.Errorf("output directory %s is not writable: %w", dstRoot, err)
+	}
+
+	modList, err := factorio.LoadModList(filepath.Join(fact.ModsDir(), "mod-list.json"))
+	if err != nil {
+		return "", err
+	}
+	enabled := map[string]bool{"mapshot": true}
+	for _, mod := range ro.enableMods {
+		if !factorio.HasMod(fact.ModsDir(), mod) {
+			return "", fmt.Errorf("unable to enable mod %q: not found in %s", mod, fact.ModsDir())
+		}
+		enabled[mod] = true
+	}
+	for _, mod := range modList.Mods {
+		if mod.Enabled && mod.Name != "mapshot" {
+			enabled[mod.Name] = true
+		}
+	}
+	var enabledNames, disabledNames []string
+	for mod := range enabled {
+		enabledNames = append(enabledNames, mod)
+	}
+	for _, mod := range modList.Mods {
+		if !enabled[mod.Name] {
+			disabledNames = append(disabledNames, mod.Name)
+		}
+	}
+	sort.Strings(enabledNames)
+	sort.Strings(disabledNames)
+
+	overrides := rf.genOverrides()
+	// Same default as the mod setting.
+	prefix := "mapshot"
+	fromGame := true
+	if p, ok := overrides["prefix"].(string); ok {
+		prefix, fromGame = strings.TrimSuffix(p, "/"), false
+	}
+	output := filepath.Join(dstRoot, filepath.FromSlash(prefix), name, "d-<id>")
+
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Dry run of the render of %q; Factorio is not started.\n", name)
+	fmt.Fprintf(tw, "Factorio:\t%s\n", fact.Binary())
+	fmt.Fprintf(tw, "Version:\t%s\n", version)
+	fmt.Fprintf(tw, "Save:\t%s\n", srcSavegame)
+	fmt.Fprintf(tw, "\t%d bytes (%.1f MiB), modified %s\n", fp.size, float64(fp.size)/(1<<20), fp.modTime.Format(time.RFC3339))
+	if ro.skipUnchanged && !ro.force {
+		if prev, err := lastRender(dstRoot, name, fp); err != nil {
+			fmt.Fprintf(tw, "\tunable to check previous renders: %v\n", err)
+		} else if prev != "" {
+			fmt.Fprintf(tw, "\tunchanged since last render, in %s; would be skipped\n", prev)
+		}
+	}
+	fmt.Fprintf(tw, "Mods:\t%s - used through a copy; mod-list.json is left untouched\n", fact.ModsDir())
+	fmt.Fprintf(tw, "\tenabled: %s\n", strings.Join(enabledNames, ", "))
+	if len(disabledNames) > 0 {
+		fmt.Fprintf(tw, "\tdisabled: %s\n", strings.Join(disabledNames, ", "))
+	}
+	if factorio.HasMod(fact.ModsDir(), "mapshot") {
+		fmt.Fprintf(tw, "\tinstalled mapshot mod is left out, replaced by mapshot %s\n", embed.Version)
+	}
+	fmt.Fprintf(tw, "Output:\t%s\n", output)
+	if fromGame {
+		fmt.Fprintf(tw, "\tunless the prefix is changed in the game; <id> is only known once rendered\n")
+	} else {
+		fmt.Fprintf(tw, "\t<id> is only known once rendered\n")
+	}
+	if ro.output != "" {
+		fmt.Fprintf(tw, "\trendered in %s, then moved\n", fact.ScriptOutput())
+	}
+	fmt.Fprintf(tw, "Mod settings:\t\n")
+	keys := []string{}
+	for key := range modSettingNumbers {
+		keys = append(keys, key)
+	}
+	for key := range overrides {
+		if _, known := modSettingNumbers[key]; !known {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if v, ok := overrides[key]; ok {
+			fmt.Fprintf(tw, "  %s\t%v\n", key, v)
+		} else {
+			fmt.Fprintf(tw, "  %s\t(from the game)\n", key)
+		}
+	}
+	tw.Flush()
+	out.print(b.String())
+	return output, nil
+}
+
+// checkWritable verifies that files can be created in dir - or in its closest
+// existing parent, as it is created when needed.
+func checkWritable(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	f, err := ioutil.TempFile(dir, ".mapshot-dry-run-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often to send something on idle event streams, so proxies do not close
+// the connection.
+const eventsHeartbeatDelay = 15 * time.Second
+
+// ShotEventJSON is the data of events sent on /api/events.
+type ShotEventJSON struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// shotEvent is a change to the list of mapshots.
+type shotEvent struct {
+	// Either "added" or "removed".
+	kind string
+	data *ShotEventJSON
+}
+
+// eventHub dispatches mapshot changes to all connected clients.
+type eventHub struct {
+	m      sync.Mutex
+	subs   map[chan *shotEvent]bool
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subs: make(map[chan *shotEvent]bool),
+	}
+}
+
+// subscribe returns a channel receiving all subsequent events. The channel is
+// closed when the hub is closed, or if the subscriber is too slow to keep up.
+func (h *eventHub) subscribe() chan *shotEvent {
+	h.m.Lock()
+	defer h.m.Unlock()
+	ch := make(chan *shotEvent, 64)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subs[ch] = true
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan *shotEvent) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.subs[ch] {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *eventHub) publish(events []*shotEvent) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for ch := range h.subs {
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+			default:
+				// Client will reconnect and reload the full list.
+				logWarning("events client too slow, disconnecting")
+				delete(h.subs, ch)
+				close(ch)
+			}
+			if !h.subs[ch] {
+				break
+			}
+		}
+	}
+}
+
+// close disconnects all clients; used when shutting down.
+func (h *eventHub) close() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// diffShots returns the events describing the changes from the previous list
+// of mapshots to the new one.
+func (s *Server) diffShots(prev, shots []shotInfo) []*shotEvent {
+	prevNames := map[string]bool{}
+	for _, shot := range prev {
+		prevNames[shot.name] = true
+	}
+	newNames := map[string]bool{}
+	var events []*shotEvent
+	for _, shot := range shots {
+		newNames[shot.name] = true
+		if !prevNames[shot.name] {
+			events = append(events, &shotEvent{
+				kind: "added",
+				data: &ShotEventJSON{Name: shot.name, Path: s.urlPath(shot.path)},
+			})
+		}
+	}
+	for _, shot := range prev {
+		if !newNames[shot.name] {
+			events = append(events, &shotEvent{
+				kind: "removed",
+				data: &ShotEventJSON{Name: shot.name, Path: s.urlPath(shot.path)},
+			})
+		}
+	}
+	return events
+}
+
+// handleEvents serves /api/events, a stream of server-sent events announcing
+// added & removed mapshots.
+func (s *Server) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	// Disable buffering in nginx.
+	hdr.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeatDelay)
+	defer heartbeat.Stop()
+	// The connection would be cut by --write_timeout; end the stream cleanly
+	// before that, so clients reconnect.
+	var end <-chan time.Time
+	if s.sf.writeTimeout > 0 {
+		end = time.After(s.sf.writeTimeout * 9 / 10)
+	}
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-end:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			raw, err := json.Marshal(ev.data)
+			if err != nil {
+				logError("unable to encode event", "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.kind, raw)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// shotFilter selects mapshots, based on the query parameters of list
+// requests.
+type shotFilter struct {
+	// Either the savename derived from the directory hierarchy, or the one
+	// recorded in mapshot.json.
+	save string
+	// Inclusive.
+	since time.Time
+	// Exclusive.
+	before     time.Time
+	namePrefix string
+	// All of them must be present in mapshot-user.json.
+	tags []string
+}
+
+// parseShotFilter reads the filter from query parameters `save`, `since`,
+// `before`, `name_prefix` & `tag`. Times use RFC 3339 format. Other parameters
+// are ignored.
+func parseShotFilter(query url.Values) (*shotFilter, error) {
+	f := &shotFilter{
+		save:       query.Get("save"),
+		namePrefix: query.Get("name_prefix"),
+		tags:       query["tag"],
+	}
+	for _, p := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"since", &f.since},
+		{"before", &f.before},
+	} {
+		raw := query.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for parameter %s: must be a RFC 3339 time, e.g., 2006-01-02T15:04:05Z", raw, p.name)
+		}
+		*p.value = t
+	}
+	return f, nil
+}
+
+func (f *shotFilter) match(shot *shotInfo) bool {
+	if f.save != "" && shot.savename != f.save && shot.json.Savename != f.save {
+		return false
+	}
+	if !f.since.IsZero() && shot.mtime.Before(f.since) {
+		return false
+	}
+	if !f.before.IsZero() && !shot.mtime.Before(f.before) {
+		return false
+	}
+	if f.namePrefix != "" && !strings.HasPrefix(shot.name, f.namePrefix) {
+		return false
+	}
+	for _, tag := range f.tags {
+		if !shot.meta.hasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the mapshots matching the filter, keeping their order.
+func (f *shotFilter) apply(shots []shotInfo) []shotInfo {
+	var selected []shotInfo
+	for i := range shots {
+		if f.match(&shots[i]) {
+			selected = append(selected, shots[i])
+		}
+	}
+	return selected
+}
+
+// serveFilteredShotsJSON serves shots.json, restricted to the mapshots
+// selected by the query parameters.
+func (s *Server) serveFilteredShotsJSON(w http.ResponseWriter, req *http.Request, shots []shotInfo) {
+	f, err := parseShotFilter(req.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.buildShotsJSON(f.apply(shots)))
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// File in the first base directory where names of mapshots seen before
+	// are stored.
+	goneFile = ".mapshot-gone.json"
+	// How long a deleted mapshot is remembered.
+	goneTTL = 90 * 24 * time.Hour
+	// Maximum number of deleted mapshots remembered; oldest are forgotten
+	// first.
+	goneMaxShots = 10000
+)
+
+// GoneJSON is the content of the file listing mapshots seen before.
+type GoneJSON struct {
+	Shots []*GoneShotJSON `json:"shots"`
+}
+
+// GoneShotJSON is part of GoneJSON.
+type GoneShotJSON struct {
+	// As in /data/<name>/.
+	Name     string    `json:"name"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// goneTracker remembers the mapshots found by previous scans, so requests for
+// deleted ones can be answered with a 410 instead of a 404.
+type goneTracker struct {
+	file string
+
+	m        sync.Mutex
+	lastSeen map[string]time.Time
+	// Names found by the last scan.
+	current map[string]bool
+}
+
+func newGoneTracker(file string) (*goneTracker, error) {
+	gt := &goneTracker{
+		file:     file,
+		lastSeen: make(map[string]time.Time),
+		current:  make(map[string]bool),
+	}
+	raw, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return gt, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read deleted mapshots: %w", err)
+	}
+	data := &GoneJSON{}
+	if err := json.Unmarshal(raw, data); err != nil {
+		return nil, fmt.Errorf("invalid file %s: %w", file, err)
+	}
+	for _, sh := range data.Shots {
+		gt.lastSeen[sh.Name] = sh.LastSeen
+	}
+	return gt, nil
+}
+
+// shotName returns the name of the mapshot as used in the tracker.
+func shotName(shot *shotInfo) string {
+	return strings.Trim(strings.TrimPrefix(shot.path, "/data/"), "/")
+}
+
+// update records the mapshots found by a successful scan. The file is only
+// written when the set of mapshots changes.
+func (gt *goneTracker) update(shots []shotInfo) {
+	now := time.Now()
+	current := make(map[string]bool, len(shots))
+	for i := range shots {
+		current[shotName(&shots[i])] = true
+	}
+
+	gt.m.Lock()
+	defer gt.m.Unlock()
+	changed := len(current) != len(gt.current)
+	for name := range current {
+		gt.lastSeen[name] = now
+		if !gt.current[name] {
+			changed = true
+		}
+	}
+	gt.current = current
+	if !changed {
+		return
+	}
+	gt.prune(now)
+	if err := gt.save(); err != nil {
+		logWarning("unable to save deleted mapshots", "path", gt.file, "error", err)
+	}
+}
+
+// prune forgets mapshots deleted for too long, and the oldest ones beyond
+// goneMaxShots. Must be called with the lock held.
+func (gt *goneTracker) prune(now time.Time) {
+	var gone []string
+	for name, seen := range gt.lastSeen {
+		if gt.current[name] {
+			continue
+		}
+		if now.Sub(seen) > goneTTL {
+			delete(gt.lastSeen, name)
+			continue
+		}
+		gone = append(gone, name)
+	}
+	if len(gone) <= goneMaxShots {
+		return
+	}
+	sort.Slice(gone, func(i, j int) bool {
+		return gt.lastSeen[gone[i]].Before(gt.lastSeen[gone[j]])
+	})
+	for _, name := range gone[:len(gone)-goneMaxShots] {
+		delete(gt.lastSeen, name)
+	}
+}
+
+// save writes the file; gt.m must be held.
+func (gt *goneTracker) save() error {
+	data := &GoneJSON{Shots: []*GoneShotJSON{}}
+	for name, seen := range gt.lastSeen {
+		data.Shots = append(data.Shots, &GoneShotJSON{Name: name, LastSeen: seen})
+	}
+	sort.Slice(data.Shots, func(i, j int) bool {
+		return data.Shots[i].Name < data.Shots[j].Name
+	})
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(gt.file), goneFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(raw)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), gt.file)
+}
+
+// lookup returns the name of the deleted mapshot the path - relative to
+// /data/ - belongs to, or an empty string if there is none.
+func (gt *goneTracker) lookup(p string) string {
+	gt.m.Lock()
+	defer gt.m.Unlock()
+	// Names can contain slashes; the longest match wins.
+	for idx := strings.LastIndex(p, "/"); idx > 0; idx = strings.LastIndex(p[:idx], "/") {
+		name := p[:idx]
+		if _, ok := gt.lastSeen[name]; ok && !gt.current[name] {
+			return name
+		}
+	}
+	if _, ok := gt.lastSeen[p]; ok && p != "" && !gt.current[p] {
+		return p
+	}
+	return ""
+}
+
+// handleUnknownShot serves /data/ paths which do not belong to any available
+// mapshot: it tells apart mapshots which were deleted (410) from those which
+// never existed (404).
+func (s *Server) handleUnknownShot(w http.ResponseWriter, req *http.Request) {
+	name := ""
+	if s.gone != nil {
+		name = s.gone.lookup(strings.TrimPrefix(req.URL.Path, "/data/"))
+	}
+	if name == "" {
+		http.NotFound(w, req)
+		return
+	}
+	// The mapshot might come back - e.g., restored from a backup.
+	w.Header().Set("Cache-Control", "no-cache")
+	if wantsJSON(req) {
+		writeJSONError(w, http.StatusGone, "mapshot %q was deleted; see %s for available mapshots", name, s.urlPath("/shots.json"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+	fmt.Fprintf(w, gonePage, html.EscapeString(name), html.EscapeString(s.urlPath("/")))
+}
+
+const gonePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>mapshot</title></head>
+<body>
+<h1>Mapshot deleted</h1>
+<p>The mapshot <code>%s</code> is no longer available on this server.</p>
+<p>See the <a href="%s">list of mapshots</a>.</p>
+</body>
+</html>
+`
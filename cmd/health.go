@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"net/http"
+	"time"
+)
+
+// ReadyJSON is the body of /readyz responses.
+type ReadyJSON struct {
+	Ready bool `json:"ready"`
+	// Number of mapshots currently served.
+	Shots int `json:"shots"`
+	// When the last successful scan for mapshots finished; absent if none
+	// succeeded yet.
+	LastScan *time.Time `json:"last_scan,omitempty"`
+}
+
+// healthHandler serves /healthz & /readyz, for use by process supervisors or
+// orchestrators. Other requests are passed to the next handler.
+func (s *Server) healthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/healthz":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write([]byte("ok\n"))
+		case "/readyz":
+			s.m.Lock()
+			data := &ReadyJSON{
+				Ready: s.scanned,
+				Shots: len(s.shots),
+			}
+			if !s.lastScan.IsZero() {
+				t := s.lastScan
+				data.LastScan = &t
+			}
+			s.m.Unlock()
+
+			status := http.StatusOK
+			if !data.Ready {
+				status = http.StatusServiceUnavailable
+			}
+			w.Header().Set("Cache-Control", "no-cache")
+			writeJSON(w, status, data)
+		default:
+			next.ServeHTTP(w, req)
+		}
+	})
+}
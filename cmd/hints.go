@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often the same scan error is logged, when it persists - e.g., a
+// directory which does not exist yet.
+const scanErrorLogInterval = time.Minute
+
+// checkSources reports sources which cannot be read at startup, with a hint
+// about what to do. It does not fail: a missing Factorio script-output
+// directory is expected until the first render.
+func checkSources(sources []shotSource) {
+	for _, src := range sources {
+		ds, ok := src.store.(*dirStore)
+		if !ok {
+			continue
+		}
+		dir := ds.dir
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		if _, err := os.Stat(dir); err != nil {
+			fmt.Printf("Warning: unable to read %s: %v\n", dir, err)
+			fmt.Printf("Mapshots will be served once it exists. If this is not the right directory, use --base_dir.\n")
+			continue
+		}
+		if real, err := filepath.EvalSymlinks(dir); err == nil && real != dir {
+			fmt.Printf("%s resolves to %s\n", dir, real)
+		}
+	}
+}
+
+// reportFirstScan tells how many mapshots were found when starting.
+func reportFirstScan(res *scanResult) {
+	if res.err != nil {
+		fmt.Printf("Warning: %v\n", res.err)
+		return
+	}
+	if res.shots == 0 {
+		fmt.Printf("No mapshot found yet; render one with `mapshot render <savename>`, or from the game with the mapshot mod.\n")
+		return
+	}
+	fmt.Printf("Found %d mapshots\n", res.shots)
+}
+
+// logScanError logs errors of scans for mapshots, at most once every
+// scanErrorLogInterval for the same error.
+func (s *Server) logScanError(err error) {
+	msg := err.Error()
+	now := time.Now()
+	s.m.Lock()
+	skip := msg == s.lastScanErr && now.Sub(s.lastScanErrLog) < scanErrorLogInterval
+	if !skip {
+		s.lastScanErr = msg
+		s.lastScanErrLog = now
+	}
+	s.m.Unlock()
+	if !skip {
+		logError("scan failed", "error", err)
+	}
+}
+
+// noShotsHandler is served instead of the listing when there are no mapshots,
+// so people know what to do rather than seeing an empty list.
+func noShotsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, noShotsPage)
+}
+
+const noShotsPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>mapshot</title></head>
+<body>
+<h1>No mapshot yet</h1>
+<p>The server did not find any mapshot to serve. To create one, either:</p>
+<ul>
+<li>run <code>mapshot render &lt;savename&gt;</code>, or</li>
+<li>install the mapshot mod in Factorio, and use the <code>/mapshot</code> command in the game.</li>
+</ul>
+<p>Mapshots are looked for in Factorio <code>script-output</code> directory, or in the directory given with <code>--base_dir</code>. This page is replaced by the list of mapshots once one is found.</p>
+</body>
+</html>
+`
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// latestHandler serves /latest & /latest/<savename>, pointing to the most
+// recently rendered mapshot - overall, or of the given save.
+//
+// Browsers are redirected to the viewer. The viewer itself fetches it as JSON,
+// to get its configuration.
+type latestHandler struct {
+	s       *Server
+	newest  *shotInfo
+	perSave map[string]*shotInfo
+}
+
+func (s *Server) newLatestHandler(shots []shotInfo) *latestHandler {
+	h := &latestHandler{
+		s:       s,
+		perSave: make(map[string]*shotInfo),
+	}
+	for i := range shots {
+		shot := &shots[i]
+		if h.newest == nil || shot.mtime.After(h.newest.mtime) {
+			h.newest = shot
+		}
+		if prev := h.perSave[shot.savename]; prev == nil || shot.mtime.After(prev.mtime) {
+			h.perSave[shot.savename] = shot
+		}
+	}
+	return h
+}
+
+// wantsJSON indicates whether the client explicitly asked for JSON.
+func wantsJSON(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *latestHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Add("Vary", "Accept")
+
+	var shot *shotInfo
+	if req.URL.Path == "/latest" || req.URL.Path == "/latest/" {
+		shot = h.newest
+		if shot == nil {
+			http.Error(w, "No mapshot available yet.", http.StatusNotFound)
+			return
+		}
+	} else {
+		savename := strings.TrimPrefix(req.URL.Path, "/latest/")
+		shot = h.perSave[savename]
+		if shot == nil {
+			http.Error(w, fmt.Sprintf("No mapshot available for save %q.", savename), http.StatusNotFound)
+			return
+		}
+	}
+
+	shotPath := h.s.urlPath(shot.path)
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusOK, &MapshotConfigJSON{
+			Path: shotPath,
+		})
+		return
+	}
+	target := h.s.urlPath("/map/") + "?" + url.Values{"path": {shotPath}}.Encode()
+	http.Redirect(w, req, target, http.StatusFound)
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"net/http"
+)
+
+// inflightLimiter bounds the number of requests handled concurrently, for
+// --max_inflight. Requests over the limit are rejected immediately rather than
+// queued, so clients can retry instead of timing out.
+type inflightLimiter struct {
+	slots chan struct{}
+}
+
+func newInflightLimiter(n int) *inflightLimiter {
+	return &inflightLimiter{slots: make(chan struct{}, n)}
+}
+
+// isStream indicates whether the request is for a long-lived event stream.
+// Those would hold a slot for as long as the client is connected.
+func isStream(req *http.Request) bool {
+	switch req.URL.Path {
+	case "/api/events", "/api/live_reload":
+		return true
+	}
+	return false
+}
+
+func (il *inflightLimiter) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isStream(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		select {
+		case il.slots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server busy, try again later.", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-il.slots }()
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+)
+
+// listenAndServe runs the HTTP server until it fails or the context is
+// cancelled. On cancellation, it waits for in-flight requests to finish and
+// returns nil.
+func (sf *ServeFlags) listenAndServe(ctx context.Context, s *Server) error {
+	if err := sf.validate(); err != nil {
+		return err
+	}
+	handler, err := sf.wrap(s)
+	if err != nil {
+		return err
+	}
+	if sf.maxInflight > 0 {
+		handler = newInflightLimiter(sf.maxInflight).wrap(handler)
+	}
+	// Health checks must work without credentials, regardless of --url_prefix
+	// and when the server is busy, so they are answered before any other
+	// middleware.
+	handler = s.healthHandler(handler)
+	if sf.h2c {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: sf.readHeaderTimeout,
+		ReadTimeout:       sf.readTimeout,
+		WriteTimeout:      sf.writeTimeout,
+		IdleTimeout:       sf.idleTimeout,
+		MaxHeaderBytes:    sf.maxHeaderBytes,
+	}
+
+	// Track open connections, to report on what is drained when shutting down.
+	var active int64
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&active, 1)
+		case http.StateHijacked, http.StateClosed:
+			atomic.AddInt64(&active, -1)
+		}
+	}
+
+	var cr *certReloader
+	if sf.tlsCert != "" {
+		// Load the certificate before listening, to report errors early.
+		cr, err = newCertReloader(sf.tlsCert, sf.tlsKey)
+		if err != nil {
+			return err
+		}
+	}
+	var acme *autocert.Manager
+	if len(sf.acmeDomains) > 0 {
+		acme, err = sf.acmeManager()
+		if err != nil {
+			return err
+		}
+	}
+	ln, where, err := sf.listen()
+	if err != nil {
+		return err
+	}
+	if sf.maxConnections > 0 {
+		// Applies to all connections, including health checks.
+		ln = netutil.LimitListener(ln, sf.maxConnections)
+	}
+
+	errCh := make(chan error, 2)
+	var redirector *http.Server
+	if acme != nil && sf.acmeHTTPBind != "" {
+		redirectLn, err := net.Listen(sf.network, sf.acmeHTTPBind)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("unable to listen on %s for ACME challenges: %w", sf.acmeHTTPBind, err)
+		}
+		// Answers HTTP-01 challenges, and redirects everything else to HTTPS.
+		redirector = &http.Server{Handler: acme.HTTPHandler(nil)}
+		fmt.Printf("Redirecting HTTP on %s to HTTPS ...\n", sf.acmeHTTPBind)
+		go func() {
+			if err := redirector.Serve(redirectLn); err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("HTTP redirector failed: %w", err)
+			}
+		}()
+	}
+
+	switch {
+	case acme != nil:
+		// Also answers TLS-ALPN-01 challenges.
+		srv.TLSConfig = acme.TLSConfig()
+		fmt.Printf("Listening on %s (TLS, certificates for %s) ...\n", where, strings.Join(sf.acmeDomains, ", "))
+		go func() {
+			errCh <- srv.ServeTLS(ln, "", "")
+		}()
+	case cr == nil:
+		if sf.h2c {
+			fmt.Printf("Listening on %s (h2c) ...\n", where)
+		} else {
+			fmt.Printf("Listening on %s ...\n", where)
+		}
+		go func() {
+			errCh <- srv.Serve(ln)
+		}()
+	default:
+		go cr.watch(ctx)
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: cr.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+		fmt.Printf("Listening on %s (TLS) ...\n", where)
+		go func() {
+			// Certificate is provided through TLSConfig.
+			errCh <- srv.ServeTLS(ln, "", "")
+		}()
+	}
+
+	if sf.open {
+		go sf.openWhenReady(ctx, ln.Addr())
+	}
+	if redirector != nil {
+		defer redirector.Close()
+	}
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	drained := atomic.LoadInt64(&active)
+	fmt.Printf("Shutting down, waiting for %d connections ...\n", drained)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), sf.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		remaining := atomic.LoadInt64(&active)
+		srv.Close()
+		return fmt.Errorf("unable to shutdown within %v, %d connections dropped: %w", sf.shutdownTimeout, remaining, err)
+	}
+	logInfo("HTTP server stopped", "drained", drained)
+	return nil
+}
+
+// acmeManager creates the manager obtaining certificates from Let's Encrypt
+// for --acme_domain.
+func (sf *ServeFlags) acmeManager() (*autocert.Manager, error) {
+	dir := sf.acmeCacheDir
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("unable to find cache directory; use --acme_cache_dir: %w", err)
+		}
+		dir = filepath.Join(cacheDir, "mapshot", "acme")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create --acme_cache_dir: %w", err)
+	}
+	logInfo("storing ACME certificates", "dir", dir)
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(sf.acmeDomains...),
+		Cache:      autocert.DirCache(dir),
+	}, nil
+}
+
+// listen creates the listener for the HTTP server. It also returns a
+// description of where it listens.
+func (sf *ServeFlags) listen() (net.Listener, string, error) {
+	ln, err := systemdListener()
+	if err != nil {
+		return nil, "", err
+	}
+	if ln != nil {
+		logInfo("using systemd socket activation; ignoring --port, --bind and --unix_socket")
+		return ln, "socket from systemd (" + ln.Addr().String() + ")", nil
+	}
+	if sf.unixSocket != "" {
+		ln, err = listenUnix(sf.unixSocket, sf.unixSocketMode)
+		if err != nil {
+			return nil, "", err
+		}
+		return ln, "unix socket " + sf.unixSocket, nil
+	}
+	addr, err := sf.addr()
+	if err != nil {
+		return nil, "", err
+	}
+	ln, err = net.Listen(sf.network, addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to listen on %s (%s): %w", addr, sf.network, err)
+	}
+	// Differs from the requested address when using port 0.
+	return ln, ln.Addr().String(), nil
+}
+
+// First file descriptor passed by systemd socket activation.
+const systemdFirstFD = 3
+
+// systemdListener returns the listener passed by systemd socket activation,
+// following sd_listen_fds(3). It returns nil if the process was not started
+// that way.
+func systemdListener() (net.Listener, error) {
+	pidStr, fdsStr := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pidStr == "" && fdsStr == "" {
+		return nil, nil
+	}
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_PID %q from socket activation: %w", pidStr, err)
+	}
+	if pid != os.Getpid() {
+		// Inherited from a parent process; not meant for us.
+		logInfo("ignoring socket activation for another process", "pid", pid)
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(fdsStr)
+	if err != nil || fds < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q from socket activation", fdsStr)
+	}
+	if fds > 1 {
+		return nil, fmt.Errorf("socket activation passed %d sockets, only 1 is supported", fds)
+	}
+	// Do not pass those to child processes - e.g., Factorio.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdFirstFD, "systemd-socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use socket from socket activation: %w", err)
+	}
+	return ln, nil
+}
+
+// listenUnix listens on a Unix domain socket, replacing any stale socket file.
+// The socket file is removed when the listener is closed - i.e., on shutdown.
+func listenUnix(path string, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --unix_socket_mode %q: %w", mode, err)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		logInfo("removing stale socket", "path", path)
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket: %w", err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("unable to set permissions of %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+// certReloader keeps a TLS certificate loaded from disk, and reloads it on
+// request - allowing to renew certificates without restarting the server.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	m    sync.Mutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate %s with key %s: %w", cr.certFile, cr.keyFile, err)
+	}
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	cr.cert = &cert
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	return cr.cert, nil
+}
+
+// watch reloads the certificate every time SIGHUP is received. If reloading
+// fails, the previous certificate is kept.
+func (cr *certReloader) watch(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return
+		}
+		if err := cr.reload(); err != nil {
+			logError("unable to reload TLS certificate, keeping previous one", "error", err)
+			continue
+		}
+		logInfo("reloaded TLS certificate", "path", cr.certFile)
+	}
+}
@@ -0,0 +1,450 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost at certFile &
+// keyFile, with the given serial number.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestServeTLS(t *testing.T) {
+	s, _ := newTestServer(t, newTestServeFlags(t))
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeTestCert(t, certFile, keyFile, 1)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(s)
+	// Same configuration as listenAndServe.
+	ts.TLS = &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first)
+	get := func(p string) *http.Response {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{
+			// The name makes the client send SNI, which the test server
+			// needs to use GetCertificate instead of its own certificate.
+			TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "localhost"},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get(ts.URL + p)
+		if err != nil {
+			t.Fatalf("GET %s: %v", p, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, p := range []string{"/shots.json", "/data/mapshot/test/d-1/s1zoom_0/tile_0_0.jpg"} {
+		resp := get(p)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: got status %d, want %d", p, resp.StatusCode, http.StatusOK)
+		}
+		if resp.TLS == nil || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 1 {
+			t.Errorf("GET %s: not served with the certificate", p)
+		}
+	}
+
+	// Renewed certificate, as on SIGHUP.
+	second := writeTestCert(t, certFile, keyFile, 2)
+	roots.AddCert(second)
+	if err := cr.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := get("/shots.json"); resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Error("reloaded certificate not used")
+	}
+
+	// A broken certificate keeps the previous one.
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.reload(); err == nil {
+		t.Error("reloading an invalid certificate succeeded")
+	}
+	if resp := get("/shots.json"); resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Error("previous certificate not kept after a failed reload")
+	}
+}
+
+func TestServeTLSFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"--tls_cert", "cert.pem"},
+		{"--tls_key", "key.pem"},
+	} {
+		err := newTestServeFlags(t, args...).validate()
+		if err == nil || !strings.Contains(err.Error(), "together") {
+			t.Errorf("validate() with %q = %v, want error about both flags", args, err)
+		}
+	}
+	if _, err := newCertReloader(filepath.Join(t.TempDir(), "missing.pem"), "missing.key"); err == nil {
+		t.Error("newCertReloader succeeded with missing files")
+	}
+}
+
+// unixClient returns a client sending all requests to the Unix socket.
+func unixClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "mapshot.sock")
+	sf := newTestServeFlags(t, "--unix_socket", socket, "--unix_socket_mode", "0600")
+	s, _ := newTestServer(t, sf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- sf.listenAndServe(ctx, s) }()
+
+	client := unixClient(socket)
+	deadline := time.Now().Add(10 * time.Second)
+	var resp *http.Response
+	for {
+		var err error
+		resp, err = client.Get("http://mapshot/shots.json")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unable to reach the server on %s: %v", socket, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("got socket permissions %v, want 0600", perm)
+	}
+
+	client.CloseIdleConnections()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("listenAndServe: %v", err)
+	}
+	if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket file still there after shutdown: %v", err)
+	}
+}
+
+func TestListenUnixStale(t *testing.T) {
+	quietLogs(t)
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "mapshot.sock")
+	// Left behind, e.g., by a crash: the socket file stays without listener.
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(socket, "0660")
+	if err != nil {
+		t.Fatalf("listenUnix over a stale socket: %v", err)
+	}
+	ln.Close()
+
+	file := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file, "0660"); err == nil {
+		t.Error("listenUnix replaced a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestUnixSocketFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"--unix_socket", "/run/mapshot.sock"}, true},
+		{[]string{"--unix_socket", "/run/mapshot.sock", "--port", "8080"}, false},
+		{[]string{"--unix_socket", "/run/mapshot.sock", "--bind", "127.0.0.1:8080"}, false},
+		{[]string{"--unix_socket", "/run/mapshot.sock", "--open"}, false},
+		{[]string{"--unix_socket", "/run/mapshot.sock", "--unix_socket_mode", "rw"}, false},
+		{[]string{"--unix_socket", "/run/mapshot.sock", "--unix_socket_mode", "0999"}, false},
+	} {
+		err := newTestServeFlags(t, tc.args...).validate()
+		if (err == nil) != tc.ok {
+			t.Errorf("validate() with %q = %v, want ok=%v", tc.args, err, tc.ok)
+		}
+	}
+}
+
+// setenv sets or - with an empty value - unsets environment variables for the
+// duration of the test.
+func setenv(t *testing.T, kv ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, value := kv[i], kv[i+1]
+		prev, had := os.LookupEnv(key)
+		if value == "" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, value)
+		}
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(key, prev)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+func TestSystemdListenerEnv(t *testing.T) {
+	quietLogs(t)
+	pid := strconv.Itoa(os.Getpid())
+	for _, tc := range []struct {
+		desc string
+		pid  string
+		fds  string
+		ok   bool
+	}{
+		{"not activated", "", "", true},
+		{"other process", strconv.Itoa(os.Getpid() + 1), "1", true},
+		{"invalid pid", "systemd", "1", false},
+		{"missing pid", "", "1", false},
+		{"missing fds", pid, "", false},
+		{"invalid fds", pid, "three", false},
+		{"no fds", pid, "0", false},
+		{"too many fds", pid, "2", false},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			setenv(t, "LISTEN_PID", tc.pid, "LISTEN_FDS", tc.fds)
+			// None of those get to use the file descriptor.
+			ln, err := systemdListener()
+			if (err == nil) != tc.ok {
+				t.Errorf("systemdListener() = %v, want ok=%v", err, tc.ok)
+			}
+			if ln != nil {
+				ln.Close()
+				t.Error("got a listener")
+			}
+		})
+	}
+}
+
+// TestSystemdListenerHelper is run in a child process by TestSystemdListener,
+// as systemd would start mapshot: with the socket as file descriptor 3.
+func TestSystemdListenerHelper(t *testing.T) {
+	if os.Getenv("MAPSHOT_TEST_SYSTEMD") == "" {
+		t.Skip("only run by TestSystemdListener")
+	}
+	// Set by systemd once the process is started.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	ln, err := systemdListener()
+	if err != nil || ln == nil {
+		t.Fatalf("systemdListener() = %v, %v", ln, err)
+	}
+	http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "activated, LISTEN_FDS=%q", os.Getenv("LISTEN_FDS"))
+	}))
+}
+
+func TestSystemdListener(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "mapshot.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListenerHelper$")
+	cmd.Env = append(os.Environ(), "MAPSHOT_TEST_SYSTEMD=1", "LISTEN_FDS=1")
+	// First of ExtraFiles is file descriptor 3.
+	cmd.ExtraFiles = []*os.File{f}
+	out := &strings.Builder{}
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	// The socket is listening already; connections wait for the child to
+	// accept them.
+	client := unixClient(socket)
+	client.Timeout = 30 * time.Second
+	resp, err := client.Get("http://mapshot/")
+	if err != nil {
+		t.Fatalf("GET through the activated socket: %v; child output:\n%s", err, out)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// Not given to child processes of mapshot.
+	if want := `activated, LISTEN_FDS=""`; string(body) != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+}
+
+// ipv6Available indicates whether the IPv6 loopback can be used.
+func ipv6Available() bool {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+func TestListenNetwork(t *testing.T) {
+	if !ipv6Available() {
+		t.Skip("IPv6 loopback not available")
+	}
+	for _, tc := range []struct {
+		network string
+		ipv4    bool
+		ipv6    bool
+	}{
+		{"tcp4", true, false},
+		{"tcp6", false, true},
+	} {
+		t.Run(tc.network, func(t *testing.T) {
+			sf := newTestServeFlags(t, "--network", tc.network, "--port", "0")
+			if err := sf.validate(); err != nil {
+				t.Fatal(err)
+			}
+			ln, where, err := sf.listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}()
+			// The actual address, not the requested one.
+			_, port, err := net.SplitHostPort(where)
+			if err != nil || port == "0" {
+				t.Fatalf("listening on %q, want an address with the bound port", where)
+			}
+			for _, target := range []struct {
+				host string
+				want bool
+			}{
+				{"127.0.0.1", tc.ipv4},
+				{"::1", tc.ipv6},
+			} {
+				conn, err := net.DialTimeout("tcp", net.JoinHostPort(target.host, port), 5*time.Second)
+				if err == nil {
+					conn.Close()
+				}
+				if got := err == nil; got != target.want {
+					t.Errorf("connection to %s: got %v, want connected=%v", target.host, err, target.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNetworkFlag(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"--network", "tcp"}, true},
+		{[]string{"--network", "tcp4", "--bind", "127.0.0.1:8080"}, true},
+		{[]string{"--network", "tcp6", "--bind", "[::1]:8080"}, true},
+		{[]string{"--network", "udp"}, false},
+		{[]string{"--network", "unix"}, false},
+	} {
+		err := newTestServeFlags(t, tc.args...).validate()
+		if (err == nil) != tc.ok {
+			t.Errorf("validate() with %q = %v, want ok=%v", tc.args, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long to wait after a change to the frontend before reloading pages, as
+// a build usually writes multiple files.
+const liveReloadDelay = 200 * time.Millisecond
+
+// liveReloader watches the frontend directory given with --frontend_dir, and
+// tells pages to reload when it changes. Only used with --live_reload.
+type liveReloader struct {
+	dir string
+
+	m      sync.Mutex
+	subs   map[chan struct{}]bool
+	closed bool
+}
+
+func newLiveReloader(dir string) *liveReloader {
+	return &liveReloader{
+		dir:  dir,
+		subs: make(map[chan struct{}]bool),
+	}
+}
+
+// subscribe returns a channel receiving something when pages must reload. It
+// is closed when the reloader stops.
+func (lr *liveReloader) subscribe() chan struct{} {
+	lr.m.Lock()
+	defer lr.m.Unlock()
+	ch := make(chan struct{}, 1)
+	if lr.closed {
+		close(ch)
+		return ch
+	}
+	lr.subs[ch] = true
+	return ch
+}
+
+func (lr *liveReloader) unsubscribe(ch chan struct{}) {
+	lr.m.Lock()
+	defer lr.m.Unlock()
+	if lr.subs[ch] {
+		delete(lr.subs, ch)
+		close(ch)
+	}
+}
+
+func (lr *liveReloader) notify() {
+	lr.m.Lock()
+	defer lr.m.Unlock()
+	for ch := range lr.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// A reload is already pending.
+		}
+	}
+}
+
+func (lr *liveReloader) close() {
+	lr.m.Lock()
+	defer lr.m.Unlock()
+	lr.closed = true
+	for ch := range lr.subs {
+		delete(lr.subs, ch)
+		close(ch)
+	}
+}
+
+// run watches the frontend directory until the context is done.
+func (lr *liveReloader) run(ctx context.Context) {
+	defer lr.close()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logError("live reload disabled: unable to create filesystem watcher", "error", err)
+		return
+	}
+	defer w.Close()
+	if err := lr.add(w, lr.dir); err != nil {
+		logError("live reload disabled", "error", err)
+		return
+	}
+	logInfo("live reload: watching frontend", "dir", lr.dir)
+
+	// Only set when a reload is pending.
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			logDebug("frontend event", "event", ev)
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					if err := lr.add(w, ev.Name); err != nil {
+						logWarning("live reload: unable to watch directory", "error", err)
+					}
+				}
+			}
+			if pending == nil {
+				pending = time.After(liveReloadDelay)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			logWarning("live reload: error from filesystem notifications", "error", err)
+		case <-pending:
+			pending = nil
+			logInfo("frontend changed, reloading pages")
+			lr.notify()
+		}
+	}
+}
+
+// add watches the directory and all its subdirectories.
+func (lr *liveReloader) add(w *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if err := w.Add(p); err != nil {
+			return fmt.Errorf("unable to watch %s: %w", p, err)
+		}
+		return nil
+	})
+}
+
+// handleLiveReload serves /api/live_reload, a stream of server-sent events
+// telling pages to reload.
+func (s *Server) handleLiveReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	ch := s.reloader.subscribe()
+	defer s.reloader.unsubscribe(ch)
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	hdr.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeatDelay)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// liveReloadScript returns the script added to HTML pages, reloading them when
+// told so.
+func (s *Server) liveReloadScript() []byte {
+	return []byte(fmt.Sprintf(`<script>new EventSource(%q).addEventListener("reload", function() { location.reload(); });</script>`, s.urlPath("/api/live_reload")))
+}
+
+// injectLiveReload adds the live reload script to HTML pages served by the
+// handler. Other responses are left untouched.
+func (s *Server) injectLiveReload(h http.Handler) http.Handler {
+	script := s.liveReloadScript()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			h.ServeHTTP(w, req)
+			return
+		}
+		// Partial content would not match the modified page.
+		req.Header.Del("Range")
+		iw := &injectWriter{ResponseWriter: w}
+		h.ServeHTTP(iw, req)
+		if iw.buf == nil {
+			return
+		}
+		body := iw.buf.Bytes()
+		if idx := bytes.LastIndex(body, []byte("</body>")); idx >= 0 {
+			body = append(body[:idx:idx], append(script, body[idx:]...)...)
+		} else {
+			body = append(body, script...)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(iw.status)
+		w.Write(body)
+	})
+}
+
+// injectWriter buffers successful text/html responses, so they can be
+// modified; anything else is passed through.
+type injectWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	status      int
+	// Only set when buffering.
+	buf *bytes.Buffer
+}
+
+func (iw *injectWriter) WriteHeader(status int) {
+	if iw.wroteHeader {
+		return
+	}
+	iw.wroteHeader = true
+	ctype := iw.Header().Get("Content-Type")
+	if status == http.StatusOK && iw.Header().Get("Content-Encoding") == "" && strings.HasPrefix(ctype, "text/html") {
+		iw.status = status
+		iw.buf = &bytes.Buffer{}
+		iw.Header().Del("Content-Length")
+		// The page depends on the script, not only on the file.
+		iw.Header().Del("ETag")
+		iw.Header().Del("Last-Modified")
+		return
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+func (iw *injectWriter) Write(b []byte) (int, error) {
+	if !iw.wroteHeader {
+		iw.WriteHeader(http.StatusOK)
+	}
+	if iw.buf != nil {
+		return iw.buf.Write(b)
+	}
+	return iw.ResponseWriter.Write(b)
+}
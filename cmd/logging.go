@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Palats/mapshot/factorio"
+	"github.com/spf13/pflag"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug:   "debug",
+	levelInfo:    "info",
+	levelWarning: "warning",
+	levelError:   "error",
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, n := range logLevelNames {
+		if n == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q; must be debug, info, warning or error", name)
+}
+
+// logger writes log entries. Fields are given as alternating keys and values,
+// e.g., "shot", name, "duration", d.
+type logger interface {
+	log(level logLevel, msg string, fields ...interface{})
+}
+
+// textLogger writes entries as single human readable lines.
+type textLogger struct {
+	min logLevel
+
+	m sync.Mutex
+	w io.Writer
+}
+
+func (tl *textLogger) log(level logLevel, msg string, fields ...interface{}) {
+	if level < tl.min {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(time.Now().Format("2006-01-02 15:04:05.000"))
+	b.WriteString(" ")
+	b.WriteString(strings.ToUpper(logLevelNames[level]))
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		v := fmt.Sprint(fields[i+1])
+		if strings.ContainsAny(v, " \t\n\"=") || v == "" {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %v=%s", fields[i], v)
+	}
+	b.WriteString("\n")
+
+	tl.m.Lock()
+	defer tl.m.Unlock()
+	io.WriteString(tl.w, b.String())
+}
+
+// jsonLogger writes entries as JSON objects, one per line; fields are
+// included as members of the object.
+type jsonLogger struct {
+	min logLevel
+
+	m sync.Mutex
+	w io.Writer
+}
+
+func (jl *jsonLogger) log(level logLevel, msg string, fields ...interface{}) {
+	if level < jl.min {
+		return
+	}
+	var b strings.Builder
+	// Members are written one by one, to keep them in order.
+	add := func(key string, value interface{}) {
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(logValue(value))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		if b.Len() > 0 {
+			b.WriteString(",")
+		}
+		b.Write(k)
+		b.WriteString(":")
+		b.Write(v)
+	}
+	add("time", time.Now().Format(time.RFC3339Nano))
+	add("level", logLevelNames[level])
+	add("msg", msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		add(fmt.Sprint(fields[i]), fields[i+1])
+	}
+
+	jl.m.Lock()
+	defer jl.m.Unlock()
+	io.WriteString(jl.w, "{"+b.String()+"}\n")
+}
+
+// logValue converts values which would not be readable as JSON.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		// Seconds, like the access log.
+		return v.Seconds()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// LogFlags selects how the serve & render commands log.
+type LogFlags struct {
+	format string
+	level  string
+}
+
+// Register creates flags for logging.
+func (lf *LogFlags) Register(flags *pflag.FlagSet) {
+	flags.StringVar(&lf.format, "log_format", "text", "Format of logs on stderr: text (human readable) or json (one object per line).")
+	flags.StringVar(&lf.level, "log_level", "", "Minimum level of logs: debug, info, warning or error. If empty, uses info - or debug when -v is specified.")
+}
+
+// setup configures the logger from the flags.
+func (lf *LogFlags) setup() error {
+	min := levelInfo
+	if lf.level != "" {
+		var err error
+		if min, err = parseLogLevel(lf.level); err != nil {
+			return fmt.Errorf("invalid --log_level: %w", err)
+		}
+	} else if f := flag.Lookup("v"); f != nil && f.Value.String() != "0" {
+		// Compatibility with glog verbosity.
+		min = levelDebug
+	}
+	switch lf.format {
+	case "text":
+		logs = &textLogger{min: min, w: os.Stderr}
+	case "json":
+		logs = &jsonLogger{min: min, w: os.Stderr}
+	default:
+		return fmt.Errorf("invalid --log_format %q: must be text or json", lf.format)
+	}
+	return nil
+}
+
+var logFlags = &LogFlags{}
+
+// logs is where the serve & render commands log.
+var logs logger = &textLogger{min: levelInfo, w: os.Stderr}
+
+// Levels of the log entries of the factorio package.
+var factorioLogLevels = map[factorio.LogLevel]logLevel{
+	factorio.LogDebug:   levelDebug,
+	factorio.LogInfo:    levelInfo,
+	factorio.LogWarning: levelWarning,
+}
+
+func init() {
+	// So the factorio package follows --log_format & --log_level too.
+	factorio.SetLogger(func(level factorio.LogLevel, msg string, fields ...interface{}) {
+		logs.log(factorioLogLevels[level], msg, fields...)
+	})
+}
+
+func logDebug(msg string, fields ...interface{}) {
+	logs.log(levelDebug, msg, fields...)
+}
+
+func logInfo(msg string, fields ...interface{}) {
+	logs.log(levelInfo, msg, fields...)
+}
+
+func logWarning(msg string, fields ...interface{}) {
+	logs.log(levelWarning, msg, fields...)
+}
+
+func logError(msg string, fields ...interface{}) {
+	logs.log(levelError, msg, fields...)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Palats/mapshot/factorio"
+	"github.com/spf13/pflag"
+)
+
+// Logs of the factorio package go through the configured logger.
+func TestFactorioLogs(t *testing.T) {
+	var buf bytes.Buffer
+	prev := logs
+	logs = &jsonLogger{min: levelDebug, w: &buf}
+	t.Cleanup(func() { logs = prev })
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs := (&factorio.Settings{}).Register(flags, "factorio_")
+	if err := flags.Parse([]string{"--factorio_datadir", missing}); err != nil {
+		t.Fatal(err)
+	}
+	if dir := fs.DataDir(); dir != "" {
+		t.Fatalf("got data dir %q, want none", dir)
+	}
+
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		if entry["path"] == missing {
+			found = true
+			if entry["level"] != "debug" {
+				t.Errorf("got level %v, want debug", entry["level"])
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no log entry about %s in %q", missing, buf.String())
+	}
+
+	// Not shown at the default level.
+	buf.Reset()
+	logs = &jsonLogger{min: levelInfo, w: &buf}
+	fs.DataDir()
+	if buf.Len() != 0 {
+		t.Errorf("got logs %q at info level", buf.String())
+	}
+}
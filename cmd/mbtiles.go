@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	// Pure Go, so cross-compiling does not need cgo.
+	_ "modernc.org/sqlite"
+)
+
+// Tiles of a mapshot can be stored in a single MBTiles (SQLite) file, instead
+// of one file per tile - either as tiles.mbtiles in the mapshot directory, or
+// as a <name>.mbtiles file with mapshot.json in its metadata table.
+const (
+	mbtilesFile   = "tiles.mbtiles"
+	mbtilesSuffix = ".mbtiles"
+	// Key in the metadata table holding the content of mapshot.json.
+	mbtilesMapshotKey = "mapshot_json"
+)
+
+// Tile paths as requested by the viewer, and in the usual {z}/{x}/{y} layout.
+var (
+	mbtilesNativeRE = regexp.MustCompile(`^s[0-9]+zoom_([0-9]+)/tile_(-?[0-9]+)_(-?[0-9]+)\.(jpg|jpeg|png|webp|avif)$`)
+	mbtilesXYZRE    = regexp.MustCompile(`^([0-9]+)/([0-9]+)/([0-9]+)\.(jpg|jpeg|png|webp|avif)$`)
+)
+
+// mbtilesCoords returns the MBTiles coordinates of the tile at the given path.
+// MBTiles follows the TMS convention, where rows are counted from the bottom;
+// hence the y-flip.
+func mbtilesCoords(name string) (zoom, column, row int64, ok bool) {
+	m := mbtilesNativeRE.FindStringSubmatch(name)
+	if m == nil {
+		m = mbtilesXYZRE.FindStringSubmatch(name)
+	}
+	if m == nil {
+		return 0, 0, 0, false
+	}
+	zoom, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil || zoom > 30 {
+		return 0, 0, 0, false
+	}
+	x, err := strconv.ParseInt(m[2], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	y, err := strconv.ParseInt(m[3], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return zoom, x, (int64(1) << zoom) - 1 - y, true
+}
+
+// openMBTiles opens the MBTiles file read-only.
+func openMBTiles(p string) (*sql.DB, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(abs), RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite", u.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", p, err)
+	}
+	// Fails early on files which are not MBTiles.
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tiles WHERE 0").Scan(&count); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s is not a valid MBTiles file: %w", p, err)
+	}
+	return db, nil
+}
+
+// mbtilesFS gives access to a mapshot with tiles in an MBTiles file. Other
+// files come from base - the mapshot directory - if any; otherwise, only
+// mapshot.json is available, from the metadata table.
+type mbtilesFS struct {
+	// Path of the MBTiles file.
+	path    string
+	base    fs.FS
+	tileDBs *archiveCache
+}
+
+// db returns the database for the current version of the file.
+func (mf *mbtilesFS) db() (*sql.DB, os.FileInfo, error) {
+	info, err := os.Stat(mf.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := mf.tileDBs.openMBTiles(mf.path, info)
+	return db, info, err
+}
+
+func (mf *mbtilesFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if mf.base != nil {
+		f, err := mf.base.Open(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	if name == "." && mf.base == nil {
+		return &mbtilesDir{}, nil
+	}
+
+	db, info, err := mf.db()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	var data []byte
+	if zoom, column, row, ok := mbtilesCoords(name); ok {
+		err = db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", zoom, column, row).Scan(&data)
+	} else if name == "mapshot.json" && mf.base == nil {
+		var value string
+		err = db.QueryRow("SELECT value FROM metadata WHERE name = ?", mbtilesMapshotKey).Scan(&value)
+		data = []byte(value)
+	} else {
+		err = fs.ErrNotExist
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &tileFile{
+		Reader:  bytes.NewReader(data),
+		name:    filepath.Base(name),
+		size:    int64(len(data)),
+		modTime: info.ModTime(),
+	}, nil
+}
+
+// tileStats returns the number of tiles and their total size.
+func (mf *mbtilesFS) tileStats() (tiles int64, bytes int64, zooms []int, err error) {
+	db, _, err := mf.db()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(LENGTH(tile_data)), 0) FROM tiles").Scan(&tiles, &bytes); err != nil {
+		return 0, 0, nil, err
+	}
+	rows, err := db.Query("SELECT DISTINCT zoom_level FROM tiles ORDER BY zoom_level")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var z int
+		if err := rows.Scan(&z); err != nil {
+			return 0, 0, nil, err
+		}
+		zooms = append(zooms, z)
+	}
+	return tiles, bytes, zooms, rows.Err()
+}
+
+// mbtilesShot reads the mapshot information from a <name>.mbtiles file. Name
+// & paths are left to the caller.
+func mbtilesShot(p string, info os.FileInfo, tileDBs *archiveCache) (*shotInfo, error) {
+	logDebug("found MBTiles mapshot", "path", p)
+	fsys := &mbtilesFS{path: p, tileDBs: tileDBs}
+	raw, err := fs.ReadFile(fsys, "mapshot.json")
+	if err != nil {
+		return nil, fmt.Errorf("no %s in metadata: %w", mbtilesMapshotKey, err)
+	}
+	mapshotData, jsonErr := parseMapshotJSON(raw)
+	if jsonErr != nil {
+		logWarning("MBTiles file has an invalid mapshot.json", "path", p, "err", jsonErr)
+	}
+	return &shotInfo{
+		fsPath:  p,
+		archive: true,
+		fsys:    fsys,
+		tilesDB: p,
+		json:    mapshotData,
+		jsonErr: jsonErr,
+		mtime:   info.ModTime(),
+	}, nil
+}
+
+// tileFile is a file read from an MBTiles database.
+type tileFile struct {
+	*bytes.Reader
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (f *tileFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *tileFile) Close() error               { return nil }
+func (f *tileFile) Name() string               { return f.name }
+func (f *tileFile) Size() int64                { return f.size }
+func (f *tileFile) Mode() fs.FileMode          { return 0444 }
+func (f *tileFile) ModTime() time.Time         { return f.modTime }
+func (f *tileFile) IsDir() bool                { return false }
+func (f *tileFile) Sys() interface{}           { return nil }
+
+// mbtilesDir is the root of a mapshot stored as a single MBTiles file. Its
+// content is not listed.
+type mbtilesDir struct{}
+
+func (d *mbtilesDir) Stat() (fs.FileInfo, error) { return d, nil }
+func (d *mbtilesDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: fs.ErrInvalid}
+}
+func (d *mbtilesDir) Close() error { return nil }
+func (d *mbtilesDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n > 0 {
+		return nil, io.EOF
+	}
+	return nil, nil
+}
+func (d *mbtilesDir) Name() string       { return "." }
+func (d *mbtilesDir) Size() int64        { return 0 }
+func (d *mbtilesDir) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d *mbtilesDir) ModTime() time.Time { return time.Time{} }
+func (d *mbtilesDir) IsDir() bool        { return true }
+func (d *mbtilesDir) Sys() interface{}   { return nil }
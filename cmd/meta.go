@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File next to mapshot.json with information provided by users, as opposed
+// to generated by the mod.
+const userMetaFile = "mapshot-user.json"
+
+// UserMetaJSON is the content of mapshot-user.json.
+type UserMetaJSON struct {
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// readUserMeta reads mapshot-user.json of a mapshot. It returns nil if there is
+// none.
+func readUserMeta(fsys fs.FS) (*UserMetaJSON, error) {
+	raw, err := fs.ReadFile(fsys, userMetaFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &UserMetaJSON{}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", userMetaFile, err)
+	}
+	return meta, nil
+}
+
+// hasTag indicates whether the mapshot has the tag.
+func (meta *UserMetaJSON) hasTag(tag string) bool {
+	if meta == nil {
+		return false
+	}
+	for _, t := range meta.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// validate cleans up the metadata provided by a client.
+func (meta *UserMetaJSON) validate() error {
+	meta.Description = strings.TrimSpace(meta.Description)
+	seen := map[string]bool{}
+	var tags []string
+	for _, tag := range meta.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return errors.New("tags must not be empty")
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	meta.Tags = tags
+	return nil
+}
+
+// writeUserMeta replaces mapshot-user.json in the mapshot directory. It is
+// written to a temporary file first, so readers never see a partial file.
+func writeUserMeta(dir string, meta *UserMetaJSON) error {
+	raw, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".mapshot-user-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(raw, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, userMetaFile))
+}
+
+// handleMeta serves /api/shots/<name>/meta, to read & modify the description &
+// tags of a mapshot.
+func (s *Server) handleMeta(w http.ResponseWriter, req *http.Request, shot *shotInfo) {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		meta, err := readUserMeta(shot.fsys)
+		if err != nil {
+			logError("unable to read user metadata", "file", userMetaFile, "shot", shot.name, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "unable to read %s", userMetaFile)
+			return
+		}
+		if meta == nil {
+			meta = &UserMetaJSON{}
+		}
+		writeJSON(w, http.StatusOK, meta)
+		return
+	}
+	if req.Method != http.MethodPut {
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+
+	if !s.sf.enableAdmin {
+		writeJSONError(w, http.StatusForbidden, "admin API is disabled; use --enable_admin to enable it")
+		return
+	}
+	if shot.fsPath == "" || shot.archive {
+		writeJSONError(w, http.StatusNotImplemented, "metadata can only be modified for mapshot directories on the local filesystem")
+		return
+	}
+	if !s.inSources(shot.fsPath) {
+		logError("refusing to modify mapshot not within served directories", "path", shot.fsPath)
+		writeJSONError(w, http.StatusForbidden, "mapshot is not within served directories")
+		return
+	}
+	meta := &UserMetaJSON{}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<16)).Decode(meta); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	if err := meta.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if err := writeUserMeta(shot.fsPath, meta); err != nil {
+		logError("unable to write user metadata", "file", userMetaFile, "shot", shot.name, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to write %s", userMetaFile)
+		return
+	}
+	logInfo("updated user metadata", "file", userMetaFile, "shot", shot.name)
+	s.updateMux()
+	writeJSON(w, http.StatusOK, meta)
+}
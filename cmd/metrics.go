@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the HTTP request duration histogram buckets, in seconds.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// requestKey identifies a counter of HTTP requests.
+type requestKey struct {
+	class string
+	code  int
+}
+
+// durationHistogram is a Prometheus-style histogram.
+type durationHistogram struct {
+	// Cumulative counts, per bucket of durationBuckets.
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// serverMetrics collects metrics about the server, exposed in Prometheus text
+// format. Labels are based on the type of content, never on mapshot names, to
+// keep the number of series bounded.
+type serverMetrics struct {
+	m         sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*durationHistogram
+
+	scans        uint64
+	scanErrors   uint64
+	scanDuration time.Duration
+	shots        int
+
+	panics uint64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[string]*durationHistogram),
+	}
+}
+
+// requestClass gives the kind of content served for a given path.
+func requestClass(p string) string {
+	switch {
+	case p == "/shots.json":
+		return "shots_json"
+	case strings.HasPrefix(p, "/data/"):
+		return "tiles"
+	case strings.HasPrefix(p, "/api/"):
+		return "api"
+	case strings.HasPrefix(p, "/latest/"):
+		return "latest"
+	case p == "/metrics":
+		return "metrics"
+	default:
+		return "frontend"
+	}
+}
+
+// recordRequest is nil-safe, so it can be called when metrics are disabled.
+func (sm *serverMetrics) recordRequest(class string, code int, d time.Duration) {
+	if sm == nil {
+		return
+	}
+	sm.m.Lock()
+	defer sm.m.Unlock()
+	sm.requests[requestKey{class: class, code: code}]++
+	h := sm.durations[class]
+	if h == nil {
+		h = &durationHistogram{buckets: make([]uint64, len(durationBuckets))}
+		sm.durations[class] = h
+	}
+	secs := d.Seconds()
+	for i, le := range durationBuckets {
+		if secs <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+// recordScan is nil-safe, so it can be called when metrics are disabled.
+func (sm *serverMetrics) recordScan(shots int, d time.Duration, err error) {
+	if sm == nil {
+		return
+	}
+	sm.m.Lock()
+	defer sm.m.Unlock()
+	sm.scans++
+	sm.scanDuration = d
+	if err != nil {
+		sm.scanErrors++
+		return
+	}
+	sm.shots = shots
+}
+
+// recordPanic is nil-safe, so it can be called when metrics are disabled.
+func (sm *serverMetrics) recordPanic() {
+	if sm == nil {
+		return
+	}
+	sm.m.Lock()
+	defer sm.m.Unlock()
+	sm.panics++
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (sm *serverMetrics) write(w io.Writer) {
+	sm.m.Lock()
+	defer sm.m.Unlock()
+
+	fmt.Fprintln(w, "# HELP mapshot_http_requests_total Number of HTTP requests, by type of content and status code.")
+	fmt.Fprintln(w, "# TYPE mapshot_http_requests_total counter")
+	var keys []requestKey
+	for k := range sm.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].class != keys[j].class {
+			return keys[i].class < keys[j].class
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "mapshot_http_requests_total{class=%q,code=\"%d\"} %d\n", k.class, k.code, sm.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP mapshot_http_request_duration_seconds Duration of HTTP requests, by type of content.")
+	fmt.Fprintln(w, "# TYPE mapshot_http_request_duration_seconds histogram")
+	var classes []string
+	for c := range sm.durations {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+	for _, c := range classes {
+		h := sm.durations[c]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "mapshot_http_request_duration_seconds_bucket{class=%q,le=%q} %d\n", c, formatFloat(le), h.buckets[i])
+		}
+		fmt.Fprintf(w, "mapshot_http_request_duration_seconds_bucket{class=%q,le=\"+Inf\"} %d\n", c, h.count)
+		fmt.Fprintf(w, "mapshot_http_request_duration_seconds_sum{class=%q} %s\n", c, formatFloat(h.sum))
+		fmt.Fprintf(w, "mapshot_http_request_duration_seconds_count{class=%q} %d\n", c, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP mapshot_shots Number of mapshots found by the last successful scan.")
+	fmt.Fprintln(w, "# TYPE mapshot_shots gauge")
+	fmt.Fprintf(w, "mapshot_shots %d\n", sm.shots)
+	fmt.Fprintln(w, "# HELP mapshot_scan_duration_seconds Duration of the last scan for mapshots.")
+	fmt.Fprintln(w, "# TYPE mapshot_scan_duration_seconds gauge")
+	fmt.Fprintf(w, "mapshot_scan_duration_seconds %s\n", formatFloat(sm.scanDuration.Seconds()))
+	fmt.Fprintln(w, "# HELP mapshot_scans_total Number of scans for mapshots.")
+	fmt.Fprintln(w, "# TYPE mapshot_scans_total counter")
+	fmt.Fprintf(w, "mapshot_scans_total %d\n", sm.scans)
+	fmt.Fprintln(w, "# HELP mapshot_scan_errors_total Number of failed scans for mapshots.")
+	fmt.Fprintln(w, "# TYPE mapshot_scan_errors_total counter")
+	fmt.Fprintf(w, "mapshot_scan_errors_total %d\n", sm.scanErrors)
+	fmt.Fprintln(w, "# HELP mapshot_http_panics_total Number of HTTP requests which failed due to a panic.")
+	fmt.Fprintln(w, "# TYPE mapshot_http_panics_total counter")
+	fmt.Fprintf(w, "mapshot_http_panics_total %d\n", sm.panics)
+}
+
+func (sm *serverMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	sm.write(w)
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// Content types of files found in mapshots. The system MIME database might
+// not know about some of them - e.g., when tiles are recompressed offline -
+// and sniffing the content does not work for all.
+var shotContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".json": "application/json; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".js":   "text/javascript; charset=utf-8",
+	".css":  "text/css; charset=utf-8",
+	".svg":  "image/svg+xml",
+}
+
+// registerMIMETypes makes the content types of mapshot files known to the
+// mime package, in case the system database is incomplete.
+func registerMIMETypes() {
+	for ext, ctype := range shotContentTypes {
+		if err := mime.AddExtensionType(ext, ctype); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// shotContentType returns the content type of a mapshot file, or an empty
+// string if it must be sniffed from the content.
+func shotContentType(name string) string {
+	return shotContentTypes[strings.ToLower(path.Ext(name))]
+}
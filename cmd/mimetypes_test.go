@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestShotContentTypes(t *testing.T) {
+	modTime := time.Unix(1000, 0)
+	fsys := fstest.MapFS{
+		// With a BOM, which makes sniffing see text.
+		"mapshot.json":          {Data: []byte("\xef\xbb\xbf{\"savename\": \"test\"}"), ModTime: modTime},
+		"s1zoom_0/tile_0_0.jpg": {Data: []byte("not really a jpeg"), ModTime: modTime},
+		"s1zoom_0/tile_0_1.JPG": {Data: []byte("not really a jpeg"), ModTime: modTime},
+		"s1zoom_0/tile_1_0.png": {Data: []byte("not really a png"), ModTime: modTime},
+		// Sniffing knows about WebP, but not AVIF.
+		"s1zoom_0/tile_1_1.webp": {Data: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), ModTime: modTime},
+		"s1zoom_0/tile_2_0.avif": {Data: []byte("\x00\x00\x00\x1cftypavif"), ModTime: modTime},
+		"legend.html":            {Data: []byte("<!doctype html>"), ModTime: modTime},
+		"viewer.js":              {Data: []byte("console.log(1);"), ModTime: modTime},
+		"viewer.css":             {Data: []byte("body {}"), ModTime: modTime},
+		"thumbnail.svg":          {Data: []byte("<svg></svg>"), ModTime: modTime},
+		"README":                 {Data: []byte("some notes"), ModTime: modTime},
+	}
+	s := &Server{sf: &ServeFlags{missingTile: "404"}}
+	h := http.StripPrefix("/data/test/", s.shotHandler(fsys, "/data/test/"))
+	for _, tc := range []struct {
+		name  string
+		ctype string
+	}{
+		{"mapshot.json", "application/json; charset=utf-8"},
+		{"s1zoom_0/tile_0_0.jpg", "image/jpeg"},
+		{"s1zoom_0/tile_0_1.JPG", "image/jpeg"},
+		{"s1zoom_0/tile_1_0.png", "image/png"},
+		{"s1zoom_0/tile_1_1.webp", "image/webp"},
+		{"s1zoom_0/tile_2_0.avif", "image/avif"},
+		{"legend.html", "text/html; charset=utf-8"},
+		{"viewer.js", "text/javascript; charset=utf-8"},
+		{"viewer.css", "text/css; charset=utf-8"},
+		{"thumbnail.svg", "image/svg+xml"},
+		// Unknown; sniffed.
+		{"README", "text/plain; charset=utf-8"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, method := range []string{"GET", "HEAD"} {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(method, "/data/test/"+tc.name, nil))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: got status %d, want %d", method, rec.Code, http.StatusOK)
+				}
+				if got := rec.Header().Get("Content-Type"); got != tc.ctype {
+					t.Errorf("%s: got Content-Type %q, want %q", method, got, tc.ctype)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterMIMETypes(t *testing.T) {
+	registerMIMETypes()
+	for ext, want := range shotContentTypes {
+		if got := contentType("file"+ext, nil); got != want {
+			t.Errorf("content type of %s files is %q, want %q", ext, got, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/otiai10/copy"
+)
+
+// How often progress is printed while copying a mapshot.
+const moveProgressDelay = 2 * time.Second
+
+// moveShot moves a mapshot directory to dst, which must not exist yet. When
+// both are on the same filesystem, this is a rename. Otherwise, files are
+// copied, verified and only then is the source removed; mapshot.json is
+// copied last, so a server watching the destination only picks up the
+// mapshot once complete.
+func moveShot(src, dst string, out *renderOutput) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("unable to create %s: %w", filepath.Dir(dst), err)
+	}
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	// Typically, source & destination are on different filesystems; the
+	// error for that varies across systems.
+	out.logInfo("unable to rename mapshot, copying it instead", "from", src, "to", dst, "error", err)
+	if err := copyShot(src, dst, out); err != nil {
+		if rmErr := os.RemoveAll(dst); rmErr != nil {
+			out.logWarning("unable to remove partial copy", "path", dst, "error", rmErr)
+		}
+		return err
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return fmt.Errorf("mapshot copied to %s, but unable to remove %s: %w", dst, src, err)
+	}
+	return nil
+}
+
+// moveResult moves a mapshot from a script-output directory to the same
+// location in dstRoot, along with the viewer files the mod writes next to it.
+func moveResult(srcRoot, dstRoot, resultPrefix string, out *renderOutput) error {
+	src := filepath.Join(srcRoot, filepath.FromSlash(resultPrefix))
+	dst := filepath.Join(dstRoot, filepath.FromSlash(resultPrefix))
+	if err := moveShot(src, dst, out); err != nil {
+		return err
+	}
+	// Those files are the same for all renders of a save, so any existing
+	// ones are replaced.
+	srcParent := filepath.Dir(src)
+	entries, err := ioutil.ReadDir(srcParent)
+	if err != nil {
+		return fmt.Errorf("unable to list viewer files: %w", err)
+	}
+	for _, e := range entries {
+		if !e.Mode().IsRegular() {
+			continue
+		}
+		p := filepath.Join(filepath.Dir(dst), e.Name())
+		if err := copy.Copy(filepath.Join(srcParent, e.Name()), p); err != nil {
+			return fmt.Errorf("unable to copy viewer file %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// shotFile is a file of a mapshot being copied.
+type shotFile struct {
+	rel  string
+	info os.FileInfo
+}
+
+// copyShot copies the mapshot directory to dst, checking the content of each
+// file once written.
+func copyShot(src, dst string, out *renderOutput) error {
+	var files []*shotFile
+	var last *shotFile
+	var total int64
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("unsupported file type for %s", p)
+		}
+		f := &shotFile{rel: rel, info: info}
+		total += info.Size()
+		if rel == "mapshot.json" {
+			last = f
+			return nil
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list files of %s: %w", src, err)
+	}
+	if last != nil {
+		files = append(files, last)
+	}
+
+	var copied int64
+	nextProgress := time.Now().Add(moveProgressDelay)
+	for _, f := range files {
+		if err := copyVerified(filepath.Join(src, f.rel), filepath.Join(dst, f.rel), f.info); err != nil {
+			return err
+		}
+		copied += f.info.Size()
+		if now := time.Now(); now.After(nextProgress) {
+			nextProgress = now.Add(moveProgressDelay)
+			out.Printf("Copying mapshot: %d%% (%.1f / %.1f MiB)\n", copied*100/total, float64(copied)/(1<<20), float64(total)/(1<<20))
+		}
+	}
+	// Directories get their time last, as adding files changes it.
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(filepath.Join(dst, rel), info.ModTime(), info.ModTime())
+	})
+}
+
+// copyVerified copies a single file, and then reads it back to check its
+// content. The modification time is kept, as the one of mapshot.json is used
+// as the time of the render.
+func copyVerified(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to copy %s: %w", src, err)
+	}
+	if n != info.Size() {
+		return fmt.Errorf("%s changed while being copied", src)
+	}
+	if err := os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	want := h.Sum(nil)
+	got, err := hashFile(dst)
+	if err != nil {
+		return fmt.Errorf("unable to verify %s: %w", dst, err)
+	}
+	if !bytes.Equal(got[:], want) {
+		return fmt.Errorf("content of %s differs from %s after copy", dst, src)
+	}
+	return nil
+}
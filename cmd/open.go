@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// How long to wait for the server to accept connections before opening the
+// browser anyway.
+const openTimeout = 10 * time.Second
+
+// browserURL returns the URL to open in a browser for a server listening on
+// the given address, or an empty string if it cannot be reached that way -
+// e.g., on a Unix socket.
+func (sf *ServeFlags) browserURL(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	scheme := "http"
+	if sf.tlsCert != "" || len(sf.acmeDomains) > 0 {
+		scheme = "https"
+	}
+	host := localHost(tcpAddr.IP)
+	if len(sf.acmeDomains) > 0 {
+		// Certificates are only valid for those.
+		host = sf.acmeDomains[0]
+	}
+	port := strconv.Itoa(tcpAddr.Port)
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		return fmt.Sprintf("%s://%s%s/", scheme, host, sf.cleanURLPrefix())
+	}
+	return fmt.Sprintf("%s://%s%s/", scheme, net.JoinHostPort(host, port), sf.cleanURLPrefix())
+}
+
+// localHost gives the host to reach a server listening on the given IP from
+// the same machine. Servers listening on all interfaces are reached through
+// localhost.
+func localHost(ip net.IP) string {
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+		return "localhost"
+	}
+	return ip.String()
+}
+
+// openWhenReady waits for the server to accept connections, and then opens
+// the UI in the default browser. Used for --open.
+func (sf *ServeFlags) openWhenReady(ctx context.Context, addr net.Addr) {
+	u := sf.browserURL(addr)
+	if u == "" {
+		fmt.Printf("Unable to open a browser on %s; --open requires a TCP port.\n", addr)
+		return
+	}
+	dialAddr := addr.String()
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		dialAddr = net.JoinHostPort(localHost(tcpAddr.IP), strconv.Itoa(tcpAddr.Port))
+	}
+	if err := waitForPort(ctx, dialAddr, openTimeout); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		logWarning("server not accepting connections; opening browser anyway", "addr", dialAddr, "err", err)
+	}
+	fmt.Printf("Opening %s in your browser ...\n", u)
+	if err := openBrowser(u); err != nil {
+		logWarning("unable to open browser", "url", u, "err", err)
+		fmt.Printf("Open %s in your browser.\n", u)
+	}
+}
+
+// waitForPort tries to connect to the address until it succeeds, the timeout
+// expires or the context is done.
+func waitForPort(ctx context.Context, addr string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// openBrowser opens the URL in the default browser of the user. Launchers
+// usually return once the browser is started.
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	case "darwin":
+		cmd = exec.Command("open", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unable to run %s: %w", cmd.Args[0], err)
+	}
+	return nil
+}
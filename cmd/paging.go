@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// cursorJSON is the content of pagination cursors. It holds the sort keys of
+// the last mapshot of a page, so the next page starts right after it even if
+// the list of mapshots changed in the meantime.
+type cursorJSON struct {
+	Name        string    `json:"n"`
+	Mtime       time.Time `json:"m"`
+	TicksPlayed int64     `json:"t,omitempty"`
+}
+
+func encodeCursor(shot *shotInfo) string {
+	raw, _ := json.Marshal(&cursorJSON{
+		Name:        shot.name,
+		Mtime:       shot.mtime,
+		TicksPlayed: shot.json.TicksPlayed,
+	})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(token string) (*shotInfo, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	c := &cursorJSON{}
+	if err := json.Unmarshal(raw, c); err != nil {
+		return nil, err
+	}
+	return &shotInfo{
+		name:  c.Name,
+		mtime: c.Mtime,
+		json:  &MapshotJSON{TicksPlayed: c.TicksPlayed},
+	}, nil
+}
+
+// shotPage is a subset of the list of mapshots.
+type shotPage struct {
+	shots []shotInfo
+	// Number of mapshots, across all pages.
+	total int
+	// Query parameters to get the next page; nil if this is the last page.
+	next url.Values
+}
+
+// paginate selects the mapshots from the query parameters `limit`, `offset` &
+// `cursor`. Mapshots must be sorted with the given ordering. Without
+// parameters, all mapshots are returned.
+func paginate(query url.Values, shots []shotInfo, less func(a, b *shotInfo) bool) (*shotPage, error) {
+	limit := 0
+	if raw := query.Get("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid value %q for parameter limit: must be a positive integer", raw)
+		}
+		limit = v
+	}
+	offset := 0
+	if raw := query.Get("offset"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid value %q for parameter offset: must be a non-negative integer", raw)
+		}
+		offset = v
+	}
+
+	page := &shotPage{total: len(shots)}
+	start := 0
+	if raw := query.Get("cursor"); raw != "" {
+		after, err := decodeCursor(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for parameter cursor", raw)
+		}
+		for start < len(shots) && !less(after, &shots[start]) {
+			start++
+		}
+	}
+	start += offset
+	if start > len(shots) {
+		start = len(shots)
+	}
+	end := len(shots)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	page.shots = shots[start:end]
+
+	if end < len(shots) && end > start {
+		next := url.Values{}
+		for k, v := range query {
+			next[k] = v
+		}
+		next.Del("offset")
+		next.Set("cursor", encodeCursor(&shots[end-1]))
+		page.next = next
+	}
+	return page, nil
+}
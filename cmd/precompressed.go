@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Precompressed copies of a file are stored next to it, with the suffix
+// matching their encoding. They are listed by order of preference.
+var precompressedVariants = []struct {
+	suffix   string
+	encoding string
+}{
+	{".br", "br"},
+	{".gz", "gzip"},
+}
+
+// addVary adds a value to the Vary header, if not already present.
+func addVary(hdr http.Header, value string) {
+	for _, v := range hdr.Values("Vary") {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return
+			}
+		}
+	}
+	hdr.Add("Vary", value)
+}
+
+// contentType returns the MIME type of the named file, based on its
+// extension, or on its content if the extension is unknown.
+func contentType(name string, content []byte) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+	return http.DetectContentType(content)
+}
+
+// serveEncoded serves already encoded content. Headers describe the
+// original file, beside the encoding.
+func serveEncoded(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, content io.ReadSeeker, encoding string, ctype string) {
+	hdr := w.Header()
+	hdr.Set("Content-Type", ctype)
+	hdr.Set("Content-Encoding", encoding)
+	addVary(hdr, "Accept-Encoding")
+	// http.ServeContent does not know about the encoding, so give it a name
+	// without the encoding suffix.
+	http.ServeContent(w, req, name, modTime, content)
+}
+
+// servePrecompressed serves a precompressed copy of the named file, if there
+// is one which the client supports, with the given Cache-Control header if not
+// empty. It returns false if nothing was served.
+func servePrecompressed(w http.ResponseWriter, req *http.Request, fsys fs.FS, name string, cacheControl string) bool {
+	if precompressedExts[strings.ToLower(path.Ext(name))] {
+		return false
+	}
+	for _, variant := range precompressedVariants {
+		info, err := fs.Stat(fsys, name+variant.suffix)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		// Even when not used, the response depends on the encoding.
+		addVary(w.Header(), "Accept-Encoding")
+		if !acceptsEncoding(req, variant.encoding) {
+			continue
+		}
+		f, err := fsys.Open(name + variant.suffix)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		content, ok := f.(io.ReadSeeker)
+		if !ok {
+			// E.g., compressed entries of zip archives.
+			continue
+		}
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x-%s"`, info.ModTime().UnixNano(), info.Size(), variant.encoding))
+		serveEncoded(w, req, name, info.ModTime(), content, variant.encoding, ctype)
+		return true
+	}
+	return false
+}
+
+// gzipContent compresses the content, for files which are served many times -
+// e.g., embedded frontend files. It returns nil if compression does not
+// reduce the size.
+func gzipContent(content []byte) []byte {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil
+	}
+	if _, err := gz.Write(content); err != nil {
+		return nil
+	}
+	if err := gz.Close(); err != nil {
+		return nil
+	}
+	if buf.Len() >= len(content) {
+		return nil
+	}
+	return buf.Bytes()
+}
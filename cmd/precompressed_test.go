@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func newTestPrecompressedFS() fstest.MapFS {
+	modTime := time.Unix(1000, 0)
+	return fstest.MapFS{
+		"both.json":       {Data: []byte(`{"raw": true}`), ModTime: modTime},
+		"both.json.br":    {Data: []byte("brotli"), ModTime: modTime},
+		"both.json.gz":    {Data: []byte("gzip"), ModTime: modTime},
+		"index.html":      {Data: []byte("<html></html>"), ModTime: modTime},
+		"index.html.gz":   {Data: []byte("gzip"), ModTime: modTime},
+		"plain.json":      {Data: []byte(`{}`), ModTime: modTime},
+		"tile.jpg":        {Data: []byte("jpeg"), ModTime: modTime},
+		"tile.jpg.gz":     {Data: []byte("gzip"), ModTime: modTime},
+		"dir.json.gz/foo": {Data: []byte("not a variant"), ModTime: modTime},
+	}
+}
+
+func TestServePrecompressed(t *testing.T) {
+	// As done by the server; tests do not depend on the system database.
+	registerMIMETypes()
+	fsys := newTestPrecompressedFS()
+	for _, tc := range []struct {
+		desc     string
+		name     string
+		accept   string
+		served   bool
+		encoding string
+		body     string
+		ctype    string
+		vary     bool
+	}{
+		{"brotli preferred", "both.json", "gzip, br", true, "br", "brotli", "application/json; charset=utf-8", true},
+		{"gzip only accepted", "both.json", "gzip", true, "gzip", "gzip", "application/json; charset=utf-8", true},
+		{"brotli refused", "both.json", "br;q=0, gzip", true, "gzip", "gzip", "application/json; charset=utf-8", true},
+		{"wildcard", "both.json", "*", true, "br", "brotli", "application/json; charset=utf-8", true},
+		{"gzip variant only", "index.html", "br, gzip", true, "gzip", "gzip", "text/html; charset=utf-8", true},
+		{"no accepted variant", "index.html", "br", false, "", "", "", true},
+		{"no accept-encoding", "both.json", "", false, "", "", "", true},
+		{"no variant", "plain.json", "gzip, br", false, "", "", "", false},
+		{"variant is a directory", "dir.json", "gzip", false, "", "", "", false},
+		{"already compressed", "tile.jpg", "gzip", false, "", "", "", false},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/"+tc.name, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept-Encoding", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			served := servePrecompressed(rec, req, fsys, tc.name, "public, max-age=60")
+			if served != tc.served {
+				t.Fatalf("got served=%v, want %v", served, tc.served)
+			}
+			if got := rec.Header().Get("Vary") == "Accept-Encoding"; got != tc.vary {
+				t.Errorf("got Vary %q, want set=%v", rec.Header().Get("Vary"), tc.vary)
+			}
+			if !served {
+				if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+					t.Errorf("got Content-Encoding %q when not served", enc)
+				}
+				if cc := rec.Header().Get("Cache-Control"); cc != "" {
+					t.Errorf("got Cache-Control %q when not served", cc)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tc.encoding {
+				t.Errorf("got Content-Encoding %q, want %q", got, tc.encoding)
+			}
+			// Type of the original file, not of the compressed one.
+			if got := rec.Header().Get("Content-Type"); got != tc.ctype {
+				t.Errorf("got Content-Type %q, want %q", got, tc.ctype)
+			}
+			if got := rec.Body.String(); got != tc.body {
+				t.Errorf("got body %q, want %q", got, tc.body)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "public, max-age=60" {
+				t.Errorf("got Cache-Control %q", got)
+			}
+			if etag := rec.Header().Get("ETag"); !strings.HasSuffix(etag, "-"+tc.encoding+`"`) {
+				t.Errorf("got ETag %q, want one specific to %s", etag, tc.encoding)
+			}
+		})
+	}
+}
+
+func TestServePrecompressedConditional(t *testing.T) {
+	fsys := newTestPrecompressedFS()
+	req := httptest.NewRequest("GET", "/both.json", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	servePrecompressed(rec, req, fsys, "both.json", "")
+	etag := rec.Header().Get("ETag")
+
+	req = httptest.NewRequest("GET", "/both.json", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	servePrecompressed(rec, req, fsys, "both.json", "")
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+
+	// The ETag of the gzip variant must not match the brotli one.
+	req = httptest.NewRequest("GET", "/both.json", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	servePrecompressed(rec, req, fsys, "both.json", "")
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d for another encoding, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Header().Get("Cache-Control") != "" {
+		t.Errorf("got Cache-Control %q, want none", rec.Header().Get("Cache-Control"))
+	}
+}
+
+func TestFrontendHandlerGzip(t *testing.T) {
+	html := strings.Repeat("<p>mapshot</p>", 100)
+	h := frontendHandler(fstest.MapFS{
+		"index.html": {Data: []byte(html)},
+		"tiny.js":    {Data: []byte("x")},
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("got Vary %q", got)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != html {
+		t.Errorf("got content %q", content)
+	}
+
+	// Without gzip support, the original is served - still varying.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("got Content-Encoding %q without gzip support", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("got Vary %q without gzip support", got)
+	}
+	if got := rec.Body.String(); got != html {
+		t.Errorf("got body %q", got)
+	}
+
+	// Compression would not reduce the size; never compressed.
+	req = httptest.NewRequest("GET", "/tiny.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("got Content-Encoding %q for a tiny file", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "" {
+		t.Errorf("got Vary %q for a tiny file", got)
+	}
+}
+
+func TestGzipContent(t *testing.T) {
+	content := bytes.Repeat([]byte("mapshot "), 100)
+	gzipped := gzipContent(content)
+	if gzipped == nil {
+		t.Fatal("compressible content not compressed")
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %q after decompression", got)
+	}
+	if gzipContent([]byte("x")) != nil {
+		t.Error("content compressed despite growing")
+	}
+}
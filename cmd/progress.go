@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often progress is printed when the output is not a terminal.
+const progressLogDelay = 30 * time.Second
+
+// ProgressPlanJSON is written by the mod once all screenshots have been
+// requested, as `mapshot-progress-<runid>` in script-output.
+type ProgressPlanJSON struct {
+	Layers []*ProgressLayerJSON `json:"layers"`
+}
+
+// ProgressLayerJSON is part of ProgressPlanJSON.
+type ProgressLayerJSON struct {
+	SurfaceName string `json:"surface_name"`
+	Zoom        int    `json:"zoom"`
+	// Directory of the tiles, relative to script-output.
+	Path string `json:"path"`
+	// Number of tiles to be written in that directory.
+	Tiles int `json:"tiles"`
+}
+
+// ProgressEventJSON is printed on stdout, one per line, with --json_progress.
+type ProgressEventJSON struct {
+	// One of "start", "progress", "done", "skipped" or "error".
+	Event          string  `json:"event"`
+	Name           string  `json:"name,omitempty"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// Only for "progress".
+	TilesDone  int      `json:"tiles_done,omitempty"`
+	TilesTotal int      `json:"tiles_total,omitempty"`
+	Surface    string   `json:"surface,omitempty"`
+	Zoom       *int     `json:"zoom,omitempty"`
+	ETASeconds *float64 `json:"eta_seconds,omitempty"`
+	// Only for "done" & "skipped".
+	Output      string `json:"output,omitempty"`
+	OutputBytes int64  `json:"output_bytes,omitempty"`
+	// Only for "error".
+	Error string `json:"error,omitempty"`
+}
+
+// renderProgress follows the tiles written by Factorio, and reports on them.
+type renderProgress struct {
+	name      string
+	planFile  string
+	scriptDir string
+	jsonOut   bool
+	out       *renderOutput
+	tty       bool
+	start     time.Time
+
+	plan  *ProgressPlanJSON
+	total int
+	// Number of tiles in the layers fully written; screenshots are written
+	// in order, so those do not need to be checked again.
+	doneLayers int
+	doneTiles  int
+	// Tiles of the current layer.
+	current int
+	// When the first tile appeared, with how many were there; used for the
+	// ETA, as loading the game can take a while.
+	firstTime  time.Time
+	firstTiles int
+
+	lastPrint time.Time
+	lastDone  int
+	// Length of the progress line currently displayed on the terminal.
+	lineLen int
+}
+
+func newRenderProgress(name string, scriptDir string, planFile string, jsonOut bool, out *renderOutput) *renderProgress {
+	return &renderProgress{
+		name:      name,
+		planFile:  planFile,
+		scriptDir: scriptDir,
+		jsonOut:   jsonOut,
+		out:       out,
+		// A line updated in place would be garbled by other renders.
+		tty:   out.prefix == "" && isTerminal(os.Stdout),
+		start: time.Now(),
+	}
+}
+
+// isTerminal indicates if the file is a terminal, in which case the progress
+// line is updated in place.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *renderProgress) elapsed() time.Duration {
+	return time.Since(p.start).Round(time.Second)
+}
+
+// emit prints an event with --json_progress.
+func (p *renderProgress) emit(ev *ProgressEventJSON) {
+	if !p.jsonOut {
+		return
+	}
+	ev.Name = p.name
+	ev.ElapsedSeconds = time.Since(p.start).Seconds()
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		p.out.logWarning("unable to encode progress", "error", err)
+		return
+	}
+	p.endLine()
+	// Not prefixed, to keep it parseable; the name is part of the event.
+	p.out.raw(string(raw) + "\n")
+}
+
+// endLine terminates the progress line on the terminal, if any, so other
+// output goes on its own line.
+func (p *renderProgress) endLine() {
+	if p.lineLen > 0 {
+		p.out.Println()
+		p.lineLen = 0
+	}
+}
+
+func (p *renderProgress) started() {
+	p.emit(&ProgressEventJSON{Event: "start"})
+}
+
+// loadPlan reads the list of expected tiles, if the mod wrote it already.
+func (p *renderProgress) loadPlan() error {
+	raw, err := ioutil.ReadFile(p.planFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	plan := &ProgressPlanJSON{}
+	if err := json.Unmarshal(raw, plan); err != nil {
+		return fmt.Errorf("invalid progress file %s: %w", p.planFile, err)
+	}
+	p.plan = plan
+	for _, l := range plan.Layers {
+		p.total += l.Tiles
+	}
+	p.out.logDebug("progress file loaded", "path", p.planFile, "layers", len(plan.Layers), "tiles", p.total)
+	return nil
+}
+
+// countTiles returns how many tiles of the layer exist.
+func (p *renderProgress) countTiles(l *ProgressLayerJSON) int {
+	entries, err := ioutil.ReadDir(filepath.Join(p.scriptDir, filepath.FromSlash(l.Path)))
+	if err != nil {
+		// Most likely, nothing was written in it yet.
+		return 0
+	}
+	count := 0
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "tile_") {
+			count++
+		}
+	}
+	return count
+}
+
+// update checks the tiles written so far and reports on them.
+func (p *renderProgress) update() {
+	if p.plan == nil {
+		if err := p.loadPlan(); err != nil {
+			p.out.logWarning("unable to follow render progress", "error", err)
+			// Do not try again.
+			p.plan = &ProgressPlanJSON{}
+		}
+		if p.plan == nil {
+			return
+		}
+	}
+	if p.plan.Layers == nil || p.total == 0 {
+		return
+	}
+
+	p.current = 0
+	for p.doneLayers < len(p.plan.Layers) {
+		l := p.plan.Layers[p.doneLayers]
+		count := p.countTiles(l)
+		if count < l.Tiles {
+			p.current = count
+			break
+		}
+		p.doneLayers++
+		p.doneTiles += l.Tiles
+	}
+	done := p.doneTiles + p.current
+	now := time.Now()
+	if done > 0 && p.firstTime.IsZero() {
+		p.firstTime = now
+		p.firstTiles = done
+	}
+
+	ev := &ProgressEventJSON{
+		Event:      "progress",
+		TilesDone:  done,
+		TilesTotal: p.total,
+	}
+	var l *ProgressLayerJSON
+	if p.doneLayers < len(p.plan.Layers) {
+		l = p.plan.Layers[p.doneLayers]
+	} else {
+		l = p.plan.Layers[len(p.plan.Layers)-1]
+	}
+	ev.Surface = l.SurfaceName
+	zoom := l.Zoom
+	ev.Zoom = &zoom
+	var eta time.Duration
+	if rate := float64(done-p.firstTiles) / now.Sub(p.firstTime).Seconds(); done > p.firstTiles && rate > 0 {
+		eta = time.Duration(float64(p.total-done) / rate * float64(time.Second)).Round(time.Second)
+		etaSeconds := eta.Seconds()
+		ev.ETASeconds = &etaSeconds
+	}
+
+	if p.jsonOut {
+		// Only when something changed, beside a periodic heartbeat.
+		if done != p.lastDone || now.Sub(p.lastPrint) >= progressLogDelay {
+			p.lastPrint = now
+			p.lastDone = done
+			p.emit(ev)
+		}
+		return
+	}
+	msg := fmt.Sprintf("Rendering: %d/%d tiles (%d%%), surface %s, zoom %d", done, p.total, done*100/p.total, l.SurfaceName, l.Zoom)
+	if ev.ETASeconds != nil {
+		msg += fmt.Sprintf(", ETA %v", eta)
+	}
+	if p.tty {
+		// Pad with spaces to cover the end of a longer previous line.
+		pad := ""
+		if n := p.lineLen - len(msg); n > 0 {
+			pad = strings.Repeat(" ", n)
+		}
+		p.out.Printf("\r%s%s", msg, pad)
+		p.lineLen = len(msg)
+		return
+	}
+	if now.Sub(p.lastPrint) >= progressLogDelay || done == p.total {
+		p.lastPrint = now
+		p.out.Println(msg)
+	}
+}
+
+// finished reports the end of a successful render, with the location and size
+// of the output.
+func (p *renderProgress) finished(output string) {
+	size, err := dirSize(output)
+	if err != nil {
+		p.out.logWarning("unable to get size of mapshot", "path", output, "error", err)
+	}
+	p.emit(&ProgressEventJSON{
+		Event:       "done",
+		Output:      output,
+		OutputBytes: size,
+	})
+	p.endLine()
+	p.out.Printf("Rendered in %v; %.1f MiB.\n", p.elapsed(), float64(size)/(1<<20))
+}
+
+// skipped reports a render not done, as the save did not change since the
+// mapshot in output.
+func (p *renderProgress) skipped(output string) {
+	p.emit(&ProgressEventJSON{
+		Event:  "skipped",
+		Output: output,
+	})
+}
+
+// failed reports the end of a render with an error.
+func (p *renderProgress) failed(err error) {
+	p.emit(&ProgressEventJSON{
+		Event: "error",
+		Error: err.Error(),
+	})
+	p.endLine()
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies takes the client address & scheme from X-Forwarded-For and
+// X-Forwarded-Proto headers, for requests coming from reverse proxies given
+// with --trusted_proxies. Headers from other peers are ignored, as anybody
+// can set them.
+type trustedProxies struct {
+	nets []*net.IPNet
+}
+
+// newTrustedProxies parses a list of CIDR ranges; plain IP addresses are
+// accepted as a single address range.
+func newTrustedProxies(cidrs []string) (*trustedProxies, error) {
+	tp := &trustedProxies{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid --trusted_proxies range %q: must be a CIDR range, e.g., 10.0.0.0/8, or an IP address", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			tp.nets = append(tp.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --trusted_proxies range %q: %w", cidr, err)
+		}
+		tp.nets = append(tp.nets, n)
+	}
+	return tp, nil
+}
+
+func (tp *trustedProxies) trusted(ip net.IP) bool {
+	for _, n := range tp.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client, from the peer address & the
+// X-Forwarded-For values. Hops are considered from the right, as each proxy
+// appends the address it received the request from; the first untrusted one
+// is the client - anything on its left could have been made up. It returns
+// nil if the peer itself is not trusted.
+func (tp *trustedProxies) clientIP(peer net.IP, forwardedFor []string) net.IP {
+	if peer == nil || !tp.trusted(peer) {
+		return nil
+	}
+	var hops []string
+	for _, v := range forwardedFor {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHopIP(hops[i])
+		if ip == nil {
+			// Garbage from a trusted proxy; stick to what is known.
+			break
+		}
+		client = ip
+		if !tp.trusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// parseHopIP parses a single X-Forwarded-For value. Some proxies include the
+// port.
+func parseHopIP(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// wrap rewrites the remote address & scheme of requests from trusted
+// proxies, so all other handlers see the client.
+func (tp *trustedProxies) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		client := tp.clientIP(net.ParseIP(host), req.Header.Values("X-Forwarded-For"))
+		if client == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+		req2 := req.Clone(req.Context())
+		// The port is the one of the last proxy, not of the client.
+		req2.RemoteAddr = net.JoinHostPort(client.String(), "0")
+		// The leftmost value is the one closest to the client.
+		proto := strings.TrimSpace(strings.SplitN(req.Header.Get("X-Forwarded-Proto"), ",", 2)[0])
+		if proto = strings.ToLower(proto); proto == "http" || proto == "https" {
+			req2.URL.Scheme = proto
+		}
+		h.ServeHTTP(w, req2)
+	})
+}
+
+// requestScheme returns the scheme used by the client: http or https.
+func requestScheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		// Set from X-Forwarded-Proto.
+		return req.URL.Scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// absoluteURL returns the full URL of the path, as seen by the client.
+func absoluteURL(req *http.Request, p string) string {
+	return requestScheme(req) + "://" + req.Host + p
+}
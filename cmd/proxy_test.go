@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tp, err := newTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc string
+		peer string
+		xff  []string
+		// Empty if the peer is not trusted.
+		want string
+	}{
+		{"untrusted peer", "203.0.113.5", []string{"198.51.100.1"}, ""},
+		{"untrusted peer without header", "203.0.113.5", nil, ""},
+		{"trusted peer without header", "10.0.0.1", nil, "10.0.0.1"},
+		{"single hop", "10.0.0.1", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"single IP range", "192.168.1.1", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"chain", "10.0.0.1", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "198.51.100.1"},
+		{"spoofed left of client", "10.0.0.1", []string{"1.2.3.4, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"rightmost untrusted", "10.0.0.1", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"multiple headers", "10.0.0.1", []string{"198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"fully trusted chain", "10.0.0.1", []string{"10.0.0.4, 10.0.0.3, 10.0.0.2"}, "10.0.0.4"},
+		{"with ports", "10.0.0.1", []string{"198.51.100.1:4321, 10.0.0.2:80"}, "198.51.100.1"},
+		{"empty entries", "10.0.0.1", []string{" , 198.51.100.1,,  "}, "198.51.100.1"},
+		{"malformed rightmost", "10.0.0.1", []string{"198.51.100.1, garbage"}, "10.0.0.1"},
+		{"malformed after trusted", "10.0.0.1", []string{"garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"ipv6 client", "10.0.0.1", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"ipv6 client with port", "10.0.0.1", []string{"[2001:db8::1]:4321"}, "2001:db8::1"},
+		{"ipv6 proxy", "fd00::1", []string{"2001:db8::1, fd00::2"}, "2001:db8::1"},
+		{"untrusted ipv6 peer", "2001:db8::2", []string{"2001:db8::1"}, ""},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := tp.clientIP(net.ParseIP(tc.peer), tc.xff)
+			if tc.want == "" {
+				if got != nil {
+					t.Errorf("clientIP(%s, %q) = %v, want nil", tc.peer, tc.xff, got)
+				}
+				return
+			}
+			if !got.Equal(net.ParseIP(tc.want)) {
+				t.Errorf("clientIP(%s, %q) = %v, want %s", tc.peer, tc.xff, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewTrustedProxiesInvalid(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0/8", ""} {
+		if _, err := newTrustedProxies([]string{cidr}); err == nil {
+			t.Errorf("newTrustedProxies(%q) succeeded, want error", cidr)
+		}
+	}
+}
+
+func TestTrustedProxiesWrap(t *testing.T) {
+	tp, err := newTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotAddr, gotScheme string
+	h := tp.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotAddr, gotScheme = req.RemoteAddr, requestScheme(req)
+	}))
+	for _, tc := range []struct {
+		desc   string
+		remote string
+		xff    string
+		proto  string
+		addr   string
+		scheme string
+	}{
+		{"trusted", "10.0.0.1:1234", "198.51.100.1", "https", "198.51.100.1:0", "https"},
+		{"first proto", "10.0.0.1:1234", "198.51.100.1", "HTTPS, http", "198.51.100.1:0", "https"},
+		{"unknown proto", "10.0.0.1:1234", "198.51.100.1", "gopher", "198.51.100.1:0", "http"},
+		{"untrusted", "203.0.113.5:1234", "198.51.100.1", "https", "203.0.113.5:1234", "http"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/latest", nil)
+			req.RemoteAddr = tc.remote
+			req.Header.Set("X-Forwarded-For", tc.xff)
+			req.Header.Set("X-Forwarded-Proto", tc.proto)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if gotAddr != tc.addr {
+				t.Errorf("got remote address %q, want %q", gotAddr, tc.addr)
+			}
+			if gotScheme != tc.scheme {
+				t.Errorf("got scheme %q, want %q", gotScheme, tc.scheme)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A mapshot directory containing this file is never removed by --keep_last
+// and --keep_days.
+const pinnedMarker = ".mapshot-pinned"
+
+// pruneRenders removes the mapshots of the same save as the one just rendered
+// in output, as recorded in their mapshot.json, which are beyond --keep_last
+// and --keep_days. A mapshot is kept if either of them keeps it. Only
+// mapshot directories of dstRoot are considered; archives and pinned
+// mapshots are left alone.
+func pruneRenders(dstRoot string, output string, ro *renderOptions, out *renderOutput) {
+	if ro.keepLast == 0 && ro.keepDays == 0 {
+		return
+	}
+	shots, _, err := findShots(dstRoot, newArchiveCache(), scanOptions{}, nil)
+	if err != nil {
+		out.logWarning("unable to look for old mapshots to prune", "error", err)
+		return
+	}
+	realOutput, err := filepath.EvalSymlinks(output)
+	if err != nil {
+		out.logWarning("unable to look for old mapshots to prune", "error", err)
+		return
+	}
+	var current *shotInfo
+	for i := range shots {
+		if shots[i].fsPath == realOutput {
+			current = &shots[i]
+		}
+	}
+	if current == nil || current.json == nil || current.json.Savename == "" {
+		out.logWarning("savename of the new mapshot is not known; not pruning old ones", "output", output)
+		return
+	}
+
+	var candidates []*shotInfo
+	for i := range shots {
+		shot := &shots[i]
+		if shot == current || shot.archive || shot.fsPath == "" || shot.json == nil || shot.json.Savename != current.json.Savename {
+			continue
+		}
+		candidates = append(candidates, shot)
+	}
+	// Most recent first.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].mtime.After(candidates[j].mtime)
+	})
+
+	cutoff := time.Now().AddDate(0, 0, -ro.keepDays)
+	var removed []string
+	var freed int64
+	for i, shot := range candidates {
+		// The new mapshot is the first of the last renders.
+		if ro.keepLast > 0 && i+1 < ro.keepLast {
+			continue
+		}
+		if ro.keepDays > 0 && shot.mtime.After(cutoff) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(shot.fsPath, pinnedMarker)); err == nil {
+			out.logInfo("old mapshot is pinned, not pruning it", "path", shot.fsPath)
+			continue
+		}
+		size, err := dirSize(shot.fsPath)
+		if err != nil {
+			out.logWarning("unable to compute size of old mapshot", "path", shot.fsPath, "error", err)
+		}
+		if err := os.RemoveAll(shot.fsPath); err != nil {
+			out.logWarning("unable to prune old mapshot", "path", shot.fsPath, "error", err)
+			continue
+		}
+		removed = append(removed, shot.fsPath)
+		freed += size
+	}
+	if len(removed) == 0 {
+		out.logInfo("no old mapshot to prune", "savename", current.json.Savename)
+		return
+	}
+	out.Printf("Pruned %d old mapshots of %q, reclaiming %d bytes (%.1f MiB):\n", len(removed), current.json.Savename, freed, float64(freed)/(1<<20))
+	for _, p := range removed {
+		out.Printf("  %s\n", p)
+	}
+}
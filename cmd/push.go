@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var pushFlags struct {
+	name           string
+	source         string
+	adminToken     string
+	adminTokenFile string
+}
+
+var cmdPush = &cobra.Command{
+	Use:   "push <dir> <url>",
+	Short: "Upload a rendered mapshot to a mapshot server.",
+	Long: `Upload a rendered mapshot to a mapshot server.
+
+<dir> is the directory containing mapshot.json. <url> is the base URL of the
+server, which must run with --enable_admin.
+	`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, baseURL := args[0], args[1]
+		if _, err := os.Stat(filepath.Join(dir, "mapshot.json")); err != nil {
+			return fmt.Errorf("%s is not a mapshot directory: %w", dir, err)
+		}
+		token := pushFlags.adminToken
+		if pushFlags.adminTokenFile != "" {
+			var err error
+			if token, err = loadAdminToken(pushFlags.adminTokenFile); err != nil {
+				return err
+			}
+		}
+
+		query := url.Values{}
+		if pushFlags.name != "" {
+			query.Set("name", pushFlags.name)
+		}
+		if pushFlags.source != "" {
+			query.Set("source", pushFlags.source)
+		}
+		target := strings.TrimSuffix(baseURL, "/") + "/api/shots"
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeTarGz(pw, dir))
+		}()
+		req, err := http.NewRequestWithContext(cmd.Context(), http.MethodPost, target, pr)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/gzip")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		fmt.Printf("Uploading %s to %s ...\n", dir, baseURL)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to upload: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			e := &ErrorJSON{}
+			if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Error == "" {
+				return fmt.Errorf("upload failed: %s", resp.Status)
+			}
+			return fmt.Errorf("upload failed: %s: %s", resp.Status, e.Error)
+		}
+		shot := &APIShotJSON{}
+		if err := json.NewDecoder(resp.Body).Decode(shot); err != nil {
+			return fmt.Errorf("invalid response from server: %w", err)
+		}
+		fmt.Printf("Uploaded as %s\n", shot.Name)
+		return nil
+	},
+}
+
+// writeTarGz writes the content of the directory as a gzipped tar stream.
+func writeTarGz(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return fmt.Errorf("unsupported file %s; only files and directories are allowed", p)
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdPush)
+	cmdPush.Flags().StringVar(&pushFlags.name, "name", "", "Name of the mapshot on the server. If empty, derived from the savename & unique ID in mapshot.json.")
+	cmdPush.Flags().StringVar(&pushFlags.source, "source", "", "Label of the directory to upload to, when the server serves multiple ones.")
+	cmdPush.Flags().StringVar(&pushFlags.adminToken, "admin_token", "", "Token of the server, if it uses --admin_token.")
+	cmdPush.Flags().StringVar(&pushFlags.adminTokenFile, "admin_token_file", "", "File containing the token for --admin_token.")
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// How often idle clients are removed from the rate limiter.
+const rateLimitSweepDelay = time.Minute
+
+// tokenBucket tracks the requests of a single client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter implements a per client IP token bucket.
+type rateLimiter struct {
+	// Tokens added per second.
+	rate float64
+	// Maximum number of tokens.
+	burst float64
+	// If true, requests from loopback addresses are never limited.
+	exemptLoopback bool
+
+	m         sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int, exemptLoopback bool) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:           rate,
+		burst:          float64(burst),
+		exemptLoopback: exemptLoopback,
+		buckets:        make(map[string]*tokenBucket),
+		lastSweep:      time.Now(),
+	}
+}
+
+// allow consumes a token for the client with the given remote address -
+// typically http.Request.RemoteAddr. If no token is available, it returns
+// false with how long to wait for a token.
+func (rl *rateLimiter) allow(remoteAddr string) (bool, time.Duration) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if rl.exemptLoopback {
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return true, 0
+		}
+	}
+
+	now := time.Now()
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	rl.sweep(now)
+
+	b := rl.buckets[host]
+	if b == nil {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[host] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes clients which have been idle long enough to have a full
+// bucket; they are indistinguishable from new clients. Must be called with the
+// lock held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepDelay {
+		return
+	}
+	rl.lastSweep = now
+	for host, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, host)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverHandler turns panics of the handler into 500 errors, so a bug in a
+// single endpoint does not affect other requests. http.ErrAbortHandler is
+// passed through, as it is the expected way to abort a response.
+func (s *Server) recoverHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+			logError("panic while serving request", "method", req.Method, "path", req.URL.Path, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			s.metrics.recordPanic()
+			if sr.status != 0 {
+				// Part of the response was already sent; the only way to tell
+				// the client is to cut the connection.
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(sr, req)
+	})
+}
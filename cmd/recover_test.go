@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// quietLogs discards logs for the duration of the test.
+func quietLogs(t testing.TB) {
+	prev := logs
+	logs = &textLogger{min: levelError, w: ioutil.Discard}
+	t.Cleanup(func() { logs = prev })
+}
+
+func newPanicMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	})
+	mux.HandleFunc("/abort", func(w http.ResponseWriter, req *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	mux.HandleFunc("/partial", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("boom")
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	return mux
+}
+
+func TestRecoverHandler(t *testing.T) {
+	quietLogs(t)
+	s := &Server{metrics: newServerMetrics()}
+	ts := httptest.NewServer(s.recoverHandler(newPanicMux()))
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(ts.URL + "/panic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+		}
+
+		resp, err = http.Get(ts.URL + "/ok")
+		if err != nil {
+			t.Fatalf("server not serving after a panic: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Errorf("got status %d, body %q after a panic; want %d, %q", resp.StatusCode, body, http.StatusOK, "ok")
+		}
+	}
+	if s.metrics.panics != 2 {
+		t.Errorf("got %d panics recorded, want 2", s.metrics.panics)
+	}
+}
+
+func TestRecoverHandlerAbort(t *testing.T) {
+	quietLogs(t)
+	for _, tc := range []struct {
+		desc string
+		path string
+		// Aborting on purpose is not a panic for the metrics.
+		recorded uint64
+	}{
+		{"abort", "/abort", 0},
+		{"partial response", "/partial", 1},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := &Server{metrics: newServerMetrics()}
+			h := s.recoverHandler(newPanicMux())
+			func() {
+				defer func() {
+					if r := recover(); r != http.ErrAbortHandler {
+						t.Errorf("got panic %v, want http.ErrAbortHandler", r)
+					}
+				}()
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.path, nil))
+			}()
+			if s.metrics.panics != tc.recorded {
+				t.Errorf("got %d panics recorded, want %d", s.metrics.panics, tc.recorded)
+			}
+		})
+	}
+}
@@ -6,13 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Palats/mapshot/embed"
 	"github.com/Palats/mapshot/factorio"
-	"github.com/golang/glog"
 	"github.com/google/uuid"
 	"github.com/otiai10/copy"
 	"github.com/spf13/cobra"
@@ -28,26 +34,333 @@ type RenderFlags struct {
 	resolution    int64
 	jpgquality    int64
 	minjpgquality int64
-	surface       string
+	zoommin       int64
+	zoommax       int64
+	format        string
+	surface       []string
+	allSurfaces   bool
+	modSettings   []string
 }
 
 // Register creates flags for the rendering parameters.
 func (rf *RenderFlags) Register(flags *pflag.FlagSet, prefix string) *RenderFlags {
-	flags.StringVar(&rf.area, prefix+"area", "", "How to pick the area to render. all=all existing chunks; entities=chunks including artifical build. If empty, use value from the game.")
-	flags.Int64Var(&rf.tilemin, prefix+"tilemin", 0, "Size in in-game units of a tile for the most zoomed layer. If 0, use value from the game.")
-	flags.Int64Var(&rf.tilemax, prefix+"tilemax", 0, "Size in in-game units of a tile for the least zoomed layer. If 0, use value from the game.")
+	flags.StringVar(&rf.area, prefix+"area", "", "How to pick the area to render. all=all existing chunks; entities=chunks including artifical build; x1,y1,x2,y2=rectangle in world coordinates, e.g., -500,-500,500,500. If empty, use value from the game.")
+	flags.Int64Var(&rf.tilemin, prefix+"tilemin", 0, "Size in in-game units of a tile for the most zoomed layer; a power of 2 between 16 and 1024. If 0, use value from the game.")
+	flags.Int64Var(&rf.tilemax, prefix+"tilemax", 0, "Size in in-game units of a tile for the least zoomed layer; a power of 2 between 16 and 1024. If 0, use value from the game.")
 	flags.StringVar(&rf.prefix, prefix+"prefix", "", "Prefix to add to all generated filenames. If empty, use value from the game.")
-	flags.Int64Var(&rf.resolution, prefix+"resolution", 0, "Pixel size for generated tiles. If 0, use value from the game.")
-	flags.Int64Var(&rf.jpgquality, prefix+"jpgquality", 0, "Compression quality for jpg files. If 0, use value from the game.")
-	flags.Int64Var(&rf.minjpgquality, prefix+"minjpgquality", -1, "Compression quality for jpg files when no player entities are present. Set to 0 to skip the tile entirely.")
-	flags.StringVar(&rf.surface, prefix+"surface", "", "Game surface to render. If empty, use value from the game. Use _all_ for render all surfaces (default behavior).")
+	flags.Int64Var(&rf.resolution, prefix+"resolution", 0, "Pixel size for generated tiles, between 16 and 16384. If 0, use value from the game.")
+	flags.Int64Var(&rf.jpgquality, prefix+"jpgquality", 0, "Compression quality for jpg files, between 1 and 100. If 0, use value from the game.")
+	flags.Int64Var(&rf.minjpgquality, prefix+"minjpgquality", -1, "Compression quality for jpg files when no player entities are present, up to 100. Set to 0 to skip the tile entirely. If -1, use value from the game.")
+	flags.StringVar(&rf.format, prefix+"format", "", "Image format of the tiles: jpg or png - lossless, but much larger. If empty, use value from the game.")
+	flags.Int64Var(&rf.zoommin, prefix+"zoommin", -1, "Least detailed zoom level to generate; 0 is the layer of tilemax. If -1, start from 0.")
+	flags.Int64Var(&rf.zoommax, prefix+"zoommax", -1, "Most detailed zoom level to generate; e.g., to skip the layers which take the most time. If -1, go up to the layer of tilemin.")
+	flags.StringSliceVar(&rf.surface, prefix+"surface", nil, "Game surface to render; can be repeated or comma separated, e.g., --surface=nauvis --surface=nauvis-orbit. If empty, use value from the game.")
+	flags.BoolVar(&rf.allSurfaces, prefix+"all_surfaces", false, "If true, render all surfaces of the game, as one mapshot.")
+	flags.StringArrayVar(&rf.modSettings, prefix+"mod_setting", nil, "Mod setting to use for the render, as key=value - e.g., --mod_setting=resolution=2048; takes precedence over the other flags and the value from the game. Can be repeated.")
 	return rf
 }
 
+// Settings of the mod which can be given with --mod_setting, with whether
+// their value is a number. zoommin & zoommax have no setting in the game, but
+// are read the same way.
+var modSettingNumbers = map[string]bool{
+	"area":          false,
+	"prefix":        false,
+	"tilemin":       true,
+	"tilemax":       true,
+	"resolution":    true,
+	"jpgquality":    true,
+	"minjpgquality": true,
+	"format":        false,
+	"surface":       false,
+	"zoommin":       true,
+	"zoommax":       true,
+}
+
+// parseModSettings returns the values of --mod_setting, along with the keys
+// which are not known mod settings - those are still given to the mod.
+func (rf *RenderFlags) parseModSettings() (map[string]interface{}, []string, error) {
+	values := map[string]interface{}{}
+	var unknown []string
+	for _, s := range rf.modSettings {
+		idx := strings.Index(s, "=")
+		if idx <= 0 {
+			return nil, nil, fmt.Errorf("invalid --mod_setting %q: must be key=value", s)
+		}
+		key, value := s[:idx], s[idx+1:]
+		isNumber, known := modSettingNumbers[key]
+		if !known {
+			unknown = append(unknown, key)
+		}
+		if isNumber {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid --mod_setting %q: %s must be an integer", s, key)
+			}
+			values[key] = n
+			continue
+		}
+		values[key] = value
+	}
+	return values, unknown, nil
+}
+
+// modSettingNames returns the known settings, for messages.
+func modSettingNames() string {
+	var names []string
+	for name := range modSettingNumbers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// renderOptions are parameters of the render command which are not passed
+// to the mod.
+type renderOptions struct {
+	output       string
+	timeout      time.Duration
+	jsonProgress bool
+	parallel     int
+
+	allSaves         bool
+	saveGlob         string
+	newerThan        time.Duration
+	includeAutosaves bool
+
+	skipUnchanged bool
+	force         bool
+
+	watch       string
+	minInterval time.Duration
+
+	every    time.Duration
+	schedule string
+
+	enableMods     []string
+	keepLogs       int
+	cleanOnFailure bool
+
+	keepLast int
+	keepDays int
+
+	downloadFactorio bool
+	factorioVersion  string
+
+	dryRun bool
+}
+
+func (ro *renderOptions) Register(flags *pflag.FlagSet) {
+	flags.StringVar(&ro.output, "output", "", "Directory where to move the mapshot once rendered, instead of leaving it in Factorio script-output. Its layout is the same - i.e., use it as --base_dir when serving.")
+	flags.DurationVar(&ro.timeout, "timeout", 0, "Maximum duration of the render; if exceeded, Factorio is stopped and the render fails. 0 means no limit.")
+	flags.BoolVar(&ro.jsonProgress, "json_progress", false, "If true, print progress as JSON objects on stdout, one per line, instead of a progress line.")
+	flags.IntVar(&ro.parallel, "parallel", 1, "When rendering multiple saves, how many Factorio instances to run at the same time.")
+	flags.BoolVar(&ro.allSaves, "all_saves", false, "If true, render all the saves of the Factorio saves directory, instead of those given as arguments.")
+	flags.StringVar(&ro.saveGlob, "save_glob", "", "With --all_saves, only render saves whose name - without .zip - matches this pattern; e.g., 'megabase-*'.")
+	flags.DurationVar(&ro.newerThan, "newer_than", 0, "With --all_saves, only render saves modified within that duration; e.g., 24h. 0 means no limit.")
+	flags.BoolVar(&ro.includeAutosaves, "include_autosaves", false, "With --all_saves, also render autosaves.")
+	flags.BoolVar(&ro.skipUnchanged, "skip_unchanged", false, "If true, do not render saves which did not change since their last render in the output directory.")
+	flags.BoolVar(&ro.force, "force", false, "If true, render even with --skip_unchanged.")
+	flags.StringVar(&ro.watch, "watch", "", "If set, keep running and render saves of the Factorio saves directory whenever they are updated; the value is the name of the save to watch, or a pattern - e.g., --watch='_autosave*'. --watch alone watches all saves.")
+	flags.Lookup("watch").NoOptDefVal = "*"
+	flags.DurationVar(&ro.minInterval, "min_interval", 0, "With --watch, minimum duration between the start of two renders of the same save; e.g., 30m. Updates in the meantime are rendered once it has elapsed. 0 means no limit.")
+	flags.DurationVar(&ro.every, "every", 0, "If set, keep running and render the saves at this interval; e.g., 6h. A render still running when the next one is due skips it. 0 to render only once.")
+	flags.StringVar(&ro.schedule, "schedule", "", "If set, keep running and render the saves at the times of this cron expression - minute, hour, day of month, month and day of week, in local time; e.g., '0 */6 * * *'. A render still running when the next one is due skips it.")
+	flags.BoolVar(&ro.cleanOnFailure, "clean_on_failure", false, "If true, remove what was written of the mapshot when the render fails.")
+	flags.IntVar(&ro.keepLogs, "keep_logs", 10, "How many logs of Factorio output to keep per save, in "+renderLogsDir+" of the output directory. 0 to keep them all.")
+	flags.IntVar(&ro.keepLast, "keep_last", 0, "After a successful render, remove older mapshots of the same save in the output directory beyond the last N - the new one included. Mapshots with a "+pinnedMarker+" file are never removed. 0 to keep them all.")
+	flags.IntVar(&ro.keepDays, "keep_days", 0, "After a successful render, remove mapshots of the same save in the output directory rendered more than that many days ago. With --keep_last, mapshots kept by either are kept. 0 to keep them all.")
+	flags.StringSliceVar(&ro.enableMods, "enable_mod", nil, "Name of a mod to enable for the render, even if it is disabled in Factorio mod list; e.g., to match the mods of the save. Can be repeated.")
+	flags.BoolVar(&ro.dryRun, "dry_run", false, "If true, only check the parameters and print what the render would do - Factorio binary & version, save, mods, output and mod settings - without starting Factorio.")
+	flags.BoolVar(&ro.downloadFactorio, "download_factorio", false, "If true, render with the full client of Factorio downloaded from factorio.com - kept in the user cache dir - instead of a local install. Needs $FACTORIO_USERNAME and $FACTORIO_TOKEN of an account owning the game. Linux only.")
+	flags.StringVar(&ro.factorioVersion, "factorio_version", "", "With --download_factorio, the version of Factorio to use - e.g., 1.1.110; once downloaded, no network access is needed. If empty, uses the latest stable version.")
+}
+
+// validate checks the options before starting Factorio.
+func (ro *renderOptions) validate() error {
+	if ro.parallel < 1 {
+		return fmt.Errorf("invalid --parallel %d: must be at least 1", ro.parallel)
+	}
+	if !ro.allSaves && (ro.saveGlob != "" || ro.newerThan != 0 || ro.includeAutosaves) {
+		return errors.New("--save_glob, --newer_than and --include_autosaves require --all_saves")
+	}
+	if _, err := filepath.Match(ro.saveGlob, ""); err != nil {
+		return fmt.Errorf("invalid --save_glob %q: %w", ro.saveGlob, err)
+	}
+	if ro.watch != "" && ro.allSaves {
+		return errors.New("--watch and --all_saves are mutually exclusive")
+	}
+	if _, err := filepath.Match(ro.watch, ""); err != nil {
+		return fmt.Errorf("invalid --watch %q: %w", ro.watch, err)
+	}
+	if ro.minInterval < 0 {
+		return fmt.Errorf("invalid --min_interval %v: must not be negative", ro.minInterval)
+	}
+	if ro.minInterval != 0 && ro.watch == "" {
+		return errors.New("--min_interval requires --watch")
+	}
+	if _, err := ro.parseSchedule(); err != nil {
+		return err
+	}
+	if ro.watch != "" && (ro.every != 0 || ro.schedule != "") {
+		return errors.New("--watch cannot be used with --every or --schedule")
+	}
+	if ro.dryRun && (ro.watch != "" || ro.every != 0 || ro.schedule != "") {
+		return errors.New("--dry_run cannot be used with --watch, --every or --schedule")
+	}
+	for _, mod := range ro.enableMods {
+		if mod == "" || mod == "mapshot" {
+			return fmt.Errorf("invalid --enable_mod %q", mod)
+		}
+	}
+	if ro.keepLogs < 0 {
+		return fmt.Errorf("invalid --keep_logs %d: must not be negative", ro.keepLogs)
+	}
+	if ro.keepLast < 0 {
+		return fmt.Errorf("invalid --keep_last %d: must not be negative", ro.keepLast)
+	}
+	if ro.keepDays < 0 {
+		return fmt.Errorf("invalid --keep_days %d: must not be negative", ro.keepDays)
+	}
+	if ro.newerThan < 0 {
+		return fmt.Errorf("invalid --newer_than %v: must not be negative", ro.newerThan)
+	}
+	if ro.timeout < 0 {
+		return fmt.Errorf("invalid --timeout %v: must not be negative", ro.timeout)
+	}
+	return nil
+}
+
+// setupDownload makes the render use a downloaded Factorio when
+// --download_factorio is set; never otherwise.
+func (ro *renderOptions) setupDownload(ctx context.Context, factorioSettings *factorio.Settings) error {
+	if !ro.downloadFactorio {
+		if ro.factorioVersion != "" {
+			return errors.New("--factorio_version requires --download_factorio")
+		}
+		return nil
+	}
+	version := ro.factorioVersion
+	if version == "" {
+		var err error
+		if version, err = factorio.LatestRelease(ctx); err != nil {
+			return err
+		}
+		logInfo("latest stable Factorio", "version", version)
+	}
+	// Do not download a version the mod cannot run on.
+	if want := modFactorioVersion(); want != "" && !strings.HasPrefix(version, want+".") {
+		return fmt.Errorf("Factorio %s is not supported by mapshot %s, whose mod requires Factorio %s; use --factorio_version to pick a %s.x version", version, embed.Version, want, want)
+	}
+	dir, err := factorio.Download(ctx, version)
+	if err != nil {
+		return err
+	}
+	logInfo("using downloaded Factorio", "version", version, "dir", dir)
+	return factorioSettings.UseInstall(dir)
+}
+
+// Value of the surface parameter of the mod to render all surfaces.
+const allSurfaces = "_all_"
+
+// parseArea checks the value of --area, returning what to give to the mod.
+// Rectangles are normalized, with the top left corner first.
+func parseArea(area string) (string, error) {
+	if area == "" || area == "all" || area == "entities" {
+		return area, nil
+	}
+	parts := strings.Split(area, ",")
+	if len(parts) != 4 {
+		return "", fmt.Errorf("invalid --area %q: must be all, entities or x1,y1,x2,y2", area)
+	}
+	var coords [4]float64
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", fmt.Errorf("invalid --area %q: %q is not a number", area, p)
+		}
+		coords[i] = v
+	}
+	x1, y1 := math.Min(coords[0], coords[2]), math.Min(coords[1], coords[3])
+	x2, y2 := math.Max(coords[0], coords[2]), math.Max(coords[1], coords[3])
+	if x1 == x2 || y1 == y2 {
+		return "", fmt.Errorf("invalid --area %q: rectangle is empty", area)
+	}
+	// No exponent, as the mod does not parse them.
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return strings.Join([]string{format(x1), format(y1), format(x2), format(y2)}, ","), nil
+}
+
+// validate checks the parameters before starting Factorio.
+func (rf *RenderFlags) validate() error {
+	if _, err := parseArea(rf.area); err != nil {
+		return err
+	}
+	// Same limits as the mod settings; tile sizes must be powers of 2 for
+	// the zoom levels to line up.
+	for _, ts := range []struct {
+		name  string
+		value int64
+	}{{"tilemin", rf.tilemin}, {"tilemax", rf.tilemax}} {
+		if ts.value != 0 && (ts.value < 16 || ts.value > 1024 || ts.value&(ts.value-1) != 0) {
+			return fmt.Errorf("invalid --%s %d: must be a power of 2 between 16 and 1024", ts.name, ts.value)
+		}
+	}
+	if rf.tilemin != 0 && rf.tilemax != 0 && rf.tilemin > rf.tilemax {
+		return fmt.Errorf("invalid --tilemin %d: must not be larger than --tilemax %d", rf.tilemin, rf.tilemax)
+	}
+	if rf.resolution != 0 && (rf.resolution < 16 || rf.resolution > 16384) {
+		return fmt.Errorf("invalid --resolution %d: must be between 16 and 16384", rf.resolution)
+	}
+	if rf.jpgquality < 0 || rf.jpgquality > 100 {
+		return fmt.Errorf("invalid --jpgquality %d: must be between 1 and 100", rf.jpgquality)
+	}
+	if rf.minjpgquality < -1 || rf.minjpgquality > 100 {
+		return fmt.Errorf("invalid --minjpgquality %d: must be between 0 and 100", rf.minjpgquality)
+	}
+	if rf.format != "" && rf.format != "jpg" && rf.format != "png" {
+		return fmt.Errorf("invalid --format %q: must be jpg or png", rf.format)
+	}
+	if rf.zoommin < -1 {
+		return fmt.Errorf("invalid --zoommin %d: must not be negative", rf.zoommin)
+	}
+	if rf.zoommax < -1 {
+		return fmt.Errorf("invalid --zoommax %d: must not be negative", rf.zoommax)
+	}
+	if rf.zoommin >= 0 && rf.zoommax >= 0 && rf.zoommin > rf.zoommax {
+		return fmt.Errorf("invalid --zoommin %d: must not be larger than --zoommax %d", rf.zoommin, rf.zoommax)
+	}
+	if rf.tilemin != 0 && rf.tilemax != 0 {
+		// Otherwise, the mod clamps them to the levels which exist.
+		levels := int64(0)
+		for ts := rf.tilemax; ts > rf.tilemin; ts /= 2 {
+			levels++
+		}
+		if rf.zoommin > levels || rf.zoommax > levels {
+			return fmt.Errorf("invalid zoom levels: with --tilemin %d and --tilemax %d, levels go from 0 to %d", rf.tilemin, rf.tilemax, levels)
+		}
+	}
+	if _, _, err := rf.parseModSettings(); err != nil {
+		return err
+	}
+	if rf.allSurfaces && len(rf.surface) > 0 {
+		return errors.New("--surface and --all_surfaces are mutually exclusive")
+	}
+	for _, name := range rf.surface {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("invalid --surface: empty name")
+		}
+		if name == allSurfaces {
+			return fmt.Errorf("invalid --surface %q: use --all_surfaces instead", name)
+		}
+	}
+	return nil
+}
+
 func (rf *RenderFlags) genOverrides() map[string]interface{} {
 	ov := map[string]interface{}{}
-	if rf.area != "" {
-		ov["area"] = rf.area
+	if area, _ := parseArea(rf.area); area != "" {
+		ov["area"] = area
 	}
 	if rf.tilemin != 0 {
 		ov["tilemin"] = rf.tilemin
@@ -64,11 +377,27 @@ func (rf *RenderFlags) genOverrides() map[string]interface{} {
 	if rf.jpgquality != 0 {
 		ov["jpgquality"] = rf.jpgquality
 	}
-	if rf.jpgquality != -1 {
+	if rf.minjpgquality != -1 {
 		ov["minjpgquality"] = rf.minjpgquality
 	}
-	if rf.surface != "" {
-		ov["surface"] = rf.surface
+	if rf.format != "" {
+		ov["format"] = rf.format
+	}
+	if rf.zoommin != -1 {
+		ov["zoommin"] = rf.zoommin
+	}
+	if rf.zoommax != -1 {
+		ov["zoommax"] = rf.zoommax
+	}
+	if rf.allSurfaces {
+		ov["surface"] = allSurfaces
+	} else if len(rf.surface) > 0 {
+		ov["surface"] = strings.Join(rf.surface, ",")
+	}
+	// Already checked by validate.
+	settings, _, _ := rf.parseModSettings()
+	for k, v := range settings {
+		ov[k] = v
 	}
 	return ov
 }
@@ -86,7 +415,7 @@ func copyMod(dstMapshot string) error {
 	return nil
 }
 
-func writeOverrides(data map[string]interface{}, dstPath string) error {
+func writeOverrides(data map[string]interface{}, dstPath string, out *renderOutput) error {
 	inline, err := json.Marshal(data)
 	if err != nil {
 		return err
@@ -96,68 +425,194 @@ func writeOverrides(data map[string]interface{}, dstPath string) error {
 	if err := ioutil.WriteFile(overridesFilename, []byte(overrides), 0644); err != nil {
 		return fmt.Errorf("unable to write overrides file %q: %w", overridesFilename, err)
 	}
-	glog.Infof("overrides file created at %q", overridesFilename)
+	out.logInfo("overrides file created", "path", overridesFilename)
 	return nil
 }
 
-func render(ctx context.Context, factorioSettings *factorio.Settings, rf *RenderFlags, rawname string) error {
+// saveName returns the name of the mapshot for the save given on the command
+// line.
+func saveName(rawname string) string {
+	// The parameter can be a filename, so extract a name.
+	name := filepath.Base(rawname)
+	return name[:len(name)-len(filepath.Ext(name))]
+}
+
+// renderJob is the render of a single save.
+type renderJob struct {
+	// As given on the command line.
+	rawname string
+	out     *renderOutput
+	// Run Factorio with its own write data directory, as other instances
+	// might be running.
+	isolate bool
+}
+
+// render creates the mapshot of a save, returning where it was written.
+func render(ctx context.Context, factorioSettings *factorio.Settings, rf *RenderFlags, ro *renderOptions, job *renderJob) (_ string, retErr error) {
+	rawname := job.rawname
+	out := job.out
+	if err := ro.validate(); err != nil {
+		return "", err
+	}
+	if err := rf.validate(); err != nil {
+		return "", err
+	}
 	fact, err := factorio.New(factorioSettings)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if err := fact.CheckRender(ctx); err != nil {
+		return "", err
+	}
+	// Already known by CheckRender.
+	version, err := fact.Version(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := checkFactorioVersion(version); err != nil {
+		return "", err
+	}
+	if ro.dryRun {
+		return dryRun(fact, version, rf, ro, job)
 	}
 
 	runID := uuid.New().String()
-	glog.Infof("runid: %s", runID)
+	out.logInfo("starting render", "runid", runID)
 
-	// The parameter can be a filename, so extract a name.
-	name := filepath.Base(rawname)
-	name = name[:len(name)-len(filepath.Ext(name))]
+	name := saveName(rawname)
 
-	tmpdir, cleanup := getWorkDir()
+	tmpdir, cleanup := getWorkDir(fact.TempDir())
 	defer cleanup()
 
+	// Instance of Factorio doing the render; it writes its output in
+	// a temporary script-output when isolated.
+	runFact := fact
+	if job.isolate {
+		if runFact, err = fact.Isolated(filepath.Join(tmpdir, "write")); err != nil {
+			return "", err
+		}
+	}
+	runFact.SetOutput(out)
+
+	progressFile := filepath.Join(runFact.ScriptOutput(), "mapshot-progress-"+runID)
+	defer func() {
+		err := os.Remove(progressFile)
+		out.logDebug("removed progress-file", "path", progressFile, "error", err)
+	}()
+	progress := newRenderProgress(name, runFact.ScriptOutput(), progressFile, ro.jsonProgress, out)
+	// Directory of the mapshot, once known from the done marker.
+	output := ""
+	defer func() {
+		if retErr != nil && !errors.Is(retErr, errUnchanged) {
+			progress.failed(retErr)
+			if ro.cleanOnFailure {
+				if progress.plan == nil {
+					if err := progress.loadPlan(); err != nil {
+						out.logWarning("unable to read the tiles planned by the mod", "error", err)
+					}
+				}
+				cleanPartial(runFact.ScriptOutput(), output, progress.plan, out)
+			}
+		}
+	}()
+
+	// Where the mapshot ends up; past renders are recorded there.
+	dstRoot := ro.output
+	if dstRoot == "" {
+		dstRoot = fact.ScriptOutput()
+	} else if err := os.MkdirAll(dstRoot, 0755); err != nil {
+		// Before rendering, rather than failing once done.
+		return "", fmt.Errorf("invalid --output: %w", err)
+	}
+
 	// Copy game save
 	srcSavegame, err := fact.FindSaveFile(rawname)
 	if err != nil {
-		return fmt.Errorf("unable to find savegame %q: %w", rawname, err)
+		return "", fmt.Errorf("unable to find savegame %q: %w", rawname, err)
+	}
+	fp, err := newSaveFingerprint(srcSavegame)
+	if err != nil {
+		return "", fmt.Errorf("unable to read savegame %q: %w", srcSavegame, err)
+	}
+	if ro.skipUnchanged && !ro.force {
+		prev, err := lastRender(dstRoot, name, fp)
+		if err != nil {
+			out.logWarning("unable to check previous renders; rendering anyway", "error", err)
+		} else if prev != "" {
+			out.Printf("No changes in %s since last render, skipping; mapshot is in %s\n", srcSavegame, prev)
+			progress.skipped(prev)
+			return prev, errUnchanged
+		}
+	}
+	out.Printf("Generating mapshot %q using file %s\n", name, srcSavegame)
+	rlog, err := newRenderLog(dstRoot, name, ro.keepLogs)
+	if err != nil {
+		out.logWarning("unable to create log file for Factorio output", "error", err)
+	} else {
+		defer rlog.Close()
+		runFact.SetLog(rlog)
+		out.logInfo("logging Factorio output", "path", rlog.path)
+	}
+	if rf.format == "png" {
+		out.Println("Warning: png tiles are typically several times larger than jpg ones; make sure there is enough disk space.")
 	}
-	fmt.Printf("Generating mapshot %q using file %s\n", name, srcSavegame)
 
 	dstSavegame := filepath.Join(tmpdir, name+".zip")
 	if err := copy.Copy(srcSavegame, dstSavegame); err != nil {
-		return fmt.Errorf("unable to copy file %q: %w", srcSavegame, err)
+		return "", fmt.Errorf("unable to copy file %q: %w", srcSavegame, err)
 	}
-	glog.Infof("copied save from %q to %q", srcSavegame, dstSavegame)
+	// Record the content which was actually rendered, in case the save is
+	// written to in the meantime.
+	fp.path = dstSavegame
+	out.logInfo("copied save", "from", srcSavegame, "to", dstSavegame)
 
-	// Copy mods
+	// Copy mods. Factorio is pointed to that copy with --mod-directory, so
+	// the mod-list.json of the user is never modified - nothing needs to be
+	// restored, even if the render is interrupted.
 	dstMods := filepath.Join(tmpdir, "mods")
 	if err := fact.CopyMods(dstMods, []string{"mapshot"}); err != nil {
-		return err
+		return "", err
 	}
 
 	// Add the mod itself.
 	dstMapshot := filepath.Join(dstMods, "mapshot")
 	if err := copyMod(dstMapshot); err != nil {
-		return err
+		return "", err
 	}
 	if err := factorio.EnableMod(dstMods, "mapshot"); err != nil {
-		return err
+		return "", err
+	}
+	for _, mod := range ro.enableMods {
+		if !factorio.HasMod(dstMods, mod) {
+			return "", fmt.Errorf("unable to enable mod %q: not found in %s", mod, fact.ModsDir())
+		}
+		if err := factorio.EnableMod(dstMods, mod); err != nil {
+			return "", err
+		}
+		out.logInfo("mod enabled", "name", mod)
 	}
-	glog.Infof("mod created at %q", dstMapshot)
+	out.logInfo("mod created", "path", dstMapshot)
 
 	// Generates overrides to the parameters. This is done by creating a Lua
 	// file, as mods don't have any way of loading data.
 	overridesData := rf.genOverrides()
+	if _, unknown, _ := rf.parseModSettings(); len(unknown) > 0 {
+		out.logWarning("unknown mod settings given with --mod_setting", "keys", strings.Join(unknown, ","), "valid", modSettingNames())
+	}
 	overridesData["onstartup"] = runID
 	overridesData["savename"] = name
-	if err := writeOverrides(overridesData, dstMapshot); err != nil {
-		return err
+	overridesData["factorio_version"] = version.String()
+	if err := writeOverrides(overridesData, dstMapshot, out); err != nil {
+		return "", err
 	}
 
 	// Remove done marker if still present
-	doneFile := filepath.Join(fact.ScriptOutput(), "mapshot-done-"+runID)
+	doneFile := filepath.Join(runFact.ScriptOutput(), "mapshot-done-"+runID)
 	err = os.Remove(doneFile)
-	glog.Infof("removed done-file %q: %v", doneFile, err)
+	out.logDebug("removed done-file", "path", doneFile, "error", err)
+	// Written by the mod instead of the done marker when it cannot render.
+	errorFile := filepath.Join(runFact.ScriptOutput(), "mapshot-error-"+runID)
+	defer os.Remove(errorFile)
 
 	factorioArgs := []string{
 		"--disable-audio",
@@ -166,11 +621,15 @@ func render(ctx context.Context, factorioSettings *factorio.Settings, rf *Render
 	}
 
 	execCtx, cancel := context.WithCancel(ctx)
+	if ro.timeout > 0 {
+		execCtx, cancel = context.WithTimeout(ctx, ro.timeout)
+	}
 	defer cancel()
 	errCh := make(chan error)
-	fmt.Println("Starting Factorio...")
+	out.Println("Starting Factorio...")
+	progress.started()
 	go func() {
-		errCh <- fact.Run(execCtx, factorioArgs)
+		errCh <- runFact.Run(execCtx, factorioArgs)
 	}()
 
 	// Wait for the `done` file to be created, indicating that the work is
@@ -178,58 +637,304 @@ func render(ctx context.Context, factorioSettings *factorio.Settings, rf *Render
 	for {
 		_, err := os.Stat(doneFile)
 		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("unable to stat file %q: %w", doneFile, err)
+			return "", fmt.Errorf("unable to stat file %q: %w", doneFile, err)
 		}
 		if err == nil {
 			cancel()
 			break
 		}
+		if modErr := readModError(errorFile); modErr != nil {
+			cancel()
+			<-errCh
+			return "", modErr
+		}
+		if msg := rlog.modFailure(); msg != "" {
+			cancel()
+			<-errCh
+			return "", fmt.Errorf("the mapshot mod failed; see %s:\n%s", rlog.path, msg)
+		}
+		progress.update()
 
 		// Context cancellation should terminate Factorio, which is detected
 		// through errCh, so no need to wait on context.
 		select {
 		case <-time.After(time.Second):
 		case err := <-errCh:
+			if errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+				return "", timeoutError(runFact, rlog, ro.timeout)
+			}
 			if err == nil {
-				return errors.New("factorio exited early")
+				return "", rlog.withTail(errors.New("factorio exited early"))
 			}
-			return fmt.Errorf("factorio exited early: %w", err)
+			return "", rlog.withTail(fmt.Errorf("factorio exited early: %w", err))
 		}
 	}
-	glog.Infof("done file %q now exists", doneFile)
+	progress.update()
+	out.logInfo("done file now exists", "path", doneFile)
 	rawDone, err := ioutil.ReadFile(doneFile)
 	if err != nil {
-		return fmt.Errorf("unable to read file %q: %w", doneFile, err)
+		return "", fmt.Errorf("unable to read file %q: %w", doneFile, err)
 	}
 	resultPrefix := string(rawDone)
-	glog.Infof("output at %s", resultPrefix)
-	fmt.Println("Output:", filepath.Join(fact.ScriptOutput(), resultPrefix))
+	out.logInfo("render done", "output", resultPrefix)
 
 	// Cleaning up done file now that we've read it.
 	err = os.Remove(doneFile)
-	glog.Infof("removed done-file %q: %v", doneFile, err)
+	out.logDebug("removed done-file", "path", doneFile, "error", err)
 
 	// Wait for Factorio to terminate.
 	err = <-errCh
+	output = filepath.Join(runFact.ScriptOutput(), filepath.FromSlash(resultPrefix))
+	if msg := rlog.modFailure(); msg != "" {
+		return "", fmt.Errorf("the mapshot mod failed; see %s:\n%s", rlog.path, msg)
+	}
+	if err != nil {
+		out.logWarning("Factorio finished with an error; ignoring as rendering was done", "error", err)
+	}
+
+	if err := checkMetadata(output, rf, progress.plan, out); err != nil {
+		return "", err
+	}
+	// When isolated, the temporary script-output is removed with the work
+	// directory.
+	if ro.output != "" || job.isolate {
+		dst := filepath.Join(dstRoot, filepath.FromSlash(resultPrefix))
+		out.Printf("Moving mapshot to %s ...\n", dst)
+		if err := moveResult(runFact.ScriptOutput(), dstRoot, resultPrefix, out); err != nil {
+			if job.isolate {
+				return "", fmt.Errorf("unable to move mapshot to %s: %w", dstRoot, err)
+			}
+			return "", fmt.Errorf("unable to move mapshot to --output; it is still in %s: %w", output, err)
+		}
+		output = dst
+	}
+	if err := recordRender(dstRoot, name, fp, resultPrefix); err != nil {
+		out.logWarning("unable to record render; --skip_unchanged will not know about it", "error", err)
+	}
+	progress.finished(output)
+	out.Println("Output:", output)
+	pruneRenders(dstRoot, output, ro, out)
+	return output, nil
+}
+
+// RenderErrorJSON is written by the mod, as `mapshot-error-<runid>`, when it
+// cannot start the render.
+type RenderErrorJSON struct {
+	Error             string   `json:"error"`
+	UnknownSurfaces   []string `json:"unknown_surfaces"`
+	AvailableSurfaces []string `json:"available_surfaces"`
+}
+
+// readModError returns the error reported by the mod, if any.
+func readModError(errorFile string) error {
+	raw, err := ioutil.ReadFile(errorFile)
 	if err != nil {
-		glog.Warningf("Factorio finished with an error; ignoring as rendering was done. Error: %v", err)
+		// Most likely, it does not exist - i.e., no error.
+		return nil
+	}
+	data := &RenderErrorJSON{}
+	if err := json.Unmarshal(raw, data); err != nil {
+		// Might be partially written; will be checked again.
+		return nil
 	}
+	if len(data.UnknownSurfaces) > 0 {
+		return fmt.Errorf("unknown surface(s) %s; the save has: %s", strings.Join(data.UnknownSurfaces, ", "), strings.Join(data.AvailableSurfaces, ", "))
+	}
+	return fmt.Errorf("render failed: %s", data.Error)
+}
 
+// checkMetadata verifies that the mapshot metadata lists rendered surfaces,
+// as expected by the viewer & server, and that their tiles exist and match its
+// format.
+func checkMetadata(output string, rf *RenderFlags, plan *ProgressPlanJSON, out *renderOutput) error {
+	p := filepath.Join(output, "mapshot.json")
+	raw, err := ioutil.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("unable to read mapshot metadata: %w", err)
+	}
+	data, err := parseMapshotJSON(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	if len(data.Surfaces) == 0 {
+		return fmt.Errorf("no surface was rendered; see %s for details", p)
+	}
+	rendered := map[string]bool{}
+	var names []string
+	for _, surface := range data.Surfaces {
+		rendered[surface.SurfaceName] = true
+		names = append(names, surface.SurfaceName)
+	}
+	for _, name := range rf.surface {
+		if name = strings.TrimSpace(name); !rendered[name] {
+			// E.g., no chunk in the requested area.
+			out.logWarning("requested surface is not part of the mapshot", "surface", name)
+		}
+	}
+	out.logInfo("surfaces rendered", "surfaces", strings.Join(names, ","))
+	if err := checkTiles(output, data, plan); err != nil {
+		return err
+	}
+	return checkTileFormat(output, data.TileFormat)
+}
+
+// checkTiles verifies that each zoom level of the mapshot has its tiles: as
+// many as the mod requested when known, at least one otherwise - e.g., when
+// Factorio could not write them.
+func checkTiles(output string, data *MapshotJSON, plan *ProgressPlanJSON) error {
+	// Number of tiles, by name of the layer directory.
+	expected := map[string]int{}
+	if plan != nil {
+		for _, l := range plan.Layers {
+			expected[path.Base(l.Path)] = l.Tiles
+		}
+	}
+	for _, surface := range data.Surfaces {
+		for zoom := surface.ZoomMin; zoom <= surface.ZoomMax; zoom++ {
+			dir := fmt.Sprintf("s%dzoom_%d", surface.SurfaceIdx, zoom)
+			want, known := expected[dir]
+			if known && want == 0 {
+				// E.g., nothing to render with minjpgquality=0.
+				continue
+			}
+			count := 0
+			entries, _ := ioutil.ReadDir(filepath.Join(output, dir))
+			for _, e := range entries {
+				if !e.IsDir() && strings.HasPrefix(e.Name(), "tile_") {
+					count++
+				}
+			}
+			if !known && count == 0 {
+				return fmt.Errorf("no tile was written for surface %s, zoom %d, in %s", surface.SurfaceName, zoom, output)
+			}
+			if count < want {
+				return fmt.Errorf("only %d of %d tiles were written for surface %s, zoom %d, in %s", count, want, surface.SurfaceName, zoom, output)
+			}
+		}
+	}
+	return nil
+}
+
+// cleanPartial removes the mapshot of a failed render with
+// --clean_on_failure; its location comes from the done marker, or is
+// derived from the tiles the mod planned to write.
+func cleanPartial(scriptOutput string, output string, plan *ProgressPlanJSON, out *renderOutput) {
+	if output == "" && plan != nil && len(plan.Layers) > 0 {
+		// Layers are in the directory of the mapshot.
+		output = filepath.Join(scriptOutput, filepath.FromSlash(path.Dir(path.Clean(plan.Layers[0].Path))))
+	}
+	if output == "" {
+		out.logInfo("nothing written yet by the failed render")
+		return
+	}
+	if err := os.RemoveAll(output); err != nil {
+		out.logWarning("unable to remove partial mapshot", "path", output, "error", err)
+		return
+	}
+	out.Printf("Removed partial mapshot %s\n", output)
+}
+
+// checkTileFormat makes sure all the tiles of the mapshot have the format of
+// its metadata - e.g., a render with a different format did not write in the
+// directory of a previous one; the viewer would only show some of the tiles.
+func checkTileFormat(output string, format string) error {
+	if format == "" {
+		format = "jpg"
+	}
+	entries, err := ioutil.ReadDir(output)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !layerDirRE.MatchString(e.Name()) {
+			continue
+		}
+		tiles, err := ioutil.ReadDir(filepath.Join(output, e.Name()))
+		if err != nil {
+			return err
+		}
+		for _, t := range tiles {
+			if ext := strings.TrimPrefix(filepath.Ext(t.Name()), "."); ext != format {
+				return fmt.Errorf("mapshot %s mixes tile formats: %s is not %s, as in mapshot.json", output, filepath.Join(e.Name(), t.Name()), format)
+			}
+		}
+	}
 	return nil
 }
 
+// timeoutError describes a render which did not finish in time, including
+// the end of the Factorio output to help figure out where it got stuck - from
+// Factorio own log if there is no log of the render.
+func timeoutError(fact *factorio.Factorio, rlog *renderLog, timeout time.Duration) error {
+	if rlog != nil {
+		return rlog.withTail(fmt.Errorf("render did not finish within --timeout=%v", timeout))
+	}
+	tail, err := fact.LogTail(logTailLines)
+	if err != nil {
+		return fmt.Errorf("render did not finish within --timeout=%v; unable to read Factorio log: %v", timeout, err)
+	}
+	return fmt.Errorf("render did not finish within --timeout=%v; last lines of %s:\n%s", timeout, fact.LogFile(), tail)
+}
+
 var cmdRender = &cobra.Command{
-	Use:   "render",
-	Short: "Create a screenshot from a save.",
-	Args:  cobra.ExactArgs(1),
+	Use:   "render [save...] [-- factorio args...]",
+	Short: "Create a screenshot from one or more saves.",
+	Args:  cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return render(cmd.Context(), factorioSettings, renderFlags, args[0])
+		// Everything after `--` goes to Factorio as is.
+		if n := cmd.ArgsLenAtDash(); n >= 0 {
+			factorioSettings.AddArgs(args[n:]...)
+			args = args[:n]
+		}
+		// Factorio runs in its own process group, so it does not get Ctrl+C
+		// from the terminal; it is stopped through the context instead.
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := renderOpts.setupDownload(ctx, factorioSettings); err != nil {
+			return err
+		}
+		if renderOpts.watch != "" {
+			if len(args) > 0 {
+				return errors.New("saves cannot be given as arguments with --watch; use --watch=<save>")
+			}
+			return renderWatch(ctx, factorioSettings, renderFlags, renderOpts)
+		}
+		schedule, err := renderOpts.parseSchedule()
+		if err != nil {
+			return err
+		}
+		if renderOpts.allSaves {
+			if len(args) > 0 {
+				return errors.New("saves cannot be given as arguments with --all_saves")
+			}
+		} else if len(args) == 0 {
+			return errors.New("no save to render; give at least one, or use --all_saves")
+		}
+		if schedule != nil {
+			return renderScheduled(ctx, factorioSettings, renderFlags, renderOpts, schedule, args)
+		}
+		saves := args
+		if renderOpts.allSaves {
+			if saves, err = renderOpts.findSaves(factorioSettings); err != nil {
+				return err
+			}
+		}
+
+		err = renderAll(ctx, factorioSettings, renderFlags, renderOpts, saves)
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		return err
 	},
 }
 
-var renderFlags = &RenderFlags{}
+var (
+	renderFlags = &RenderFlags{}
+	renderOpts  = &renderOptions{}
+)
 
 func init() {
 	renderFlags.Register(cmdRender.PersistentFlags(), "")
+	renderOpts.Register(cmdRender.PersistentFlags())
 	cmdRoot.AddCommand(cmdRender)
 }
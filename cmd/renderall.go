@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Palats/mapshot/factorio"
+)
+
+// stdoutMu serializes writes on stdout from concurrent renders, so lines do
+// not get mixed.
+var stdoutMu sync.Mutex
+
+// renderOutput is where a render prints messages. When rendering multiple
+// saves, each line is prefixed with the name of the save, and logs get
+// a `save` field.
+type renderOutput struct {
+	prefix string
+	fields []interface{}
+
+	// Incomplete line written through Write.
+	m       sync.Mutex
+	partial []byte
+}
+
+// newRenderOutput creates the output for the render of the named save;
+// prefixed indicates whether to tell apart its messages from those of other
+// renders.
+func newRenderOutput(name string, prefixed bool) *renderOutput {
+	if !prefixed {
+		return &renderOutput{}
+	}
+	return &renderOutput{
+		prefix: "[" + name + "] ",
+		fields: []interface{}{"save", name},
+	}
+}
+
+// raw writes directly on stdout, without prefix.
+func (o *renderOutput) raw(s string) {
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	os.Stdout.WriteString(s)
+}
+
+func (o *renderOutput) print(s string) {
+	if o.prefix == "" {
+		o.raw(s)
+		return
+	}
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line != "" {
+			b.WriteString(o.prefix + line)
+		}
+	}
+	o.raw(b.String())
+}
+
+func (o *renderOutput) Printf(format string, args ...interface{}) {
+	o.print(fmt.Sprintf(format, args...))
+}
+
+func (o *renderOutput) Println(args ...interface{}) {
+	o.print(fmt.Sprintln(args...))
+}
+
+// Write implements io.Writer, for Factorio output; only complete lines are
+// printed.
+func (o *renderOutput) Write(b []byte) (int, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.partial = append(o.partial, b...)
+	if idx := strings.LastIndexByte(string(o.partial), '\n'); idx >= 0 {
+		o.print(string(o.partial[:idx+1]))
+		o.partial = append([]byte{}, o.partial[idx+1:]...)
+	}
+	return len(b), nil
+}
+
+func (o *renderOutput) logDebug(msg string, fields ...interface{}) {
+	logDebug(msg, append(fields, o.fields...)...)
+}
+
+func (o *renderOutput) logInfo(msg string, fields ...interface{}) {
+	logInfo(msg, append(fields, o.fields...)...)
+}
+
+func (o *renderOutput) logWarning(msg string, fields ...interface{}) {
+	logWarning(msg, append(fields, o.fields...)...)
+}
+
+// Prefix of the names of saves created by Factorio itself.
+const autosavePrefix = "_autosave"
+
+// findSaves returns the saves to render with --all_saves.
+func (ro *renderOptions) findSaves(factorioSettings *factorio.Settings) ([]string, error) {
+	if err := ro.validate(); err != nil {
+		return nil, err
+	}
+	fact, err := factorio.New(factorioSettings)
+	if err != nil {
+		return nil, err
+	}
+	saves, err := fact.ListSaves()
+	if err != nil {
+		return nil, err
+	}
+	var paths, names []string
+	for _, sv := range saves {
+		if !ro.includeAutosaves && strings.HasPrefix(sv.Name, autosavePrefix) {
+			continue
+		}
+		if ro.saveGlob != "" {
+			if ok, _ := filepath.Match(ro.saveGlob, sv.Name); !ok {
+				continue
+			}
+		}
+		if ro.newerThan > 0 && time.Since(sv.ModTime) > ro.newerThan {
+			continue
+		}
+		paths = append(paths, sv.Path)
+		names = append(names, sv.Name)
+	}
+	dir := filepath.Join(fact.DataDir(), factorio.SavesDir)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no save to render found in %s", dir)
+	}
+	fmt.Printf("Found %d saves to render in %s: %s\n", len(paths), dir, strings.Join(names, ", "))
+	return paths, nil
+}
+
+// renderResult is the outcome of the render of one save.
+type renderResult struct {
+	name     string
+	output   string
+	err      error
+	duration time.Duration
+}
+
+// renderAll renders each of the saves, with up to --parallel instances of
+// Factorio at once. A failed render does not prevent the others.
+func renderAll(ctx context.Context, factorioSettings *factorio.Settings, rf *RenderFlags, ro *renderOptions, saves []string) error {
+	if len(saves) == 1 {
+		_, err := render(ctx, factorioSettings, rf, ro, &renderJob{
+			rawname: saves[0],
+			out:     newRenderOutput(saveName(saves[0]), false),
+		})
+		return err
+	}
+	if err := ro.validate(); err != nil {
+		return err
+	}
+	if err := rf.validate(); err != nil {
+		return err
+	}
+	seen := map[string]string{}
+	for _, save := range saves {
+		name := saveName(save)
+		if prev, ok := seen[name]; ok {
+			return fmt.Errorf("saves %q and %q would both render as mapshot %q", prev, save, name)
+		}
+		seen[name] = save
+	}
+
+	results := make([]*renderResult, len(saves))
+	sem := make(chan struct{}, ro.parallel)
+	var wg sync.WaitGroup
+	for i, save := range saves {
+		wg.Add(1)
+		go func(i int, save string) {
+			defer wg.Done()
+			name := saveName(save)
+			res := &renderResult{name: name}
+			results[i] = res
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				res.err = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			res.output, res.err = render(ctx, factorioSettings, rf, ro, &renderJob{
+				rawname: save,
+				out:     newRenderOutput(name, true),
+				isolate: ro.parallel > 1,
+			})
+			res.duration = time.Since(start).Round(time.Second)
+			if res.err != nil && !errors.Is(res.err, errUnchanged) {
+				logError("render failed", "save", name, "error", res.err)
+			}
+		}(i, save)
+	}
+	wg.Wait()
+
+	failed := 0
+	stdoutMu.Lock()
+	fmt.Println("Summary:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, res := range results {
+		if errors.Is(res.err, errUnchanged) {
+			fmt.Fprintf(tw, "  %s\tUNCHANGED\t%v\t%s\n", res.name, res.duration, res.output)
+			continue
+		}
+		if res.err != nil {
+			failed++
+			// Only the first line, as details were already logged.
+			msg := strings.SplitN(res.err.Error(), "\n", 2)[0]
+			fmt.Fprintf(tw, "  %s\tFAILED\t%v\t%s\n", res.name, res.duration, msg)
+			continue
+		}
+		fmt.Fprintf(tw, "  %s\tOK\t%v\t%s\n", res.name, res.duration, res.output)
+	}
+	tw.Flush()
+	stdoutMu.Unlock()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d renders failed", failed, len(saves))
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Palats/mapshot/factorio"
+)
+
+// Directory of the output directory - script-output or --output - where the
+// output of Factorio is logged for each render.
+const renderLogsDir = ".mapshot-logs"
+
+// How many lines of Factorio output to include in errors.
+const logTailLines = 50
+
+// renderLog is the file receiving Factorio output during a render, named
+// after the save and the time of the render.
+type renderLog struct {
+	path string
+
+	// stdout & stderr are written concurrently.
+	m sync.Mutex
+	f *os.File
+
+	// How much of the file was looked at by modFailure, and what it found.
+	scanned int64
+	failure string
+}
+
+// newRenderLog creates the log file for a render of the named save,
+// removing the oldest ones of that save to keep at most keep of them - unless
+// keep is 0.
+func newRenderLog(root string, name string, keep int) (*renderLog, error) {
+	dir := filepath.Join(root, renderLogsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	p := filepath.Join(dir, fmt.Sprintf("%s-%s.log", name, time.Now().Format("20060102-150405")))
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if keep > 0 {
+		if err := pruneRenderLogs(dir, name, keep); err != nil {
+			logWarning("unable to remove old logs", "dir", dir, "error", err)
+		}
+	}
+	return &renderLog{path: p, f: f}, nil
+}
+
+// pruneRenderLogs removes the oldest logs of the save, keeping the last keep
+// ones.
+func pruneRenderLogs(dir string, name string, keep int) error {
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(name) + `-\d{8}-\d{6}\.log$`)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var logs []string
+	for _, e := range entries {
+		if !e.IsDir() && re.MatchString(e.Name()) {
+			logs = append(logs, e.Name())
+		}
+	}
+	// Timestamps sort in chronological order.
+	sort.Strings(logs)
+	for len(logs) > keep {
+		p := filepath.Join(dir, logs[0])
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		logDebug("removed old log", "path", p)
+		logs = logs[1:]
+	}
+	return nil
+}
+
+func (l *renderLog) Write(b []byte) (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.f.Write(b)
+}
+
+func (l *renderLog) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.f.Close()
+}
+
+// Lines of Factorio output telling that the mod failed: the error itself, or
+// a Lua error location - which, unlike messages logged by the mod, are not
+// prefixed with `@`.
+var modFailureRE = regexp.MustCompile(`(?i)mod mapshot .*caused a non-recoverable error|error while running event mapshot::|(?:^|[^@])__mapshot__/\S+\.lua:\d+:`)
+
+// How many lines of Factorio output to show from the failure.
+const modFailureLines = 15
+
+// modFailure looks at what Factorio wrote since the last call for signs of an
+// error in the mod, and returns the corresponding lines; "" if there is none.
+// Factorio does not exit in that case - it shows the error and stays there.
+func (l *renderLog) modFailure() string {
+	if l == nil {
+		return ""
+	}
+	if l.failure != "" {
+		return l.failure
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if _, err := f.Seek(l.scanned, io.SeekStart); err != nil {
+		return ""
+	}
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		return ""
+	}
+	// Only complete lines; the rest is looked at next time.
+	end := bytes.LastIndexByte(raw, '\n')
+	if end < 0 {
+		return ""
+	}
+	raw = raw[:end+1]
+	lines := strings.Split(string(raw), "\n")
+	for i, line := range lines {
+		if modFailureRE.MatchString(line) {
+			last := i + modFailureLines
+			if last > len(lines) {
+				last = len(lines)
+			}
+			l.failure = strings.TrimRight(strings.Join(lines[i:last], "\n"), "\n")
+			return l.failure
+		}
+	}
+	l.scanned += int64(len(raw))
+	return ""
+}
+
+// withTail adds the end of the Factorio output to the error of a failed
+// render. Without log, the error is unchanged.
+func (l *renderLog) withTail(err error) error {
+	if l == nil {
+		return err
+	}
+	tail, terr := factorio.TailFile(l.path, logTailLines)
+	if terr != nil {
+		return fmt.Errorf("%w; Factorio output is in %s", err, l.path)
+	}
+	return fmt.Errorf("%w; last lines of Factorio output, from %s:\n%s", err, l.path, tail)
+}
@@ -0,0 +1,318 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Palats/mapshot/factorio"
+)
+
+// Directory of the output directory - script-output or --output - where each
+// running `render --every/--schedule` writes its status, for `serve`.
+const scheduleStatusDir = ".mapshot-schedules"
+
+// ScheduleStatusJSON is the status of a running `render` with --every or
+// --schedule.
+type ScheduleStatusJSON struct {
+	Schedule string `json:"schedule"`
+	// Saves as given on the command line; empty with --all_saves.
+	Saves    []string  `json:"saves,omitempty"`
+	AllSaves bool      `json:"all_saves,omitempty"`
+	PID      int       `json:"pid"`
+	Started  time.Time `json:"started"`
+	// Set while a render is in progress.
+	Running bool `json:"running"`
+	// Unset until the first render has finished.
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	// ok, unchanged or failed.
+	LastOutcome string    `json:"last_outcome,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextRun     time.Time `json:"next_run"`
+	// Renders not started as the previous one was still running.
+	Skipped int `json:"skipped,omitempty"`
+}
+
+// APISchedulesJSON is the response of /api/schedules.
+type APISchedulesJSON struct {
+	Schedules []*ScheduleStatusJSON `json:"schedules"`
+}
+
+// parseSchedule returns the schedule of --every or --schedule; nil if none is
+// set.
+func (ro *renderOptions) parseSchedule() (renderSchedule, error) {
+	if ro.every != 0 && ro.schedule != "" {
+		return nil, errors.New("--every and --schedule are mutually exclusive")
+	}
+	if ro.every < 0 {
+		return nil, fmt.Errorf("invalid --every %v: must not be negative", ro.every)
+	}
+	if ro.every > 0 {
+		if ro.every < time.Minute {
+			return nil, fmt.Errorf("invalid --every %v: must be at least 1m", ro.every)
+		}
+		return intervalSchedule(ro.every), nil
+	}
+	if ro.schedule != "" {
+		return parseCron(ro.schedule)
+	}
+	return nil, nil
+}
+
+// scheduledRender runs renders on a schedule.
+type scheduledRender struct {
+	factorioSettings *factorio.Settings
+	rf               *RenderFlags
+	ro               *renderOptions
+	schedule         renderSchedule
+	saves            []string
+	// File where the status is written; empty if it cannot be.
+	statusFile string
+
+	m      sync.Mutex
+	status *ScheduleStatusJSON
+}
+
+// renderScheduled renders the saves - those of the saves directory with
+// --all_saves - each time the schedule says so, until the context is
+// cancelled. A render still running when the next one is due skips it.
+// Failed renders are logged, and do not stop the
+// schedule.
+func renderScheduled(ctx context.Context, factorioSettings *factorio.Settings, rf *RenderFlags, ro *renderOptions, schedule renderSchedule, saves []string) error {
+	if err := ro.validate(); err != nil {
+		return err
+	}
+	if err := rf.validate(); err != nil {
+		return err
+	}
+	fact, err := factorio.New(factorioSettings)
+	if err != nil {
+		return err
+	}
+	sr := &scheduledRender{
+		factorioSettings: factorioSettings,
+		rf:               rf,
+		ro:               ro,
+		schedule:         schedule,
+		saves:            saves,
+		status: &ScheduleStatusJSON{
+			Schedule: schedule.String(),
+			Saves:    saves,
+			AllSaves: ro.allSaves,
+			PID:      os.Getpid(),
+			Started:  time.Now(),
+		},
+	}
+	dstRoot := ro.output
+	if dstRoot == "" {
+		dstRoot = fact.ScriptOutput()
+	}
+	dir := filepath.Join(dstRoot, scheduleStatusDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logWarning("unable to create directory for the schedule status; it is only logged", "error", err)
+	} else {
+		sr.statusFile = filepath.Join(dir, strconv.Itoa(os.Getpid())+".json")
+		defer func() {
+			if err := os.Remove(sr.statusFile); err != nil && !os.IsNotExist(err) {
+				logWarning("unable to remove schedule status", "path", sr.statusFile, "error", err)
+			}
+		}()
+	}
+
+	next := schedule.next(time.Now())
+	if _, ok := schedule.(intervalSchedule); ok {
+		// Intervals start with a render.
+		next = time.Now()
+	}
+	if next.IsZero() {
+		return fmt.Errorf("schedule %q never matches", schedule)
+	}
+	done := make(chan struct{}, 1)
+	running := false
+	for {
+		sr.update(func(st *ScheduleStatusJSON) { st.NextRun = next })
+		logInfo("next scheduled render", "at", next.Format(time.RFC3339), "schedule", schedule)
+		timer := time.NewTimer(time.Until(next))
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				if running {
+					// The render sees the cancellation too, and stops Factorio.
+					<-done
+				}
+				fmt.Println("Stopped scheduled renders.")
+				return nil
+			case <-done:
+				running = false
+			case <-timer.C:
+				break wait
+			}
+		}
+		// Based on the time it was due, so the schedule does not drift; due
+		// times missed altogether - e.g., during a suspend - are dropped.
+		prev := next
+		if next = schedule.next(prev); !next.IsZero() && next.Before(time.Now()) {
+			next = schedule.next(time.Now())
+		}
+		if next.IsZero() {
+			return fmt.Errorf("schedule %q does not match anymore", schedule)
+		}
+		if running {
+			logWarning("previous render still running, skipping this one", "due", prev.Format(time.RFC3339))
+			sr.update(func(st *ScheduleStatusJSON) { st.Skipped++ })
+			continue
+		}
+		running = true
+		go func() {
+			sr.run(ctx)
+			done <- struct{}{}
+		}()
+	}
+}
+
+// run does one render of the saves, recording its outcome.
+func (sr *scheduledRender) run(ctx context.Context) {
+	sr.update(func(st *ScheduleStatusJSON) { st.Running = true })
+	start := time.Now()
+	err := sr.render(ctx)
+	if ctx.Err() != nil {
+		// Interrupted; not a failure of the render itself.
+		sr.update(func(st *ScheduleStatusJSON) { st.Running = false })
+		return
+	}
+	duration := time.Since(start).Round(time.Second)
+	outcome := "ok"
+	switch {
+	case errors.Is(err, errUnchanged):
+		outcome = "unchanged"
+		err = nil
+	case err != nil:
+		outcome = "failed"
+	}
+	if err != nil {
+		logError("scheduled render failed", "duration", duration, "error", err)
+	} else {
+		logInfo("scheduled render done", "outcome", outcome, "duration", duration)
+	}
+	sr.update(func(st *ScheduleStatusJSON) {
+		st.Running = false
+		st.LastRun = &start
+		st.LastDuration = duration.String()
+		st.LastOutcome = outcome
+		st.LastError = ""
+		if err != nil {
+			st.LastError = err.Error()
+		}
+	})
+}
+
+func (sr *scheduledRender) render(ctx context.Context) error {
+	saves := sr.saves
+	if sr.ro.allSaves {
+		// Saves might have been added since the last render.
+		var err error
+		if saves, err = sr.ro.findSaves(sr.factorioSettings); err != nil {
+			return err
+		}
+	}
+	return renderAll(ctx, sr.factorioSettings, sr.rf, sr.ro, saves)
+}
+
+// update changes the status and writes it to the status file.
+func (sr *scheduledRender) update(change func(st *ScheduleStatusJSON)) {
+	sr.m.Lock()
+	defer sr.m.Unlock()
+	change(sr.status)
+	if sr.statusFile == "" {
+		return
+	}
+	raw, err := json.MarshalIndent(sr.status, "", "  ")
+	if err != nil {
+		logWarning("unable to encode schedule status", "error", err)
+		return
+	}
+	// Written to a temporary file first, so `serve` never reads a partial
+	// status.
+	tmp := sr.statusFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		logWarning("unable to write schedule status", "path", tmp, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, sr.statusFile); err != nil {
+		logWarning("unable to write schedule status", "path", sr.statusFile, "error", err)
+	}
+}
+
+// readScheduleStatuses returns the statuses of scheduled renders writing in
+// dir.
+func readScheduleStatuses(dir string) ([]*ScheduleStatusJSON, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(dir, scheduleStatusDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var statuses []*ScheduleStatusJSON
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, scheduleStatusDir, e.Name()))
+		if err != nil {
+			// E.g., removed as the render stopped.
+			continue
+		}
+		st := &ScheduleStatusJSON{}
+		if err := json.Unmarshal(raw, st); err != nil {
+			logDebug("invalid schedule status", "path", e.Name(), "error", err)
+			continue
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
+
+// handleSchedules serves /api/schedules, the status of scheduled renders
+// writing to the local base directories.
+func (s *Server) handleSchedules(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+	data := &APISchedulesJSON{Schedules: []*ScheduleStatusJSON{}}
+	for _, src := range s.sources {
+		ds, ok := src.store.(*dirStore)
+		if !ok {
+			continue
+		}
+		statuses, err := readScheduleStatuses(ds.dir)
+		if err != nil {
+			logWarning("unable to read schedule statuses", "dir", ds.dir, "error", err)
+			continue
+		}
+		data.Schedules = append(data.Schedules, statuses...)
+	}
+	sort.Slice(data.Schedules, func(i, j int) bool {
+		a, b := data.Schedules[i], data.Schedules[j]
+		if a.Started.Equal(b.Started) {
+			return strings.Join(a.Saves, ",") < strings.Join(b.Saves, ",")
+		}
+		return a.Started.Before(b.Started)
+	})
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, data)
+}
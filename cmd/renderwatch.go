@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Palats/mapshot/factorio"
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long a save must stay the same before being rendered with --watch.
+// Factorio writes saves in several steps, so a burst of changes is expected.
+const saveSettleDelay = 5 * time.Second
+
+// watchedSave is what --watch knows about a save.
+type watchedSave struct {
+	size    int64
+	modTime time.Time
+	// When the save was last seen changing; zero when there is nothing new
+	// to render.
+	changed time.Time
+	running bool
+	// Start of the last render, for --min_interval.
+	lastRender time.Time
+}
+
+// saveWatcher renders the saves of the Factorio saves directory when they are
+// updated.
+type saveWatcher struct {
+	factorioSettings *factorio.Settings
+	rf               *RenderFlags
+	ro               *renderOptions
+	fact             *factorio.Factorio
+
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	m     sync.Mutex
+	saves map[string]*watchedSave
+	// False until the first scan is done; saves existing then are not
+	// rendered.
+	started bool
+}
+
+// renderWatch renders saves matching --watch whenever they change, until the
+// context is cancelled. Ongoing renders are then stopped - the mod list of the
+// user is never modified by a render, so nothing else needs restoring.
+func renderWatch(ctx context.Context, factorioSettings *factorio.Settings, rf *RenderFlags, ro *renderOptions) error {
+	if err := ro.validate(); err != nil {
+		return err
+	}
+	if err := rf.validate(); err != nil {
+		return err
+	}
+	fact, err := factorio.New(factorioSettings)
+	if err != nil {
+		return err
+	}
+	sw := &saveWatcher{
+		factorioSettings: factorioSettings,
+		rf:               rf,
+		ro:               ro,
+		fact:             fact,
+		sem:              make(chan struct{}, ro.parallel),
+		saves:            map[string]*watchedSave{},
+	}
+	dir := filepath.Join(fact.DataDir(), factorio.SavesDir)
+	if _, err := fact.ListSaves(); err != nil {
+		return err
+	}
+	fmt.Printf("Watching %s for updates of saves matching %q; press Ctrl+C to stop.\n", dir, ro.watch)
+	sw.loop(ctx, dir)
+	// Renders see the cancellation too, and stop Factorio.
+	sw.wg.Wait()
+	fmt.Println("Stopped watching saves.")
+	return nil
+}
+
+// loop looks for updated saves on filesystem notifications, with a slow
+// periodic rescan in case some were missed. When notifications are not
+// available, it scans the saves directory every pollDelay instead.
+func (sw *saveWatcher) loop(ctx context.Context, dir string) {
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	notify, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = notify.Add(dir); err != nil {
+			notify.Close()
+		}
+	}
+	if err != nil {
+		logWarning("filesystem notifications not available, polling saves instead", "error", err)
+	} else {
+		defer notify.Close()
+		events, errs = notify.Events, notify.Errors
+	}
+
+	for {
+		delay := sw.scan(ctx, time.Now())
+		poll := fallbackDelay
+		if events == nil {
+			poll = pollDelay
+		}
+		if delay <= 0 || delay > poll {
+			delay = poll
+		}
+		timer := time.NewTimer(delay)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				break wait
+			case ev, ok := <-events:
+				if !ok {
+					logWarning("filesystem notifications stopped, polling saves instead")
+					events, errs = nil, nil
+					break wait
+				}
+				logDebug("filesystem event", "event", ev)
+				// Waits for the end of a burst of events.
+				timer.Stop()
+				timer = time.NewTimer(notifyDelay)
+			case err := <-errs:
+				logWarning("error from filesystem notifications, polling saves instead", "error", err)
+				notify.Close()
+				events, errs = nil, nil
+				break wait
+			}
+		}
+		timer.Stop()
+	}
+}
+
+// scan looks for updated saves, starting the render of those which are done
+// being written. It returns how long to wait for the next scan to render the
+// saves not ready yet; 0 if there are none.
+func (sw *saveWatcher) scan(ctx context.Context, now time.Time) time.Duration {
+	saves, err := sw.fact.ListSaves()
+	if err != nil {
+		logWarning("unable to look for updated saves", "error", err)
+		return 0
+	}
+	sw.m.Lock()
+	defer sw.m.Unlock()
+
+	seen := map[string]bool{}
+	var next time.Duration
+	for _, sv := range saves {
+		if ok, _ := filepath.Match(sw.ro.watch, sv.Name); !ok {
+			continue
+		}
+		seen[sv.Name] = true
+		st := sw.saves[sv.Name]
+		if st == nil {
+			st = &watchedSave{size: sv.Size, modTime: sv.ModTime}
+			sw.saves[sv.Name] = st
+			if sw.started {
+				logInfo("new save found", "save", sv.Name)
+				st.changed = now
+			}
+		} else if st.size != sv.Size || !st.modTime.Equal(sv.ModTime) {
+			logDebug("save updated", "save", sv.Name)
+			st.size, st.modTime = sv.Size, sv.ModTime
+			st.changed = now
+		}
+		if st.changed.IsZero() {
+			continue
+		}
+
+		wait := st.changed.Add(saveSettleDelay).Sub(now)
+		if sw.ro.minInterval > 0 && !st.lastRender.IsZero() {
+			if d := st.lastRender.Add(sw.ro.minInterval).Sub(now); d > wait {
+				logDebug("save rendered less than --min_interval ago, waiting", "save", sv.Name, "wait", d)
+				wait = d
+			}
+		}
+		if wait > 0 {
+			if next == 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		st.changed = time.Time{}
+		if st.running {
+			logInfo("save updated while being rendered, skipping", "save", sv.Name)
+			continue
+		}
+		st.running = true
+		st.lastRender = now
+		sw.start(ctx, sv)
+	}
+	for name, st := range sw.saves {
+		// E.g., a temporary file, or a removed save.
+		if !seen[name] && !st.running {
+			delete(sw.saves, name)
+		}
+	}
+	sw.started = true
+	return next
+}
+
+// start renders the save in the background, with up to --parallel renders at
+// once.
+func (sw *saveWatcher) start(ctx context.Context, sv *factorio.SaveFile) {
+	sw.wg.Add(1)
+	go func() {
+		defer sw.wg.Done()
+		defer func() {
+			sw.m.Lock()
+			defer sw.m.Unlock()
+			if st := sw.saves[sv.Name]; st != nil {
+				st.running = false
+			}
+		}()
+		select {
+		case sw.sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-sw.sem }()
+
+		out := newRenderOutput(sv.Name, true)
+		out.Printf("Save updated, rendering %s\n", sv.Path)
+		start := time.Now()
+		output, err := render(ctx, sw.factorioSettings, sw.rf, sw.ro, &renderJob{
+			rawname: sv.Path,
+			out:     out,
+			isolate: sw.ro.parallel > 1,
+		})
+		duration := time.Since(start).Round(time.Second)
+		switch {
+		case errors.Is(err, errUnchanged):
+		case ctx.Err() != nil:
+			out.logInfo("render interrupted", "error", err)
+		case err != nil:
+			logError("render failed", "save", sv.Name, "duration", duration, "error", err)
+		default:
+			out.logInfo("render done", "output", output, "duration", duration)
+		}
+	}()
+}
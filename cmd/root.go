@@ -6,7 +6,6 @@ import (
 	"os"
 
 	"github.com/Palats/mapshot/factorio"
-	"github.com/golang/glog"
 	"github.com/spf13/cobra"
 )
 
@@ -15,26 +14,49 @@ var cmdRoot = &cobra.Command{
 	Short: "mapshot generates zoomable screenshot for Factorio",
 	// Do not show help if not requested - e.g., when an error is generated.
 	SilenceUsage: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// Before logging setup, as the config can change it.
+		unknown, err := setupConfig(cmd)
+		if err != nil {
+			return err
+		}
+		if err := logFlags.setup(); err != nil {
+			return err
+		}
+		for _, key := range unknown {
+			logWarning("unknown key in config file, ignored", "key", key, "file", config.file)
+		}
+		return nil
+	},
 }
 
-func getWorkDir() (string, func()) {
+// getWorkDir returns the directory for temporary files, created in base - or
+// the system default if empty - unless --work_dir is set.
+func getWorkDir(base string) (string, func()) {
 	if workDir != "" {
-		glog.Infof("using work dir %s", workDir)
+		logInfo("using work dir", "dir", workDir)
 		return workDir, func() {}
 	}
 
-	tmpdir, err := ioutil.TempDir("", "mapshot")
+	if base != "" {
+		if err := os.MkdirAll(base, 0755); err != nil {
+			logError("unable to create dir", "dir", base, "error", err)
+			os.Exit(1)
+		}
+	}
+	tmpdir, err := ioutil.TempDir(base, "mapshot")
 	if err != nil {
-		glog.Fatalf("unable to create temp dir: %v", err)
+		logError("unable to create temp dir", "error", err)
+		os.Exit(1)
 	}
-	glog.Info("temp dir: ", tmpdir)
+	logInfo("temp dir created", "dir", tmpdir)
 
 	cleanup := func() {
 		// Remove temporary directory.
 		if err := os.RemoveAll(tmpdir); err != nil {
-			glog.Errorf("unable to remove temp dir %q: %v", tmpdir, err)
+			logError("unable to remove temp dir", "dir", tmpdir, "error", err)
 		} else {
-			glog.Infof("temp dir %q removed", tmpdir)
+			logInfo("temp dir removed", "dir", tmpdir)
 		}
 	}
 	return tmpdir, cleanup
@@ -47,10 +69,12 @@ var (
 
 func init() {
 	factorioSettings.Register(cmdRoot.PersistentFlags(), "factorio_")
+	logFlags.Register(cmdRoot.PersistentFlags())
 	cmdRoot.PersistentFlags().StringVar(&workDir, "work_dir", "", "If specified, uses this as working directory. Otherwise, creates a temporary one and delete it on exit.")
 }
 
 // Execute run the full command tree.
 func Execute(ctx context.Context) error {
+	addEnvUsage(cmdRoot)
 	return cmdRoot.ExecuteContext(ctx)
 }
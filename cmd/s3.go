@@ -0,0 +1,365 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/pflag"
+)
+
+// s3Flags holds parameters to serve mapshots from an S3 bucket.
+type s3Flags struct {
+	bucket   string
+	prefix   string
+	region   string
+	endpoint string
+	presign  time.Duration
+}
+
+// Register creates flags for the S3 parameters.
+func (f *s3Flags) Register(flags *pflag.FlagSet, prefix string) *s3Flags {
+	flags.StringVar(&f.bucket, prefix+"s3_bucket", "", "If specified, serve mapshots from this S3 bucket. Credentials are taken from the standard AWS environment variables & configuration files.")
+	flags.StringVar(&f.prefix, prefix+"s3_prefix", "", "Prefix of the keys of the mapshots in --s3_bucket, e.g., script-output/mapshot/.")
+	flags.StringVar(&f.region, prefix+"s3_region", "", "Region of --s3_bucket. If empty, uses the AWS configuration.")
+	flags.StringVar(&f.endpoint, prefix+"s3_endpoint", "", "If specified, URL of an S3 compatible service to use instead of AWS.")
+	flags.DurationVar(&f.presign, prefix+"s3_presign", 0, "If positive, redirect clients to presigned URLs valid for that long, instead of streaming mapshot content through the server.")
+	return f
+}
+
+func (f *s3Flags) newStore() (*s3Store, error) {
+	cfg := aws.Config{}
+	if f.region != "" {
+		cfg.Region = aws.String(f.region)
+	}
+	if f.endpoint != "" {
+		cfg.Endpoint = aws.String(f.endpoint)
+		// Most S3 compatible services do not support virtual-hosted buckets.
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create AWS session: %w", err)
+	}
+	prefix := f.prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3Store{
+		client:  s3.New(sess),
+		bucket:  f.bucket,
+		prefix:  prefix,
+		presign: f.presign,
+		known:   make(map[string]*s3Mapshot),
+	}, nil
+}
+
+// s3Mapshot is the content of a mapshot.json found in the bucket.
+type s3Mapshot struct {
+	etag string
+	data *MapshotJSON
+	// Set if the content could not be fully parsed.
+	jsonErr error
+}
+
+// s3Store gives access to mapshots in an S3 bucket.
+type s3Store struct {
+	client  *s3.S3
+	bucket  string
+	prefix  string
+	presign time.Duration
+
+	// Content of mapshot.json files, per key, to avoid fetching them again
+	// on each rescan.
+	m     sync.Mutex
+	known map[string]*s3Mapshot
+}
+
+func (st *s3Store) String() string {
+	return "s3://" + st.bucket + "/" + st.prefix
+}
+
+func (st *s3Store) list() ([]shotInfo, error) {
+	logDebug("looking for shots", "store", st)
+	var shots []shotInfo
+	known := map[string]*s3Mapshot{}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(st.bucket),
+		Prefix: aws.String(st.prefix),
+	}
+	err := st.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			if path.Base(key) != "mapshot.json" {
+				continue
+			}
+			logDebug("found mapshot.json", "key", key)
+			data, err := st.mapshotJSON(key, aws.StringValue(obj.ETag))
+			if err != nil {
+				logWarning("object is not a valid mapshot.json, skipped", "key", key, "error", err)
+				continue
+			}
+			known[key] = data
+
+			relpath := path.Dir(strings.TrimPrefix(key, st.prefix))
+			shots = append(shots, shotInfo{
+				name:     relpath,
+				savename: path.Dir(relpath),
+				json:     data.data,
+				jsonErr:  data.jsonErr,
+				path:     "/data/" + relpath + "/",
+				mtime:    aws.TimeValue(obj.LastModified),
+				fsys: &s3FS{
+					store: st,
+					root:  path.Dir(key) + "/",
+				},
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list objects: %w", err)
+	}
+
+	st.m.Lock()
+	defer st.m.Unlock()
+	st.known = known
+	return shots, nil
+}
+
+// mapshotJSON returns the content of a mapshot.json object, only fetching it
+// if it was not seen with the same ETag before.
+func (st *s3Store) mapshotJSON(key string, etag string) (*s3Mapshot, error) {
+	st.m.Lock()
+	prev := st.known[key]
+	st.m.Unlock()
+	if prev != nil && prev.etag == etag {
+		return prev, nil
+	}
+
+	out, err := st.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	raw, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	data, jsonErr := parseMapshotJSON(raw)
+	if jsonErr != nil {
+		logWarning("object does not have valid JSON, listed anyway", "key", key, "error", jsonErr)
+	}
+	return &s3Mapshot{etag: etag, data: data, jsonErr: jsonErr}, nil
+}
+
+// isNotFound indicates whether the error from S3 means that the object does
+// not exist.
+func isNotFound(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound
+}
+
+// redirector is implemented by mapshot content which clients can fetch
+// directly from elsewhere.
+type redirector interface {
+	// redirectURL returns the URL to fetch the named file from, or an empty
+	// string if it should be served normally.
+	redirectURL(name string) (string, error)
+}
+
+// s3FS gives access to the objects of a single mapshot.
+type s3FS struct {
+	store *s3Store
+	// Key prefix of the mapshot, including trailing slash.
+	root string
+}
+
+func (sfs *s3FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &s3File{info: &s3FileInfo{name: ".", dir: true}}, nil
+	}
+	out, err := sfs.store.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(sfs.store.bucket),
+		Key:    aws.String(sfs.root + name),
+	})
+	if isNotFound(err) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &s3File{
+		fsys: sfs,
+		key:  sfs.root + name,
+		info: &s3FileInfo{
+			name:    path.Base(name),
+			size:    aws.Int64Value(out.ContentLength),
+			modTime: aws.TimeValue(out.LastModified),
+		},
+	}, nil
+}
+
+// ReadDir implements fs.ReadDirFS, listing objects as if the key prefixes
+// were directories.
+func (sfs *s3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	prefix := sfs.root
+	if name != "." {
+		prefix += name + "/"
+	}
+	var entries []fs.DirEntry
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(sfs.store.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	err := sfs.store.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			entries = append(entries, &s3FileInfo{
+				name: path.Base(strings.TrimPrefix(aws.StringValue(p.Prefix), prefix)),
+				dir:  true,
+			})
+		}
+		for _, obj := range page.Contents {
+			entries = append(entries, &s3FileInfo{
+				name:    strings.TrimPrefix(aws.StringValue(obj.Key), prefix),
+				size:    aws.Int64Value(obj.Size),
+				modTime: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+func (sfs *s3FS) redirectURL(name string) (string, error) {
+	if sfs.store.presign <= 0 {
+		return "", nil
+	}
+	req, _ := sfs.store.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(sfs.store.bucket),
+		Key:    aws.String(sfs.root + name),
+	})
+	return req.Presign(sfs.store.presign)
+}
+
+// s3FileInfo implements both fs.FileInfo & fs.DirEntry.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return fi.dir }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
+
+func (fi *s3FileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (fi *s3FileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *s3FileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// s3File streams the content of an object. Seeking is supported by fetching
+// the object again, from the new offset.
+type s3File struct {
+	fsys *s3FS
+	key  string
+	info *s3FileInfo
+
+	offset int64
+	// Content of the object from offset; nil if not fetched yet.
+	body io.ReadCloser
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Read(b []byte) (int, error) {
+	if f.info.dir {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: errors.New("is a directory")}
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		out, err := f.fsys.store.client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(f.fsys.store.bucket),
+			Key:    aws.String(f.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", f.offset)),
+		})
+		if err != nil {
+			return 0, err
+		}
+		f.body = out.Body
+	}
+	n, err := f.body.Read(b)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = f.offset + offset
+	case io.SeekEnd:
+		pos = f.info.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	if pos != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = pos
+	return pos, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
@@ -0,0 +1,451 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Entries modified more recently than that are read again on the next scan:
+// another change could happen without modifying the timestamp, depending on
+// the filesystem granularity.
+const racyDelay = 2 * time.Second
+
+const (
+	// A directory containing this file is skipped, with its content - e.g.,
+	// to hide a test render.
+	ignoreMarker = ".mapshot-ignore"
+	// File in a base directory listing glob patterns of directories to skip,
+	// one per line, like --exclude.
+	ignoreListFile = "mapshot-ignore.txt"
+)
+
+// scanOptions controls how directories are scanned for mapshots.
+type scanOptions struct {
+	// How often to read everything again, instead of only what changed.
+	fullRescanInterval time.Duration
+	// If true, symlinks to directories & archives are followed.
+	followSymlinks bool
+	// Glob patterns of directories to skip; see excluded.
+	excludes []string
+	// How many levels of directories below the base directory are looked
+	// into; 0 for no limit.
+	maxDepth int
+}
+
+// tooDeep indicates whether a directory at that depth must not be looked
+// into. The base directory is at depth 0.
+func (opts scanOptions) tooDeep(depth int) bool {
+	return opts.maxDepth > 0 && depth > opts.maxDepth
+}
+
+// excluded indicates whether the directory must be skipped. Patterns are
+// matched against both the path relative to the base directory, and the name
+// of the directory.
+func excluded(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scanCache is what a scan found, so the next one only reads what changed.
+type scanCache struct {
+	// Keyed by directory path.
+	dirs map[string]*cachedDir
+	// Keyed by mapshot directory or archive path.
+	shots map[string]*cachedShot
+	// Keyed by path of mapshot-user.json.
+	metas map[string]*cachedMeta
+}
+
+func newScanCache() *scanCache {
+	return &scanCache{
+		dirs:  make(map[string]*cachedDir),
+		shots: make(map[string]*cachedShot),
+		metas: make(map[string]*cachedMeta),
+	}
+}
+
+// cachedDir is the relevant content of a directory, as of its modification
+// time.
+type cachedDir struct {
+	// Zero if it must be read again.
+	mtime    time.Time
+	subdirs  []string
+	archives []string
+	// Only when following symlinks.
+	links []string
+	// True if the directory contains mapshot.json.
+	isShot bool
+	// True if the directory contains ignoreMarker.
+	ignored bool
+}
+
+// cachedShot is a mapshot, as of the modification time & size of its
+// mapshot.json - or of the zip file for archives.
+type cachedShot struct {
+	// Zero if it must be read again.
+	mtime time.Time
+	size  int64
+	shot  shotInfo
+}
+
+// cachedMeta is the content of mapshot-user.json, as of its modification time
+// & size. It is tracked separately from the mapshot, as it can be modified
+// afterward.
+type cachedMeta struct {
+	// Zero if it must be read again.
+	mtime time.Time
+	size  int64
+	meta  *UserMetaJSON
+}
+
+// shotScanner looks for mapshots in a directory tree. Content of mapshot
+// directories is not looked into, which avoids going through tiles.
+type shotScanner struct {
+	realDir  string
+	archives *archiveCache
+	opts     scanOptions
+	// Result of the previous scan; empty for a full scan.
+	prev  *scanCache
+	next  *scanCache
+	now   time.Time
+	shots []shotInfo
+	// Number of paths which could not be scanned - e.g., unreadable.
+	skipped int
+	// Real paths of the directories being scanned, from the base directory to
+	// the current one; used to detect symlink loops.
+	ancestors map[string]bool
+}
+
+// findShots looks for mapshots in baseDir. Directories & mapshots which did
+// not change since the scan which produced `prev` are not read again; with a
+// nil `prev`, everything is read. It returns the cache for the next scan.
+func findShots(baseDir string, archives *archiveCache, opts scanOptions, prev *scanCache) ([]shotInfo, *scanCache, error) {
+	realDir, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to eval symlinks for %s: %w", baseDir, err)
+	}
+	logDebug("looking for shots", "dir", realDir)
+	if patterns := loadIgnoreList(filepath.Join(realDir, ignoreListFile)); len(patterns) > 0 {
+		opts.excludes = append(append([]string{}, opts.excludes...), patterns...)
+	}
+	if prev == nil {
+		prev = newScanCache()
+	}
+	sc := &shotScanner{
+		realDir:   realDir,
+		archives:  archives,
+		opts:      opts,
+		prev:      prev,
+		next:      newScanCache(),
+		now:       time.Now(),
+		ancestors: make(map[string]bool),
+	}
+	info, err := os.Stat(realDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Only failing to read the base directory itself fails the scan.
+	if err := sc.scanDir(realDir, realDir, 0, info); err != nil {
+		return nil, nil, err
+	}
+	if sc.skipped > 0 {
+		logWarning("skipped paths while scanning", "dir", realDir, "skipped", sc.skipped)
+	}
+	return sc.shots, sc.next, nil
+}
+
+// loadIgnoreList reads the patterns of ignoreListFile. Empty lines and lines
+// starting with '#' are skipped.
+func loadIgnoreList(p string) []string {
+	raw, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		logWarning("unable to read ignore file", "path", p, "error", err)
+		return nil
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			logWarning("invalid ignore pattern, skipped", "pattern", line, "path", p, "error", err)
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// stamp returns the modification time to remember for an entry.
+func (sc *shotScanner) stamp(t time.Time) time.Time {
+	if sc.now.Sub(t) < racyDelay {
+		return time.Time{}
+	}
+	return t
+}
+
+// readDir returns the content of the directory, reusing the previous scan if
+// it was not modified since.
+func (sc *shotScanner) readDir(dir string, info os.FileInfo) (*cachedDir, error) {
+	if c := sc.prev.dirs[dir]; c != nil && !c.mtime.IsZero() && c.mtime.Equal(info.ModTime()) {
+		return c, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &cachedDir{mtime: sc.stamp(info.ModTime())}
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasPrefix(name, uploadTmpPrefix):
+			// Upload in progress.
+		case name == ignoreMarker:
+			c.ignored = true
+		case e.IsDir():
+			c.subdirs = append(c.subdirs, name)
+		case name == "mapshot.json":
+			c.isShot = true
+		case isArchiveName(name) && e.Type().IsRegular():
+			c.archives = append(c.archives, name)
+		case e.Type()&os.ModeSymlink != 0 && sc.opts.followSymlinks:
+			c.links = append(c.links, name)
+		}
+	}
+	return c, nil
+}
+
+// skip records a path which cannot be scanned.
+func (sc *shotScanner) skip(p string, err error) {
+	logWarning("unable to read path, skipped", "path", p, "error", err)
+	sc.skipped++
+}
+
+// scanDir looks for mapshots in the directory. `real` is its path with
+// symlinks resolved, and depth is relative to the base directory.
+func (sc *shotScanner) scanDir(dir string, real string, depth int, info os.FileInfo) error {
+	c, err := sc.readDir(dir, info)
+	if err != nil {
+		return err
+	}
+	sc.next.dirs[dir] = c
+	if c.ignored {
+		logDebug("skipping directory with ignore marker", "dir", dir, "marker", ignoreMarker)
+		return nil
+	}
+	if c.isShot {
+		sc.addShot(dir)
+		return nil
+	}
+	sc.ancestors[real] = true
+	defer delete(sc.ancestors, real)
+	for _, name := range c.archives {
+		p := filepath.Join(dir, name)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			sc.skip(p, err)
+			continue
+		}
+		sc.addArchive(p, info)
+	}
+	for _, name := range c.subdirs {
+		p := filepath.Join(dir, name)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			sc.skip(p, err)
+			continue
+		}
+		if !info.IsDir() {
+			continue
+		}
+		sc.scanSubdir(p, filepath.Join(real, name), depth+1, info)
+	}
+	for _, name := range c.links {
+		sc.followLink(filepath.Join(dir, name), depth+1)
+	}
+	return nil
+}
+
+func (sc *shotScanner) scanSubdir(p string, real string, depth int, info os.FileInfo) {
+	if sc.opts.tooDeep(depth) {
+		return
+	}
+	if rel, err := filepath.Rel(sc.realDir, p); err == nil && excluded(sc.opts.excludes, rel) {
+		return
+	}
+	if err := sc.scanDir(p, real, depth, info); err != nil && !os.IsNotExist(err) {
+		sc.skip(p, err)
+	}
+}
+
+// followLink looks for mapshots through a symlink - either an archive, or a
+// directory.
+func (sc *shotScanner) followLink(p string, depth int) {
+	info, err := os.Stat(p)
+	if err != nil {
+		logWarning("dangling symlink, skipped", "path", p, "error", err)
+		sc.skipped++
+		return
+	}
+	switch {
+	case info.Mode().IsRegular() && isArchiveName(p):
+		sc.addArchive(p, info)
+	case info.IsDir():
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			sc.skip(p, err)
+			return
+		}
+		if sc.ancestors[real] {
+			logWarning("symlink loops back, skipped", "path", p, "target", real)
+			sc.skipped++
+			return
+		}
+		sc.scanSubdir(p, real, depth, info)
+	}
+}
+
+// reuse adds the mapshot from the previous scan, if still valid.
+func (sc *shotScanner) reuse(p string, info os.FileInfo) bool {
+	c := sc.prev.shots[p]
+	if c == nil || c.mtime.IsZero() || !c.mtime.Equal(info.ModTime()) || c.size != info.Size() {
+		return false
+	}
+	sc.next.shots[p] = c
+	sc.shots = append(sc.shots, c.shot)
+	return true
+}
+
+func (sc *shotScanner) add(p string, info os.FileInfo, shot *shotInfo) {
+	sc.next.shots[p] = &cachedShot{
+		mtime: sc.stamp(info.ModTime()),
+		size:  info.Size(),
+		shot:  *shot,
+	}
+	sc.shots = append(sc.shots, *shot)
+}
+
+func (sc *shotScanner) addShot(shotPath string) {
+	p := filepath.Join(shotPath, "mapshot.json")
+	info, err := os.Stat(p)
+	if err != nil {
+		sc.skip(p, err)
+		return
+	}
+	if sc.reuse(shotPath, info) {
+		sc.addMeta(shotPath)
+		return
+	}
+	logDebug("found mapshot.json", "path", p)
+	raw, err := ioutil.ReadFile(p)
+	if err != nil {
+		sc.skip(p, err)
+		return
+	}
+
+	mapshotData, jsonErr := parseMapshotJSON(raw)
+	if jsonErr != nil {
+		logWarning("file does not have valid JSON, listed anyway", "path", p, "error", jsonErr)
+	}
+
+	relpath, err := filepath.Rel(sc.realDir, shotPath)
+	if err != nil {
+		logWarning("unable to get relative path", "path", shotPath, "error", err)
+		return
+	}
+	shot := &shotInfo{
+		fsPath:   shotPath,
+		fsys:     os.DirFS(shotPath),
+		name:     filepath.ToSlash(relpath),
+		savename: filepath.ToSlash(filepath.Dir(relpath)),
+		json:     mapshotData,
+		jsonErr:  jsonErr,
+		path:     "/data/" + filepath.ToSlash(relpath) + "/",
+		mtime:    info.ModTime(),
+	}
+	if dbPath := filepath.Join(shotPath, mbtilesFile); isRegularFile(dbPath) {
+		shot.tilesDB = dbPath
+		shot.fsys = &mbtilesFS{path: dbPath, base: shot.fsys, tileDBs: sc.archives}
+	}
+	sc.add(shotPath, info, shot)
+	sc.addMeta(shotPath)
+}
+
+// addMeta sets the content of mapshot-user.json on the mapshot which was just
+// added, reusing the previous scan if it did not change.
+func (sc *shotScanner) addMeta(shotPath string) {
+	p := filepath.Join(shotPath, userMetaFile)
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		sc.skip(p, err)
+		return
+	}
+	c := sc.prev.metas[p]
+	if c == nil || c.mtime.IsZero() || !c.mtime.Equal(info.ModTime()) || c.size != info.Size() {
+		meta, err := readUserMeta(os.DirFS(shotPath))
+		if err != nil {
+			logWarning("unable to read path, ignored", "path", p, "error", err)
+		}
+		c = &cachedMeta{
+			mtime: sc.stamp(info.ModTime()),
+			size:  info.Size(),
+			meta:  meta,
+		}
+	}
+	sc.next.metas[p] = c
+	sc.shots[len(sc.shots)-1].meta = c.meta
+}
+
+func (sc *shotScanner) addArchive(p string, info os.FileInfo) {
+	if sc.reuse(p, info) {
+		return
+	}
+	relpath, err := filepath.Rel(sc.realDir, strings.TrimSuffix(p, archiveFileSuffix(p)))
+	if err != nil {
+		logWarning("unable to get relative path", "path", p, "error", err)
+		return
+	}
+	var shot *shotInfo
+	if strings.HasSuffix(p, mbtilesSuffix) {
+		shot, err = mbtilesShot(p, info, sc.archives)
+	} else {
+		shot, err = archiveShot(p, info, sc.archives)
+	}
+	if err != nil {
+		logWarning("archive is not a valid mapshot, skipped", "path", p, "error", err)
+		return
+	}
+	shot.name = filepath.ToSlash(relpath)
+	shot.savename = filepath.ToSlash(filepath.Dir(relpath))
+	shot.path = "/data/" + shot.name + "/"
+	if shot.meta, err = readUserMeta(shot.fsys); err != nil {
+		logWarning("unable to read user metadata, ignored", "file", userMetaFile, "path", p, "error", err)
+	}
+	sc.add(p, info, shot)
+}
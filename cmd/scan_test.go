@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeTestShot creates a minimal mapshot directory at p.
+func writeTestShot(t testing.TB, p string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(p, "s1zoom_0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(p, "mapshot.json"), []byte(`{"savename": "test"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func symlink(t *testing.T, target, p string) {
+	t.Helper()
+	if err := os.Symlink(target, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// shotNames returns the sorted names of the mapshots.
+func shotNames(shots []shotInfo) []string {
+	names := []string{}
+	for _, shot := range shots {
+		names = append(names, shot.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findTestShots scans the directory, failing the test on error.
+func findTestShots(t *testing.T, dir string, opts scanOptions) []string {
+	t.Helper()
+	shots, _, err := findShots(dir, newArchiveCache(), opts, nil)
+	if err != nil {
+		t.Fatalf("findShots(%s): %v", dir, err)
+	}
+	return shotNames(shots)
+}
+
+func TestFindShotsSymlinks(t *testing.T) {
+	quietLogs(t)
+	root := t.TempDir()
+	base := filepath.Join(root, "script-output")
+	other := filepath.Join(root, "other-volume")
+	writeTestShot(t, filepath.Join(base, "mapshot", "local", "d-1"))
+	writeTestShot(t, filepath.Join(other, "remote", "d-2"))
+	writeTestShot(t, filepath.Join(other, "linked", "d-3"))
+
+	// A single mapshot, and a directory of them.
+	symlink(t, filepath.Join(other, "remote", "d-2"), filepath.Join(base, "mapshot", "local", "d-2"))
+	symlink(t, filepath.Join(other, "linked"), filepath.Join(base, "mapshot", "linked"))
+	// Dangling.
+	symlink(t, filepath.Join(root, "missing"), filepath.Join(base, "mapshot", "gone"))
+	// Loops, directly and through another link.
+	symlink(t, filepath.Join(base, "mapshot"), filepath.Join(base, "mapshot", "local", "loop"))
+	symlink(t, base, filepath.Join(other, "linked", "back"))
+
+	for _, tc := range []struct {
+		desc string
+		opts scanOptions
+		want []string
+	}{
+		{"not following", scanOptions{}, []string{"mapshot/local/d-1"}},
+		{"following", scanOptions{followSymlinks: true}, []string{"mapshot/linked/d-3", "mapshot/local/d-1", "mapshot/local/d-2"}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := findTestShots(t, base, tc.opts); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got shots %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindShotsSymlinkedShot(t *testing.T) {
+	quietLogs(t)
+	root := t.TempDir()
+	base := filepath.Join(root, "script-output")
+	writeTestShot(t, filepath.Join(root, "elsewhere", "d-1"))
+	if err := os.MkdirAll(filepath.Join(base, "mapshot", "save"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, filepath.Join(root, "elsewhere", "d-1"), filepath.Join(base, "mapshot", "save", "d-1"))
+
+	shots, _, err := findShots(base, newArchiveCache(), scanOptions{followSymlinks: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shots) != 1 {
+		t.Fatalf("got %d shots, want 1", len(shots))
+	}
+	shot := shots[0]
+	// Served under the path of the link, from the target.
+	if shot.name != "mapshot/save/d-1" || shot.path != "/data/mapshot/save/d-1/" || shot.savename != "mapshot/save" {
+		t.Errorf("got name %q, path %q, savename %q", shot.name, shot.path, shot.savename)
+	}
+	if _, err := shot.fsys.Open("mapshot.json"); err != nil {
+		t.Errorf("unable to read mapshot.json through the link: %v", err)
+	}
+}
+
+func TestFindShotsDanglingBase(t *testing.T) {
+	quietLogs(t)
+	root := t.TempDir()
+	base := filepath.Join(root, "script-output")
+	symlink(t, filepath.Join(root, "missing"), base)
+	if _, _, err := findShots(base, newArchiveCache(), scanOptions{followSymlinks: true}, nil); err == nil {
+		t.Error("findShots succeeded on a dangling base directory, want error")
+	}
+}
+
+// BenchmarkFindShots scans a tree of 50 saves with 20 mapshots each.
+func BenchmarkFindShots(b *testing.B) {
+	quietLogs(b)
+	base := b.TempDir()
+	for save := 0; save < 50; save++ {
+		for shot := 0; shot < 20; shot++ {
+			writeTestShot(b, filepath.Join(base, "mapshot", fmt.Sprintf("save-%d", save), fmt.Sprintf("d-%d", shot)))
+		}
+	}
+	archives := newArchiveCache()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		shots, _, err := findShots(base, archives, scanOptions{}, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(shots) != 1000 {
+			b.Fatalf("got %d shots, want 1000", len(shots))
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// renderSchedule tells when to start renders with --every or --schedule.
+type renderSchedule interface {
+	// next returns the first time strictly after t to render at.
+	next(t time.Time) time.Time
+	String() string
+}
+
+// intervalSchedule renders at a fixed interval, with --every.
+type intervalSchedule time.Duration
+
+func (is intervalSchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(is))
+}
+
+func (is intervalSchedule) String() string {
+	return "every " + time.Duration(is).String()
+}
+
+// cronSchedule is a crontab-like expression given with --schedule: minute,
+// hour, day of month, month and day of week, in local time.
+type cronSchedule struct {
+	expr    string
+	minutes map[int]bool
+	hours   map[int]bool
+	days    map[int]bool
+	months  map[int]bool
+	// Sunday is 0.
+	weekdays map[int]bool
+	// Whether days and weekdays were restricted; when both are, a day
+	// matching either is enough, as in crontab.
+	anyDay     bool
+	anyWeekday bool
+}
+
+// cronFields are the fields of a cron expression, with their ranges.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	// 7 is also Sunday.
+	{"day of week", 0, 7},
+}
+
+// parseCron parses a cron expression, e.g., "0 */6 * * *". Each field is
+// a comma separated list of `*`, values or ranges like `1-5`, each optionally
+// with a step, e.g., `*/15`.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid --schedule %q: must have 5 fields - minute, hour, day of month, month and day of week", expr)
+	}
+	sets := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --schedule %q: %s: %w", expr, cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{
+		expr:       expr,
+		minutes:    sets[0],
+		hours:      sets[1],
+		days:       sets[2],
+		months:     sets[3],
+		weekdays:   sets[4],
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			n, err := strconv.Atoi(part[idx+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:idx]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				// E.g., 5/10 means from 5 on.
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (cs *cronSchedule) dayMatches(t time.Time) bool {
+	day, weekday := cs.days[t.Day()], cs.weekdays[int(t.Weekday())]
+	switch {
+	case cs.anyDay && cs.anyWeekday:
+		return true
+	case cs.anyDay:
+		return weekday
+	case cs.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+func (cs *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Expressions like "0 0 30 2 *" never match.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !cs.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (cs *cronSchedule) String() string {
+	return cs.expr
+}
@@ -3,22 +3,524 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Palats/mapshot/embed"
-	"github.com/golang/glog"
+	"github.com/Palats/mapshot/factorio"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/sync/singleflight"
 )
 
+// ServeFlags holds parameters for the HTTP server.
+type ServeFlags struct {
+	port     int
+	bind     string
+	network  string
+	baseDirs []string
+	tlsCert  string
+	tlsKey   string
+
+	// Always labelled, as label=path.
+	namedSources []string
+
+	acmeDomains  []string
+	acmeCacheDir string
+	acmeHTTPBind string
+
+	authUser     string
+	authPassword string
+	authFile     string
+
+	adminToken     string
+	adminTokenFile string
+
+	compress bool
+
+	tileCacheTTL time.Duration
+
+	shutdownTimeout time.Duration
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+
+	sort string
+
+	enableAdmin   bool
+	maxUploadSize int64
+
+	corsOrigins []string
+
+	urlPrefix string
+
+	accessLog       bool
+	accessLogFile   string
+	accessLogFormat string
+
+	enableMetrics bool
+
+	rateLimit               float64
+	rateLimitBurst          int
+	rateLimitExemptLoopback bool
+
+	trustedProxies []string
+
+	maxConnections int
+	maxInflight    int
+
+	s3 s3Flags
+
+	rescanInterval     time.Duration
+	fullRescanInterval time.Duration
+	followSymlinks     bool
+	excludes           []string
+	maxScanDepth       int
+
+	thumbnailCacheDir string
+
+	unixSocket     string
+	unixSocketMode string
+
+	h2c bool
+
+	frontendDir string
+	liveReload  bool
+
+	open bool
+
+	missingTile string
+
+	allowListing bool
+
+	// Flags as registered, to know which ones were explicitly set.
+	flags  *pflag.FlagSet
+	prefix string
+}
+
+// Register creates flags for the HTTP server parameters.
+func (sf *ServeFlags) Register(flags *pflag.FlagSet, prefix string) *ServeFlags {
+	flags.IntVar(&sf.port, prefix+"port", 8080, "Port to listen on, on all interfaces. Ignored if --bind is specified.")
+	flags.StringVar(&sf.bind, prefix+"bind", "", "Address to listen on, as host:port; e.g., 127.0.0.1:8080 or [::1]:8080. If empty, uses --port on all interfaces.")
+	flags.StringVar(&sf.network, prefix+"network", "tcp", "Network to listen on: tcp (IPv4 and IPv6, depending on the system), tcp4 (IPv4 only) or tcp6 (IPv6 only).")
+	flags.StringSliceVar(&sf.baseDirs, prefix+"base_dir", nil, "Directory to serve mapshots from, as [label=]path. Can be repeated; with multiple directories, shots are prefixed by the label, which defaults to the directory name. If empty, uses Factorio script-output directory.")
+	flags.StringSliceVar(&sf.namedSources, prefix+"source", nil, "Directory to serve mapshots from, as label=path; shots are always prefixed by the label, e.g., to serve multiple Factorio instances. Can be repeated, and combined with --base_dir. The directory does not need to exist yet, e.g., for a mount point.")
+	flags.StringVar(&sf.tlsCert, prefix+"tls_cert", "", "Path to a PEM certificate file. If specified with --tls_key, serves over HTTPS. Send SIGHUP to reload it.")
+	flags.StringVar(&sf.tlsKey, prefix+"tls_key", "", "Path to the PEM private key file matching --tls_cert.")
+	flags.StringSliceVar(&sf.acmeDomains, prefix+"acme_domain", nil, "If specified, serve over HTTPS with certificates obtained automatically from Let's Encrypt for this domain name. Can be repeated; other domain names are rejected. Listens on port 443 unless --port or --bind is specified.")
+	flags.StringVar(&sf.acmeCacheDir, prefix+"acme_cache_dir", "", "Directory where to store certificates obtained for --acme_domain. If empty, uses a mapshot directory in the user cache directory.")
+	flags.StringVar(&sf.acmeHTTPBind, prefix+"acme_http_bind", ":80", "With --acme_domain, address where to answer Let's Encrypt HTTP challenges and redirect plain HTTP requests to HTTPS. Set to empty to disable.")
+	flags.StringVar(&sf.authUser, prefix+"auth_user", "", "If specified, require HTTP basic auth with this user name; see --auth_password.")
+	flags.StringVar(&sf.authPassword, prefix+"auth_password", "", "Password for --auth_user. Prefer --auth_file as command line arguments might be visible to other users.")
+	flags.StringVar(&sf.authFile, prefix+"auth_file", "", "If specified, require HTTP basic auth with users from this htpasswd-style file. Supports bcrypt, {SHA} and plain text entries.")
+	flags.StringVar(&sf.adminToken, prefix+"admin_token", "", "If specified, API requests modifying mapshots (e.g., deletion) require this token, as an Authorization: Bearer <token> header. Prefer --admin_token_file.")
+	flags.StringVar(&sf.adminTokenFile, prefix+"admin_token_file", "", "File containing the token for --admin_token.")
+	flags.BoolVar(&sf.compress, prefix+"compress", true, "If true, compress responses with gzip when supported by the client. Tiles are never compressed.")
+	flags.DurationVar(&sf.tileCacheTTL, prefix+"tile_cache_ttl", 7*24*time.Hour, "How long browsers can cache mapshot content, e.g., tiles. Set to 0 to not send caching headers.")
+	flags.DurationVar(&sf.shutdownTimeout, prefix+"shutdown_timeout", 10*time.Second, "On SIGINT/SIGTERM, how long to wait for in-flight requests before stopping.")
+	flags.DurationVar(&sf.readHeaderTimeout, prefix+"read_header_timeout", 10*time.Second, "How long clients can take to send request headers. Set to 0 for no limit.")
+	flags.DurationVar(&sf.readTimeout, prefix+"read_timeout", 0, "How long clients can take to send a whole request, including its body - e.g., uploads. Set to 0 for no limit.")
+	flags.DurationVar(&sf.writeTimeout, prefix+"write_timeout", 0, "How long sending a response can take, including large downloads; the event stream is closed before that, for clients to reconnect. Set to 0 for no limit.")
+	flags.DurationVar(&sf.idleTimeout, prefix+"idle_timeout", 2*time.Minute, "How long to keep idle connections open, waiting for the next request. Set to 0 to use --read_timeout.")
+	flags.IntVar(&sf.maxHeaderBytes, prefix+"max_header_bytes", 64<<10, "Maximum size in bytes of request headers.")
+	flags.StringVar(&sf.sort, prefix+"sort", "mtime", "Order of the mapshots of a save: mtime (most recent render first), tick (most played first) or name.")
+	flags.BoolVar(&sf.enableAdmin, prefix+"enable_admin", false, "If true, enable API endpoints modifying mapshots on disk - e.g., deletion.")
+	flags.Int64Var(&sf.maxUploadSize, prefix+"max_upload_size", 4<<30, "Maximum size in bytes of mapshots uploaded through the admin API, both as uploaded and once unpacked.")
+	flags.StringSliceVar(&sf.corsOrigins, prefix+"cors_origin", nil, "Origin allowed to access the API and mapshots from another site, e.g., https://example.com. Can be repeated; use * to allow any origin.")
+	flags.StringVar(&sf.urlPrefix, prefix+"url_prefix", "", "Path prefix under which everything is served, e.g., /factorio when behind a reverse proxy serving https://example.com/factorio/.")
+	flags.BoolVar(&sf.accessLog, prefix+"access_log", false, "If true, log each HTTP request on stderr.")
+	flags.StringVar(&sf.accessLogFile, prefix+"access_log_file", "", "If specified, log each HTTP request in that file.")
+	flags.StringVar(&sf.accessLogFormat, prefix+"access_log_format", "clf", "Format of the access log: clf (Common Log Format, with the duration in seconds appended) or json (one object per line).")
+	flags.BoolVar(&sf.enableMetrics, prefix+"enable_metrics", false, "If true, expose metrics in Prometheus format on /metrics.")
+	flags.Float64Var(&sf.rateLimit, prefix+"rate_limit", 0, "If positive, maximum number of requests per second for mapshot content (e.g., tiles) from a single client IP. Clients going over get a 429 response.")
+	flags.IntVar(&sf.rateLimitBurst, prefix+"rate_limit_burst", 200, "Number of requests a client can do in a burst above --rate_limit.")
+	flags.BoolVar(&sf.rateLimitExemptLoopback, prefix+"rate_limit_exempt_loopback", false, "If true, requests from loopback addresses are not subject to --rate_limit.")
+	flags.StringSliceVar(&sf.trustedProxies, prefix+"trusted_proxies", nil, "CIDR ranges of reverse proxies, e.g., 127.0.0.1/32,10.0.0.0/8. For requests from those, the client address & scheme are taken from X-Forwarded-For and X-Forwarded-Proto - for logs, --rate_limit and generated URLs. Those headers are ignored otherwise.")
+	flags.IntVar(&sf.maxConnections, prefix+"max_connections", 0, "If positive, maximum number of simultaneous connections; further connections wait to be accepted. Idle keep-alive connections count, until --idle_timeout closes them.")
+	flags.IntVar(&sf.maxInflight, prefix+"max_inflight", 0, "If positive, maximum number of requests handled at the same time; further requests get a 503 response. Health checks and event streams are not counted.")
+	flags.StringVar(&sf.thumbnailCacheDir, prefix+"thumbnail_cache_dir", "", "Directory where to store generated thumbnails of mapshots. If empty, they are stored next to mapshot.json when possible.")
+	flags.StringVar(&sf.unixSocket, prefix+"unix_socket", "", "If specified, listen on a Unix domain socket at this path instead of a TCP port.")
+	flags.StringVar(&sf.unixSocketMode, prefix+"unix_socket_mode", "0660", "Permissions of the --unix_socket file, in octal.")
+	flags.BoolVar(&sf.h2c, prefix+"h2c", false, "If true, accept HTTP/2 without TLS (h2c), e.g., from a reverse proxy. HTTP/2 is always available with TLS.")
+	flags.DurationVar(&sf.rescanInterval, prefix+"rescan_interval", pollDelay, "How often to look for new mapshots when filesystem notifications are not available. Set to 0 to only look for mapshots once at startup, e.g., when serving a read-only archive; filesystem notifications are then not used either.")
+	flags.DurationVar(&sf.fullRescanInterval, prefix+"full_rescan_interval", time.Hour, "How often to read all directories when looking for mapshots. In between, only directories which changed are read. Set to 0 to always read everything.")
+	flags.BoolVar(&sf.followSymlinks, prefix+"follow_symlinks", false, "If true, follow symlinks to directories & archives when looking for mapshots - e.g., to serve mapshots stored on another volume.")
+	flags.StringSliceVar(&sf.excludes, prefix+"exclude", nil, "Glob pattern of directories to skip when looking for mapshots, matched against both the directory name and its path relative to the base directory; e.g., screenshots or mapshot/old-*. Can be repeated.")
+	flags.IntVar(&sf.maxScanDepth, prefix+"max_scan_depth", 4, "How many levels of directories below the base directory are looked into for mapshots. Mapshots rendered by Factorio are 3 levels down. Set to 0 for no limit.")
+	flags.StringVar(&sf.missingTile, prefix+"missing_tile", "404", "How to answer requests for tiles which were never rendered, e.g., at the edges of the map: 404, or transparent to serve a transparent image instead.")
+	flags.BoolVar(&sf.allowListing, prefix+"allow_listing", false, "If true, list the content of directories of mapshots - e.g., to browse the tiles. Otherwise, they get a 404.")
+	flags.StringVar(&sf.frontendDir, prefix+"frontend_dir", "", "If specified, serve the UI from this directory instead of the embedded one - e.g., frontend/dist/ when working on the UI. It must contain listing/ and viewer/ subdirectories.")
+	flags.BoolVar(&sf.liveReload, prefix+"live_reload", false, "If true, reload pages of the UI when files in --frontend_dir change. For development only.")
+	flags.BoolVar(&sf.open, prefix+"open", false, "If true, open the UI in the default browser once the server is ready.")
+	sf.s3.Register(flags, prefix)
+	sf.flags = flags
+	sf.prefix = prefix
+	return sf
+}
+
+// validate checks the consistency of the flags. It is meant to be called
+// before doing any significant work, so errors are reported early.
+func (sf *ServeFlags) validate() error {
+	if sf.accessLogFormat != "clf" && sf.accessLogFormat != "json" {
+		return fmt.Errorf("invalid --access_log_format %q; must be clf or json", sf.accessLogFormat)
+	}
+	if sf.urlPrefix != "" && !strings.HasPrefix(sf.urlPrefix, "/") {
+		return fmt.Errorf("invalid --url_prefix %q: must start with '/'", sf.urlPrefix)
+	}
+	if sf.readHeaderTimeout < 0 || sf.readTimeout < 0 || sf.writeTimeout < 0 || sf.idleTimeout < 0 {
+		return errors.New("flags --read_header_timeout, --read_timeout, --write_timeout and --idle_timeout must not be negative")
+	}
+	if sf.maxHeaderBytes <= 0 {
+		return fmt.Errorf("invalid --max_header_bytes %d: must be positive", sf.maxHeaderBytes)
+	}
+	if sf.rescanInterval < 0 {
+		return fmt.Errorf("invalid --rescan_interval %v: must not be negative", sf.rescanInterval)
+	}
+	if sf.maxScanDepth < 0 {
+		return fmt.Errorf("invalid --max_scan_depth %d: must not be negative", sf.maxScanDepth)
+	}
+	if sf.rateLimit < 0 {
+		return fmt.Errorf("invalid --rate_limit %v: must not be negative", sf.rateLimit)
+	}
+	if _, err := newTrustedProxies(sf.trustedProxies); err != nil {
+		return err
+	}
+	if sf.maxConnections < 0 {
+		return fmt.Errorf("invalid --max_connections %d: must not be negative", sf.maxConnections)
+	}
+	if sf.maxInflight < 0 {
+		return fmt.Errorf("invalid --max_inflight %d: must not be negative", sf.maxInflight)
+	}
+	if sf.missingTile != "404" && sf.missingTile != "transparent" {
+		return fmt.Errorf("invalid --missing_tile %q; must be 404 or transparent", sf.missingTile)
+	}
+	if shotOrders[sf.sort] == nil {
+		return fmt.Errorf("invalid --sort value %q; must be one of mtime, tick, name", sf.sort)
+	}
+	if sf.network != "tcp" && sf.network != "tcp4" && sf.network != "tcp6" {
+		return fmt.Errorf("invalid --network %q; must be tcp, tcp4 or tcp6", sf.network)
+	}
+	if sf.unixSocket != "" {
+		if sf.open {
+			return errors.New("flag --open cannot be used with --unix_socket; browsers need a TCP port")
+		}
+		if sf.bind != "" || (sf.flags != nil && sf.flags.Changed(sf.prefix+"port")) {
+			return errors.New("flag --unix_socket cannot be used with --port or --bind")
+		}
+		if _, err := strconv.ParseUint(sf.unixSocketMode, 8, 32); err != nil {
+			return fmt.Errorf("invalid --unix_socket_mode %q: must be octal, e.g., 0660", sf.unixSocketMode)
+		}
+	} else if _, err := sf.addr(); err != nil {
+		return err
+	}
+	for _, pattern := range sf.excludes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid --exclude pattern %q: %w", pattern, err)
+		}
+	}
+	if (sf.tlsCert == "") != (sf.tlsKey == "") {
+		return errors.New("flags --tls_cert and --tls_key must be specified together")
+	}
+	if sf.adminToken != "" && sf.adminTokenFile != "" {
+		return errors.New("flags --admin_token and --admin_token_file cannot be used together")
+	}
+	if sf.h2c && sf.tlsCert != "" {
+		return errors.New("flag --h2c cannot be used with --tls_cert; HTTP/2 is already served over TLS")
+	}
+	if len(sf.acmeDomains) > 0 {
+		if sf.tlsCert != "" {
+			return errors.New("flags --acme_domain and --tls_cert cannot be used together; certificates are either obtained automatically or provided")
+		}
+		if sf.h2c {
+			return errors.New("flag --h2c cannot be used with --acme_domain; HTTP/2 is already served over TLS")
+		}
+		for _, domain := range sf.acmeDomains {
+			if domain == "" || strings.ContainsAny(domain, ":/* ") {
+				return fmt.Errorf("invalid --acme_domain %q: must be a domain name, e.g., maps.example.com", domain)
+			}
+		}
+	}
+	if (sf.authUser == "") != (sf.authPassword == "") {
+		return errors.New("flags --auth_user and --auth_password must be specified together")
+	}
+	if sf.frontendDir != "" {
+		for _, sub := range []string{"listing", "viewer"} {
+			if err := checkDir(filepath.Join(sf.frontendDir, sub)); err != nil {
+				return fmt.Errorf("invalid --frontend_dir: %w", err)
+			}
+		}
+	}
+	if sf.liveReload && sf.frontendDir == "" {
+		return errors.New("--live_reload requires --frontend_dir; the embedded UI never changes")
+	}
+	return nil
+}
+
+// frontend returns the handlers for the listing & viewer UIs, either embedded
+// or from --frontend_dir.
+func (sf *ServeFlags) frontend() (http.Handler, http.Handler) {
+	if sf.frontendDir == "" {
+		return builtinListingMux, builtinViewerMux
+	}
+	return diskFrontendHandler(filepath.Join(sf.frontendDir, "listing")), diskFrontendHandler(filepath.Join(sf.frontendDir, "viewer"))
+}
+
+// scanOptions returns how to look for mapshots in directories.
+func (sf *ServeFlags) scanOptions() scanOptions {
+	return scanOptions{
+		fullRescanInterval: sf.fullRescanInterval,
+		followSymlinks:     sf.followSymlinks,
+		excludes:           sf.excludes,
+		maxDepth:           sf.maxScanDepth,
+	}
+}
+
+// shotSource is a location containing mapshots.
+type shotSource struct {
+	// Label prefixing names & paths of shots from this source. Empty when only
+	// a single source is served.
+	label string
+	store shotStore
+}
+
+// sources returns the locations containing the mapshots to serve. Factorio
+// is only looked up when no explicit location was provided.
+func (sf *ServeFlags) sources(fs *factorio.Settings) ([]shotSource, error) {
+	if len(sf.baseDirs) == 0 && len(sf.namedSources) == 0 && sf.s3.bucket == "" {
+		dir, err := fs.ScriptOutput()
+		if err != nil {
+			return nil, err
+		}
+		return []shotSource{{store: newDirStore(dir, sf.scanOptions())}}, nil
+	}
+
+	count := len(sf.baseDirs) + len(sf.namedSources)
+	if sf.s3.bucket != "" {
+		count++
+	}
+	var sources []shotSource
+	labels := map[string]bool{}
+	checkLabel := func(flag string, label string) error {
+		if strings.Contains(label, "/") || label == "." || label == ".." {
+			return fmt.Errorf("invalid --%s: label %q must not contain '/'", flag, label)
+		}
+		if labels[label] {
+			return fmt.Errorf("invalid --%s: label %q is used multiple times; use <label>=<path> to specify distinct labels", flag, label)
+		}
+		labels[label] = true
+		return nil
+	}
+	for _, value := range sf.baseDirs {
+		label, dir := "", value
+		if idx := strings.Index(value, "="); idx >= 0 {
+			label = value[:idx]
+			dir = value[idx+1:]
+		}
+		if err := checkDir(dir); err != nil {
+			return nil, fmt.Errorf("invalid --base_dir: %w", err)
+		}
+		if count == 1 {
+			// Keep names unchanged when there is a single source.
+			sources = append(sources, shotSource{store: newDirStore(dir, sf.scanOptions())})
+			break
+		}
+		if label == "" {
+			label = filepath.Base(filepath.Clean(dir))
+		}
+		if err := checkLabel("base_dir", label); err != nil {
+			return nil, err
+		}
+		sources = append(sources, shotSource{label: label, store: newDirStore(dir, sf.scanOptions())})
+	}
+	for _, value := range sf.namedSources {
+		idx := strings.Index(value, "=")
+		if idx <= 0 || idx == len(value)-1 {
+			return nil, fmt.Errorf("invalid --source %q: must be label=path", value)
+		}
+		label, dir := value[:idx], value[idx+1:]
+		if err := checkLabel("source", label); err != nil {
+			return nil, err
+		}
+		sources = append(sources, shotSource{label: label, store: newDirStore(dir, sf.scanOptions())})
+	}
+	if sf.s3.bucket != "" {
+		store, err := sf.s3.newStore()
+		if err != nil {
+			return nil, err
+		}
+		if labels["s3"] {
+			return nil, errors.New("invalid --base_dir or --source: label \"s3\" is reserved for --s3_bucket")
+		}
+		src := shotSource{label: "s3", store: store}
+		if count == 1 {
+			src.label = ""
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// checkDir verifies that the directory exists and is readable.
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return fmt.Errorf("unable to read %s: %w", dir, err)
+	}
+	return nil
+}
+
+// addr returns the address to listen on.
+func (sf *ServeFlags) addr() (string, error) {
+	if sf.bind == "" && len(sf.acmeDomains) > 0 && (sf.flags == nil || !sf.flags.Changed(sf.prefix+"port")) {
+		return ":443", nil
+	}
+	if sf.bind == "" {
+		if sf.port < 0 || sf.port > 65535 {
+			return "", fmt.Errorf("invalid port %d", sf.port)
+		}
+		return fmt.Sprintf(":%d", sf.port), nil
+	}
+	host, port, err := net.SplitHostPort(sf.bind)
+	if err != nil {
+		return "", fmt.Errorf("invalid --bind address %q: %w", sf.bind, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid port in --bind address %q", sf.bind)
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid IPv6 address in --bind address %q", sf.bind)
+	}
+	return sf.bind, nil
+}
+
+// wrap adds the middlewares configured by the flags around the handler.
+func (sf *ServeFlags) wrap(s *Server) (http.Handler, error) {
+	var handler http.Handler = s
+	if sf.compress {
+		handler = compressHandler(handler)
+	}
+	authorized := handler
+	if sf.authUser != "" || sf.authFile != "" {
+		auth := newAuthenticator()
+		if sf.authUser != "" {
+			auth.addPlain(sf.authUser, sf.authPassword)
+		}
+		if sf.authFile != "" {
+			if err := auth.loadFile(sf.authFile); err != nil {
+				return nil, err
+			}
+		}
+		if s.shares != nil {
+			auth.bypass = s.shares.allows
+		}
+		handler = auth.wrap(handler)
+	}
+	if sf.adminToken != "" || sf.adminTokenFile != "" {
+		token := sf.adminToken
+		if sf.adminTokenFile != "" {
+			var err error
+			if token, err = loadAdminToken(sf.adminTokenFile); err != nil {
+				return nil, err
+			}
+		}
+		ta := &tokenAuthenticator{token: []byte(token)}
+		handler = ta.wrap(handler, authorized)
+	}
+	// CORS preflight requests do not carry credentials, so must be answered
+	// before authentication.
+	if len(sf.corsOrigins) > 0 {
+		handler = newCORSHandler(handler, sf.corsOrigins)
+	}
+	if p := sf.cleanURLPrefix(); p != "" {
+		handler = prefixHandler(p, handler)
+	}
+	// Within the access log, so failed requests are logged with their 500.
+	handler = s.recoverHandler(handler)
+	if sf.accessLog || sf.accessLogFile != "" {
+		var writers []io.Writer
+		if sf.accessLog {
+			writers = append(writers, os.Stderr)
+		}
+		if sf.accessLogFile != "" {
+			f, err := os.OpenFile(sf.accessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open access log: %w", err)
+			}
+			writers = append(writers, f)
+		}
+		al := &accessLogger{
+			format: sf.accessLogFormat,
+			w:      io.MultiWriter(writers...),
+		}
+		handler = al.wrap(handler)
+	}
+	// Before anything looking at the client address.
+	if len(sf.trustedProxies) > 0 {
+		tp, err := newTrustedProxies(sf.trustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		handler = tp.wrap(handler)
+	}
+	return handler, nil
+}
+
+// cleanURLPrefix returns the URL prefix, without trailing slash.
+func (sf *ServeFlags) cleanURLPrefix() string {
+	return strings.TrimSuffix(sf.urlPrefix, "/")
+}
+
+// prefixHandler serves the handler only under the given prefix, which is
+// removed from the path. Anything else is not found.
+func prefixHandler(prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == prefix {
+			http.Redirect(w, req, prefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(req.URL.Path, prefix+"/") {
+			http.NotFound(w, req)
+			return
+		}
+		http.StripPrefix(prefix, h).ServeHTTP(w, req)
+	})
+}
+
 // shotInfo gives internal information about a single mapshot.
 type shotInfo struct {
 	name string
@@ -27,32 +529,131 @@ type shotInfo struct {
 	// Name of the save. Always uses slashes.
 	savename string
 	json     *MapshotJSON
-	// Filesystem path of this mapshot.
+	// Filesystem path of this mapshot - the directory, or the zip file for
+	// archives. Empty if the mapshot is not on the local filesystem.
 	fsPath string
+	// True if the mapshot is a single file - zip or MBTiles - instead of a
+	// directory.
+	archive bool
+	// Path of the MBTiles file containing the tiles; empty if tiles are
+	// regular files.
+	tilesDB string
+	// Content of the mapshot.
+	fsys fs.FS
+	// Label of the source directory; empty if there is only one.
+	source string
+	// Modification time of mapshot.json - i.e., when the render finished.
+	mtime time.Time
+	// Content of mapshot-user.json; nil if absent.
+	meta *UserMetaJSON
+	// Set if mapshot.json could not be fully parsed; json then only has
+	// what could be read.
+	jsonErr error
 }
 
 // ShotsJSON is the data sent to the UI to build the listing.
 type ShotsJSON struct {
+	// Shots, grouped by directory.
 	All []*ShotsJSONSave `json:"all"`
+	// Shots, grouped by the savename recorded in mapshot.json.
+	Saves []*ShotsJSONGroup `json:"saves"`
 }
 
+// Group of the shots which do not have a savename in their mapshot.json.
+const unknownGroup = "unknown"
+
 // ShotsJSONSave is part of ShotsJSON.
 type ShotsJSONSave struct {
 	Savename string           `json:"savename"`
+	Source   string           `json:"source,omitempty"`
 	Versions []*ShotsJSONInfo `json:"versions"`
 }
 
-// ShotsJSONInfo is part of ShotsJSONSave.
+// ShotsJSONGroup is part of ShotsJSON. Shots are ordered by tick.
+type ShotsJSONGroup struct {
+	Savename string           `json:"savename"`
+	Shots    []*ShotsJSONInfo `json:"shots"`
+}
+
+// ShotsJSONInfo is part of ShotsJSONSave & ShotsJSONGroup.
 type ShotsJSONInfo struct {
 	Name        string `json:"name,omitempty"`
 	Path        string `json:"path,omitempty"`
 	TicksPlayed int64  `json:"ticks_played,omitempty"`
+	Source      string `json:"source,omitempty"`
+	// Savename as recorded in mapshot.json.
+	Savename string `json:"savename,omitempty"`
+	Tick     int64  `json:"tick,omitempty"`
+	// When mapshot.json was last modified.
+	Mtime time.Time `json:"mtime"`
+	// Total size of the files & number of tiles; only set once computed.
+	Bytes int64 `json:"bytes,omitempty"`
+	Tiles int64 `json:"tiles,omitempty"`
+	// From mapshot-user.json.
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Rendered surfaces, from mapshot.json - so the viewer does not need to
+	// fetch it before showing the layers.
+	Surfaces []*MapshotSurfaceJSON `json:"surfaces,omitempty"`
+	// Set if mapshot.json could not be parsed; other fields might be
+	// missing.
+	MetadataError string `json:"metadata_error,omitempty"`
 }
 
 // MapshotJSON is a partial representation of the content of mapshot.json.
 type MapshotJSON struct {
 	// Many field omitted that are not used from go.
-	TicksPlayed int64 `json:"ticks_played,omitempty"`
+	Savename    string                `json:"savename,omitempty"`
+	Tick        int64                 `json:"tick,omitempty"`
+	TicksPlayed int64                 `json:"ticks_played,omitempty"`
+	UniqueID    string                `json:"unique_id,omitempty"`
+	Surfaces    []*MapshotSurfaceJSON `json:"surfaces,omitempty"`
+	// Extension of the tiles; jpg if empty.
+	TileFormat string `json:"tile_format,omitempty"`
+	// Version of the Factorio binary, when rendered with `mapshot render`.
+	FactorioVersion string `json:"factorio_version,omitempty"`
+	// Effective rendering parameters; nil for old mapshots.
+	Params *MapshotParamsJSON `json:"params,omitempty"`
+}
+
+// MapshotParamsJSON is part of MapshotJSON; only what is used from go is
+// kept.
+type MapshotParamsJSON struct {
+	// Tiles without entities are not rendered when 0.
+	MinJPGQuality *float64 `json:"minjpgquality,omitempty"`
+}
+
+// MapshotSurfaceJSON is the part of mapshot.json describing a rendered
+// surface; only what the listing needs is kept.
+type MapshotSurfaceJSON struct {
+	SurfaceName string `json:"surface_name"`
+	SurfaceIdx  int    `json:"surface_idx"`
+	// Size of a tile in in-game units, for the least detailed zoom level.
+	TileSize float64 `json:"tile_size"`
+	// Size of a tile, in pixels.
+	RenderSize int `json:"render_size"`
+	// Area rendered.
+	WorldMin *FactorioPosition `json:"world_min,omitempty"`
+	WorldMax *FactorioPosition `json:"world_max,omitempty"`
+	ZoomMin  int               `json:"zoom_min"`
+	ZoomMax  int               `json:"zoom_max"`
+}
+
+// FactorioPosition is a position in the game, in tiles.
+type FactorioPosition struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// parseMapshotJSON parses the content of mapshot.json. On invalid content, it
+// still returns whatever could be read - possibly nothing - along with the
+// error, so the mapshot can be listed anyway.
+func parseMapshotJSON(raw []byte) (*MapshotJSON, error) {
+	data := &MapshotJSON{}
+	if err := json.Unmarshal(raw, data); err != nil {
+		return data, fmt.Errorf("invalid mapshot.json: %w", err)
+	}
+	return data, nil
 }
 
 // MapshotConfigJSON is a representation of the viewer configuration.
@@ -60,85 +661,262 @@ type MapshotConfigJSON struct {
 	Path string `json:"path"`
 }
 
-func findShots(baseDir string) ([]shotInfo, error) {
-	realDir, err := filepath.EvalSymlinks(baseDir)
+// archiveShot reads the mapshot information from a zip file. Name & paths are
+// left to the caller.
+func archiveShot(path string, info os.FileInfo, archives *archiveCache) (*shotInfo, error) {
+	logDebug("found mapshot archive", "path", path)
+	zr, err := archives.open(path, info)
 	if err != nil {
-		return nil, fmt.Errorf("unable to eval symlinks for %s: %w", baseDir, err)
+		return nil, err
 	}
-	glog.Infof("Looking for shots in %s", realDir)
-	var shots []shotInfo
-	err = filepath.Walk(realDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if filepath.Base(path) != "mapshot.json" {
-			return nil
-		}
-		glog.Infof("found mapshot.json: %s", path)
-		raw, err := ioutil.ReadFile(path)
-		if err != nil {
-			glog.Errorf("file %s is not readable", path)
-			return nil
-		}
-
-		mapshotData := &MapshotJSON{}
-		if err := json.Unmarshal(raw, mapshotData); err != nil {
-			glog.Errorf("file %s does not have valid JSON", path)
-			return nil
-		}
-
-		shotPath := filepath.Dir(path)
-		relpath, err := filepath.Rel(realDir, shotPath)
-		if err != nil {
-			glog.Infof("unable to get relative path of %q: %v", shotPath, err)
-			return nil
-		}
-		savename := filepath.ToSlash(filepath.Dir(relpath))
-
-		shots = append(shots, shotInfo{
-			fsPath:   shotPath,
-			name:     filepath.ToSlash(relpath),
-			savename: savename,
-			json:     mapshotData,
-			path:     "/data/" + filepath.ToSlash(relpath) + "/",
-		})
-		return nil
-	})
+	jsonInfo, err := fs.Stat(zr, "mapshot.json")
 	if err != nil {
 		return nil, err
 	}
-	return shots, nil
+	raw, err := fs.ReadFile(zr, "mapshot.json")
+	if err != nil {
+		return nil, err
+	}
+	mapshotData, jsonErr := parseMapshotJSON(raw)
+	if jsonErr != nil {
+		logWarning("archive has an invalid mapshot.json", "path", path, "err", jsonErr)
+	}
+	return &shotInfo{
+		fsPath:  path,
+		archive: true,
+		fsys:    zr,
+		json:    mapshotData,
+		jsonErr: jsonErr,
+		mtime:   jsonInfo.ModTime(),
+	}, nil
+}
+
+// shotOrders lists the available orderings of the mapshots, for --sort. Ties
+// are broken by name, to keep the order stable across rescans.
+var shotOrders = map[string]func(a, b *shotInfo) bool{
+	// Most recent render first.
+	"mtime": func(a, b *shotInfo) bool {
+		if !a.mtime.Equal(b.mtime) {
+			return a.mtime.After(b.mtime)
+		}
+		return a.name < b.name
+	},
+	// Most played first.
+	"tick": func(a, b *shotInfo) bool {
+		if a.json.TicksPlayed != b.json.TicksPlayed {
+			return a.json.TicksPlayed > b.json.TicksPlayed
+		}
+		return a.name < b.name
+	},
+	"name": func(a, b *shotInfo) bool {
+		return a.name < b.name
+	},
 }
 
 // Server implements a server presenting available mapshots and serving their
 // content.
 type Server struct {
-	baseDir               string
+	sf                    *ServeFlags
+	sources               []shotSource
 	listingMux, viewerMux http.Handler
 
-	m   sync.Mutex
-	mux *http.ServeMux
+	// Current *http.ServeMux; read without locking on each request. It is
+	// only written with m held, to stay consistent with the other fields.
+	mux atomic.Value
+
+	m     sync.Mutex
+	shots []shotInfo
+	// Generation of the stats used to build the current mux.
+	statsGen int
+	// Last scan error logged, to avoid repeating it on every scan.
+	lastScanErr    string
+	lastScanErrLog time.Time
+
+	// Set once the first scan for mapshots has completed, even if it failed.
+	scanned bool
+	// When the last successful scan finished.
+	lastScan time.Time
+
+	// Nil if metrics are disabled.
+	metrics *serverMetrics
+	// Nil if rate limiting is disabled.
+	limiter *rateLimiter
+
+	events     *eventHub
+	thumbnails *thumbnailCache
+	// Survives mux updates.
+	stats *statsCache
+	// Nil if sharing is not available.
+	shares *shareStore
+	// Nil if deleted mapshots cannot be tracked.
+	gone *goneTracker
+	// Refreshed after scans.
+	diskUsageCache diskUsageCache
+	// Nil unless --live_reload.
+	reloader *liveReloader
+
+	// Coalesces rescans requested through the API.
+	rescans singleflight.Group
+	// Held for a whole updateMux, so a scan which started earlier cannot
+	// replace the result of a more recent one.
+	scanMu sync.Mutex
 }
 
-func newServer(baseDir string, listingMux, viewerMux http.Handler) *Server {
+func newServer(sf *ServeFlags, sources []shotSource, listingMux, viewerMux http.Handler) *Server {
+	registerMIMETypes()
 	s := &Server{
-		baseDir:    baseDir,
+		sf:         sf,
+		sources:    sources,
 		listingMux: listingMux,
 		viewerMux:  viewerMux,
+		events:     newEventHub(),
+		thumbnails: newThumbnailCache(),
+		stats:      newStatsCache(),
+	}
+	if sf.enableMetrics {
+		s.metrics = newServerMetrics()
+	}
+	if sf.rateLimit > 0 {
+		s.limiter = newRateLimiter(sf.rateLimit, sf.rateLimitBurst, sf.rateLimitExemptLoopback)
+	}
+	if sf.liveReload {
+		s.reloader = newLiveReloader(sf.frontendDir)
+		s.listingMux = s.injectLiveReload(listingMux)
+		s.viewerMux = s.injectLiveReload(viewerMux)
+	}
+	// Share tokens & deleted mapshots are stored in the first local
+	// directory.
+	for _, src := range sources {
+		if ds, ok := src.store.(*dirStore); ok {
+			shares, err := newShareStore(filepath.Join(ds.dir, sharesFile))
+			if err != nil {
+				logError("sharing disabled", "error", err)
+			} else {
+				s.shares = shares
+			}
+			gone, err := newGoneTracker(filepath.Join(ds.dir, goneFile))
+			if err != nil {
+				logError("deleted mapshots will not be reported", "error", err)
+			} else {
+				s.gone = gone
+			}
+			break
+		}
 	}
-	s.updateMux()
 	return s
 }
 
-// watch regularly updates the list of available maps. Current implementation is
-// the dumbest possible one - it just rescan files every few seconds and
-// recreate a completely new mux in that case.
+// Delays between rescans of the mapshots. When filesystem notifications are
+// available, rescans are mostly triggered by those; a periodic rescan is still
+// done, just in case some notifications were missed. Otherwise, rescans are
+// done every --rescan_interval, which defaults to pollDelay.
+const (
+	pollDelay     = 8 * time.Second
+	fallbackDelay = 5 * time.Minute
+	// How long to wait after a notification before rescanning, to batch
+	// together bursts of changes.
+	notifyDelay = time.Second
+)
+
+// fuzzDelay adds up to 25% of random extra time to the delay.
+func fuzzDelay(d time.Duration) time.Duration {
+	if d < 4 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/4))
+}
+
+// watch keeps the list of available maps up to date. It relies on filesystem
+// notifications, with a slow periodic rescan in case changes were missed. On
+// any issue with notifications, it reverts to a regular rescan every
+// --rescan_interval. It starts with an initial scan; until then, the server is
+// not ready.
 func (s *Server) watch(ctx context.Context) {
+	// Event streams would otherwise prevent a graceful shutdown.
+	defer s.events.close()
+	if s.reloader != nil {
+		go s.reloader.run(ctx)
+	}
+	reportFirstScan(s.updateMux())
+	if s.sf.rescanInterval == 0 {
+		logInfo("rescans disabled; mapshots are only looked for at startup")
+		<-ctx.Done()
+		return
+	}
+	logInfo("rescanning mapshots periodically when filesystem notifications are not available", "interval", s.sf.rescanInterval)
+
+	// Only local directories can be watched; other stores rely on the
+	// periodic rescan.
+	var dirs []string
+	for _, src := range s.sources {
+		if ds, ok := src.store.(*dirStore); ok {
+			dirs = append(dirs, ds.dir)
+		}
+	}
+	sw, err := newShotsWatcher(dirs, s.sf.scanOptions())
+	if err != nil {
+		logWarning("filesystem notifications not available, polling instead", "error", err)
+		s.poll(ctx)
+		return
+	}
+	defer sw.close()
+	if err := sw.sync(s.currentShots()); err != nil {
+		logWarning("unable to watch mapshots, polling instead", "error", err)
+		s.poll(ctx)
+		return
+	}
+
+	fallback := time.NewTimer(fuzzDelay(fallbackDelay))
+	defer fallback.Stop()
+	// Only set when a rescan is pending after a notification.
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-sw.w.Events:
+			if !ok {
+				logWarning("filesystem notifications stopped, polling instead")
+				s.poll(ctx)
+				return
+			}
+			logDebug("filesystem event", "event", ev)
+			if pending == nil && sw.relevant(ev) {
+				pending = time.After(notifyDelay)
+			}
+			continue
+		case err := <-sw.w.Errors:
+			logWarning("error from filesystem notifications, polling instead", "error", err)
+			s.poll(ctx)
+			return
+		case <-pending:
+		case <-fallback.C:
+		}
+
+		pending = nil
+		s.updateMux()
+		if err := sw.sync(s.currentShots()); err != nil {
+			logWarning("unable to watch mapshots, polling instead", "error", err)
+			s.poll(ctx)
+			return
+		}
+		if !fallback.Stop() {
+			select {
+			case <-fallback.C:
+			default:
+			}
+		}
+		fallback.Reset(fuzzDelay(fallbackDelay))
+	}
+}
+
+// poll regularly updates the list of available maps. It is the dumbest
+// possible approach - it just rescan files every --rescan_interval and
+// recreate a completely new mux in that case.
+func (s *Server) poll(ctx context.Context) {
 	for {
-		// Update list of maps regular, with some fuzzing.
-		delay := time.Duration(8000+rand.Int63n(2000)) * time.Millisecond
 		select {
-		case <-time.After(delay):
+		case <-time.After(fuzzDelay(s.sf.rescanInterval)):
 		case <-ctx.Done():
 			return
 		}
@@ -146,97 +924,411 @@ func (s *Server) watch(ctx context.Context) {
 	}
 }
 
-func (s *Server) updateMux() {
+// currentMux returns the mux serving the mapshots; nil until the first scan
+// has completed.
+func (s *Server) currentMux() *http.ServeMux {
+	mux, _ := s.mux.Load().(*http.ServeMux)
+	return mux
+}
+
+// currentShots returns the mapshots found during the last successful scan.
+func (s *Server) currentShots() []shotInfo {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.shots
+}
+
+// findAllShots looks for mapshots in all sources, adjusting their names to
+// include the label of their source. A source which cannot be read - e.g., an
+// unmounted directory - only drops its own mapshots; an error is returned
+// only if none could be read. Other failures are returned as partialErr.
+func (s *Server) findAllShots() (all []shotInfo, partialErr error, err error) {
+	var failures []string
+	for _, src := range s.sources {
+		shots, err := src.store.list()
+		if err != nil {
+			err = fmt.Errorf("unable to find mapshots at %s: %w", src.store, err)
+			if len(s.sources) == 1 {
+				return nil, nil, err
+			}
+			failures = append(failures, err.Error())
+			continue
+		}
+		for _, shot := range shots {
+			if src.label != "" {
+				shot.source = src.label
+				shot.name = src.label + "/" + shot.name
+				shot.savename = src.label + "/" + shot.savename
+				shot.path = "/data/" + shot.name + "/"
+			}
+			all = append(all, shot)
+		}
+	}
+	if len(failures) == 0 {
+		return all, nil, nil
+	}
+	err = errors.New(strings.Join(failures, "; "))
+	if len(failures) == len(s.sources) {
+		return nil, nil, err
+	}
+	return all, err, nil
+}
+
+// updateMux looks for mapshots and, if they changed, swaps in a new mux
+// serving them. Concurrent calls are serialized; each one sees changes made
+// on disk before it was called.
+func (s *Server) updateMux() *scanResult {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
 	// Find all existing mapshots.
-	shots, err := findShots(s.baseDir)
-	if err != nil {
+	start := time.Now()
+	shots, partialErr, scanErr := s.findAllShots()
+	res := &scanResult{shots: len(shots), duration: time.Since(start), err: scanErr}
+	s.metrics.recordScan(len(shots), res.duration, scanErr)
+	if scanErr != nil {
 		shots = nil
-		glog.Errorf("unable to find mapshots at %s: %v", s.baseDir, err)
+		s.logScanError(scanErr)
+	} else if partialErr != nil {
+		s.logScanError(partialErr)
 	}
 
-	// Build shots.json
+	less := shotOrders[s.sf.sort]
 	sort.Slice(shots, func(i, j int) bool {
-		return shots[i].json.TicksPlayed > shots[j].json.TicksPlayed
+		return less(&shots[i], &shots[j])
 	})
-	kwShots := map[string]*ShotsJSONSave{}
-	var savenames []string
-	for _, shot := range shots {
-		if kwShots[shot.savename] == nil {
-			savenames = append(savenames, shot.savename)
-			kwShots[shot.savename] = &ShotsJSONSave{
-				Savename: shot.savename,
-			}
-		}
-		kwShots[shot.savename].Versions = append(kwShots[shot.savename].Versions, &ShotsJSONInfo{
-			Name:        shot.name,
-			Path:        shot.path,
-			TicksPlayed: shot.json.TicksPlayed,
-		})
+
+	if scanErr == nil {
+		s.updateStats(shots)
+	}
+	// With a partial failure, mapshots of the failing source are missing, but
+	// not deleted.
+	if scanErr == nil && partialErr == nil && s.gone != nil {
+		s.gone.update(shots)
 	}
-	sort.Strings(savenames)
 
-	var data ShotsJSON
-	for _, savename := range savenames {
-		data.All = append(data.All, kwShots[savename])
+	// Keep the current mux when nothing changed, so handlers are not
+	// recreated needlessly.
+	statsGen := s.stats.generation()
+	s.m.Lock()
+	unchanged := scanErr == nil && s.currentMux() != nil && sameShots(s.shots, shots) && s.statsGen == statsGen
+	if unchanged {
+		s.scanned = true
+		s.lastScan = time.Now()
+	}
+	s.m.Unlock()
+	if unchanged {
+		return res
 	}
 
+	// Build shots.json
+	data := s.buildShotsJSON(shots)
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		jsonData = nil
-		glog.Errorf("unable to build shots.json: %v", err)
+		logError("unable to build shots.json", "error", err)
 	}
+	// Captured by the handler below, so they are swapped together with the
+	// mux.
+	jsonSum := sha256.Sum256(jsonData)
+	jsonETag := `"` + hex.EncodeToString(jsonSum[:16]) + `"`
+	jsonModTime := time.Now()
 
 	// Serve each shot data
 	mux := http.NewServeMux()
 	for _, shot := range shots {
-		mux.Handle(shot.path, http.StripPrefix(shot.path, http.FileServer(http.Dir(shot.fsPath))))
+		mux.Handle(shot.path, http.StripPrefix(shot.path, s.shotHandler(shot.fsys, shot.path)))
 	}
 
-	// Serve pointer to latest
-	for _, versions := range data.All {
-		savename := versions.Savename
-		if len(versions.Versions) < 1 {
-			continue
-		}
-		latest := versions.Versions[0]
+	// Unknown mapshots - e.g., hidden or deleted ones - must not get the
+	// listing UI.
+	mux.HandleFunc("/data/", s.handleUnknownShot)
 
-		cfg := &MapshotConfigJSON{
-			Path: latest.Path,
-		}
-		jsonCfg, err := json.Marshal(cfg)
-		if err != nil {
-			glog.Errorf("unable to build mapshot config: %v", err)
-		}
-		mux.HandleFunc("/latest/"+savename, func(w http.ResponseWriter, req *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(jsonCfg)
-		})
-	}
+	// Serve pointer to latest
+	latest := s.newLatestHandler(shots)
+	mux.Handle("/latest", latest)
+	mux.Handle("/latest/", latest)
 
 	// Serve basic site.
-	mux.Handle("/", s.listingMux)
+	if len(shots) == 0 {
+		mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/" {
+				noShotsHandler(w, req)
+				return
+			}
+			s.listingMux.ServeHTTP(w, req)
+		}))
+	} else {
+		mux.Handle("/", s.listingMux)
+	}
 	mux.HandleFunc("/shots.json", func(w http.ResponseWriter, req *http.Request) {
+		// Content changes as soon as a new mapshot is available.
+		w.Header().Set("Cache-Control", "no-cache")
+		if len(req.URL.RawQuery) > 0 {
+			s.serveFilteredShotsJSON(w, req, shots)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(jsonData)
+		w.Header().Set("ETag", jsonETag)
+		// Takes care of conditional requests & Content-Length.
+		http.ServeContent(w, req, "shots.json", jsonModTime, bytes.NewReader(jsonData))
 	})
 
 	// Serve map viewer.
 	mux.Handle("/map/", http.StripPrefix("/map", s.viewerMux))
 
+	// API.
+	mux.HandleFunc("/api/shots", s.handleUpload)
+	mux.HandleFunc("/api/shots/", s.handleShotsAPI)
+	mux.HandleFunc("/api/v1/shots", s.handleAPIShots)
+	mux.HandleFunc("/api/v1/shots/", s.handleAPIShot)
+	mux.HandleFunc("/api/events", s.handleEvents)
+	mux.HandleFunc("/api/rescan", s.handleRescan)
+	mux.HandleFunc("/api/disk-usage", s.handleDiskUsage)
+	mux.HandleFunc("/api/schedules", s.handleSchedules)
+	mux.HandleFunc("/api/shares", s.handleShares)
+	mux.HandleFunc("/api/shares/", s.handleShares)
+	mux.HandleFunc("/share/", s.handleShare)
+	if s.reloader != nil {
+		mux.HandleFunc("/api/live_reload", s.handleLiveReload)
+	}
+
+	if s.metrics != nil {
+		mux.Handle("/metrics", s.metrics)
+	}
+
 	s.m.Lock()
-	defer s.m.Unlock()
+	s.scanned = true
+	var events []*shotEvent
+	if scanErr == nil {
+		s.lastScan = time.Now()
+		events = s.diffShots(s.shots, shots)
+	}
 	// Only update if reading did not fail - or if it was the first call, to
 	// make sure we always have a mux.
-	if shots != nil || s.mux == nil {
-		s.mux = mux
+	if scanErr == nil || s.currentMux() == nil {
+		s.mux.Store(mux)
+		s.shots = shots
+		s.statsGen = statsGen
+	}
+	s.m.Unlock()
+
+	for _, ev := range events {
+		if ev.kind == "added" {
+			res.added++
+		} else {
+			res.removed++
+		}
+	}
+	if len(events) > 0 {
+		s.events.publish(events)
+		logInfo("mapshots changed", "shots", res.shots, "added", res.added, "removed", res.removed, "duration", res.duration)
+	}
+	for _, ev := range events {
+		logDebug("mapshot "+ev.kind, "shot", ev.data.Name)
+	}
+	return res
+}
+
+// scanResult describes what a scan for mapshots found.
+type scanResult struct {
+	shots          int
+	added, removed int
+	duration       time.Duration
+	err            error
+}
+
+// sameShots indicates whether both lists contain the same mapshots, with the
+// same content, regardless of order.
+func sameShots(a, b []shotInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	known := map[string]*shotInfo{}
+	for i := range a {
+		known[a[i].name] = &a[i]
+	}
+	for i := range b {
+		prev := known[b[i].name]
+		if prev == nil || prev.fsPath != b[i].fsPath || prev.archive != b[i].archive || !prev.mtime.Equal(b[i].mtime) || prev.meta != b[i].meta {
+			return false
+		}
+	}
+	return true
+}
+
+// buildShotsJSON builds the content of shots.json, from already sorted
+// mapshots.
+func (s *Server) buildShotsJSON(shots []shotInfo) *ShotsJSON {
+	kwShots := map[string]*ShotsJSONSave{}
+	var savenames []string
+	groups := map[string]*ShotsJSONGroup{}
+	var groupNames []string
+	for _, shot := range shots {
+		if kwShots[shot.savename] == nil {
+			savenames = append(savenames, shot.savename)
+			kwShots[shot.savename] = &ShotsJSONSave{
+				Savename: shot.savename,
+				Source:   shot.source,
+			}
+		}
+		info := &ShotsJSONInfo{
+			Name:        shot.name,
+			Path:        s.urlPath(shot.path),
+			TicksPlayed: shot.json.TicksPlayed,
+			Source:      shot.source,
+			Savename:    shot.json.Savename,
+			Tick:        shot.json.Tick,
+			Mtime:       shot.mtime,
+			Surfaces:    shot.json.Surfaces,
+		}
+		if shot.jsonErr != nil {
+			info.MetadataError = shot.jsonErr.Error()
+		}
+		if stats := s.stats.lookup(&shot); stats != nil {
+			info.Bytes = stats.Bytes
+			info.Tiles = stats.Tiles
+		}
+		if shot.meta != nil {
+			info.Description = shot.meta.Description
+			info.Tags = shot.meta.Tags
+		}
+		kwShots[shot.savename].Versions = append(kwShots[shot.savename].Versions, info)
+
+		groupName := shot.json.Savename
+		if groupName == "" {
+			groupName = unknownGroup
+		}
+		if groups[groupName] == nil {
+			groupNames = append(groupNames, groupName)
+			groups[groupName] = &ShotsJSONGroup{Savename: groupName}
+		}
+		groups[groupName].Shots = append(groups[groupName].Shots, info)
 	}
+	sort.Strings(savenames)
+	sort.Strings(groupNames)
+
+	data := &ShotsJSON{
+		Saves: []*ShotsJSONGroup{},
+	}
+	for _, savename := range savenames {
+		data.All = append(data.All, kwShots[savename])
+	}
+	for _, name := range groupNames {
+		group := groups[name]
+		sort.SliceStable(group.Shots, func(i, j int) bool {
+			return group.Shots[i].Tick < group.Shots[j].Tick
+		})
+		data.Saves = append(data.Saves, group)
+	}
+
+	return data
+}
+
+// urlPath returns the URL path to use in data sent to clients, taking into
+// account --url_prefix.
+func (s *Server) urlPath(p string) string {
+	return s.sf.cleanURLPrefix() + p
+}
+
+// shotHandler serves the files of a single mapshot, available at shotPath.
+// Content of a mapshot never changes once rendered, so it can be cached by
+// browsers.
+func (s *Server) shotHandler(fsys fs.FS, shotPath string) http.Handler {
+	fileServer := http.FileServer(http.FS(fsys))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+		if name == "" {
+			name = "."
+		}
+		if r, ok := fsys.(redirector); ok && name != "." {
+			u, err := r.redirectURL(name)
+			if err != nil {
+				logError("unable to get URL", "shot", name, "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if u != "" {
+				http.Redirect(w, req, u, http.StatusTemporaryRedirect)
+				return
+			}
+		}
+
+		// Only sent along content which is actually served; errors &
+		// redirects must not be cached.
+		cacheControl := ""
+		if ttl := s.sf.tileCacheTTL; ttl > 0 {
+			cacheControl = fmt.Sprintf("public, max-age=%d", int64(ttl.Seconds()))
+		}
+		if name != "." && servePrecompressed(w, req, fsys, name, cacheControl) {
+			return
+		}
+		// http.FileServer handles conditional requests based on the ETag if it
+		// is set.
+		info, err := fs.Stat(fsys, name)
+		if err == nil && info.IsDir() && !s.sf.allowListing {
+			// http.FileServer would list the content of directories without
+			// an index.html.
+			if _, err := fs.Stat(fsys, path.Join(name, "index.html")); err != nil {
+				if name == "." {
+					target := s.urlPath("/map/") + "?" + url.Values{"path": {s.urlPath(shotPath)}}.Encode()
+					http.Redirect(w, req, target, http.StatusFound)
+					return
+				}
+				http.NotFound(w, req)
+				return
+			}
+		}
+		if err == nil && info.Mode().IsRegular() {
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+			// Otherwise, http.FileServer sniffs the content.
+			if ctype := shotContentType(name); ctype != "" {
+				w.Header().Set("Content-Type", ctype)
+			}
+		}
+		if errors.Is(err, fs.ErrNotExist) && s.sf.missingTile == "transparent" && isTilePath(name) {
+			// Tiles of a mapshot never appear later, so the placeholder can
+			// be cached as well.
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			servePlaceholderTile(w, req)
+			return
+		}
+		fileServer.ServeHTTP(w, req)
+	})
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	s.m.Lock()
-	mux := s.mux
-	s.m.Unlock()
-	mux.ServeHTTP(w, req)
+	if s.limiter != nil && strings.HasPrefix(req.URL.Path, "/data/") {
+		if ok, wait := s.limiter.allow(req.RemoteAddr); !ok {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			s.metrics.recordRequest(requestClass(req.URL.Path), http.StatusTooManyRequests, 0)
+			return
+		}
+	}
+
+	mux := s.currentMux()
+	if mux == nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Looking for mapshots, try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	if s.metrics == nil {
+		mux.ServeHTTP(w, req)
+		return
+	}
+
+	start := time.Now()
+	sr := &statusRecorder{ResponseWriter: w}
+	mux.ServeHTTP(sr, req)
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	s.metrics.recordRequest(requestClass(req.URL.Path), sr.status, time.Since(start))
 }
 
 var cmdServe = &cobra.Command{
@@ -244,49 +1336,131 @@ var cmdServe = &cobra.Command{
 	Short: "Start a HTTP server giving access to mapshot generated data.",
 	Long: `Start a HTTP server giving access to mapshot generated data.
 
-It serves data from Factorio script-output directory.
+It serves data from Factorio script-output directory, or from the directory
+given with --base_dir - in which case Factorio does not need to be installed.
 	`,
 	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		baseDir, err := factorioSettings.ScriptOutput()
-		if err != nil {
+		if err := serveFlags.validate(); err != nil {
 			return err
 		}
-		fmt.Printf("Serving data from %s\n", baseDir)
-		s := newServer(baseDir, builtinListingMux, builtinViewerMux)
-		go s.watch(cmd.Context())
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
-		addr := fmt.Sprintf(":%d", port)
-		fmt.Printf("Listening on %s ...\n", addr)
-		return http.ListenAndServe(addr, s)
+		sources, err := serveFlags.sources(factorioSettings)
+		if err != nil {
+			return err
+		}
+		for _, src := range sources {
+			if src.label == "" {
+				fmt.Printf("Serving data from %s\n", src.store)
+			} else {
+				fmt.Printf("Serving data from %s as %q\n", src.store, src.label)
+			}
+		}
+		checkSources(sources)
+		if serveFlags.frontendDir != "" {
+			fmt.Printf("Serving UI from %s\n", serveFlags.frontendDir)
+		}
+		listing, viewer := serveFlags.frontend()
+		s := newServer(serveFlags, sources, listing, viewer)
+		go s.watch(ctx)
+		return serveFlags.listenAndServe(ctx, s)
 	},
 }
 
-func buildMux(files map[string]string) *http.ServeMux {
-	mux := http.NewServeMux()
-	for fname, content := range files {
-		fname := fname
-		content := content
-		mux.HandleFunc("/"+fname, func(w http.ResponseWriter, req *http.Request) {
-			b := bytes.NewReader([]byte(content))
-			http.ServeContent(w, req, fname, builtinModTime, b)
-		})
-		if fname == "index.html" {
-			mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-				b := bytes.NewReader([]byte(content))
-				http.ServeContent(w, req, fname, builtinModTime, b)
-			})
+// frontendAsset is a file of the embedded frontend, with what can be computed
+// once.
+type frontendAsset struct {
+	// Derived from the content, so it is stable across restarts.
+	etag    string
+	gzipped []byte
+	ctype   string
+}
+
+// frontendHandler serves the embedded frontend files. Files are compressed
+// once, to be served as is to clients supporting gzip. Unknown paths - e.g.,
+// `/` - get index.html.
+func frontendHandler(fsys fs.FS) http.Handler {
+	assets := map[string]*frontendAsset{}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		assets[p] = &frontendAsset{
+			etag:    hex.EncodeToString(sum[:16]),
+			gzipped: gzipContent(content),
+			ctype:   contentType(p, content),
 		}
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("unable to read embedded frontend: %v", err))
 	}
-	return mux
+
+	fileServer := http.FileServer(http.FS(fsys))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+		asset := assets[name]
+		if asset == nil || name == "index.html" {
+			name = "index.html"
+			asset = assets[name]
+			// http.FileServer serves index.html for the root, and redirects
+			// explicit requests for it.
+			r := new(http.Request)
+			*r = *req
+			r.URL = new(url.URL)
+			*r.URL = *req.URL
+			r.URL.Path = "/"
+			req = r
+		}
+		if asset == nil {
+			http.NotFound(w, req)
+			return
+		}
+		if asset.gzipped != nil {
+			if acceptsEncoding(req, "gzip") {
+				w.Header().Set("ETag", `"`+asset.etag+`-gzip"`)
+				serveEncoded(w, req, name, time.Time{}, bytes.NewReader(asset.gzipped), "gzip", asset.ctype)
+				return
+			}
+			addVary(w.Header(), "Accept-Encoding")
+		}
+		w.Header().Set("ETag", `"`+asset.etag+`"`)
+		fileServer.ServeHTTP(w, req)
+	})
+}
+
+// diskFrontendHandler serves frontend files from a directory, as they are on
+// disk - files are expected to change, so nothing is cached. Like
+// frontendHandler, unknown paths get index.html.
+func diskFrontendHandler(dir string) http.Handler {
+	fileServer := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := path.Clean("/" + req.URL.Path)
+		if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil || info.IsDir() || name == "/index.html" {
+			r := new(http.Request)
+			*r = *req
+			r.URL = new(url.URL)
+			*r.URL = *req.URL
+			r.URL.Path = "/"
+			req = r
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, req)
+	})
 }
 
-var port int
-var builtinModTime = time.Now()
-var builtinListingMux = buildMux(embed.ListingFiles)
-var builtinViewerMux = buildMux(embed.ViewerFiles)
+var serveFlags = &ServeFlags{}
+var builtinListingMux = frontendHandler(embed.ListingFS)
+var builtinViewerMux = frontendHandler(embed.ViewerFS)
 
 func init() {
-	cmdServe.PersistentFlags().IntVar(&port, "port", 8080, "Port to listen on.")
+	serveFlags.Register(cmdServe.PersistentFlags(), "")
 	cmdRoot.AddCommand(cmdServe)
 }
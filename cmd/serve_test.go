@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// newTestServeFlags returns the serve flags with their default values, as
+// modified by the args.
+func newTestServeFlags(t testing.TB, args ...string) *ServeFlags {
+	t.Helper()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	sf := (&ServeFlags{}).Register(flags, "")
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return sf
+}
+
+// newTestServer returns a server for a temporary directory containing the
+// mapshot mapshot/test/d-1, with a single tile. Mapshots have been looked
+// for already.
+func newTestServer(t testing.TB, sf *ServeFlags) (*Server, string) {
+	t.Helper()
+	quietLogs(t)
+	dir := t.TempDir()
+	shot := filepath.Join(dir, "mapshot", "test", "d-1")
+	writeTestShot(t, shot)
+	if err := ioutil.WriteFile(filepath.Join(shot, "s1zoom_0", "tile_0_0.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(sf, []shotSource{{store: newDirStore(dir, scanOptions{})}}, http.NotFoundHandler(), http.NotFoundHandler())
+	if res := s.updateMux(); res.err != nil {
+		t.Fatal(res.err)
+	}
+	// Stats are computed in the background, then trigger another scan; wait
+	// for it, so it does not outlive the test.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		gen := s.stats.generation()
+		s.m.Lock()
+		done := gen > 0 && s.statsGen == gen
+		s.m.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stats of mapshots not computed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.scanMu.Lock()
+	s.scanMu.Unlock()
+	return s, dir
+}
+
+func newTestShotHandler(sf *ServeFlags) http.Handler {
+	fsys := fstest.MapFS{
+		"mapshot.json":          {Data: []byte(`{}`), ModTime: time.Unix(1000, 0)},
+		"s1zoom_0/tile_0_0.jpg": {Data: []byte("jpeg"), ModTime: time.Unix(1000, 0)},
+		"mapshot.json.gz":       {Data: []byte("gzipped"), ModTime: time.Unix(1000, 0)},
+	}
+	s := &Server{sf: sf}
+	return http.StripPrefix("/data/test/", s.shotHandler(fsys, "/data/test/"))
+}
+
+func TestShotHandlerConditional(t *testing.T) {
+	h := newTestShotHandler(&ServeFlags{tileCacheTTL: time.Hour, missingTile: "404"})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/data/test/s1zoom_0/tile_0_0.jpg", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := rec.Header().Get("Cache-Control"), "public, max-age=3600"; got != want {
+		t.Errorf("got Cache-Control %q, want %q", got, want)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	req := httptest.NewRequest("GET", "/data/test/s1zoom_0/tile_0_0.jpg", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("got status %d with If-None-Match, want %d", rec.Code, http.StatusNotModified)
+	}
+}
+
+func TestShotHandlerCacheControl(t *testing.T) {
+	h := newTestShotHandler(&ServeFlags{tileCacheTTL: time.Hour, missingTile: "404"})
+	for _, tc := range []struct {
+		desc     string
+		path     string
+		encoding string
+		status   int
+		cached   bool
+	}{
+		{"tile", "/data/test/s1zoom_0/tile_0_0.jpg", "", http.StatusOK, true},
+		{"precompressed", "/data/test/mapshot.json", "gzip", http.StatusOK, true},
+		{"missing tile", "/data/test/s1zoom_0/tile_5_5.jpg", "", http.StatusNotFound, false},
+		{"directory", "/data/test/s1zoom_0/", "", http.StatusNotFound, false},
+		{"shot root", "/data/test/", "", http.StatusFound, false},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			if tc.encoding != "" {
+				req.Header.Set("Accept-Encoding", tc.encoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("got status %d, want %d", rec.Code, tc.status)
+			}
+			if got := rec.Header().Get("Cache-Control") != ""; got != tc.cached {
+				t.Errorf("got Cache-Control %q, want cached=%v", rec.Header().Get("Cache-Control"), tc.cached)
+			}
+		})
+	}
+}
+
+func TestShotOrders(t *testing.T) {
+	newShot := func(name string, mtime int64, ticks int64) shotInfo {
+		return shotInfo{name: name, mtime: time.Unix(mtime, 0), json: &MapshotJSON{TicksPlayed: ticks}}
+	}
+	shots := []shotInfo{
+		newShot("save/2024-1", 2000, 10),
+		newShot("save/2024-10", 3000, 30),
+		newShot("save/2024-2", 1000, 30),
+		// Same timestamp as 2024-10.
+		newShot("save/2024-09", 3000, 20),
+		newShot("other/d-1", 2000, 5),
+	}
+	for _, tc := range []struct {
+		order string
+		want  []string
+	}{
+		{"mtime", []string{"save/2024-09", "save/2024-10", "other/d-1", "save/2024-1", "save/2024-2"}},
+		{"tick", []string{"save/2024-10", "save/2024-2", "save/2024-09", "save/2024-1", "other/d-1"}},
+		{"name", []string{"other/d-1", "save/2024-09", "save/2024-1", "save/2024-10", "save/2024-2"}},
+	} {
+		t.Run(tc.order, func(t *testing.T) {
+			less := shotOrders[tc.order]
+			// Whatever the initial order, the result is the same.
+			for _, start := range [][]int{{0, 1, 2, 3, 4}, {4, 3, 2, 1, 0}, {2, 0, 4, 1, 3}} {
+				var sorted []shotInfo
+				for _, i := range start {
+					sorted = append(sorted, shots[i])
+				}
+				sort.Slice(sorted, func(i, j int) bool { return less(&sorted[i], &sorted[j]) })
+				var got []string
+				for _, shot := range sorted {
+					got = append(got, shot.name)
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("from %v: got %q, want %q", start, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestShotsJSONOrder(t *testing.T) {
+	sf := newTestServeFlags(t)
+	s, dir := newTestServer(t, sf)
+	for i, name := range []string{"d-2", "d-10", "d-3"} {
+		shot := filepath.Join(dir, "mapshot", "test", name)
+		writeTestShot(t, shot)
+		mtime := time.Unix(int64(1000*(i+1)), 0)
+		if err := os.Chtimes(filepath.Join(shot, "mapshot.json"), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.updateMux()
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/shots.json", nil))
+	data := &ShotsJSON{}
+	if err := json.Unmarshal(rec.Body.Bytes(), data); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, save := range data.All {
+		for _, shot := range save.Versions {
+			got = append(got, shot.Name)
+		}
+	}
+	// Newest first; d-1 was just created.
+	want := []string{"mapshot/test/d-1", "mapshot/test/d-3", "mapshot/test/d-10", "mapshot/test/d-2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got shots %q, want %q", got, want)
+	}
+}
+
+// BenchmarkServeHTTPParallel serves a tile from many goroutines at once, as
+// the viewer does - i.e., where reading the current mux must not contend.
+func BenchmarkServeHTTPParallel(b *testing.B) {
+	s, _ := newTestServer(b, newTestServeFlags(b))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", "/data/mapshot/test/d-1/s1zoom_0/tile_0_0.jpg", nil))
+			if rec.Code != http.StatusOK {
+				b.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+				return
+			}
+		}
+	})
+}
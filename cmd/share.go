@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// File in the first base directory where share tokens are stored.
+	sharesFile = ".mapshot-shares.json"
+	// Cookie set by the /share/<token> landing URL, so the viewer can load the
+	// mapshot without credentials.
+	shareCookie = "mapshot_share"
+)
+
+// ShareJSON is a token giving access to a single mapshot without credentials.
+type ShareJSON struct {
+	Token string `json:"token"`
+	// Name of the shared mapshot.
+	Name    string     `json:"name"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	// URL to give out; only set in API responses.
+	URL string `json:"url,omitempty"`
+}
+
+func (sh *ShareJSON) expired(now time.Time) bool {
+	return sh.Expires != nil && !now.Before(*sh.Expires)
+}
+
+// SharesJSON is the content of the shares file, and the response of
+// /api/shares.
+type SharesJSON struct {
+	Shares []*ShareJSON `json:"shares"`
+}
+
+// CreateShareJSON is the body of a request to share a mapshot.
+type CreateShareJSON struct {
+	// Duration after which the token stops working, e.g., "72h". Never
+	// expires if empty.
+	ExpiresIn string `json:"expires_in,omitempty"`
+}
+
+// shareStore keeps the share tokens, persisted in a file.
+type shareStore struct {
+	file string
+
+	m      sync.Mutex
+	shares map[string]*ShareJSON
+}
+
+func newShareStore(file string) (*shareStore, error) {
+	st := &shareStore{
+		file:   file,
+		shares: make(map[string]*ShareJSON),
+	}
+	raw, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read shares: %w", err)
+	}
+	data := &SharesJSON{}
+	if err := json.Unmarshal(raw, data); err != nil {
+		return nil, fmt.Errorf("invalid shares file %s: %w", file, err)
+	}
+	for _, sh := range data.Shares {
+		st.shares[sh.Token] = sh
+	}
+	logInfo("loaded share tokens", "path", file, "shares", len(st.shares))
+	return st, nil
+}
+
+// list returns the valid shares, oldest first.
+func (st *shareStore) list() []*ShareJSON {
+	st.m.Lock()
+	defer st.m.Unlock()
+	now := time.Now()
+	shares := []*ShareJSON{}
+	for _, sh := range st.shares {
+		if !sh.expired(now) {
+			shares = append(shares, sh)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.Before(shares[j].Created)
+	})
+	return shares
+}
+
+// save writes the shares file; st.m must be held. Expired shares are dropped.
+func (st *shareStore) save() error {
+	now := time.Now()
+	data := &SharesJSON{Shares: []*ShareJSON{}}
+	for token, sh := range st.shares {
+		if sh.expired(now) {
+			delete(st.shares, token)
+			continue
+		}
+		data.Shares = append(data.Shares, sh)
+	}
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Tokens are secrets; TempFile creates files only readable by their
+	// owner.
+	f, err := ioutil.TempFile(filepath.Dir(st.file), sharesFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(raw)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), st.file)
+}
+
+// create adds a token for the mapshot. A zero ttl means it never expires.
+func (st *shareStore) create(name string, ttl time.Duration) (*ShareJSON, error) {
+	raw := make([]byte, 18)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	sh := &ShareJSON{
+		Token:   base64.RawURLEncoding.EncodeToString(raw),
+		Name:    name,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	if ttl > 0 {
+		expires := sh.Created.Add(ttl)
+		sh.Expires = &expires
+	}
+	st.m.Lock()
+	defer st.m.Unlock()
+	st.shares[sh.Token] = sh
+	if err := st.save(); err != nil {
+		delete(st.shares, sh.Token)
+		return nil, fmt.Errorf("unable to save shares: %w", err)
+	}
+	return sh, nil
+}
+
+// revoke removes the token; it returns false if it did not exist.
+func (st *shareStore) revoke(token string) (bool, error) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	sh := st.shares[token]
+	if sh == nil {
+		return false, nil
+	}
+	delete(st.shares, token)
+	if err := st.save(); err != nil {
+		st.shares[token] = sh
+		return false, fmt.Errorf("unable to save shares: %w", err)
+	}
+	return true, nil
+}
+
+// lookup returns the share for the token, or nil if it is unknown or expired.
+func (st *shareStore) lookup(token string) *ShareJSON {
+	if token == "" {
+		return nil
+	}
+	st.m.Lock()
+	defer st.m.Unlock()
+	sh := st.shares[token]
+	if sh == nil || sh.expired(time.Now()) {
+		return nil
+	}
+	return sh
+}
+
+// allows indicates whether the request can skip authentication, thanks to a
+// share token - either as a `token` query parameter, or the cookie set by
+// /share/<token>. A token only gives read access to its mapshot & the viewer.
+func (st *shareStore) allows(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	p := path.Clean(req.URL.Path)
+	if strings.HasPrefix(p, "/share/") {
+		// Verifies the token itself.
+		return true
+	}
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		if c, err := req.Cookie(shareCookie); err == nil {
+			token = c.Value
+		}
+	}
+	sh := st.lookup(token)
+	if sh == nil {
+		return false
+	}
+	if p == "/map" || strings.HasPrefix(p, "/map/") {
+		return true
+	}
+	// path.Clean removed any trailing slash; the separator must be kept in
+	// the comparison, so that sharing `foo` does not give access to `foobar`.
+	shotPath := "/data/" + sh.Name
+	return p == shotPath || strings.HasPrefix(p, shotPath+"/")
+}
+
+// shareURL returns the share with the URL to give out, as seen by the client
+// of the request.
+func (s *Server) shareURL(req *http.Request, sh *ShareJSON) *ShareJSON {
+	c := *sh
+	c.URL = absoluteURL(req, s.urlPath("/share/"+sh.Token))
+	return &c
+}
+
+// handleShare serves /share/<token>: it sets the share cookie, and redirects to
+// the viewer of the shared mapshot.
+func (s *Server) handleShare(w http.ResponseWriter, req *http.Request) {
+	var sh *ShareJSON
+	if s.shares != nil {
+		sh = s.shares.lookup(strings.TrimPrefix(req.URL.Path, "/share/"))
+	}
+	if sh == nil {
+		http.Error(w, "Unknown or expired link.", http.StatusNotFound)
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     shareCookie,
+		Value:    sh.Token,
+		Path:     s.urlPath("/"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   requestScheme(req) == "https",
+	}
+	if sh.Expires != nil {
+		cookie.Expires = *sh.Expires
+	}
+	http.SetCookie(w, cookie)
+	w.Header().Set("Cache-Control", "no-store")
+	shotPath := s.urlPath("/data/" + sh.Name + "/")
+	http.Redirect(w, req, s.urlPath("/map/")+"?"+url.Values{"path": {shotPath}}.Encode(), http.StatusFound)
+}
+
+// handleCreateShare serves POST /api/shots/<name>/share, creating a token.
+func (s *Server) handleCreateShare(w http.ResponseWriter, req *http.Request, shot *shotInfo) {
+	if !s.sf.enableAdmin {
+		writeJSONError(w, http.StatusForbidden, "admin API is disabled; use --enable_admin to enable it")
+		return
+	}
+	if s.shares == nil {
+		writeJSONError(w, http.StatusNotImplemented, "sharing requires a base directory on the local filesystem")
+		return
+	}
+	params := &CreateShareJSON{}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<16)).Decode(params); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	var ttl time.Duration
+	if params.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(params.ExpiresIn); err != nil || ttl <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid expires_in %q: must be a positive duration, e.g., 72h", params.ExpiresIn)
+			return
+		}
+	}
+	sh, err := s.shares.create(shot.name, ttl)
+	if err != nil {
+		logError("unable to create share", "shot", shot.name, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to create share")
+		return
+	}
+	logInfo("created share", "shot", shot.name)
+	writeJSON(w, http.StatusCreated, s.shareURL(req, sh))
+}
+
+// handleShares serves /api/shares - listing shares - and
+// /api/shares/<token> - to revoke one with DELETE.
+func (s *Server) handleShares(w http.ResponseWriter, req *http.Request) {
+	if !s.sf.enableAdmin {
+		writeJSONError(w, http.StatusForbidden, "admin API is disabled; use --enable_admin to enable it")
+		return
+	}
+	if s.shares == nil {
+		writeJSONError(w, http.StatusNotImplemented, "sharing requires a base directory on the local filesystem")
+		return
+	}
+	token := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/shares"), "/")
+	switch {
+	case token == "" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		data := &SharesJSON{Shares: []*ShareJSON{}}
+		for _, sh := range s.shares.list() {
+			data.Shares = append(data.Shares, s.shareURL(req, sh))
+		}
+		writeJSON(w, http.StatusOK, data)
+	case token != "" && req.Method == http.MethodDelete:
+		found, err := s.shares.revoke(token)
+		if err != nil {
+			logError("unable to revoke share", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "unable to revoke share")
+			return
+		}
+		if !found {
+			writeJSONError(w, http.StatusNotFound, "unknown share")
+			return
+		}
+		logInfo("revoked share")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+	}
+}
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestShareStore(t *testing.T) *shareStore {
+	t.Helper()
+	quietLogs(t)
+	st, err := newShareStore(filepath.Join(t.TempDir(), sharesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestShareStoreCreateRevoke(t *testing.T) {
+	st := newTestShareStore(t)
+	sh, err := st.create("foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.Token == "" || sh.Name != "foo" || sh.Expires != nil {
+		t.Errorf("got share %+v", sh)
+	}
+	if got := st.lookup(sh.Token); got != sh {
+		t.Errorf("lookup(%q) = %+v, want %+v", sh.Token, got, sh)
+	}
+	other, err := st.create("bar", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Token == sh.Token {
+		t.Error("got the same token twice")
+	}
+	if other.Expires == nil || !other.Expires.Equal(other.Created.Add(time.Hour)) {
+		t.Errorf("got expiry %v, want an hour after %v", other.Expires, other.Created)
+	}
+
+	// Tokens are secrets.
+	info, err := os.Stat(st.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("shares file has mode %v, want only readable by its owner", perm)
+	}
+
+	// Persisted across restarts.
+	reloaded, err := newShareStore(st.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.lookup(other.Token); got == nil || got.Name != "bar" {
+		t.Errorf("lookup(%q) after reload = %+v, want share of bar", other.Token, got)
+	}
+
+	found, err := st.revoke(sh.Token)
+	if err != nil || !found {
+		t.Fatalf("revoke(%q) = %v, %v; want true, nil", sh.Token, found, err)
+	}
+	if got := st.lookup(sh.Token); got != nil {
+		t.Errorf("lookup(%q) after revoke = %+v, want nil", sh.Token, got)
+	}
+	if found, err := st.revoke(sh.Token); err != nil || found {
+		t.Errorf("second revoke(%q) = %v, %v; want false, nil", sh.Token, found, err)
+	}
+	reloaded, err = newShareStore(st.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.lookup(sh.Token); got != nil {
+		t.Errorf("lookup(%q) of revoked share after reload = %+v, want nil", sh.Token, got)
+	}
+	if got := st.lookup(""); got != nil {
+		t.Errorf("lookup of empty token = %+v, want nil", got)
+	}
+}
+
+func TestShareStoreExpiry(t *testing.T) {
+	st := newTestShareStore(t)
+	expired, err := st.create("foo", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	st.shares[expired.Token].Expires = &past
+	valid, err := st.create("foo", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := st.lookup(expired.Token); got != nil {
+		t.Errorf("lookup of expired token = %+v, want nil", got)
+	}
+	if got := st.lookup(valid.Token); got == nil {
+		t.Error("lookup of valid token = nil")
+	}
+	shares := st.list()
+	if len(shares) != 1 || shares[0].Token != valid.Token {
+		t.Errorf("list() = %+v, want only %q", shares, valid.Token)
+	}
+	// Saving - here when creating the valid one - drops expired shares.
+	reloaded, err := newShareStore(st.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.shares[expired.Token]; ok {
+		t.Error("expired share still in the shares file")
+	}
+}
+
+func TestShareStoreAllows(t *testing.T) {
+	st := newTestShareStore(t)
+	sh, err := st.create("foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc   string
+		method string
+		path   string
+		query  string
+		cookie string
+		want   bool
+	}{
+		{"query token", "GET", "/data/foo/mapshot.json", sh.Token, "", true},
+		{"cookie", "GET", "/data/foo/s1zoom_0/tile_0_0.jpg", "", sh.Token, true},
+		{"head", "HEAD", "/data/foo/mapshot.json", "", sh.Token, true},
+		{"shot root", "GET", "/data/foo/", "", sh.Token, true},
+		{"viewer", "GET", "/map/", "", sh.Token, true},
+		{"viewer assets", "GET", "/map/main.js", "", sh.Token, true},
+		{"landing", "GET", "/share/whatever", "", "", true},
+		{"other shot", "GET", "/data/bar/mapshot.json", "", sh.Token, false},
+		{"shot with same prefix", "GET", "/data/foobar/mapshot.json", "", sh.Token, false},
+		{"shot root with same prefix", "GET", "/data/foobar", "", sh.Token, false},
+		{"escaping the shot", "GET", "/data/foo/../bar/mapshot.json", "", sh.Token, false},
+		{"listing", "GET", "/", "", sh.Token, false},
+		{"shots list", "GET", "/shots.json", "", sh.Token, false},
+		{"api", "GET", "/api/v1/shots", "", sh.Token, false},
+		{"modification", "DELETE", "/data/foo/mapshot.json", "", sh.Token, false},
+		{"no token", "GET", "/data/foo/mapshot.json", "", "", false},
+		{"unknown token", "GET", "/data/foo/mapshot.json", "garbage", "", false},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			u := tc.path
+			if tc.query != "" {
+				u += "?" + url.Values{"token": {tc.query}}.Encode()
+			}
+			req := httptest.NewRequest(tc.method, u, nil)
+			if tc.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: shareCookie, Value: tc.cookie})
+			}
+			if got := st.allows(req); got != tc.want {
+				t.Errorf("allows(%s %s) = %v, want %v", tc.method, tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestShareCookieBypass(t *testing.T) {
+	st := newTestShareStore(t)
+	sh, err := st.create("foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{sf: &ServeFlags{}, shares: st}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	auth := newAuthenticator()
+	auth.addPlain("user", "password")
+	auth.bypass = st.allows
+	protected := auth.wrap(ok)
+
+	// The landing URL sets the cookie, then sends to the viewer.
+	rec := httptest.NewRecorder()
+	s.handleShare(rec, httptest.NewRequest("GET", "/share/"+sh.Token, nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusFound)
+	}
+	want := "/map/?" + url.Values{"path": {"/data/foo/"}}.Encode()
+	if got := rec.Header().Get("Location"); got != want {
+		t.Errorf("got redirect to %q, want %q", got, want)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != shareCookie || !cookies[0].HttpOnly {
+		t.Fatalf("got cookies %v, want a single HttpOnly %s", cookies, shareCookie)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/data/foo/mapshot.json", http.StatusOK},
+		{"/data/foobar/mapshot.json", http.StatusUnauthorized},
+		{"/data/bar/mapshot.json", http.StatusUnauthorized},
+		{"/api/shares", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.AddCookie(cookies[0])
+		rec := httptest.NewRecorder()
+		protected.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.path, rec.Code, tc.status)
+		}
+	}
+
+	if _, err := st.revoke(sh.Token); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/data/foo/mapshot.json", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	protected.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d with a revoked token, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleShare(rec, httptest.NewRequest("GET", "/share/"+sh.Token, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a revoked share link, want %d", rec.Code, http.StatusNotFound)
+	}
+}
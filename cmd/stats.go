@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+)
+
+// statsCache keeps the stats of each mapshot - e.g., its size. Computing them
+// requires walking all the files of the mapshot, so it is done in the
+// background, and only again when mapshot.json changes.
+type statsCache struct {
+	m sync.Mutex
+	// Keyed by mapshot name.
+	entries map[string]*statsEntry
+	// True while stats are being computed.
+	running bool
+	// Incremented every time new stats are available.
+	gen int
+}
+
+type statsEntry struct {
+	fsPath string
+	mtime  time.Time
+	// Nil if they could not be computed.
+	stats *APIShotStatsJSON
+}
+
+func newStatsCache() *statsCache {
+	return &statsCache{
+		entries: make(map[string]*statsEntry),
+	}
+}
+
+// valid indicates whether the entry is about that version of the mapshot.
+func (e *statsEntry) valid(shot *shotInfo) bool {
+	return e != nil && e.fsPath == shot.fsPath && e.mtime.Equal(shot.mtime)
+}
+
+// lookup returns the stats of the mapshot, or nil if not available yet.
+func (sc *statsCache) lookup(shot *shotInfo) *APIShotStatsJSON {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	if e := sc.entries[shot.name]; e.valid(shot) {
+		return e.stats
+	}
+	return nil
+}
+
+func (sc *statsCache) store(shot *shotInfo, stats *APIShotStatsJSON) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	sc.entries[shot.name] = &statsEntry{
+		fsPath: shot.fsPath,
+		mtime:  shot.mtime,
+		stats:  stats,
+	}
+}
+
+// generation changes every time new stats are available.
+func (sc *statsCache) generation() int {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	return sc.gen
+}
+
+// updateStats forgets stats of mapshots which are gone, and starts computing
+// the missing ones in the background. Once done, the mux is updated so they
+// are served.
+func (s *Server) updateStats(shots []shotInfo) {
+	sc := s.stats
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	known := map[string]bool{}
+	var missing []shotInfo
+	for _, shot := range shots {
+		known[shot.name] = true
+		if !sc.entries[shot.name].valid(&shot) {
+			missing = append(missing, shot)
+		}
+	}
+	for name := range sc.entries {
+		if !known[name] {
+			delete(sc.entries, name)
+		}
+	}
+	if sc.running || len(missing) == 0 {
+		return
+	}
+	sc.running = true
+	go func() {
+		for i := range missing {
+			shot := &missing[i]
+			stats, err := shotStats(shot.fsys)
+			if err != nil {
+				// Not retried until mapshot.json changes.
+				logWarning("unable to compute stats", "shot", shot.name, "error", err)
+				stats = nil
+			}
+			sc.store(shot, stats)
+		}
+		sc.m.Lock()
+		sc.running = false
+		sc.gen++
+		sc.m.Unlock()
+		logInfo("computed stats", "shots", len(missing))
+		s.updateMux()
+	}()
+}
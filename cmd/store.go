@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+)
+
+// shotStore is where a source of mapshots is stored. The content of each
+// mapshot is accessed through shotInfo.fsys.
+type shotStore interface {
+	// list returns the available mapshots. Their names & paths are relative
+	// to the store.
+	list() ([]shotInfo, error)
+	// String describes the store for messages.
+	String() string
+}
+
+// dirStore gives access to mapshots on the local filesystem, either as
+// directories or zip archives.
+type dirStore struct {
+	dir      string
+	archives *archiveCache
+	opts     scanOptions
+
+	m        sync.Mutex
+	cache    *scanCache
+	lastFull time.Time
+}
+
+func newDirStore(dir string, opts scanOptions) *dirStore {
+	return &dirStore{
+		dir:      dir,
+		archives: newArchiveCache(),
+		opts:     opts,
+	}
+}
+
+func (ds *dirStore) list() ([]shotInfo, error) {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+	prev := ds.cache
+	now := time.Now()
+	if prev != nil && now.Sub(ds.lastFull) >= ds.opts.fullRescanInterval {
+		logDebug("full rescan", "dir", ds.dir)
+		prev = nil
+	}
+	shots, cache, err := findShots(ds.dir, ds.archives, ds.opts, prev)
+	if err != nil {
+		return nil, err
+	}
+	if prev == nil {
+		ds.lastFull = now
+	}
+	ds.cache = cache
+	// Release archives which are gone.
+	keep := map[string]bool{}
+	for _, shot := range shots {
+		if shot.archive {
+			keep[shot.fsPath] = true
+		}
+		if shot.tilesDB != "" {
+			keep[shot.tilesDB] = true
+		}
+	}
+	ds.archives.prune(keep)
+	return shots, nil
+}
+
+func (ds *dirStore) String() string {
+	return ds.dir
+}
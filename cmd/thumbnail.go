@@ -0,0 +1,318 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Maximum width & height of thumbnails, in pixels.
+const thumbnailSize = 256
+
+// Name of the thumbnail file, when stored next to mapshot.json.
+const thumbnailFilename = "thumbnail.jpg"
+
+// Layers directories are named `s<surface index>zoom_<zoom level>`; older
+// mapshots only have `zoom_<zoom level>`.
+var layerDirRE = regexp.MustCompile(`^(?:s(\d+))?zoom_(\d+)$`)
+
+var tileFileRE = regexp.MustCompile(`^tile_(-?\d+)_(-?\d+)\.(?:jpg|png)$`)
+
+// thumbnailCache keeps generated thumbnails which could not be stored on disk.
+type thumbnailCache struct {
+	m    sync.Mutex
+	data map[string][]byte
+}
+
+func newThumbnailCache() *thumbnailCache {
+	return &thumbnailCache{
+		data: make(map[string][]byte),
+	}
+}
+
+// thumbnailPath returns where the thumbnail of the mapshot is stored on disk,
+// or an empty string if it cannot be stored.
+func (s *Server) thumbnailPath(shot *shotInfo) string {
+	if s.sf.thumbnailCacheDir != "" {
+		return filepath.Join(s.sf.thumbnailCacheDir, url.PathEscape(shot.name)+".jpg")
+	}
+	if shot.fsPath != "" && !shot.archive {
+		return filepath.Join(shot.fsPath, thumbnailFilename)
+	}
+	return ""
+}
+
+// thumbnail returns the JPEG thumbnail of the mapshot, generating it if
+// needed.
+func (s *Server) thumbnail(shot *shotInfo) ([]byte, error) {
+	key := shot.name + "@" + shot.mtime.String()
+	s.thumbnails.m.Lock()
+	data := s.thumbnails.data[key]
+	s.thumbnails.m.Unlock()
+	if data != nil {
+		return data, nil
+	}
+
+	cachePath := s.thumbnailPath(shot)
+	if cachePath != "" {
+		if data, err := ioutil.ReadFile(cachePath); err == nil {
+			return data, nil
+		}
+	}
+
+	data, err := renderThumbnail(shot.fsys)
+	if err != nil {
+		return nil, err
+	}
+	if cachePath != "" {
+		err := writeFileAtomic(cachePath, data)
+		if err == nil {
+			return data, nil
+		}
+		logWarning("unable to store thumbnail, keeping it in memory", "shot", shot.name, "error", err)
+	}
+	s.thumbnails.m.Lock()
+	s.thumbnails.data[key] = data
+	s.thumbnails.m.Unlock()
+	return data, nil
+}
+
+// writeFileAtomic writes the file through a temporary file, so readers never
+// see a partial file.
+func writeFileAtomic(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp-"+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	// Might be served by other HTTP servers.
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// serveThumbnail serves /api/shots/<name>/thumbnail.jpg.
+func (s *Server) serveThumbnail(w http.ResponseWriter, req *http.Request, shot *shotInfo) {
+	data, err := s.thumbnail(shot)
+	if err != nil {
+		logError("unable to generate thumbnail", "shot", shot.name, "error", err)
+		writeJSONError(w, http.StatusNotFound, "no thumbnail available")
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	if ttl := s.sf.tileCacheTTL; ttl > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(ttl.Seconds())))
+	}
+	http.ServeContent(w, req, thumbnailFilename, shot.mtime, bytes.NewReader(data))
+}
+
+// renderThumbnail builds a thumbnail from the least detailed layer of the
+// first surface, using up to 2x2 tiles around its center.
+func renderThumbnail(fsys fs.FS) ([]byte, error) {
+	layer, err := thumbnailLayer(fsys)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(fsys, layer)
+	if err != nil {
+		return nil, err
+	}
+	tiles := map[image.Point]string{}
+	var bounds image.Rectangle
+	for _, e := range entries {
+		m := tileFileRE.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		x, _ := strconv.Atoi(m[1])
+		y, _ := strconv.Atoi(m[2])
+		p := image.Pt(x, y)
+		r := image.Rectangle{Min: p, Max: p.Add(image.Pt(1, 1))}
+		if len(tiles) == 0 {
+			bounds = r
+		} else {
+			bounds = bounds.Union(r)
+		}
+		tiles[p] = path.Join(layer, e.Name())
+	}
+	if len(tiles) == 0 {
+		return nil, fmt.Errorf("no tiles in %s", layer)
+	}
+
+	// Pick up to 2 tiles in each direction, around the center.
+	pick := image.Rectangle{Min: image.Pt(
+		floorDiv(bounds.Min.X+bounds.Max.X-1, 2),
+		floorDiv(bounds.Min.Y+bounds.Max.Y-1, 2),
+	)}
+	pick.Max = pick.Min.Add(image.Pt(2, 2))
+	pick = pick.Intersect(bounds)
+
+	var tileSize image.Point
+	var canvas *image.RGBA
+	found := 0
+	for y := pick.Min.Y; y < pick.Max.Y; y++ {
+		for x := pick.Min.X; x < pick.Max.X; x++ {
+			name, ok := tiles[image.Pt(x, y)]
+			if !ok {
+				continue
+			}
+			img, err := decodeTile(fsys, name)
+			if err != nil {
+				logWarning("unable to decode tile", "tile", name, "error", err)
+				continue
+			}
+			if canvas == nil {
+				tileSize = img.Bounds().Size()
+				canvas = image.NewRGBA(image.Rect(0, 0, tileSize.X*pick.Dx(), tileSize.Y*pick.Dy()))
+				draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+			}
+			offset := image.Pt((x-pick.Min.X)*tileSize.X, (y-pick.Min.Y)*tileSize.Y)
+			dst := image.Rectangle{Min: offset, Max: offset.Add(tileSize)}
+			draw.Draw(canvas, dst, img, img.Bounds().Min, draw.Src)
+			found++
+		}
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("no readable tiles in %s", layer)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, downscale(canvas, thumbnailSize), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// thumbnailLayer returns the directory of the least detailed layer of the
+// surface with the lowest index.
+func thumbnailLayer(fsys fs.FS) (string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return "", err
+	}
+	type layer struct {
+		name          string
+		surface, zoom int
+	}
+	var layers []layer
+	for _, e := range entries {
+		m := layerDirRE.FindStringSubmatch(e.Name())
+		if m == nil || !e.IsDir() {
+			continue
+		}
+		surface, _ := strconv.Atoi(m[1])
+		zoom, _ := strconv.Atoi(m[2])
+		layers = append(layers, layer{name: e.Name(), surface: surface, zoom: zoom})
+	}
+	if len(layers) == 0 {
+		return "", errors.New("no tiles directory")
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		if layers[i].surface != layers[j].surface {
+			return layers[i].surface < layers[j].surface
+		}
+		return layers[i].zoom < layers[j].zoom
+	})
+	return layers[0].name, nil
+}
+
+// floorDiv divides, rounding towards negative infinity.
+func floorDiv(a, b int) int {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// decodeTile reads a tile; they are jpg, or png for lossless renders.
+func decodeTile(fsys fs.FS, name string) (image.Image, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if path.Ext(name) == ".png" {
+		return png.Decode(f)
+	}
+	return jpeg.Decode(f)
+}
+
+// downscale reduces the image so it fits within size x size, averaging the
+// source pixels. Images already small enough are returned as is.
+func downscale(src *image.RGBA, size int) image.Image {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+	dw, dh := size, size
+	if sw > sh {
+		dh = sh * size / sw
+	} else {
+		dw = sw * size / sh
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			var r, g, b, n uint64
+			for sy := y0; sy < y1; sy++ {
+				off := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[off])
+					g += uint64(src.Pix[off+1])
+					b += uint64(src.Pix[off+2])
+					off += 4
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			off := dst.PixOffset(x, y)
+			dst.Pix[off] = uint8(r / n)
+			dst.Pix[off+1] = uint8(g / n)
+			dst.Pix[off+2] = uint8(b / n)
+			dst.Pix[off+3] = 0xff
+		}
+	}
+	return dst
+}
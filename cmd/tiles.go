@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Tiles are generated by the mod as `s<surface>zoom_<level>/tile_<x>_<y>.jpg`.
+// Other extensions are accepted in case tiles were converted afterward.
+var tilePathRE = regexp.MustCompile(`^s[0-9]+zoom_[0-9]+/tile_-?[0-9]+_-?[0-9]+\.(jpg|jpeg|png|webp|avif)$`)
+
+// isTilePath indicates whether the name, relative to the mapshot, is a tile.
+func isTilePath(name string) bool {
+	return tilePathRE.MatchString(name)
+}
+
+// placeholderTile is a 1x1 transparent PNG, served for tiles which were never
+// generated - e.g., at the edges of a render. Browsers scale it to the tile
+// size.
+var placeholderTile, placeholderTileETag = func() ([]byte, string) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return buf.Bytes(), `"` + hex.EncodeToString(sum[:8]) + `"`
+}()
+
+// servePlaceholderTile answers with placeholderTile. Caching headers are
+// expected to be already set.
+func servePlaceholderTile(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", placeholderTileETag)
+	http.ServeContent(w, req, "placeholder.png", time.Time{}, bytes.NewReader(placeholderTile))
+}
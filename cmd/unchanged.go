@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File in the output directory - script-output or --output - recording the
+// last render of each save.
+const renderIndexFile = ".mapshot-renders.json"
+
+// errUnchanged is returned by render with --skip_unchanged when the save did
+// not change since its last render.
+var errUnchanged = errors.New("save unchanged since last render")
+
+// RenderIndexJSON is the content of the file recording past renders.
+type RenderIndexJSON struct {
+	// Keyed by name of the mapshot.
+	Saves map[string]*RenderIndexEntryJSON `json:"saves"`
+}
+
+// RenderIndexEntryJSON is part of RenderIndexJSON.
+type RenderIndexEntryJSON struct {
+	SaveSize    int64     `json:"save_size"`
+	SaveModTime time.Time `json:"save_mtime"`
+	SaveSHA256  string    `json:"save_sha256"`
+	// Directory of the mapshot, relative to the directory of the index file.
+	Output   string    `json:"output"`
+	Rendered time.Time `json:"rendered"`
+}
+
+// renderIndexMu protects the index file from concurrent renders.
+var renderIndexMu sync.Mutex
+
+func loadRenderIndex(root string) (*RenderIndexJSON, error) {
+	index := &RenderIndexJSON{Saves: map[string]*RenderIndexEntryJSON{}}
+	p := filepath.Join(root, renderIndexFile)
+	raw, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, index); err != nil {
+		return nil, fmt.Errorf("invalid file %s: %w", p, err)
+	}
+	if index.Saves == nil {
+		index.Saves = map[string]*RenderIndexEntryJSON{}
+	}
+	return index, nil
+}
+
+func (index *RenderIndexJSON) save(root string) error {
+	raw, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(root, renderIndexFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(raw)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(root, renderIndexFile))
+}
+
+// saveFingerprint identifies the content of a save, to tell if it changed
+// since a previous render.
+type saveFingerprint struct {
+	path    string
+	size    int64
+	modTime time.Time
+	// Only computed when needed, as it requires reading the whole save.
+	sha256 string
+}
+
+func newSaveFingerprint(path string) (*saveFingerprint, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &saveFingerprint{
+		path:    path,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}, nil
+}
+
+func (fp *saveFingerprint) hash() (string, error) {
+	if fp.sha256 == "" {
+		sum, err := hashFile(fp.path)
+		if err != nil {
+			return "", err
+		}
+		fp.sha256 = hex.EncodeToString(sum[:])
+	}
+	return fp.sha256, nil
+}
+
+// lastRender returns the location of the last render of the save if its
+// content is still the same, and "" otherwise. The save is only read when its
+// size & modification time do not tell already - e.g., when it was copied
+// again without changes.
+func lastRender(root string, name string, fp *saveFingerprint) (string, error) {
+	renderIndexMu.Lock()
+	index, err := loadRenderIndex(root)
+	renderIndexMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	entry := index.Saves[name]
+	if entry == nil || entry.SaveSize != fp.size {
+		return "", nil
+	}
+	output := filepath.Join(root, filepath.FromSlash(entry.Output))
+	if _, err := os.Stat(filepath.Join(output, "mapshot.json")); err != nil {
+		// Mapshot was removed since.
+		return "", nil
+	}
+	if entry.SaveModTime.Equal(fp.modTime) {
+		return output, nil
+	}
+	sum, err := fp.hash()
+	if err != nil {
+		return "", err
+	}
+	if sum != entry.SaveSHA256 {
+		return "", nil
+	}
+	return output, nil
+}
+
+// recordRender notes the render of the save in the index.
+func recordRender(root string, name string, fp *saveFingerprint, resultPrefix string) error {
+	sum, err := fp.hash()
+	if err != nil {
+		return err
+	}
+	renderIndexMu.Lock()
+	defer renderIndexMu.Unlock()
+	index, err := loadRenderIndex(root)
+	if err != nil {
+		return err
+	}
+	index.Saves[name] = &RenderIndexEntryJSON{
+		SaveSize:    fp.size,
+		SaveModTime: fp.modTime,
+		SaveSHA256:  sum,
+		Output:      resultPrefix,
+		Rendered:    time.Now(),
+	}
+	return index.save(root)
+}
@@ -0,0 +1,365 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Prefix of temporary files & directories used while receiving uploads. They
+// are ignored when looking for mapshots.
+const uploadTmpPrefix = ".mapshot-upload-"
+
+// errUploadTooLarge is returned when an upload goes over --max_upload_size.
+var errUploadTooLarge = errors.New("upload too large")
+
+// uploadError is an issue with the uploaded content, reported to the client.
+type uploadError struct {
+	msg string
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+func newUploadError(format string, a ...interface{}) error {
+	return &uploadError{msg: fmt.Sprintf(format, a...)}
+}
+
+// checkShotName verifies that a mapshot name is a relative, slash-separated
+// path, without anything which could escape the base directory.
+func checkShotName(name string) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.Contains(part, "\\") {
+			return fmt.Errorf("invalid name %q", name)
+		}
+	}
+	return nil
+}
+
+// cleanEntryName validates the name of a file within an uploaded archive, and
+// returns it cleaned. It returns an empty string for the root directory.
+func cleanEntryName(name string) (string, error) {
+	if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || filepath.VolumeName(name) != "" {
+		return "", newUploadError("invalid path %q in archive", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", newUploadError("invalid path %q in archive", name)
+		}
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// extractor writes files from an uploaded archive into a directory, enforcing
+// a limit on the total size.
+type extractor struct {
+	dir       string
+	remaining int64
+}
+
+func (e *extractor) mkdir(name string) error {
+	name, err := cleanEntryName(name)
+	if err != nil || name == "" {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(e.dir, filepath.FromSlash(name)), 0755)
+}
+
+func (e *extractor) writeFile(name string, r io.Reader) error {
+	name, err := cleanEntryName(name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return newUploadError("invalid file entry for the root directory")
+	}
+	target := filepath.Join(e.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return newUploadError("duplicate path %q in archive", name)
+		}
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, e.remaining+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	e.remaining -= n
+	if e.remaining < 0 {
+		return errUploadTooLarge
+	}
+	return nil
+}
+
+func (e *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newUploadError("invalid tar archive: %v", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = e.mkdir(hdr.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = e.writeFile(hdr.Name, tr)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			err = newUploadError("unsupported entry %q in archive; only files and directories are allowed", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *extractor) extractZip(f *os.File, size int64) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return newUploadError("invalid zip archive: %v", err)
+	}
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.mkdir(zf.Name)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			if rc, err = zf.Open(); err != nil {
+				return newUploadError("invalid zip archive: %v", err)
+			}
+			err = e.writeFile(zf.Name, rc)
+			rc.Close()
+		default:
+			err = newUploadError("unsupported entry %q in archive; only files and directories are allowed", zf.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extract unpacks the uploaded archive - zip, tar or gzipped tar - into the
+// directory.
+func (e *extractor) extract(body io.Reader) error {
+	br := bufio.NewReader(body)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		// Zip files need random access.
+		f, err := ioutil.TempFile(filepath.Dir(e.dir), uploadTmpPrefix+"*.zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		size, err := io.Copy(f, br)
+		if err != nil {
+			return err
+		}
+		return e.extractZip(f, size)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return newUploadError("invalid gzip stream: %v", err)
+		}
+		defer gz.Close()
+		return e.extractTar(gz)
+	default:
+		return e.extractTar(br)
+	}
+}
+
+// uploadStore returns the store where uploads must be written, from the
+// optional source label.
+func (s *Server) uploadStore(sourceLabel string) (*dirStore, error) {
+	for _, src := range s.sources {
+		if len(s.sources) > 1 && src.label != sourceLabel {
+			continue
+		}
+		ds, ok := src.store.(*dirStore)
+		if !ok {
+			return nil, newUploadError("uploads are only supported to directories on the local filesystem")
+		}
+		return ds, nil
+	}
+	if sourceLabel == "" {
+		return nil, newUploadError("parameter source is required when serving multiple directories")
+	}
+	return nil, newUploadError("unknown source %q", sourceLabel)
+}
+
+// uploadName returns the name of the uploaded mapshot, relative to its store.
+// Unless explicitly provided, it is built like the mod does, from the savename
+// & unique ID in mapshot.json.
+func uploadName(name string, data *MapshotJSON) (string, error) {
+	if name == "" {
+		if data.Savename == "" || data.UniqueID == "" {
+			return "", newUploadError("mapshot.json has no savename or unique_id; use parameter name")
+		}
+		name = "mapshot/" + data.Savename + "/d-" + data.UniqueID
+	}
+	if err := checkShotName(name); err != nil {
+		return "", newUploadError("%v", err)
+	}
+	return name, nil
+}
+
+// handleUpload serves POST /api/shots, adding a mapshot from an archive of its
+// directory, with mapshot.json at the root. Query parameters `name` & `source`
+// indicate where to store it.
+func (s *Server) handleUpload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %s", req.Method)
+		return
+	}
+	if !s.sf.enableAdmin {
+		writeJSONError(w, http.StatusForbidden, "admin API is disabled; use --enable_admin to enable it")
+		return
+	}
+	query := req.URL.Query()
+	sourceLabel, name := query.Get("source"), query.Get("name")
+	ds, err := s.uploadStore(sourceLabel)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if name != "" {
+		if err := checkShotName(name); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	if req.ContentLength > s.sf.maxUploadSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "upload is larger than %d bytes", s.sf.maxUploadSize)
+		return
+	}
+
+	name, err = s.receiveUpload(req.Body, ds, name)
+	if err != nil {
+		var ue *uploadError
+		switch {
+		case errors.As(err, &ue):
+			writeJSONError(w, http.StatusBadRequest, "%v", err)
+		case errors.Is(err, errUploadTooLarge):
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "upload is larger than %d bytes", s.sf.maxUploadSize)
+		case os.IsExist(err):
+			writeJSONError(w, http.StatusConflict, "mapshot already exists")
+		default:
+			logError("unable to store upload", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "unable to store mapshot")
+		}
+		return
+	}
+	s.updateMux()
+
+	if len(s.sources) > 1 {
+		name = sourceLabel + "/" + name
+	}
+	shot, rest := s.lookupShot(name)
+	if shot == nil || rest != "" {
+		logError("uploaded mapshot not found after rescan", "name", name)
+		writeJSONError(w, http.StatusInternalServerError, "mapshot stored but not found")
+		return
+	}
+	w.Header().Set("Location", s.urlPath("/api/v1/shots/"+shot.name))
+	writeJSON(w, http.StatusCreated, s.newAPIShotJSON(shot))
+}
+
+// receiveUpload unpacks the upload in a temporary directory, and moves it in
+// place once complete - so partial mapshots are never served. It returns the
+// name of the mapshot, relative to the store.
+func (s *Server) receiveUpload(r io.Reader, ds *dirStore, name string) (string, error) {
+	// Must be on the same filesystem as the target, for the final rename.
+	tmpDir, err := ioutil.TempDir(ds.dir, uploadTmpPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	body := &limitedReader{r: r, remaining: s.sf.maxUploadSize}
+	e := &extractor{dir: tmpDir, remaining: s.sf.maxUploadSize}
+	if err := e.extract(body); err != nil {
+		if body.remaining < 0 {
+			return "", errUploadTooLarge
+		}
+		return "", err
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(tmpDir, "mapshot.json"))
+	if err != nil {
+		return "", newUploadError("archive has no mapshot.json at its root")
+	}
+	data := &MapshotJSON{}
+	if err := json.Unmarshal(raw, data); err != nil {
+		return "", newUploadError("invalid mapshot.json: %v", err)
+	}
+	name, err = uploadName(name, data)
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(ds.dir, filepath.FromSlash(name))
+	if _, err := os.Lstat(target); err == nil {
+		return "", os.ErrExist
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpDir, target); err != nil {
+		return "", err
+	}
+	logInfo("stored uploaded mapshot", "name", name, "path", target)
+	return name, nil
+}
+
+// limitedReader is like io.LimitedReader, but fails once over the limit
+// instead of silently truncating.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	if lr.remaining < 0 {
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,301 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// How many problems of each kind are listed per mapshot, without --json.
+const verifyListLimit = 20
+
+var verifyFlags struct {
+	all     bool
+	baseDir string
+	json    bool
+}
+
+// VerifyJSON is the output of `verify --json`.
+type VerifyJSON struct {
+	Shots []*VerifyShotJSON `json:"shots"`
+	// Number of mapshots with problems.
+	Failed int `json:"failed"`
+}
+
+// VerifyShotJSON is part of VerifyJSON.
+type VerifyShotJSON struct {
+	Path     string `json:"path"`
+	Savename string `json:"savename,omitempty"`
+	// Tiles expected from the bounds recorded in mapshot.json.
+	Tiles int `json:"tiles"`
+	// Paths of tiles, relative to the mapshot.
+	Missing    []string `json:"missing,omitempty"`
+	Empty      []string `json:"empty,omitempty"`
+	Unreadable []string `json:"unreadable,omitempty"`
+	// Tiles not found, which is expected as the render skipped those without
+	// entities - i.e., with minjpgquality=0.
+	Skipped int `json:"skipped,omitempty"`
+	// Set if mapshot.json itself is not usable.
+	Error string `json:"error,omitempty"`
+	OK    bool   `json:"ok"`
+}
+
+// verifyShot checks that all the tiles of the mapshot described by its
+// mapshot.json exist and can be decoded.
+func verifyShot(shot *shotInfo) *VerifyShotJSON {
+	res := &VerifyShotJSON{Path: shot.fsPath}
+	defer func() {
+		res.OK = res.Error == "" && len(res.Missing) == 0 && len(res.Empty) == 0 && len(res.Unreadable) == 0
+	}()
+	if shot.jsonErr != nil {
+		res.Error = shot.jsonErr.Error()
+		return res
+	}
+	data := shot.json
+	res.Savename = data.Savename
+	if len(data.Surfaces) == 0 {
+		res.Error = "no surface in mapshot.json"
+		return res
+	}
+	format := data.TileFormat
+	if format == "" {
+		format = "jpg"
+	}
+	skipEmpty := data.Params != nil && data.Params.MinJPGQuality != nil && *data.Params.MinJPGQuality <= 0
+
+	for _, surface := range data.Surfaces {
+		if surface.WorldMin == nil || surface.WorldMax == nil || surface.TileSize <= 0 {
+			res.Error = fmt.Sprintf("bounds of surface %s are missing from mapshot.json", surface.SurfaceName)
+			return res
+		}
+		// Same tiles as the mod generates for each zoom level.
+		for zoom := surface.ZoomMin; zoom <= surface.ZoomMax; zoom++ {
+			tileSize := surface.TileSize / math.Pow(2, float64(zoom))
+			minX, minY := math.Floor(surface.WorldMin.X/tileSize), math.Floor(surface.WorldMin.Y/tileSize)
+			maxX, maxY := math.Floor(surface.WorldMax.X/tileSize), math.Floor(surface.WorldMax.Y/tileSize)
+			for y := minY; y <= maxY; y++ {
+				for x := minX; x <= maxX; x++ {
+					res.Tiles++
+					name := fmt.Sprintf("s%dzoom_%d/tile_%d_%d.%s", surface.SurfaceIdx, zoom, int64(x), int64(y), format)
+					verifyTile(shot.fsys, name, skipEmpty, res)
+				}
+			}
+		}
+	}
+	return res
+}
+
+// verifyTile records in res the problems of the tile.
+func verifyTile(fsys fs.FS, name string, skipEmpty bool, res *VerifyShotJSON) {
+	info, err := fs.Stat(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if skipEmpty {
+			res.Skipped++
+		} else {
+			res.Missing = append(res.Missing, name)
+		}
+		return
+	}
+	if err != nil {
+		res.Unreadable = append(res.Unreadable, name)
+		return
+	}
+	if info.Size() == 0 {
+		res.Empty = append(res.Empty, name)
+		return
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		res.Unreadable = append(res.Unreadable, name)
+		return
+	}
+	defer f.Close()
+	// Only the header is read; enough to catch most truncated or garbage
+	// files.
+	if _, _, err := image.DecodeConfig(f); err != nil {
+		res.Unreadable = append(res.Unreadable, name)
+	}
+}
+
+// findVerifyTargets returns the mapshots designated by the arguments: paths
+// of mapshots - or of directories containing them - or names of mapshots or
+// saves in the base directory.
+func findVerifyTargets(args []string) ([]shotInfo, error) {
+	baseDir := verifyFlags.baseDir
+	var baseShots []shotInfo
+	loadBase := func() error {
+		if baseShots != nil {
+			return nil
+		}
+		if baseDir == "" {
+			dir, err := factorioSettings.ScriptOutput()
+			if err != nil {
+				return err
+			}
+			baseDir = dir
+		}
+		shots, _, err := findShots(baseDir, newArchiveCache(), scanOptions{}, nil)
+		if err != nil {
+			return err
+		}
+		baseShots = shots
+		return nil
+	}
+
+	if verifyFlags.all {
+		if len(args) > 0 {
+			return nil, errors.New("mapshots cannot be given as arguments with --all")
+		}
+		if err := loadBase(); err != nil {
+			return nil, err
+		}
+		if len(baseShots) == 0 {
+			return nil, fmt.Errorf("no mapshot found in %s", baseDir)
+		}
+		return baseShots, nil
+	}
+	if len(args) == 0 {
+		return nil, errors.New("no mapshot to verify; give at least one, or use --all")
+	}
+
+	var targets []shotInfo
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		switch {
+		case err == nil && info.IsDir():
+			shots, _, err := findShots(arg, newArchiveCache(), scanOptions{}, nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(shots) == 0 {
+				return nil, fmt.Errorf("no mapshot found in %s", arg)
+			}
+			targets = append(targets, shots...)
+		case err == nil && isArchiveName(arg):
+			real, err := filepath.EvalSymlinks(arg)
+			if err != nil {
+				return nil, err
+			}
+			shots, _, err := findShots(filepath.Dir(real), newArchiveCache(), scanOptions{}, nil)
+			if err != nil {
+				return nil, err
+			}
+			found := false
+			for _, shot := range shots {
+				if shot.fsPath == real {
+					targets = append(targets, shot)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("%s is not a readable mapshot archive", arg)
+			}
+		default:
+			if err := loadBase(); err != nil {
+				return nil, err
+			}
+			found := false
+			for _, shot := range baseShots {
+				if shot.name == arg || (shot.json != nil && shot.json.Savename == arg) {
+					targets = append(targets, shot)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("no mapshot %q: not a path, nor a mapshot or save name in %s", arg, baseDir)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// printVerifyList prints the tiles with a problem, up to verifyListLimit.
+func printVerifyList(kind string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	fmt.Printf("  %d %s tiles:\n", len(names), kind)
+	for i, name := range names {
+		if i == verifyListLimit {
+			fmt.Printf("    ... and %d more\n", len(names)-i)
+			break
+		}
+		fmt.Printf("    %s\n", name)
+	}
+}
+
+var cmdVerify = &cobra.Command{
+	Use:   "verify [path|name...]",
+	Short: "Check that mapshots have all their tiles.",
+	Long: `Check that mapshots have all their tiles.
+
+The tiles of each zoom level are derived from the bounds and tile size recorded
+in mapshot.json; missing tiles, empty files and tiles which cannot be decoded
+are reported - e.g., after an interrupted copy. Mapshots are given as paths -
+of a mapshot, or of a directory containing mapshots - or as names of mapshots
+or saves in the base directory. With --all, all the mapshots of the base
+directory are verified.
+
+Exits with an error if any problem is found.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shots, err := findVerifyTargets(args)
+		if err != nil {
+			return err
+		}
+		sort.Slice(shots, func(i, j int) bool { return shots[i].fsPath < shots[j].fsPath })
+
+		data := &VerifyJSON{Shots: []*VerifyShotJSON{}}
+		for i := range shots {
+			res := verifyShot(&shots[i])
+			data.Shots = append(data.Shots, res)
+			if !res.OK {
+				data.Failed++
+			}
+			if verifyFlags.json {
+				continue
+			}
+			if res.OK {
+				fmt.Printf("OK      %s: %d tiles\n", res.Path, res.Tiles)
+				continue
+			}
+			if res.Error != "" {
+				fmt.Printf("FAILED  %s: %s\n", res.Path, res.Error)
+				continue
+			}
+			fmt.Printf("FAILED  %s: %d missing, %d empty, %d unreadable, of %d tiles\n", res.Path, len(res.Missing), len(res.Empty), len(res.Unreadable), res.Tiles)
+			printVerifyList("missing", res.Missing)
+			printVerifyList("empty", res.Empty)
+			printVerifyList("unreadable", res.Unreadable)
+		}
+
+		if verifyFlags.json {
+			raw, err := json.MarshalIndent(data, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(raw))
+		} else {
+			fmt.Printf("Verified %d mapshots: %d OK, %d with problems\n", len(data.Shots), len(data.Shots)-data.Failed, data.Failed)
+		}
+		if data.Failed > 0 {
+			return fmt.Errorf("%d of %d mapshots have problems", data.Failed, len(data.Shots))
+		}
+		return nil
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdVerify)
+	cmdVerify.Flags().BoolVar(&verifyFlags.all, "all", false, "If true, verify all the mapshots of the base directory.")
+	cmdVerify.Flags().StringVar(&verifyFlags.baseDir, "base_dir", "", "Directory where to look for mapshots given by name, or with --all. If empty, uses Factorio script-output directory.")
+	cmdVerify.Flags().BoolVar(&verifyFlags.json, "json", false, "If true, print the results as a JSON object on stdout.")
+}
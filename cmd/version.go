@@ -1,20 +1,65 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/Palats/mapshot/embed"
-	"github.com/golang/glog"
+	"github.com/Palats/mapshot/factorio"
 	"github.com/spf13/cobra"
 )
 
+// modFactorioVersion returns the version of Factorio the embedded mod is for -
+// e.g., `1.1` - from its info.json; "" if unknown.
+func modFactorioVersion() string {
+	var info struct {
+		FactorioVersion string `json:"factorio_version"`
+	}
+	if err := json.Unmarshal([]byte(embed.ModFiles["info.json"]), &info); err != nil {
+		logInfo("unable to read mod info.json", "error", err)
+		return ""
+	}
+	return info.FactorioVersion
+}
+
+// checkFactorioVersion verifies that the embedded mod can run on that version of
+// Factorio; Factorio only loads mods made for its major.minor version.
+func checkFactorioVersion(v *factorio.VersionInfo) error {
+	want := modFactorioVersion()
+	if want == "" {
+		return nil
+	}
+	if got := fmt.Sprintf("%d.%d", v.Major, v.Minor); got != want {
+		return fmt.Errorf("Factorio %s is not supported by mapshot %s, whose mod requires Factorio %s; use a mapshot version made for Factorio %s", v, embed.Version, want, got)
+	}
+	return nil
+}
+
 var cmdVersion = &cobra.Command{
 	Use:   "version",
-	Short: "Show the version of the mod.",
+	Short: "Show the version of the mod, and of Factorio.",
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println(embed.Version)
-		glog.Infof("Version hash: %s", embed.VersionHash)
+		logInfo("version hash", "hash", embed.VersionHash)
+		if v := modFactorioVersion(); v != "" {
+			fmt.Println("Mod for Factorio:", v)
+		}
+		fact, err := factorio.New(factorioSettings)
+		if err != nil {
+			fmt.Printf("Factorio: unknown (%v)\n", err)
+			return
+		}
+		v, err := fact.Version(context.Background())
+		if err != nil {
+			fmt.Printf("Factorio: unknown (%v)\n", err)
+			return
+		}
+		fmt.Printf("Factorio: %s, %s\n", v, fact.Binary())
+		if err := checkFactorioVersion(v); err != nil {
+			fmt.Println("Warning:", err)
+		}
 	},
 }
 
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// shotsWatcher tracks filesystem changes which could impact the list of
+// mapshots. It watches all directories, except the content of mapshots
+// themselves - only their root is watched, to detect changes to
+// `mapshot.json`.
+type shotsWatcher struct {
+	baseDirs []string
+	// Directories which are not scanned are not watched either.
+	opts scanOptions
+	w    *fsnotify.Watcher
+	// Currently watched directories.
+	watched map[string]bool
+}
+
+func newShotsWatcher(baseDirs []string, opts scanOptions) (*shotsWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create filesystem watcher: %w", err)
+	}
+	return &shotsWatcher{
+		baseDirs: baseDirs,
+		opts:     opts,
+		w:        w,
+		watched:  make(map[string]bool),
+	}, nil
+}
+
+func (sw *shotsWatcher) close() {
+	if err := sw.w.Close(); err != nil {
+		logError("unable to close filesystem watcher", "error", err)
+	}
+}
+
+// sync updates the list of watched directories, based on the known
+// mapshots. Content of known mapshots is not watched, which avoids watching
+// the potentially very numerous tile directories.
+func (sw *shotsWatcher) sync(shots []shotInfo) error {
+	shotDirs := map[string]bool{}
+	for _, shot := range shots {
+		shotDirs[shot.fsPath] = true
+	}
+
+	targets := map[string]bool{}
+	for _, baseDir := range sw.baseDirs {
+		err := sw.findTargets(baseDir, shotDirs, targets)
+		if errors.Is(err, fs.ErrNotExist) {
+			// E.g., an unmounted directory. Watch its parent instead, to notice
+			// when it comes back.
+			logDebug("not watching missing directory", "dir", baseDir, "error", err)
+			if abs, err := filepath.Abs(baseDir); err == nil {
+				if info, err := os.Stat(filepath.Dir(abs)); err == nil && info.IsDir() {
+					targets[filepath.Dir(abs)] = true
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Mapshots reached through symlinks are not found when walking; watch
+	// their root anyway.
+	for _, shot := range shots {
+		if shot.fsPath != "" && !shot.archive {
+			targets[shot.fsPath] = true
+		}
+	}
+
+	for path := range sw.watched {
+		if targets[path] {
+			continue
+		}
+		// Removal fails when the directory has been deleted, as it is then
+		// dropped automatically.
+		sw.w.Remove(path)
+		delete(sw.watched, path)
+	}
+	for path := range targets {
+		if sw.watched[path] {
+			continue
+		}
+		if err := sw.w.Add(path); err != nil {
+			return fmt.Errorf("unable to watch %s: %w", path, err)
+		}
+		sw.watched[path] = true
+	}
+	logDebug("watching directories", "dirs", len(sw.watched))
+	return nil
+}
+
+// findTargets adds to targets all the directories to watch in baseDir.
+func (sw *shotsWatcher) findTargets(baseDir string, shotDirs map[string]bool, targets map[string]bool) error {
+	realDir, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return fmt.Errorf("unable to eval symlinks for %s: %w", baseDir, err)
+	}
+	return filepath.Walk(realDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == realDir {
+				return err
+			}
+			logInfo("unable to watch directory", "dir", path, "error", err)
+			// Unreadable directories cannot be watched either.
+			delete(targets, path)
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if rel, err := filepath.Rel(realDir, path); err == nil && path != realDir {
+			depth := strings.Count(rel, string(filepath.Separator)) + 1
+			if sw.opts.tooDeep(depth) || excluded(sw.opts.excludes, rel) {
+				return filepath.SkipDir
+			}
+		}
+		targets[path] = true
+		if shotDirs[path] {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, ignoreMarker)); err == nil {
+			// Only watched to notice when the marker is removed.
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// relevant indicates whether the event might change the list of mapshots.
+func (sw *shotsWatcher) relevant(ev fsnotify.Event) bool {
+	switch filepath.Base(ev.Name) {
+	case "mapshot.json", userMetaFile, ignoreMarker, ignoreListFile:
+		return true
+	}
+	if isArchiveName(ev.Name) {
+		return true
+	}
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		return sw.watched[ev.Name]
+	}
+	if ev.Op&fsnotify.Create != 0 {
+		info, err := os.Stat(ev.Name)
+		return err == nil && info.IsDir()
+	}
+	return false
+}
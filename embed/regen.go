@@ -123,7 +123,7 @@ func filenameToVar(fname string) string {
 	return "File" + s
 }
 
-func genGo(modFiles, viewerFiles, listingFiles []*FileInfo, version string, versionHash string) {
+func genGo(modFiles []*FileInfo, version string, versionHash string) {
 	f, err := os.Create("embed/generated.go")
 	if err != nil {
 		log.Fatal(err)
@@ -157,24 +157,6 @@ func genGo(modFiles, viewerFiles, listingFiles []*FileInfo, version string, vers
 	writeLn("}")
 	writeLn("")
 
-	writeLn("// ViewerFiles is the files for the UI to navigate a single mapshot (map view).")
-	writeLn("var ViewerFiles = map[string]string{")
-	for _, fi := range viewerFiles {
-		files = append(files, fi)
-		writeLn(fmt.Sprintf("\t%q: %s,", filepath.Base(fi.Filename), filenameToVar(fi.Filename)))
-	}
-	writeLn("}")
-	writeLn("")
-
-	writeLn("// ListingFiles is the files for the UI to navigate the list of mapshots.")
-	writeLn("var ListingFiles = map[string]string{")
-	for _, fi := range listingFiles {
-		files = append(files, fi)
-		writeLn(fmt.Sprintf("\t%q: %s,", filepath.Base(fi.Filename), filenameToVar(fi.Filename)))
-	}
-	writeLn("}")
-	writeLn("")
-
 	seen := map[*FileInfo]bool{}
 	for _, fi := range sortFiles(files) {
 		if seen[fi] {
@@ -198,6 +180,23 @@ func genGo(modFiles, viewerFiles, listingFiles []*FileInfo, version string, vers
 	}
 }
 
+// copyFrontend copies the frontend files in embed/<dir>, for go:embed in
+// resources.go.
+func copyFrontend(dir string, files []*FileInfo) {
+	dst := filepath.Join("embed", dir)
+	if err := os.RemoveAll(dst); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		log.Fatal(err)
+	}
+	for _, fi := range files {
+		if err := ioutil.WriteFile(filepath.Join(dst, filepath.Base(fi.Filename)), fi.Content, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 type Loader struct {
 	hash        hash.Hash
 	hashingDone bool
@@ -342,5 +341,7 @@ func main() {
 	// Generate Lua file first as it will be embedded also in Go module files.
 	genLua(viewerFiles, version, versionHash)
 	modFiles = append(modFiles, loader.LoadTextFile("mod/generated.lua"))
-	genGo(modFiles, viewerFiles, listingFiles, version, versionHash)
+	genGo(modFiles, version, versionHash)
+	copyFrontend("viewer", viewerFiles)
+	copyFrontend("listing", listingFiles)
 }
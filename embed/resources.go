@@ -2,3 +2,27 @@ package embed
 
 // Content is mostly autogenerated in generated.go. Here are just helper
 // functions.
+
+import (
+	goembed "embed"
+	"io/fs"
+)
+
+// frontendFiles contains the built frontend, copied here by regen.go.
+//
+//go:embed viewer listing
+var frontendFiles goembed.FS
+
+// ViewerFS is the files for the UI to navigate a single mapshot (map view).
+var ViewerFS = mustSub(frontendFiles, "viewer")
+
+// ListingFS is the files for the UI to navigate the list of mapshots.
+var ListingFS = mustSub(frontendFiles, "listing")
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
@@ -0,0 +1,85 @@
+package factorio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Factorio args which cannot be given as extra args, as mapshot sets them
+// itself or they prevent rendering; with the reason why.
+var conflictingArgs = map[string]string{
+	"--load-game":                  "mapshot loads a copy of the save itself",
+	"--load-scenario":              "mapshot renders saves, which it loads itself",
+	"--create":                     "mapshot renders existing saves",
+	"--mp-connect":                 "renders are done locally, in single player",
+	"--start-server":               "renders need a game with a player, not a headless server",
+	"--start-server-load-scenario": "renders need a game with a player, not a headless server",
+	"--start-server-load-latest":   "renders need a game with a player, not a headless server",
+	"--benchmark":                  "mapshot loads the save itself, and benchmarks do not render",
+	"--mod-directory":              "mapshot gives Factorio a copy of the mods with mapshot enabled; use --enable_mod to enable other mods",
+	"--config":                     "mapshot may give its own config, e.g., for --parallel; use --factorio_datadir to pick another Factorio setup",
+	"-c":                           "mapshot may give its own config, e.g., for --parallel; use --factorio_datadir to pick another Factorio setup",
+	"--instrument-mod":             "mapshot already loads its own mod",
+	"--map2scenario":               "mapshot renders saves, which it loads itself",
+	"--scenario2map":               "mapshot renders saves, which it loads itself",
+	"--apply-update":               "Factorio would update instead of rendering",
+	"--version":                    "Factorio would exit without rendering",
+	"--help":                       "Factorio would exit without rendering",
+	"-h":                           "Factorio would exit without rendering",
+	"--dump-data":                  "Factorio would exit without rendering",
+	"--dump-icon-sprites":          "Factorio would exit without rendering",
+	"--dump-prototype-locale":      "Factorio would exit without rendering",
+	"--generate-map-preview":       "Factorio would exit without rendering",
+}
+
+// Factorio args which take no value and are always set by mapshot; giving
+// them again is harmless, so they are just not repeated.
+var switchArgs = map[string]bool{
+	"--disable-audio": true,
+}
+
+// checkExtraArgs verifies that args do not conflict with what mapshot gives
+// to Factorio.
+func checkExtraArgs(args []string) error {
+	for _, arg := range args {
+		name := arg
+		if idx := strings.Index(name, "="); idx >= 0 {
+			name = name[:idx]
+		}
+		if reason := conflictingArgs[name]; reason != "" {
+			return fmt.Errorf("extra Factorio arg %q cannot be used: %s", arg, reason)
+		}
+	}
+	return nil
+}
+
+// mergeArgs returns args followed by extra, without the switches of extra
+// which args already has.
+func mergeArgs(args []string, extra []string) []string {
+	present := map[string]bool{}
+	for _, a := range args {
+		present[a] = true
+	}
+	res := append([]string{}, args...)
+	for _, a := range extra {
+		if switchArgs[a] && present[a] {
+			continue
+		}
+		res = append(res, a)
+	}
+	return res
+}
+
+// quoteArgs formats a command line for logs, quoting args when needed to
+// tell them apart.
+func quoteArgs(args []string) string {
+	var parts []string
+	for _, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n\"'\\$`") {
+			a = strconv.Quote(a)
+		}
+		parts = append(parts, a)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,298 @@
+package factorio
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Endpoints of factorio.com used to download the game.
+const (
+	latestReleasesURL = "https://factorio.com/api/latest-releases"
+	checksumsURL      = "https://www.factorio.com/download/sha256sums/"
+	// Followed by <version>/alpha/linux64; `alpha` is the full client - the
+	// one which can render, as opposed to `headless`.
+	getDownloadURL = "https://www.factorio.com/get-download/"
+)
+
+// Environment variables with the factorio.com credentials - the same as the
+// ones used for the headless server updates; the token is on the profile
+// page of factorio.com.
+const (
+	usernameEnv = "FACTORIO_USERNAME"
+	tokenEnv    = "FACTORIO_TOKEN"
+)
+
+var releaseRE = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// DownloadDir returns where downloaded versions of Factorio are kept - e.g.,
+// ~/.cache/mapshot/factorio on Linux.
+func DownloadDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("no cache dir to download Factorio to: %w", err)
+	}
+	return filepath.Join(dir, "mapshot", "factorio"), nil
+}
+
+// Download makes sure the full client of Factorio is available in the cache,
+// downloading it from factorio.com if needed, and returns the directory of
+// that install. version is e.g. `1.1.110`; see LatestRelease. This needs a
+// factorio.com account owning the game, through $FACTORIO_USERNAME and
+// $FACTORIO_TOKEN.
+func Download(ctx context.Context, version string) (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", errors.New("downloading Factorio is only supported on Linux")
+	}
+	cacheDir, err := DownloadDir()
+	if err != nil {
+		return "", err
+	}
+	if !releaseRE.MatchString(version) {
+		return "", fmt.Errorf("invalid Factorio version %q: must be like 1.1.110", version)
+	}
+	dir := filepath.Join(cacheDir, version)
+	if isInstall(dir) {
+		logInfo("using downloaded Factorio", "version", version, "dir", dir)
+		return dir, nil
+	}
+	username, token := os.Getenv(usernameEnv), os.Getenv(tokenEnv)
+	if username == "" || token == "" {
+		return "", fmt.Errorf("downloading Factorio requires a factorio.com account owning the game: set $%s and $%s - the token is on your profile page on factorio.com", usernameEnv, tokenEnv)
+	}
+
+	filename := fmt.Sprintf("factorio_linux_%s.tar.xz", version)
+	checksum, err := releaseChecksum(ctx, filename)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create dir %q: %w", cacheDir, err)
+	}
+	archive := filepath.Join(cacheDir, filename)
+	q := url.Values{}
+	q.Set("username", username)
+	q.Set("token", token)
+	src := getDownloadURL + version + "/alpha/linux64?" + q.Encode()
+	if err := downloadFile(ctx, src, archive, checksum); err != nil {
+		return "", fmt.Errorf("unable to download Factorio %s: %w", version, err)
+	}
+	if err := unpack(archive, dir); err != nil {
+		return "", err
+	}
+	// The archive is not needed anymore once unpacked.
+	if err := os.Remove(archive); err != nil {
+		logWarning("unable to remove archive", "path", archive, "error", err)
+	}
+	logInfo("Factorio downloaded", "version", version, "dir", dir)
+	return dir, nil
+}
+
+// InstallBinary returns the Factorio binary of a downloaded install.
+func InstallBinary(dir string) string {
+	return filepath.Join(dir, "bin", "x64", "factorio")
+}
+
+// isInstall indicates if dir is a complete downloaded install.
+func isInstall(dir string) bool {
+	info, err := os.Stat(InstallBinary(dir))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// LatestRelease returns the latest stable version of the full client, from
+// factorio.com.
+func LatestRelease(ctx context.Context) (string, error) {
+	raw, err := httpGet(ctx, latestReleasesURL)
+	if err != nil {
+		return "", fmt.Errorf("unable to find the latest version of Factorio: %w", err)
+	}
+	var releases struct {
+		Stable struct {
+			Alpha string `json:"alpha"`
+		} `json:"stable"`
+	}
+	if err := json.Unmarshal(raw, &releases); err != nil {
+		return "", fmt.Errorf("unable to decode %s: %w", latestReleasesURL, err)
+	}
+	if !releaseRE.MatchString(releases.Stable.Alpha) {
+		return "", fmt.Errorf("no stable version found in %s", latestReleasesURL)
+	}
+	return releases.Stable.Alpha, nil
+}
+
+// releaseChecksum returns the SHA-256 of the archive, as published by
+// factorio.com.
+func releaseChecksum(ctx context.Context, filename string) (string, error) {
+	raw, err := httpGet(ctx, checksumsURL)
+	if err != nil {
+		return "", fmt.Errorf("unable to get the checksums of Factorio releases: %w", err)
+	}
+	// Same format as sha256sum: `<checksum>  <filename>`.
+	scanner := bufio.NewScanner(strings.NewReader(string(raw)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == filename {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum published for %s in %s; is that version available?", filename, checksumsURL)
+}
+
+func httpGet(ctx context.Context, src string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP status %s", src, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// downloadFile fetches src into dst, and verifies its SHA-256. Data is written
+// to dst.part first; when that file exists - e.g., after an interrupted
+// download - the download resumes from where it stopped.
+func downloadFile(ctx context.Context, src string, dst string, checksum string) error {
+	part := dst + ".part"
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return redactError(err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return redactError(err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		logInfo("resuming download", "path", dst, "offset", offset)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// Already complete.
+		logInfo("download already complete", "path", dst)
+	case resp.StatusCode == http.StatusOK:
+		// Not resumable; start over.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		logInfo("downloading", "path", dst)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("HTTP status %s; check $%s and $%s, and that this account owns the game", resp.Status, usernameEnv, tokenEnv)
+	default:
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if _, err := io.Copy(f, resp.Body); err != nil {
+			return fmt.Errorf("download interrupted - it will resume on the next run: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	got, err := fileChecksum(part)
+	if err != nil {
+		return err
+	}
+	if got != checksum {
+		// Nothing to resume from.
+		os.Remove(part)
+		return fmt.Errorf("invalid checksum of %s: got %s, expected %s", dst, got, checksum)
+	}
+	return os.Rename(part, dst)
+}
+
+func fileChecksum(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// redactError removes the query - i.e., the token - from the URL of an HTTP
+// error.
+func redactError(err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		if u, perr := url.Parse(uerr.URL); perr == nil {
+			u.RawQuery = ""
+			uerr.URL = u.String()
+		}
+	}
+	return err
+}
+
+// unpack extracts the Factorio archive as dir. It is extracted next to it
+// first, so dir only exists once complete. The install is set up to keep its
+// data - mods, saves and so on - in its own directory.
+func unpack(archive string, dir string) error {
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	logInfo("unpacking", "path", archive)
+	// tar.xz is not supported by the standard library.
+	cmd := exec.Command("tar", "-xJf", archive, "-C", tmp)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to unpack %s - tar with xz support is needed: %w; output: %s", archive, err, strings.TrimSpace(string(out)))
+	}
+	// The archive contains a single `factorio` directory.
+	root := filepath.Join(tmp, "factorio")
+	if !isInstall(root) {
+		return fmt.Errorf("no Factorio binary found in %s", archive)
+	}
+	cfg := filepath.Join(root, "config-path.cfg")
+	if err := ioutil.WriteFile(cfg, []byte("config-path=__PATH__executable__/../../config\nuse-system-read-write-data-directories=false\n"), 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %w", cfg, err)
+	}
+	mods := filepath.Join(root, ModsDir)
+	if err := os.MkdirAll(mods, 0755); err != nil {
+		return fmt.Errorf("unable to create dir %q: %w", mods, err)
+	}
+	mlist := &ModList{Mods: []*ModListEntry{{Name: "base", Enabled: true}}}
+	if err := mlist.Write(filepath.Join(mods, "mod-list.json")); err != nil {
+		return err
+	}
+	return os.Rename(root, dir)
+}
@@ -7,15 +7,18 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/golang/glog"
 	"github.com/mitchellh/go-homedir"
 	"github.com/otiai10/copy"
 	"github.com/spf13/pflag"
@@ -36,13 +39,34 @@ type Factorio struct {
 	verbose      bool
 	keepRunning  bool
 	extraArgs    []string
+	// Where Factorio writes its log, script-output, ... when different from
+	// datadir; see Isolated.
+	writeDir string
+	// Extra args coming from the Factorio setup, such as --config.
+	setupArgs []string
+	// Where Factorio stdout/stderr go when verbose; os.Stdout/os.Stderr if nil.
+	output io.Writer
+	// Where Factorio stdout/stderr also go, verbose or not.
+	log io.Writer
+	// Run Factorio in a virtual X server.
+	xvfb bool
+	// Args before the Factorio ones, when the binary is a launcher - i.e.,
+	// flatpak.
+	launchArgs []string
+	// Version of the binary, once known; see Version().
+	version *versionState
+	// Command to start the binary with, e.g., wine.
+	wrapper []string
+	// When running the Windows version through Wine.
+	wine       *winePrefix
+	flagPrefix string
 }
 
 // New creates a new Factorio instance from the settings.
 func New(s *Settings) (*Factorio, error) {
 	datadir := s.DataDir()
 	if datadir == "" {
-		return nil, fmt.Errorf("no factorio data dir found; use --alsologtostderr for more info and --%sdatadir to specify its location", s.flagPrefix)
+		return nil, fmt.Errorf("no factorio data dir found; use --log_level=debug for more info and --%sdatadir to specify its location", s.flagPrefix)
 	}
 	scriptOutput, err := s.ScriptOutput()
 	if err != nil {
@@ -52,6 +76,21 @@ func New(s *Settings) (*Factorio, error) {
 	if err != nil {
 		return nil, err
 	}
+	if s.xvfb && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("--%sxvfb is only supported on Linux", s.flagPrefix)
+	}
+	wrapper := strings.Fields(s.wrapper)
+	wine := s.winePrefix()
+	if wine != nil && len(wrapper) == 0 {
+		wrapper = []string{"wine"}
+	}
+	var launchArgs []string
+	if s.Flatpak() {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("--%sflatpak is only supported on Linux", s.flagPrefix)
+		}
+		launchArgs = flatpakArgs()
+	}
 
 	var extraArgs []string
 	for _, s := range strings.Split(s.extraArgs, " ") {
@@ -60,6 +99,10 @@ func New(s *Settings) (*Factorio, error) {
 			extraArgs = append(extraArgs, s)
 		}
 	}
+	extraArgs = append(extraArgs, s.args...)
+	if err := checkExtraArgs(extraArgs); err != nil {
+		return nil, err
+	}
 	return &Factorio{
 		datadir:      datadir,
 		scriptOutput: scriptOutput,
@@ -67,9 +110,95 @@ func New(s *Settings) (*Factorio, error) {
 		verbose:      s.verbose,
 		extraArgs:    extraArgs,
 		keepRunning:  s.keepRunning,
+		xvfb:         s.xvfb,
+		launchArgs:   launchArgs,
+		version:      &versionState{},
+		wrapper:      wrapper,
+		wine:         wine,
+		flagPrefix:   s.flagPrefix,
 	}, nil
 }
 
+// Isolated returns a copy of the Factorio instance which uses dir as write
+// data directory, instead of the datadir - i.e., for its log, script-output,
+// lock file and so on. Factorio refuses to run twice on the same write data
+// directory, so this allows for multiple instances at the same time. Saves and
+// mods are still looked for in the datadir.
+func (f *Factorio) Isolated(dir string) (*Factorio, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create dir %q: %w", dir, err)
+	}
+	config, err := f.isolatedConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	configFile := filepath.Join(dir, "config.ini")
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		return nil, fmt.Errorf("unable to write config file %q: %w", configFile, err)
+	}
+	logDebug("created isolated config", "path", configFile)
+
+	n := *f
+	n.writeDir = dir
+	n.scriptOutput = filepath.Join(dir, "script-output")
+	n.setupArgs = append(append([]string{}, f.setupArgs...), "--config", configFile)
+	return &n, nil
+}
+
+// isolatedConfig generates the content of a config.ini, based on the current
+// one, but with dir as write data directory.
+func (f *Factorio) isolatedConfig(dir string) (string, error) {
+	// Factorio accepts forward slashes on Windows too, and they do not need
+	// any escaping.
+	writeData := "write-data=" + filepath.ToSlash(dir)
+	if f.wine != nil {
+		writeData = "write-data=" + f.wine.toWindows(dir, true)
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(f.DataDir(), "config", "config.ini"))
+	if os.IsNotExist(err) {
+		// Same as Factorio defaults, beside the write directory.
+		readData := "__PATH__executable__/../../data"
+		if runtime.GOOS == "darwin" {
+			readData = "__PATH__executable__/../data"
+		}
+		return "[path]\nread-data=" + readData + "\n" + writeData + "\n", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read Factorio config: %w", err)
+	}
+	var lines []string
+	section := ""
+	found := false
+	for _, line := range strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			section = trimmed
+		}
+		if section == "[path]" && strings.HasPrefix(trimmed, "write-data") {
+			continue
+		}
+		lines = append(lines, line)
+		if trimmed == "[path]" {
+			lines = append(lines, writeData)
+			found = true
+		}
+	}
+	if !found {
+		lines = append([]string{"[path]", writeData}, lines...)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// SetOutput changes where Factorio stdout & stderr go when verbose.
+func (f *Factorio) SetOutput(w io.Writer) {
+	f.output = w
+}
+
+// SetLog makes Factorio stdout & stderr also go to w, even when not verbose.
+func (f *Factorio) SetLog(w io.Writer) {
+	f.log = w
+}
+
 // ForceVerbose set verbose to true.
 func (f *Factorio) ForceVerbose() {
 	f.verbose = true
@@ -85,6 +214,16 @@ func (f *Factorio) Binary() string {
 	return f.binary
 }
 
+// TempDir returns where to create the temporary files given to Factorio -
+// e.g., the copy of a save. It is "" for the system default, which a Flatpak
+// sandbox cannot access; the data dir is used then.
+func (f *Factorio) TempDir() string {
+	if len(f.launchArgs) > 0 {
+		return filepath.Join(f.DataDir(), "mapshot-temp")
+	}
+	return ""
+}
+
 // ModsDir is the directory where all the mods are located.
 func (f *Factorio) ModsDir() string {
 	return filepath.Join(f.DataDir(), ModsDir)
@@ -107,25 +246,83 @@ func (f *Factorio) FindSaveFile(name string) (string, error) {
 	for _, c := range candidates {
 		_, err := os.Stat(c)
 		if err == nil {
-			glog.Infof("Looking for save %q; %s exists.", name, c)
+			logDebug("save found", "save", name, "path", c)
 			return c, nil
 		}
 		if !os.IsNotExist(err) {
 			return "", nil
 		}
-		glog.Infof("Looking for save %q; %s does not exists.", name, c)
+		logDebug("save not found", "save", name, "path", c)
 	}
 	return "", os.ErrNotExist
 }
 
-// Run factorio.
+// SaveFile is a game save found in the datadir.
+type SaveFile struct {
+	// Name of the save, without .zip.
+	Name    string
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ListSaves returns the saves of the datadir, sorted by name.
+func (f *Factorio) ListSaves() ([]*SaveFile, error) {
+	dir := filepath.Join(f.DataDir(), SavesDir)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list saves: %w", err)
+	}
+	var saves []*SaveFile
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || filepath.Ext(e.Name()) != ".zip" {
+			continue
+		}
+		saves = append(saves, &SaveFile{
+			Name:    strings.TrimSuffix(e.Name(), ".zip"),
+			Path:    filepath.Join(dir, e.Name()),
+			Size:    e.Size(),
+			ModTime: e.ModTime(),
+		})
+	}
+	return saves, nil
+}
+
+// How long to wait for Factorio to stop before killing it.
+const killDelay = 10 * time.Second
+
+// Run factorio. When the context is cancelled, Factorio is asked to quit -
+// unless --keep_running is set; when the context deadline is exceeded,
+// Factorio is always stopped. If it does not stop within killDelay, it is
+// killed along with the processes it started.
 func (f *Factorio) Run(ctx context.Context, args []string) error {
-	args = append(append([]string{}, args...), f.extraArgs...)
-	glog.Infof("Running factorio with args: %v", args)
-	cmd := exec.Command(f.binary, args...)
+	args = mergeArgs(append(append([]string{}, f.setupArgs...), args...), f.extraArgs)
+	cmd := f.command(args)
+	logDebug("running Factorio", "args", args, "command", quoteArgs(cmd.Args))
 	if f.verbose {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
+		if f.output != nil {
+			cmd.Stdout = f.output
+			cmd.Stderr = f.output
+		}
+	}
+	if f.log != nil {
+		cmd.Stdout = teeWriter(cmd.Stdout, f.log)
+		cmd.Stderr = teeWriter(cmd.Stderr, f.log)
+	}
+	setProcessGroup(cmd)
+	if f.xvfb {
+		x, err := startXvfb()
+		if err != nil {
+			return err
+		}
+		// Only once Factorio is done with the display.
+		defer x.stop()
+		cmd.Env = x.env(cmd.Env)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start Factorio: %w", err)
 	}
 	done := make(chan struct{})
 	go func() {
@@ -133,25 +330,115 @@ func (f *Factorio) Run(ctx context.Context, args []string) error {
 		case <-done:
 			return
 		case <-ctx.Done():
-			if f.keepRunning {
-				glog.Infof("interrupt requested, but keep_running specified")
-			} else {
-				glog.Infof("interrupt requested")
-				if runtime.GOOS == "windows" {
-					// On Windows, os.Interrupt is a no-op, so be a bit more direct.
-					cmd.Process.Signal(os.Kill)
-				} else {
-					cmd.Process.Signal(os.Interrupt)
-				}
-			}
+		}
+		timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		switch {
+		case timedOut:
+			logInfo("timeout reached, stopping Factorio")
+			terminateProcess(cmd.Process)
+		case f.keepRunning:
+			logInfo("interrupt requested, but --keep_running specified")
+			return
+		default:
+			logInfo("interrupt requested, stopping Factorio")
+			interruptProcess(cmd.Process)
+		}
+		select {
+		case <-done:
+		case <-time.After(killDelay):
+			logWarning("Factorio did not stop, killing it", "delay", killDelay)
+			killProcess(cmd.Process)
 		}
 	}()
-	err := cmd.Run()
+	err := cmd.Wait()
 	close(done)
-	glog.Infof("Factorio returned: %v", err)
+	logDebug("Factorio returned", "error", err)
 	return err
 }
 
+// command prepares the execution of Factorio with the given args, through
+// the launcher & wrapper if any.
+func (f *Factorio) command(args []string) *exec.Cmd {
+	args = append(append([]string{}, f.launchArgs...), args...)
+	env := os.Environ()
+	if f.wine != nil {
+		args = f.wine.args(args)
+		env = append(env, f.wine.env()...)
+	}
+	var cmd *exec.Cmd
+	if len(f.wrapper) > 0 {
+		cmd = exec.Command(f.wrapper[0], append(append(append([]string{}, f.wrapper[1:]...), f.binary), args...)...)
+	} else {
+		cmd = exec.Command(f.binary, args...)
+	}
+	cmd.Env = env
+	return cmd
+}
+
+// CheckRender verifies that this Factorio can render screenshots - which the
+// headless version cannot - with an actionable error otherwise.
+func (f *Factorio) CheckRender(ctx context.Context) error {
+	v, err := f.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if v.Headless() {
+		return fmt.Errorf("%s is the headless version of Factorio, which cannot take screenshots; install the full game - e.g., the Linux download from factorio.com, which runs without a display with --%sxvfb - and point --%sbinary to it", f.binary, f.flagPrefix, f.flagPrefix)
+	}
+	if runtime.GOOS == "linux" && !f.xvfb && os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return fmt.Errorf("no display available - neither $DISPLAY nor $WAYLAND_DISPLAY is set - and Factorio needs one to render; use --%sxvfb to run it in a virtual X server", f.flagPrefix)
+	}
+	return nil
+}
+
+// teeWriter writes to both, w being possibly nil.
+func teeWriter(w io.Writer, log io.Writer) io.Writer {
+	if w == nil {
+		return log
+	}
+	return io.MultiWriter(w, log)
+}
+
+// LogFile returns the path of the log of the currently running - or last -
+// Factorio instance.
+func (f *Factorio) LogFile() string {
+	dir := f.writeDir
+	if dir == "" {
+		dir = f.DataDir()
+	}
+	return filepath.Join(dir, "factorio-current.log")
+}
+
+// LogTail returns up to the last n lines of the Factorio log.
+func (f *Factorio) LogTail(n int) (string, error) {
+	return TailFile(f.LogFile(), n)
+}
+
+// TailFile returns up to the last n lines of a text file.
+func TailFile(fname string, n int) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	// Only the end of the file is needed; lines are short.
+	const maxTail = 64 << 10
+	if info, err := file.Stat(); err == nil && info.Size() > maxTail {
+		if _, err := file.Seek(-maxTail, io.SeekEnd); err != nil {
+			return "", err
+		}
+	}
+	raw, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimRight(string(raw), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
 // CopyMods creates a mods directory in the given location based on the current one.
 // This can serve as a base to forcefully enable a mod or similar.
 func (f *Factorio) CopyMods(dstMods string, filterOut []string) error {
@@ -180,10 +467,10 @@ func (f *Factorio) CopyMods(dstMods string, filterOut []string) error {
 		if idx := strings.LastIndex(modName, "_"); idx >= 0 {
 			modName = modName[:idx]
 		}
-		glog.Infof("copying mod %s from %s to %s", modName, src, dst)
+		logDebug("copying mod", "mod", modName, "from", src, "to", dst)
 
 		if filtered[modName] {
-			glog.Infof("ignoring mod file %q", src)
+			logDebug("ignoring mod file", "path", src)
 			continue
 		}
 		// Fiddle with the mod list to remove filtered mods.
@@ -203,7 +490,7 @@ func (f *Factorio) CopyMods(dstMods string, filterOut []string) error {
 			if err := mlist.Write(dst); err != nil {
 				return err
 			}
-			glog.Infof("created mod-list.json")
+			logDebug("created mod-list.json", "path", dst)
 			foundModList = true
 			continue
 		}
@@ -213,7 +500,7 @@ func (f *Factorio) CopyMods(dstMods string, filterOut []string) error {
 		if err != nil {
 			return fmt.Errorf("unable to copy %q to %q: %w", src, dst, err)
 		}
-		glog.Infof("copied mod file %q to %q", src, dst)
+		logDebug("copied mod file", "from", src, "to", dst)
 	}
 
 	if !foundModList {
@@ -231,6 +518,17 @@ type Settings struct {
 	verbose      bool
 	keepRunning  bool
 	extraArgs    string
+	args         []string
+	xvfb         bool
+	flatpak      bool
+	wrapper      string
+
+	// Whether to use Flatpak, when not forced; see Flatpak().
+	flatpakOnce     sync.Once
+	flatpakDetected bool
+	// Prefix for the Windows version; see winePrefix().
+	wineOnce sync.Once
+	wine     *winePrefix
 }
 
 // Register add flags to configure how to call Factorio on the flagset.
@@ -242,9 +540,32 @@ func (s *Settings) Register(flags *pflag.FlagSet, prefix string) *Settings {
 	flags.BoolVar(&s.verbose, prefix+"verbose", false, "If true, stream Factorio stdout/stderr to the console.")
 	flags.BoolVar(&s.keepRunning, prefix+"keep_running", false, "If true, wait for Factorio to exit instead of stopping it.")
 	flags.StringVar(&s.extraArgs, prefix+"extra_args", "", "Extra args to give to Factorio; e.g., '--force-graphics-preset very-low'. Split on spaces.")
+	flags.StringArrayVar(&s.args, prefix+"arg", nil, "Extra arg to give to Factorio, as is - not split on spaces. Can be repeated; e.g., --"+prefix+"arg=--force-graphics-preset --"+prefix+"arg=very-low.")
+	flags.BoolVar(&s.flatpak, prefix+"flatpak", false, "If true, run Factorio through `flatpak run`, with its data dir in the Flatpak sandbox. Detected automatically when the Flatpak is the only install found - and no binary is specified.")
+	flags.StringVar(&s.wrapper, prefix+"wrapper", "", "Command to start Factorio with - e.g., 'wine', or 'gamemoderun'. Split on spaces. Defaults to 'wine' for the Windows version (factorio.exe) outside of Windows.")
+	flags.BoolVar(&s.xvfb, prefix+"xvfb", false, "If true, run Factorio in a virtual X server (Xvfb), for machines without a display. Linux only.")
 	return s
 }
 
+// UseInstall makes Factorio run from a downloaded install - see Download -
+// with its own data dir, unless one is specified.
+func (s *Settings) UseInstall(dir string) error {
+	if s.binary != "" || s.flatpak {
+		return fmt.Errorf("a downloaded Factorio cannot be used along with --%sbinary or --%sflatpak", s.flagPrefix, s.flagPrefix)
+	}
+	s.binary = InstallBinary(dir)
+	if s.datadir == "" {
+		s.datadir = dir
+	}
+	return nil
+}
+
+// AddArgs adds args to give to Factorio, after the ones from the flags; e.g.,
+// those after `--` on the command line.
+func (s *Settings) AddArgs(args ...string) {
+	s.args = append(s.args, args...)
+}
+
 // DataDir returns the place where saves, mods and others are located.
 // Returns "" if no directory is found.
 func (s *Settings) DataDir() string {
@@ -258,35 +579,53 @@ func (s *Settings) DataDir() string {
 	if e := os.Getenv("APPDATA"); e != "" {
 		candidates = append(candidates, filepath.Join(e, "Factorio"))
 	}
+	// Steam installs normally use the directories above; unless configured
+	// otherwise.
+	for _, dir := range steamInstalls() {
+		if d := steamDataDir(dir); d != "" {
+			logDebug("Steam install keeps its data in its own directory", "dir", dir)
+			candidates = append(candidates, d)
+		}
+	}
+	if s.Flatpak() {
+		candidates = flatpakDataDirs()
+	}
+	wine := s.winePrefix()
+	if wine != nil {
+		candidates = wine.dataDirs()
+	}
 
 	if s.datadir != "" {
 		candidates = []string{s.datadir}
+		if wine != nil {
+			candidates = []string{wine.toHost(s.datadir)}
+		}
 	}
 
 	match := ""
 	for _, c := range candidates {
 		s, err := homedir.Expand(c)
 		if err != nil {
-			glog.Infof("Unable to expand %s: %v", c, err)
+			logDebug("unable to expand path", "path", c, "error", err)
 			continue
 		}
 		info, err := os.Stat(s)
 		if os.IsNotExist(err) {
-			glog.Infof("Path %s does not exists, skipped", s)
+			logDebug("path does not exist, skipped", "path", s)
 			continue
 		}
 		if !info.IsDir() {
-			glog.Infof("Path %s is a file, skipped", s)
+			logDebug("path is a file, skipped", "path", s)
 			continue
 		}
-		glog.Infof("Found factorio data dir: %s", s)
+		logDebug("Factorio data dir found", "dir", s)
 		match = s
 	}
 	if match == "" {
-		glog.Infof("No Factorio data dir found")
+		logDebug("no Factorio data dir found")
 		return ""
 	}
-	glog.Infof("Using Factorio data dir: %s", match)
+	logDebug("using Factorio data dir", "dir", match)
 	return match
 }
 
@@ -295,7 +634,7 @@ func (s *Settings) ScriptOutput() (string, error) {
 	if s.scriptOutput == "" {
 		dataDir := s.DataDir()
 		if dataDir == "" {
-			return "", fmt.Errorf("no factorio data dir found; use --alsologtostderr for more info; use --%sscriptoutput to specify directly the script-output location", s.flagPrefix)
+			return "", fmt.Errorf("no factorio data dir found; use --log_level=debug for more info; use --%sscriptoutput to specify directly the script-output location", s.flagPrefix)
 		}
 		// Don't check extra subpath when using the default script-output
 		// location - Factorio might not have created it by default, and not
@@ -304,6 +643,9 @@ func (s *Settings) ScriptOutput() (string, error) {
 	}
 
 	d := s.scriptOutput
+	if wine := s.winePrefix(); wine != nil {
+		d = wine.toHost(d)
+	}
 	info, err := os.Stat(d)
 	if os.IsNotExist(err) {
 		return "", fmt.Errorf("script-output dir %s does not exists", d)
@@ -314,21 +656,84 @@ func (s *Settings) ScriptOutput() (string, error) {
 	return d, nil
 }
 
-// Binary returns the path to the Factorio binary.
+// Flatpak indicates whether Factorio is run through Flatpak: when --flatpak is
+// set, or when no binary is specified nor found, but the Flatpak is installed.
+func (s *Settings) Flatpak() bool {
+	if s.flatpak {
+		return true
+	}
+	if s.binary != "" || runtime.GOOS != "linux" {
+		return false
+	}
+	s.flatpakOnce.Do(func() {
+		s.flatpakDetected = s.nativeBinary() == "" && flatpakInstalled()
+		if s.flatpakDetected {
+			logDebug("no Factorio binary found, but Flatpak is installed; using it")
+		}
+	})
+	return s.flatpakDetected
+}
+
+// Binary returns the path to the Factorio binary - or to flatpak, see
+// Flatpak().
 func (s *Settings) Binary() (string, error) {
+	if s.Flatpak() {
+		p, err := exec.LookPath("flatpak")
+		if err != nil {
+			return "", fmt.Errorf("unable to find flatpak to run Factorio %s: %w", flatpakAppID, err)
+		}
+		logDebug("using Factorio Flatpak", "app", flatpakAppID, "launcher", p)
+		return p, nil
+	}
+	match := s.nativeBinary()
+	if match == "" {
+		return "", fmt.Errorf("no factorio binary found; use --log_level=debug for more info and --%sbinary to specify its location", s.flagPrefix)
+	}
+	return match, nil
+}
+
+// winePrefix returns the prefix to run the Windows version of Factorio in -
+// when that is the binary, outside of Windows - and nil otherwise.
+func (s *Settings) winePrefix() *winePrefix {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	s.wineOnce.Do(func() {
+		binary, err := homedir.Expand(s.binary)
+		if err != nil || binary == "" {
+			binary = s.nativeBinary()
+		}
+		if isWindowsBinary(binary) {
+			logDebug("Windows version of Factorio; running it through Wine")
+			s.wine = findWinePrefix(binary)
+		}
+	})
+	return s.wine
+}
+
+// nativeBinary looks for the Factorio binary, returning "" if none is found.
+func (s *Settings) nativeBinary() string {
 	// List is in reverse order of priority - last one will be preferred.
-	candidates := []string{
-		// Steam is a bit tricky to start/stop automatically, so ignore it for now.
-		// `~/Library/Application Support/Steam/steamapps/common/Factorio/factorio.app/Contents`,
+	// Steam installs come first, so a standalone version is used if there is
+	// one.
+	var candidates []string
+	fromSteam := map[string]bool{}
+	for _, dir := range steamInstalls() {
+		if runtime.GOOS != "windows" {
+			// Windows version, run through Proton.
+			exe := filepath.Join(dir, "bin", "x64", "factorio.exe")
+			candidates = append(candidates, exe)
+			fromSteam[exe] = true
+		}
+		candidates = append(candidates, steamBinary(dir))
+		fromSteam[steamBinary(dir)] = true
+	}
+	candidates = append(candidates,
 		`/opt/factorio/bin/x64/factorio`,
 		`~/factorio/bin/x64/factorio`,
 		`~/.factorio/bin/x64/factorio`,
 		`/Applications/factorio.app/Contents`,
-	}
-	// Steam is a bit tricky to start/stop automatically, so ignore it for now.
-	// if e := os.Getenv("ProgramFiles(x86)"); e != "" {
-	//	candidates = append(candidates, filepath.Join(e, "Steam", "steamapps", "common", "Factorio", "bin", "x64", "factorio.exe"))
-	// }
+	)
 	if e := os.Getenv("ProgramW6432"); e != "" {
 		candidates = append(candidates, filepath.Join(e, "Factorio", "bin", "x64", "factorio.exe"))
 	}
@@ -340,27 +745,31 @@ func (s *Settings) Binary() (string, error) {
 	for _, c := range candidates {
 		s, err := homedir.Expand(c)
 		if err != nil {
-			glog.Infof("Unable to expand %s: %v", c, err)
+			logDebug("unable to expand path", "path", c, "error", err)
 			continue
 		}
 		info, err := os.Stat(s)
 		if os.IsNotExist(err) {
-			glog.Infof("Path %s does not exists, skipped", s)
+			logDebug("path does not exist, skipped", "path", s)
 			continue
 		}
 		if info.IsDir() {
-			glog.Infof("Path %s is a directory, skipped", s)
+			logDebug("path is a directory, skipped", "path", s)
 			continue
 		}
-		glog.Infof("Factorio binary found: %s", s)
+		logDebug("Factorio binary found", "path", s)
 		match = s
 	}
 	if match == "" {
-		glog.Infof("No factorio binary found")
-		return "", fmt.Errorf("no factorio binary found; use --alsologtostderr for more info and --%sbinary to specify its location", s.flagPrefix)
+		logDebug("no Factorio binary found")
+		return ""
 	}
-	glog.Infof("Using Factorio binary: %s", match)
-	return match, nil
+	if fromSteam[match] {
+		logDebug("using Factorio binary", "path", match, "steam", true)
+	} else {
+		logDebug("using Factorio binary", "path", match)
+	}
+	return match
 }
 
 // ModList represents the content of `mod-list.json` file in Factorio.
@@ -426,6 +835,38 @@ func EnableMod(modsPath string, modName string) error {
 	return mlist.Write(modListFile)
 }
 
+// Mods which are part of Factorio itself, instead of being in the mods
+// directory.
+var builtinMods = map[string]bool{
+	"base":           true,
+	"elevated-rails": true,
+	"quality":        true,
+	"space-age":      true,
+}
+
+// HasMod indicates if the mod is available in the mods directory - as a zip
+// file or a directory, with or without version - or is part of Factorio.
+func HasMod(modsPath string, modName string) bool {
+	if builtinMods[modName] {
+		return true
+	}
+	subs, err := ioutil.ReadDir(modsPath)
+	if err != nil {
+		logWarning("unable to read directory", "dir", modsPath, "error", err)
+		return false
+	}
+	for _, sub := range subs {
+		name := strings.TrimSuffix(sub.Name(), ".zip")
+		if name == modName {
+			return true
+		}
+		if idx := strings.LastIndex(name, "_"); idx >= 0 && name[:idx] == modName {
+			return true
+		}
+	}
+	return false
+}
+
 // Encode data in a format suitable for Factorio `game.decode_string`.
 func Encode(data []byte) string {
 	// Factorio
@@ -0,0 +1,50 @@
+package factorio
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// ID of Factorio on Flathub.
+const flatpakAppID = "com.factorio.Factorio"
+
+// Command to run within the Flatpak sandbox.
+const flatpakCommand = "factorio"
+
+// flatpakInstalled indicates if the Flatpak of Factorio is installed, either
+// for the user or system wide.
+func flatpakInstalled() bool {
+	for _, c := range []string{
+		`~/.local/share/flatpak/app/` + flatpakAppID,
+		`/var/lib/flatpak/app/` + flatpakAppID,
+	} {
+		s, err := homedir.Expand(c)
+		if err != nil {
+			logDebug("unable to expand path", "path", c, "error", err)
+			continue
+		}
+		if info, err := os.Stat(s); err == nil && info.IsDir() {
+			logDebug("Factorio Flatpak found", "path", s)
+			return true
+		}
+		logDebug("path does not exist, skipped", "path", s)
+	}
+	return false
+}
+
+// flatpakDataDirs returns the possible locations of the Factorio data dir
+// within the home of the Flatpak sandbox, in reverse order of priority.
+func flatpakDataDirs() []string {
+	home := `~/.var/app/` + flatpakAppID
+	return []string{
+		filepath.Join(home, "data", "factorio"),
+		filepath.Join(home, ".factorio"),
+	}
+}
+
+// flatpakArgs returns the args of `flatpak run` to start Factorio.
+func flatpakArgs() []string {
+	return []string{"run", "--command=" + flatpakCommand, flatpakAppID}
+}
@@ -0,0 +1,64 @@
+package factorio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// LogLevel is the severity of a log entry.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+)
+
+// LogFunc receives the log entries of this package. Fields are given as
+// alternating keys and values, e.g., "path", p.
+type LogFunc func(level LogLevel, msg string, fields ...interface{})
+
+var logFunc LogFunc = glogLog
+
+// SetLogger sends the log entries of this package to f, instead of glog.
+func SetLogger(f LogFunc) {
+	logFunc = f
+}
+
+// glogLog is the default LogFunc; debug entries require -v=1.
+func glogLog(level LogLevel, msg string, fields ...interface{}) {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		v := fmt.Sprint(fields[i+1])
+		if strings.ContainsAny(v, " \t\n\"=") || v == "" {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %v=%s", fields[i], v)
+	}
+	switch level {
+	case LogDebug:
+		if glog.V(1) {
+			glog.InfoDepth(2, b.String())
+		}
+	case LogInfo:
+		glog.InfoDepth(2, b.String())
+	default:
+		glog.WarningDepth(2, b.String())
+	}
+}
+
+func logDebug(msg string, fields ...interface{}) {
+	logFunc(LogDebug, msg, fields...)
+}
+
+func logInfo(msg string, fields ...interface{}) {
+	logFunc(LogInfo, msg, fields...)
+}
+
+func logWarning(msg string, fields ...interface{}) {
+	logFunc(LogWarning, msg, fields...)
+}
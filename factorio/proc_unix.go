@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package factorio
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group, so it can be
+// stopped with whatever it started.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup sends the signal to the process group of the process.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-p.Pid, sig)
+}
+
+// interruptProcess asks Factorio to quit, as with Ctrl+C.
+func interruptProcess(p *os.Process) error {
+	return signalGroup(p, syscall.SIGINT)
+}
+
+// terminateProcess asks Factorio to stop.
+func terminateProcess(p *os.Process) error {
+	return signalGroup(p, syscall.SIGTERM)
+}
+
+// killProcess stops Factorio immediately.
+func killProcess(p *os.Process) error {
+	return signalGroup(p, syscall.SIGKILL)
+}
@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package factorio
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// interruptProcess stops Factorio. On Windows, os.Interrupt is a no-op, so be
+// a bit more direct.
+func interruptProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+// terminateProcess stops Factorio, with TerminateProcess.
+func terminateProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+// killProcess stops Factorio immediately, with TerminateProcess.
+func killProcess(p *os.Process) error {
+	return p.Kill()
+}
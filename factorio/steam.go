@@ -0,0 +1,230 @@
+package factorio
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// steamRoots returns the possible locations of the Steam client for the
+// current OS.
+func steamRoots() []string {
+	var candidates []string
+	switch runtime.GOOS {
+	case "windows":
+		for _, e := range []string{"ProgramFiles(x86)", "ProgramFiles"} {
+			if v := os.Getenv(e); v != "" {
+				candidates = append(candidates, filepath.Join(v, "Steam"))
+			}
+		}
+	case "darwin":
+		candidates = append(candidates, `~/Library/Application Support/Steam`)
+	default:
+		candidates = append(candidates,
+			`~/.steam/steam`,
+			`~/.local/share/Steam`,
+			`~/.var/app/com.valvesoftware.Steam/.local/share/Steam`,
+		)
+	}
+
+	var roots []string
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		s, err := homedir.Expand(c)
+		if err != nil {
+			logDebug("unable to expand path", "path", c, "error", err)
+			continue
+		}
+		// ~/.steam/steam is usually a symlink to one of the others.
+		if r, err := filepath.EvalSymlinks(s); err == nil {
+			s = r
+		}
+		if info, err := os.Stat(s); err != nil || !info.IsDir() {
+			logDebug("Steam dir does not exist, skipped", "dir", s)
+			continue
+		}
+		if !seen[s] {
+			seen[s] = true
+			roots = append(roots, s)
+		}
+	}
+	return roots
+}
+
+// steamLibraries returns all the Steam library folders - the Steam dir itself,
+// and the ones listed in its libraryfolders.vdf, e.g., on other drives.
+func steamLibraries() []string {
+	var libs []string
+	seen := map[string]bool{}
+	add := func(lib string, source string) {
+		lib = filepath.Clean(lib)
+		if seen[lib] {
+			return
+		}
+		seen[lib] = true
+		logDebug("Steam library", "dir", lib, "source", source)
+		libs = append(libs, lib)
+	}
+	for _, root := range steamRoots() {
+		add(root, "Steam dir")
+		// Location changed across Steam versions.
+		for _, vdf := range []string{
+			filepath.Join(root, "steamapps", "libraryfolders.vdf"),
+			filepath.Join(root, "config", "libraryfolders.vdf"),
+		} {
+			raw, err := ioutil.ReadFile(vdf)
+			if err != nil {
+				logDebug("unable to read Steam library list", "path", vdf, "error", err)
+				continue
+			}
+			for _, lib := range parseLibraryFolders(string(raw)) {
+				add(lib, vdf)
+			}
+		}
+	}
+	return libs
+}
+
+// parseLibraryFolders extracts the paths of the libraries from the content of
+// a Steam libraryfolders.vdf file. Both formats are supported:
+//
+//	"libraryfolders" { "1" { "path" "D:\\SteamLibrary" ... } }
+//
+// and the older:
+//
+//	"LibraryFolders" { "1" "D:\\SteamLibrary" }
+func parseLibraryFolders(content string) []string {
+	var paths []string
+	// Keys of the enclosing blocks.
+	var stack []string
+	var key string
+	hasKey := false
+	for _, tok := range vdfTokens(content) {
+		switch tok {
+		case "{":
+			stack = append(stack, key)
+			hasKey = false
+			continue
+		case "}":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			hasKey = false
+			continue
+		}
+		if !hasKey {
+			key = tok
+			hasKey = true
+			continue
+		}
+		hasKey = false
+		switch {
+		case strings.EqualFold(key, "path") && len(stack) == 2:
+			paths = append(paths, tok)
+		case len(stack) == 1 && isNumber(key):
+			paths = append(paths, tok)
+		}
+	}
+	return paths
+}
+
+// vdfTokens splits VDF content in quoted strings - unescaped - and braces.
+func vdfTokens(content string) []string {
+	var tokens []string
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; c {
+		case '{', '}':
+			tokens = append(tokens, string(c))
+		case '"':
+			var b strings.Builder
+			for i++; i < len(content) && content[i] != '"'; i++ {
+				if content[i] == '\\' && i+1 < len(content) {
+					i++
+				}
+				b.WriteByte(content[i])
+			}
+			tokens = append(tokens, b.String())
+		case '/':
+			// Comments.
+			if i+1 < len(content) && content[i+1] == '/' {
+				for i < len(content) && content[i] != '\n' {
+					i++
+				}
+			}
+		}
+	}
+	return tokens
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	steamOnce sync.Once
+	steamDirs []string
+)
+
+// steamInstalls returns the Factorio directories found in Steam libraries.
+// Libraries are only looked for once.
+func steamInstalls() []string {
+	steamOnce.Do(func() {
+		steamDirs = findSteamInstalls()
+	})
+	return steamDirs
+}
+
+func findSteamInstalls() []string {
+	var dirs []string
+	for _, lib := range steamLibraries() {
+		dir := filepath.Join(lib, "steamapps", "common", "Factorio")
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			logDebug("no Factorio in Steam library", "dir", lib)
+			continue
+		}
+		logDebug("Steam install of Factorio found", "dir", dir)
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// steamBinary returns the path of the Factorio binary within a Steam install.
+func steamBinary(dir string) string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(dir, "bin", "x64", "factorio.exe")
+	case "darwin":
+		return filepath.Join(dir, "factorio.app", "Contents", "MacOS", "factorio")
+	default:
+		return filepath.Join(dir, "bin", "x64", "factorio")
+	}
+}
+
+// steamDataDir returns the install dir itself when it is configured to keep
+// its data there - instead of the usual user directory, which is already
+// looked for - and "" otherwise.
+func steamDataDir(dir string) string {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "config-path.cfg"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		if strings.TrimSpace(line) == "use-system-read-write-data-directories=false" {
+			return dir
+		}
+	}
+	return ""
+}
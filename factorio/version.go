@@ -0,0 +1,258 @@
+package factorio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VersionInfo is the version of a Factorio binary, as reported by
+// `factorio --version`.
+type VersionInfo struct {
+	Major int
+	Minor int
+	Patch int
+	Build int
+	// E.g., `linux64` or `win64`.
+	Platform string
+	// E.g., `full`, `headless` or `steam`; and for Factorio 2.0, extensions
+	// such as `space-age`.
+	Flavors []string
+}
+
+// Version returns the version number, e.g., `1.1.100`.
+func (v *VersionInfo) Version() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// String returns the full version, as Factorio shows it; e.g., `1.1.100 (build
+// 59126, linux64, full)`.
+func (v *VersionInfo) String() string {
+	parts := append([]string{fmt.Sprintf("build %d", v.Build), v.Platform}, v.Flavors...)
+	return fmt.Sprintf("%s (%s)", v.Version(), strings.Join(parts, ", "))
+}
+
+// Headless indicates if this is the headless version, which cannot render.
+func (v *VersionInfo) Headless() bool {
+	for _, f := range v.Flavors {
+		if f == "headless" {
+			return true
+		}
+	}
+	return false
+}
+
+var versionRE = regexp.MustCompile(`(?m)^Version: (\d+)\.(\d+)\.(\d+) \(build (\d+), ([^,)]+)((?:, [^,)]+)*)\)`)
+
+// ParseVersion extracts the version from the output of `factorio --version`.
+func ParseVersion(output string) (*VersionInfo, error) {
+	m := versionRE.FindStringSubmatch(output)
+	if m == nil {
+		return nil, fmt.Errorf("no version found in %q", strings.TrimSpace(output))
+	}
+	var nums []int
+	for _, s := range m[1:5] {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q: %w", m[0], err)
+		}
+		nums = append(nums, n)
+	}
+	v := &VersionInfo{
+		Major:    nums[0],
+		Minor:    nums[1],
+		Patch:    nums[2],
+		Build:    nums[3],
+		Platform: m[5],
+	}
+	for _, f := range strings.Split(m[6], ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			v.Flavors = append(v.Flavors, f)
+		}
+	}
+	return v, nil
+}
+
+// Version runs `factorio --version` to find out the version of the binary.
+// The result is cached on disk, keyed by the path and modification time of the
+// binary.
+func (f *Factorio) Version(ctx context.Context) (*VersionInfo, error) {
+	f.version.once.Do(func() {
+		f.version.info, f.version.err = f.getVersion(ctx)
+	})
+	return f.version.info, f.version.err
+}
+
+// versionState holds the version of the binary, once known. It is shared by
+// the copies of the Factorio instance, see Isolated.
+type versionState struct {
+	once sync.Once
+	info *VersionInfo
+	err  error
+}
+
+func (f *Factorio) getVersion(ctx context.Context) (*VersionInfo, error) {
+	// With a launcher or wrapper, the binary does not tell which Factorio is
+	// run.
+	cacheable := len(f.launchArgs) == 0 && len(f.wrapper) == 0
+	var key *versionCacheEntry
+	binary, err := filepath.Abs(f.binary)
+	if cacheable && err == nil {
+		if info, err := os.Stat(binary); err == nil {
+			key = &versionCacheEntry{ModTime: info.ModTime(), Size: info.Size()}
+		}
+	}
+	if key != nil {
+		if output := lookupVersionCache(binary, key); output != "" {
+			logDebug("Factorio version from cache", "version", output)
+			return ParseVersion(output)
+		}
+	}
+
+	raw, err := f.runVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the version of Factorio with `%s --version` - is it a Factorio binary? %w; output: %q", f.binary, err, strings.TrimSpace(raw))
+	}
+	v, err := ParseVersion(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the version of Factorio with `%s --version` - is it a Factorio binary? %w", f.binary, err)
+	}
+	logDebug("Factorio version", "version", v)
+	if key != nil {
+		key.Output = "Version: " + v.String()
+		storeVersionCache(binary, key)
+	}
+	return v, nil
+}
+
+// How long `factorio --version` can take.
+const versionTimeout = 30 * time.Second
+
+// runVersion returns the output of `factorio --version`. Whatever it started is
+// stopped if it does not return in time - e.g., when the binary is not Factorio.
+func (f *Factorio) runVersion(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, versionTimeout)
+	defer cancel()
+	cmd := f.command([]string{"--version"})
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return out.String(), err
+	case <-ctx.Done():
+		killProcess(cmd.Process)
+		<-done
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return out.String(), fmt.Errorf("no answer within %v", versionTimeout)
+		}
+		return out.String(), ctx.Err()
+	}
+}
+
+// versionCacheEntry is the version of a binary, in the cache.
+type versionCacheEntry struct {
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+	// Version line of `factorio --version`.
+	Output string `json:"output"`
+}
+
+// versionCacheMu protects the cache file from concurrent updates.
+var versionCacheMu sync.Mutex
+
+// versionCacheFile returns the location of the cache of versions, or "" if
+// there is none.
+func versionCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		logDebug("no cache dir", "error", err)
+		return ""
+	}
+	return filepath.Join(dir, "mapshot", "factorio-versions.json")
+}
+
+func loadVersionCache(fname string) map[string]*versionCacheEntry {
+	cache := map[string]*versionCacheEntry{}
+	raw, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(raw, &cache); err != nil {
+		logWarning("ignoring invalid version cache", "path", fname, "error", err)
+		return map[string]*versionCacheEntry{}
+	}
+	return cache
+}
+
+// lookupVersionCache returns the cached version output of the binary if it
+// did not change, and "" otherwise.
+func lookupVersionCache(binary string, key *versionCacheEntry) string {
+	fname := versionCacheFile()
+	if fname == "" {
+		return ""
+	}
+	versionCacheMu.Lock()
+	defer versionCacheMu.Unlock()
+	entry := loadVersionCache(fname)[binary]
+	if entry == nil || !entry.ModTime.Equal(key.ModTime) || entry.Size != key.Size {
+		return ""
+	}
+	return entry.Output
+}
+
+// storeVersionCache records the version of the binary. Failures are only
+// logged - this is just a cache.
+func storeVersionCache(binary string, entry *versionCacheEntry) {
+	fname := versionCacheFile()
+	if fname == "" {
+		return
+	}
+	versionCacheMu.Lock()
+	defer versionCacheMu.Unlock()
+	cache := loadVersionCache(fname)
+	cache[binary] = entry
+	raw, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		logWarning("unable to encode version cache", "error", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		logWarning("unable to create cache dir", "error", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".*")
+	if err != nil {
+		logWarning("unable to write version cache", "error", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(raw)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fname)
+	}
+	if err != nil {
+		logWarning("unable to write version cache", "path", fname, "error", err)
+	}
+}
@@ -0,0 +1,146 @@
+package factorio
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Steam app ID of Factorio, used for its Proton prefix.
+const steamAppID = "427520"
+
+// isWindowsBinary indicates if the binary is the Windows version of Factorio,
+// to be run through Wine.
+func isWindowsBinary(binary string) bool {
+	return strings.HasSuffix(strings.ToLower(binary), ".exe")
+}
+
+// winePrefix is a Wine prefix - or Proton one - in which the Windows version
+// of Factorio runs. It translates paths between the host and Windows.
+type winePrefix struct {
+	// Host path of the prefix; contains `drive_c` and `dosdevices`.
+	dir string
+	// Whether this is the prefix Proton created for the Steam install.
+	proton bool
+}
+
+// findWinePrefix returns the prefix to use for the given Windows binary:
+// $WINEPREFIX if set, the Proton prefix of Factorio when the binary is in
+// a Steam library, and ~/.wine otherwise.
+func findWinePrefix(binary string) *winePrefix {
+	if e := os.Getenv("WINEPREFIX"); e != "" {
+		logDebug("using Wine prefix from $WINEPREFIX", "dir", e)
+		return &winePrefix{dir: e}
+	}
+	sep := string(filepath.Separator)
+	marker := sep + filepath.Join("steamapps", "common") + sep
+	if idx := strings.Index(binary, marker); idx >= 0 {
+		pfx := filepath.Join(binary[:idx], "steamapps", "compatdata", steamAppID, "pfx")
+		if info, err := os.Stat(pfx); err == nil && info.IsDir() {
+			logDebug("using Proton prefix", "dir", pfx)
+			return &winePrefix{dir: pfx, proton: true}
+		}
+		logDebug("no Proton prefix", "dir", pfx)
+	}
+	dir, err := homedir.Expand("~/.wine")
+	if err != nil {
+		logDebug("unable to expand ~/.wine", "error", err)
+		dir = ""
+	}
+	logDebug("using default Wine prefix", "dir", dir)
+	return &winePrefix{dir: dir}
+}
+
+// env returns the environment variables to give to Wine.
+func (w *winePrefix) env() []string {
+	env := []string{"WINEPREFIX=" + w.dir}
+	if w.proton {
+		// Proton expects the parent of the prefix.
+		env = append(env, "STEAM_COMPAT_DATA_PATH="+filepath.Dir(w.dir))
+	}
+	return env
+}
+
+// dataDirs returns the Factorio data dirs of the users of the prefix, in
+// reverse order of priority.
+func (w *winePrefix) dataDirs() []string {
+	var dirs []string
+	for _, pattern := range []string{
+		filepath.Join(w.dir, "drive_c", "users", "*", "Application Data", "Factorio"),
+		filepath.Join(w.dir, "drive_c", "users", "*", "AppData", "Roaming", "Factorio"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			logDebug("unable to look for files", "pattern", pattern, "error", err)
+			continue
+		}
+		sort.Strings(matches)
+		dirs = append(dirs, matches...)
+	}
+	return dirs
+}
+
+var windowsPathRE = regexp.MustCompile(`^([A-Za-z]):([\\/].*)?$`)
+
+// isWindowsPath indicates if p is an absolute Windows path, e.g., `C:\foo`.
+func isWindowsPath(p string) bool {
+	return windowsPathRE.MatchString(p)
+}
+
+// toHost translates a Windows path to the corresponding host path, through
+// the drives of the prefix - e.g., `C:\users\foo` to
+// `<prefix>/dosdevices/c:/users/foo`, which links to `<prefix>/drive_c/users/foo`.
+// Paths which are not Windows paths are returned unchanged.
+func (w *winePrefix) toHost(p string) string {
+	m := windowsPathRE.FindStringSubmatch(p)
+	if m == nil {
+		return p
+	}
+	drive := strings.ToLower(m[1])
+	rest := strings.ReplaceAll(m[2], `\`, "/")
+	switch drive {
+	case "c":
+		return filepath.Join(w.dir, "drive_c", filepath.FromSlash(rest))
+	case "z":
+		// Wine maps it to the host root.
+		return filepath.Join("/", filepath.FromSlash(rest))
+	}
+	return filepath.Join(w.dir, "dosdevices", drive+":", filepath.FromSlash(rest))
+}
+
+// toWindows translates a host path to a path Factorio can use from within
+// Wine: on drive C: when within the prefix, and through drive Z: - the host
+// root - otherwise. Backslashes are used, unless slash is set.
+func (w *winePrefix) toWindows(p string, slash bool) string {
+	p = filepath.Clean(p)
+	var res string
+	driveC := filepath.Join(w.dir, "drive_c")
+	if rel, err := filepath.Rel(driveC, p); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		res = `C:\` + strings.ReplaceAll(filepath.ToSlash(rel), "/", `\`)
+		if rel == "." {
+			res = `C:\`
+		}
+	} else {
+		res = `Z:` + strings.ReplaceAll(filepath.ToSlash(p), "/", `\`)
+	}
+	if slash {
+		res = strings.ReplaceAll(res, `\`, "/")
+	}
+	return res
+}
+
+// args translates the host paths in Factorio command line args.
+func (w *winePrefix) args(args []string) []string {
+	var res []string
+	for _, a := range args {
+		if filepath.IsAbs(a) {
+			a = w.toWindows(a, false)
+		}
+		res = append(res, a)
+	}
+	return res
+}
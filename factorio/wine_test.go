@@ -0,0 +1,132 @@
+package factorio
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestPrefix creates a fake Wine prefix with its C: and D: drives.
+func newTestPrefix(t *testing.T) (*winePrefix, string) {
+	t.Helper()
+	dir := t.TempDir()
+	prefix := filepath.Join(dir, "pfx")
+	other := filepath.Join(dir, "other")
+	for _, d := range []string{
+		filepath.Join(prefix, "drive_c", "users", "steamuser", "AppData", "Roaming", "Factorio"),
+		filepath.Join(prefix, "dosdevices"),
+		filepath.Join(other, "saves"),
+	} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../drive_c", filepath.Join(prefix, "dosdevices", "c:")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(other, filepath.Join(prefix, "dosdevices", "d:")); err != nil {
+		t.Fatal(err)
+	}
+	return &winePrefix{dir: prefix}, other
+}
+
+func TestWineToHost(t *testing.T) {
+	w, other := newTestPrefix(t)
+	roaming := filepath.Join(w.dir, "drive_c", "users", "steamuser", "AppData", "Roaming", "Factorio")
+	for _, tc := range []struct {
+		desc string
+		path string
+		want string
+	}{
+		{"drive c", `C:\users\steamuser\AppData\Roaming\Factorio`, roaming},
+		{"lowercase drive", `c:\users\steamuser\AppData\Roaming\Factorio`, roaming},
+		{"forward slashes", `C:/users/steamuser/AppData/Roaming/Factorio`, roaming},
+		{"drive root", `C:\`, filepath.Join(w.dir, "drive_c")},
+		{"drive z", `Z:\tmp\script-output`, "/tmp/script-output"},
+		{"other drive", `D:\saves`, filepath.Join(w.dir, "dosdevices", "d:", "saves")},
+		{"host path", "/tmp/script-output", "/tmp/script-output"},
+		{"relative path", `saves\foo.zip`, `saves\foo.zip`},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := w.toHost(tc.path)
+			if got != tc.want {
+				t.Errorf("toHost(%q) = %q, want %q", tc.path, got, tc.want)
+			}
+		})
+	}
+
+	// Drives other than C: and Z: go through dosdevices, which must lead to
+	// the drive target.
+	got, err := filepath.EvalSymlinks(w.toHost(`D:\saves`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := filepath.EvalSymlinks(filepath.Join(other, "saves"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("D:\\saves resolves to %q, want %q", got, want)
+	}
+}
+
+func TestWineToWindows(t *testing.T) {
+	w, _ := newTestPrefix(t)
+	roaming := filepath.Join(w.dir, "drive_c", "users", "steamuser", "AppData", "Roaming", "Factorio")
+	for _, tc := range []struct {
+		desc  string
+		path  string
+		slash bool
+		want  string
+	}{
+		{"within drive c", roaming, false, `C:\users\steamuser\AppData\Roaming\Factorio`},
+		{"with slashes", roaming, true, `C:/users/steamuser/AppData/Roaming/Factorio`},
+		{"drive c root", filepath.Join(w.dir, "drive_c"), false, `C:\`},
+		{"unclean path", filepath.Join(w.dir, "drive_c") + "/users/../users/", false, `C:\users`},
+		{"host path", "/tmp/script-output", false, `Z:\tmp\script-output`},
+		{"host path with slashes", "/tmp/script-output", true, `Z:/tmp/script-output`},
+		{"prefix itself", w.dir, false, `Z:` + strings.ReplaceAll(w.dir, "/", `\`)},
+		{"sibling of drive c", filepath.Join(w.dir, "drive_cfoo", "bar"), true, `Z:` + filepath.ToSlash(filepath.Join(w.dir, "drive_cfoo", "bar"))},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := w.toWindows(tc.path, tc.slash)
+			if got != tc.want {
+				t.Errorf("toWindows(%q, %v) = %q, want %q", tc.path, tc.slash, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWineRoundTrip(t *testing.T) {
+	w, _ := newTestPrefix(t)
+	for _, p := range []string{
+		filepath.Join(w.dir, "drive_c", "users", "steamuser", "AppData", "Roaming", "Factorio", "script-output"),
+		"/tmp/mapshot/saves",
+	} {
+		if got := w.toHost(w.toWindows(p, false)); got != p {
+			t.Errorf("toHost(toWindows(%q)) = %q", p, got)
+		}
+		if got := w.toHost(w.toWindows(p, true)); got != p {
+			t.Errorf("toHost(toWindows(%q, slash)) = %q", p, got)
+		}
+	}
+}
+
+func TestWineArgs(t *testing.T) {
+	w, _ := newTestPrefix(t)
+	got := w.args([]string{"--mod-directory", filepath.Join(w.dir, "drive_c", "mods"), "--create", "/tmp/save.zip", "--disable-audio"})
+	want := []string{"--mod-directory", `C:\mods`, "--create", `Z:\tmp\save.zip`, "--disable-audio"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("args() = %q, want %q", got, want)
+	}
+}
+
+func TestWineDataDirs(t *testing.T) {
+	w, _ := newTestPrefix(t)
+	want := []string{filepath.Join(w.dir, "drive_c", "users", "steamuser", "AppData", "Roaming", "Factorio")}
+	if got := w.dataDirs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("dataDirs() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package factorio
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Screen configuration of the virtual X server. Its size does not matter for
+// screenshots, which are rendered off-screen anyway.
+const xvfbScreen = "1280x720x24"
+
+// How long to wait for Xvfb to be ready.
+const xvfbStartDelay = 30 * time.Second
+
+// xvfb is a running virtual X server.
+type xvfb struct {
+	cmd     *exec.Cmd
+	display string
+	done    chan struct{}
+}
+
+// startXvfb starts a virtual X server on a free display.
+func startXvfb() (*xvfb, error) {
+	binary, err := exec.LookPath("Xvfb")
+	if err != nil {
+		return nil, fmt.Errorf("unable to find Xvfb, needed for --xvfb; install it - e.g., package `xvfb` on Debian & Ubuntu: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// With -displayfd, Xvfb picks a free display itself and writes its number
+	// on the given file descriptor once ready; ExtraFiles start at fd 3.
+	cmd := exec.Command(binary, "-displayfd", "3", "-screen", "0", xvfbScreen, "-nolisten", "tcp")
+	cmd.ExtraFiles = []*os.File{w}
+	// Its own process group, so Ctrl+C does not stop it before Factorio.
+	setProcessGroup(cmd)
+	logDebug("running Xvfb", "binary", binary, "args", cmd.Args[1:])
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start Xvfb: %w", err)
+	}
+	x := &xvfb{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		logDebug("Xvfb returned", "error", err)
+		close(x.done)
+	}()
+
+	lineCh := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		lineCh <- strings.TrimSpace(line)
+	}()
+	select {
+	case line := <-lineCh:
+		if line == "" {
+			x.stop()
+			return nil, fmt.Errorf("Xvfb did not start; use --log_level=debug for more info")
+		}
+		x.display = ":" + line
+	case <-time.After(xvfbStartDelay):
+		x.stop()
+		return nil, fmt.Errorf("Xvfb did not start within %v", xvfbStartDelay)
+	}
+	logDebug("Xvfb started", "display", x.display)
+	return x, nil
+}
+
+// env returns the environment base, changed for a process to use the
+// virtual X server.
+func (x *xvfb) env(base []string) []string {
+	env := []string{"DISPLAY=" + x.display}
+	for _, e := range base {
+		// Make sure Wayland is not preferred over the X server.
+		if strings.HasPrefix(e, "DISPLAY=") || strings.HasPrefix(e, "WAYLAND_DISPLAY=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	return env
+}
+
+// stop terminates the X server, killing it if needed.
+func (x *xvfb) stop() {
+	terminateProcess(x.cmd.Process)
+	select {
+	case <-x.done:
+	case <-time.After(killDelay):
+		logWarning("Xvfb did not stop, killing it", "delay", killDelay)
+		killProcess(x.cmd.Process)
+		<-x.done
+	}
+}
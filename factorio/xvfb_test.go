@@ -0,0 +1,219 @@
+//go:build !windows
+// +build !windows
+
+package factorio
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A fake Xvfb: it records its args and pid, announces display 99 on the
+// -displayfd file descriptor, then runs until terminated.
+const fakeXvfb = `#!/bin/sh
+echo "$@" > "$0.args"
+echo $$ > "$0.pid"
+echo 99 >&3
+exec 3>&-
+trap 'exit 0' TERM
+while :; do sleep 0.1; done
+`
+
+// Like fakeXvfb, but exits without announcing a display.
+const failingXvfb = `#!/bin/sh
+echo "cannot open display" >&2
+exit 1
+`
+
+// A fake Factorio, which records the display it was given.
+const fakeFactorio = `#!/bin/sh
+if [ "$1" = "--version" ]; then
+	echo "Version: 1.1.100 (build 59126, linux64, $FAKE_FLAVOR)"
+	exit 0
+fi
+echo "DISPLAY=$DISPLAY WAYLAND_DISPLAY=$WAYLAND_DISPLAY" > "$0.env"
+`
+
+// setenv changes environment variables for the duration of the test; an
+// empty value unsets the variable.
+func setenv(t *testing.T, kv ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, value := kv[i], kv[i+1]
+		prev, had := os.LookupEnv(key)
+		if value == "" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, value)
+		}
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(key, prev)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+// writeScript creates an executable script in dir.
+func writeScript(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// withFakeXvfb puts an Xvfb with the given content first on $PATH, and
+// returns the path of the script.
+func withFakeXvfb(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	p := writeScript(t, dir, "Xvfb", content)
+	setenv(t, "PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return p
+}
+
+// readPid returns the pid recorded by the fake Xvfb.
+func readPid(t *testing.T, xvfbPath string) int {
+	t.Helper()
+	raw, err := ioutil.ReadFile(xvfbPath + ".pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pid
+}
+
+// running indicates whether the process exists - and is not a zombie, since
+// its parent waits for it.
+func running(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+func TestStartXvfb(t *testing.T) {
+	xvfbPath := withFakeXvfb(t, fakeXvfb)
+	x, err := startXvfb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.display != ":99" {
+		t.Errorf("got display %q, want :99", x.display)
+	}
+	raw, err := ioutil.ReadFile(xvfbPath + ".args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(raw)), "-displayfd 3 -screen 0 "+xvfbScreen+" -nolisten tcp"; got != want {
+		t.Errorf("got Xvfb args %q, want %q", got, want)
+	}
+	pid := readPid(t, xvfbPath)
+	if !running(pid) {
+		t.Fatal("Xvfb is not running")
+	}
+
+	x.stop()
+	select {
+	case <-x.done:
+	default:
+		t.Error("Xvfb not waited for after stop")
+	}
+	if running(pid) {
+		t.Error("Xvfb still running after stop")
+	}
+}
+
+func TestStartXvfbFailure(t *testing.T) {
+	withFakeXvfb(t, failingXvfb)
+	if _, err := startXvfb(); err == nil || !strings.Contains(err.Error(), "did not start") {
+		t.Errorf("got error %v, want one about Xvfb not starting", err)
+	}
+}
+
+func TestStartXvfbMissing(t *testing.T) {
+	setenv(t, "PATH", t.TempDir())
+	if _, err := startXvfb(); err == nil || !strings.Contains(err.Error(), "unable to find Xvfb") {
+		t.Errorf("got error %v, want one about Xvfb not being found", err)
+	}
+}
+
+func TestXvfbEnv(t *testing.T) {
+	x := &xvfb{display: ":99"}
+	got := x.env([]string{"HOME=/home/test", "DISPLAY=:0", "WAYLAND_DISPLAY=wayland-0", "PATH=/bin"})
+	want := []string{"DISPLAY=:99", "HOME=/home/test", "PATH=/bin"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got env %q, want %q", got, want)
+	}
+}
+
+// Factorio runs on the virtual display, which is stopped once it is done.
+func TestRunXvfb(t *testing.T) {
+	xvfbPath := withFakeXvfb(t, fakeXvfb)
+	setenv(t, "DISPLAY", ":0", "WAYLAND_DISPLAY", "wayland-0")
+	binary := writeScript(t, t.TempDir(), "factorio", fakeFactorio)
+	f := &Factorio{binary: binary, xvfb: true, version: &versionState{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := f.Run(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(binary + ".env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(raw)), "DISPLAY=:99 WAYLAND_DISPLAY="; got != want {
+		t.Errorf("got Factorio env %q, want %q", got, want)
+	}
+	if running(readPid(t, xvfbPath)) {
+		t.Error("Xvfb still running after Factorio returned")
+	}
+}
+
+func TestCheckRender(t *testing.T) {
+	// Do not touch the actual version cache.
+	setenv(t, "XDG_CACHE_HOME", t.TempDir())
+	for _, tc := range []struct {
+		desc    string
+		flavor  string
+		display string
+		xvfb    bool
+		err     string
+	}{
+		{"headless", "headless", ":0", false, "headless version"},
+		{"headless with xvfb", "headless", "", true, "headless version"},
+		{"full with display", "full", ":0", false, ""},
+		{"full without display", "full", "", false, "--xvfb"},
+		{"full with xvfb", "full", "", true, ""},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			setenv(t, "FAKE_FLAVOR", tc.flavor, "DISPLAY", tc.display, "WAYLAND_DISPLAY", "")
+			// A binary per case, as versions are cached per binary.
+			binary := writeScript(t, t.TempDir(), "factorio", fakeFactorio)
+			f := &Factorio{binary: binary, xvfb: tc.xvfb, version: &versionState{}}
+			err := f.CheckRender(context.Background())
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got error %v, want one containing %q", err, tc.err)
+			}
+		})
+	}
+}
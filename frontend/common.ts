@@ -66,6 +66,12 @@ export interface MapshotJSON {
 
     // Rendering info per surface.
     surfaces: MapshotSurfaceJSON[];
+
+    // Extension of the tile files; jpg when missing.
+    tile_format?: string,
+    // Full version of Factorio - e.g., `1.1.100 (build 59126, linux64,
+    // full)` - when rendered through `mapshot render`.
+    factorio_version?: string,
 }
 
 // Information about a single exported rendered surface.
@@ -102,11 +108,22 @@ export interface MapshotSurfaceJSON {
 
 // Format of that shots.json file generated by the CLI.
 export interface ShotsJSON {
+    // Grouped by directory.
     all: ShotsJSONSave[];
+    // Grouped by savename recorded in mapshot.json; ordered by tick.
+    saves?: ShotsJSONGroup[];
+}
+
+export interface ShotsJSONGroup {
+    // "unknown" for shots without savename.
+    savename: string;
+    shots: ShotsJSONInfo[];
 }
 
 export interface ShotsJSONSave {
     savename: string;
+    // Label of the source directory, when serving multiple ones.
+    source?: string;
     versions: ShotsJSONInfo[];
 }
 
@@ -114,6 +131,28 @@ export interface ShotsJSONInfo {
     name: string;
     path: string;
     ticks_played: number;
+    source?: string;
+    // Savename as recorded in mapshot.json.
+    savename?: string;
+    tick?: number;
+    // Modification time of mapshot.json, as an ISO timestamp.
+    mtime: string;
+    // Subset of the surfaces info from mapshot.json.
+    surfaces?: ShotsJSONSurface[];
+    // Set when mapshot.json could not be parsed.
+    metadata_error?: string;
+}
+
+// Subset of MapshotSurfaceJSON, included in ShotsJSONInfo.
+export interface ShotsJSONSurface {
+    surface_name: string,
+    surface_idx: number,
+    tile_size: number,
+    render_size: number,
+    world_min?: FactorioPosition,
+    world_max?: FactorioPosition,
+    zoom_min: number,
+    zoom_max: number,
 }
 
 export function parseNumber(v: any, defvalue: number): number {
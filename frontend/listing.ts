@@ -66,17 +66,37 @@ class MapshotListing extends LitElement {
             return html`No mapshots have been found. Create some and re-start mapshot server.`;
         }
 
+        // Saves are grouped by source, when serving multiple ones.
+        const sources: string[] = [];
+        for (const save of this.shots.all) {
+            const source = save.source || "";
+            if (!sources.includes(source)) {
+                sources.push(source);
+            }
+        }
+        if (sources.length > 1 || sources[0] != "") {
+            return html`
+                ${sources.map((source) => html`
+                    <h1>${source || "other"}</h1>
+                    ${this.renderSaves(this.shots!.all.filter((save) => (save.source || "") == source))}
+                `)}
+            `;
+        }
+        return this.renderSaves(this.shots.all);
+    }
+
+    renderSaves(saves: common.ShotsJSONSave[]) {
         return html`
-                ${this.shots.all.map((save) => html`
+                ${saves.map((save) => html`
                     <div class="savename">
-                        <h2>${save.savename} <a href="map?l=${save.savename}">[permalink]</a></h2>
+                        <h2>${save.savename} <a href="map/?l=${save.savename}">[permalink]</a></h2>
                         <factorio-ticks .ticks=${save.versions[0].ticks_played}></factorio-ticks>
                         <p>
                         Available versions:
                         <ul>
                             ${save.versions.map((si) => html`
                                 <li>
-                                    <a href="map?path=${si.path}"><factorio-relticks .ticks=${si.ticks_played} .refticks=${save.versions[0].ticks_played}></factorio-relticks></a>
+                                    <a href="map/?path=${si.path}"><factorio-relticks .ticks=${si.ticks_played} .refticks=${save.versions[0].ticks_played}></factorio-relticks></a>
                                     (<factorio-ticks .ticks=${si.ticks_played}></factorio-ticks>)
                                 </li>`)}
                         </ul>
@@ -53,11 +53,11 @@ class Surface {
     tagsLayer: L.LayerGroup;
     debugLayer: L.LayerGroup;
 
-    constructor(config: common.MapshotConfig, si: common.MapshotSurfaceJSON) {
+    constructor(config: common.MapshotConfig, si: common.MapshotSurfaceJSON, tileFormat: string) {
         this.surfaceInfo = si;
 
         // .fallback comes from leaflet.tilelayer.fallback, which does not have types.
-        this.baseLayer = (L.tileLayer as any).fallback(config.path + si.file_prefix + "{z}/tile_{x}_{y}.jpg", {
+        this.baseLayer = (L.tileLayer as any).fallback(config.path + si.file_prefix + "{z}/tile_{x}_{y}." + tileFormat, {
             tileSize: si.render_size,
             bounds: L.latLngBounds(
                 this.worldToLatLng(si.world_min.x, si.world_min.y),
@@ -156,7 +156,7 @@ function run(config: common.MapshotConfig, info: common.MapshotJSON) {
     const surfaces: Surface[] = [];
     const surfaceByKey: Map<string, Surface> = new Map();
     for (const si of info.surfaces) {
-        const s = new Surface(config, si);
+        const s = new Surface(config, si, info.tile_format ?? "jpg");
         surfaces.push(s);
         layerControl.addBaseLayer(s.baseLayer, si.surface_name);
         surfaceByKey.set(s.surfaceInfo.surface_idx.toString(), s);
@@ -305,7 +305,9 @@ declare var MAPSHOT_CONFIG: common.MapshotConfig;
 
 const params = new URLSearchParams(window.location.search);
 if (params.get("l")) {
-    fetch("/latest/" + params.get("l"))
+    // Relative to the viewer location, to work when served under a prefix.
+    // Without asking for JSON, it redirects to the viewer.
+    fetch("../latest/" + params.get("l"), { headers: { "Accept": "application/json" } })
         .then(resp => resp.json())
         .then((config: common.MapshotConfig) => {
             load(config);
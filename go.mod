@@ -1,14 +1,20 @@
 module github.com/Palats/mapshot
 
-go 1.13
+go 1.16
 
 require (
+	github.com/aws/aws-sdk-go v1.44.330
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
-	github.com/google/uuid v1.1.2
+	github.com/google/uuid v1.3.0
 	github.com/inconshreveable/mousetrap v1.0.0
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/otiai10/copy v1.2.0
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.3
-	golang.org/x/sync v0.0.0-20181221193216-37e7f081c4d4
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.10.0
+	golang.org/x/sync v0.1.0
+	gopkg.in/yaml.v2 v2.2.8
+	modernc.org/sqlite v1.14.8
 )
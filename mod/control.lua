@@ -20,6 +20,10 @@ function build_params(player)
   if (params.surface == nil or params.surface == "") then
     params.surface = all_surfaces
   end
+  -- Setting might not exist yet in old saves.
+  if (params.format == nil or params.format == "") then
+    params.format = "jpg"
+  end
 
   for k,v in pairs(game.json_to_table(overrides)) do
     params[k] = v
@@ -57,7 +61,7 @@ end
 function mapshot(params)
   log("mapshot params:\n" .. serpent.block(params))
 
-  local unique_id = gen_unique_id()
+  local unique_id = gen_unique_id(params)
   local map_id = gen_map_id()
   local savename = params.savename
   if (savename == nil or #savename == 0) then
@@ -71,6 +75,26 @@ function mapshot(params)
   log("Mapshot data target " .. data_prefix)
   log("Mapshot unique id " .. unique_id)
 
+  -- Catch typos in surface names, instead of rendering nothing.
+  local unknown = unknown_surfaces(params)
+  if #unknown > 0 then
+    local available = {}
+    for _, surface in pairs(game.surfaces) do
+      table.insert(available, surface.name)
+    end
+    local msg = "Mapshot: unknown surface(s) " .. table.concat(unknown, ", ") .. "; available: " .. table.concat(available, ", ")
+    game.print(msg)
+    log(msg)
+    if params.onstartup ~= "" then
+      game.write_file("mapshot-error-" .. params.onstartup, game.table_to_json({
+        error = msg,
+        unknown_surfaces = unknown,
+        available_surfaces = available,
+      }))
+    end
+    return nil
+  end
+
   local surface_infos = {}
   log("Request surface(s): " .. params.surface)
   for _, surface in pairs(game.surfaces) do
@@ -104,7 +128,24 @@ function mapshot(params)
     map_exchange = game.get_map_exchange_string(),
     surfaces = surface_infos,
     game_version = game_version,
+    -- Only known when started by `mapshot render`.
+    factorio_version = params.factorio_version,
     active_mods = active_mods,
+    tile_format = params.format,
+    -- Effective rendering parameters, from settings & overrides.
+    params = {
+      area = params.area,
+      tilemin = params.tilemin,
+      tilemax = params.tilemax,
+      resolution = params.resolution,
+      jpgquality = params.jpgquality,
+      minjpgquality = params.minjpgquality,
+      format = params.format,
+      zoommin = params.zoommin,
+      zoommax = params.zoommax,
+      surface = params.surface,
+      prefix = params.prefix,
+    },
   }))
 
   -- Create the serving html.
@@ -120,20 +161,52 @@ function mapshot(params)
   end
 
   -- Generate all the tiles.
+  local layers = {}
   for _, surface_info in ipairs(surface_infos) do
     for render_zoom = surface_info.zoom_min, surface_info.zoom_max do
       local tile_size = surface_info.tile_size / math.pow(2, render_zoom)
       local layer_prefix = data_prefix .. surface_info.file_prefix .. render_zoom .. "/"
-      gen_layer(params, tile_size, surface_info.render_size, surface_info.world_min, surface_info.world_max, layer_prefix, game.surfaces[surface_info.surface_idx])
+      local count = gen_layer(params, tile_size, surface_info.render_size, surface_info.world_min, surface_info.world_max, layer_prefix, game.surfaces[surface_info.surface_idx])
+      table.insert(layers, {
+        surface_name = surface_info.surface_name,
+        zoom = render_zoom,
+        path = layer_prefix,
+        tiles = count,
+      })
     end
   end
 
+  -- Screenshots are only taken once this tick is over, and the game does not
+  -- tick again until they are all written - so there is no way to report
+  -- progress from here. Instead, list what is expected; the render command
+  -- counts the files as they appear.
+  if params.onstartup ~= "" and #layers > 0 then
+    game.write_file("mapshot-progress-" .. params.onstartup, game.table_to_json({
+      layers = layers,
+    }))
+  end
+
   game.print("Mapshot: all screenshots started, might take a while to render; location: " .. data_prefix)
   log("Mapshot: all screenshots started, might take a while to render; location: " .. data_prefix)
 
   return data_prefix
 end
 
+-- List the requested surfaces which do not exist in the game.
+function unknown_surfaces(params)
+  local unknown = {}
+  if (params.surface == all_surfaces) then
+    return unknown
+  end
+  for name in string.gmatch(params.surface, "([^,]+)") do
+    name = string.match(name, "^%s*(.-)%s*$")
+    if #name > 0 and game.surfaces[name] == nil then
+      table.insert(unknown, name)
+    end
+  end
+  return unknown
+end
+
 -- Check if a surface should be rendered.
 function should_render_surface(params, surface_name)
   if(params.surface == all_surfaces) then
@@ -157,11 +230,28 @@ function should_render_surface(params, surface_name)
   return false
 end
 
+-- Parse an area given as `x1,y1,x2,y2`, in world coordinates. Returns nil
+-- for other values - i.e., `all` and `entities`.
+function parse_area(area)
+  local num = "%s*(-?[%d.]+)%s*"
+  local x1, y1, x2, y2 = string.match(area, "^" .. num .. "," .. num .. "," .. num .. "," .. num .. "$")
+  if x1 == nil then
+    return nil
+  end
+  x1, y1, x2, y2 = tonumber(x1), tonumber(y1), tonumber(x2), tonumber(y2)
+  return {
+    left_top = { x = math.min(x1, x2), y = math.min(y1, y2) },
+    right_bottom = { x = math.max(x1, x2), y = math.max(y1, y2) },
+  }
+end
+
 function gen_surface_info(params, surface)
   -- Determine map min & max world coordinates based on existing chunks.
   -- When requested to match only entities, fallback using all chunks
   -- if no entities are found at all.
   local try_ent_only = params.area == "entities"
+  -- An explicit area is restricted to existing chunks.
+  local rect = parse_area(params.area)
   local world_min = { x = 2^30, y = 2^30 }
   local world_max = { x = -2^30, y = -2^30 }
   local chunk_count = 0
@@ -194,6 +284,15 @@ function gen_surface_info(params, surface)
     world_max = ent_world_max
     chunk_count = ent_chunk_count
   end
+  if rect then
+    world_min.x = math.max(world_min.x, rect.left_top.x)
+    world_min.y = math.max(world_min.y, rect.left_top.y)
+    world_max.x = math.min(world_max.x, rect.right_bottom.x)
+    world_max.y = math.min(world_max.y, rect.right_bottom.y)
+    if world_min.x >= world_max.x or world_min.y >= world_max.y then
+      chunk_count = 0
+    end
+  end
   if chunk_count == 0 then
     log("no matching chunk")
     game.print("No matching chunk")
@@ -248,6 +347,17 @@ function gen_surface_info(params, surface)
     end
   end
 
+  -- The zoom levels can be restricted through overrides - e.g., to skip the
+  -- most detailed ones, which are most of the render time.
+  local zoom_min = 0
+  local zoom_max = tile_range_max - tile_range_min
+  if params.zoommin ~= nil and params.zoommin >= 0 then
+    zoom_min = math.min(params.zoommin, zoom_max)
+  end
+  if params.zoommax ~= nil and params.zoommax >= 0 then
+    zoom_max = math.max(math.min(params.zoommax, zoom_max), zoom_min)
+  end
+
   return {
     surface_name = surface.name,
     surface_idx = surface.index,
@@ -256,14 +366,15 @@ function gen_surface_info(params, surface)
     render_size = render_size,
     world_min = world_min,
     world_max = world_max,
-    zoom_min = 0,
-    zoom_max = tile_range_max - tile_range_min,
+    zoom_min = zoom_min,
+    zoom_max = zoom_max,
     players = players,
     stations = stations,
     tags = tags,
   }
 end
 
+-- Take the screenshots of a zoom level; returns how many were requested.
 function gen_layer(params, tile_size, render_size, world_min, world_max, data_prefix, surface)
   local tile_min = { x = math.floor(world_min.x / tile_size), y = math.floor(world_min.y / tile_size) }
   local tile_max = { x = math.floor(world_max.x / tile_size), y = math.floor(world_max.y / tile_size) }
@@ -272,6 +383,7 @@ function gen_layer(params, tile_size, render_size, world_min, world_max, data_pr
   game.print(msg)
   log(msg)
 
+  local count = 0
   for tile_y = tile_min.y, tile_max.y do
     for tile_x = tile_min.x, tile_max.x do
       local top_left = { x = tile_x * tile_size, y = tile_y * tile_size }
@@ -287,21 +399,28 @@ function gen_layer(params, tile_size, render_size, world_min, world_max, data_pr
           },
           resolution = {render_size, render_size},
           zoom = factorio_zoom(render_size, tile_size),
-          path = data_prefix .. "tile_" .. tile_x .. "_" .. tile_y .. ".jpg",
+          path = data_prefix .. "tile_" .. tile_x .. "_" .. tile_y .. "." .. params.format,
           show_gui = false,
           show_entity_info = true,
           quality = quality_to_use,
           daytime = 0,
           water_tick = 0,
         }
+        count = count + 1
       end
     end
   end
+  return count
 end
 
 -- Create a unique ID of the generated mapshot.
-function gen_unique_id()
+function gen_unique_id(params)
   local data = generated.version_hash .. " " .. tostring(game.tick) .. " " .. game.get_map_exchange_string()
+  -- Tiles of different formats must not end up in the same directory; jpg
+  -- is left out to keep the same IDs as before.
+  if params.format ~= "jpg" then
+    data = data .. " " .. params.format
+  end
   -- sha256 produces 64 digits. We're not looking for crypto secure hashing, and instead
   -- just a short unique string - so pick up a subset.
   local idx = 10
@@ -335,6 +454,10 @@ script.on_event(defines.events.on_tick, function(evt)
   if params.onstartup ~= "" then
     log("onstartup requested id=" .. params.onstartup)
     local data_prefix = mapshot(params)
+    if data_prefix == nil then
+      -- Error was already reported.
+      return
+    end
 
     -- Ensure that screen shots are written before marking as done.
     game.set_wait_for_screenshots_to_finish()
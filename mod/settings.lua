@@ -6,7 +6,7 @@ data:extend({
         default_value = "entities",
         allowed_values = {"all", "entities"},
         localised_name = "Area",
-        localised_description = "How to pick the area to render. `all`=all existing chunks; `entities`=chunks including artifical build.",
+        localised_description = "How to pick the area to render. `all`=all existing chunks; `entities`=chunks including artifical build. The render command also accepts a rectangle `x1,y1,x2,y2`, in world coordinates.",
         order = "000",
     },
     {
@@ -71,6 +71,16 @@ data:extend({
         localised_description = "Compression quality for jpg files when no player entities are present. Set to 0 to skip the tile entirely.",
         order = "202",
     },
+    {
+        type = "string-setting",
+        name = "format",
+        setting_type = "runtime-per-user",
+        default_value = "jpg",
+        allowed_values = {"jpg", "png"},
+        localised_name = "Tile format",
+        localised_description = "Image format of the tiles. `png` is lossless, but files are much larger.",
+        order = "203",
+    },
     {
         type = "string-setting",
         name = "surface",